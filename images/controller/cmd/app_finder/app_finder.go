@@ -17,13 +17,11 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -41,6 +39,19 @@ func main() {
 		log.Fatal("Missing NAMESPACE env.")
 	}
 
+	clusterClient, err := broker.NewKubeClusterClient()
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+
+	// Period of the full resync, the events from the informers sync the affected apps in between.
+	resyncPeriod := 60 * time.Second
+	if v := os.Getenv("RESYNC_PERIOD"); len(v) > 0 {
+		if resyncPeriod, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid RESYNC_PERIOD: %v", err)
+		}
+	}
+
 	// Allow for single run
 	singleIteration := false
 	if os.Getenv("SINGLE_ITERATION") == "true" {
@@ -72,159 +83,47 @@ func main() {
 		addEgressSRVRecords = strings.Split(param, ",")
 	}
 
-	// Map of cached app manifest checksums
-	bundleManifestChecksums := make(map[string]string, 0)
-	userBundleManifestChecksums := make(map[string]string, 0)
-
-	for {
-		// Fetch all broker apps
-		appConfigs, err := broker.FetchBrokerAppConfigs(namespace)
-		if err != nil {
-			log.Printf("failed to fetch broker app configs: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-
-		// List of app specs that will be added to the registered app manifest.
-		registeredApps := broker.NewRegisteredAppManifest()
-
-		// Fetch all configmaps in single call
-		nsConfigMaps, err := broker.GetConfigMaps(namespace)
-		if err != nil {
-			log.Printf("failed to fetch broker appconfig map bundles: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-
-		// Fetch data required for Egress Network Policy
-		networkPolicyData, err := broker.GetEgressNetworkPolicyData(addEgressCIDRs, addEgressSRVRecords)
-		if err != nil {
-			log.Printf("failed to fetch networkpolicy data: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-		registeredApps.NetworkPolicyData = networkPolicyData
-
-		// Base dir for temp directory where updated files are staged.
-		tmpDirBase := path.Dir(broker.BundleSourceBaseDir)
-
-		for _, appConfig := range appConfigs {
-			bundleCMName := appConfig.Spec.Bundle.ConfigMapRef.Name
-			authzCMName := appConfig.Spec.Authorization.ConfigMapRef.Name
-
-			appName := appConfig.Metadata.Name
-			bundleDestDir := path.Join(broker.BundleSourceBaseDir, appName)
-			userBundleDestDir := path.Join(broker.UserBundleSourceBaseDir, appName)
-			foundUserBundleCount := 0
-
-			// Find and save configmap data for required bundle and optional authz
-			foundBundle := false
-			foundAllUserBundles := false
-			foundAuthzCM := false
-			for _, cm := range nsConfigMaps {
-				// Match on bundle configmap name
-				if cm.Metadata.Name == bundleCMName {
-					// Update working mainfests if bundle has changed.
-					cacheKey := fmt.Sprintf("%s-%s", appName, cm.Metadata.Name)
-					if err := copyConfigMapDataIfChanged(cm, tmpDirBase, bundleDestDir, cacheKey, bundleManifestChecksums); err != nil {
-						log.Printf("%v", err)
-					} else {
-						foundBundle = true
-					}
-				}
-
-				// Match on a user bundle configmap name
-				for i, userBundle := range appConfig.Spec.UserBundles {
-					userBundleCMName := userBundle.ConfigMapRef.Name
-
-					// Match on user bundle configmap name
-					if cm.Metadata.Name == userBundleCMName {
-						destDir := path.Join(userBundleDestDir, fmt.Sprintf("%d", i))
-						cacheKey := fmt.Sprintf("%s-%s", appName, cm.Metadata.Name)
-						if err := copyConfigMapDataIfChanged(cm, tmpDirBase, destDir, cacheKey, userBundleManifestChecksums); err != nil {
-							log.Printf("%v", err)
-						} else {
-							foundUserBundleCount++
-						}
-					}
-				}
-
-				// Match on authz configmap name
-				if cm.Metadata.Name == authzCMName {
-					foundAuthzCM = true
-					if appConfig.Spec.AuthorizedUsers == nil {
-						appConfig.Spec.AuthorizedUsers = make([]string, 0)
-					}
-					// Extract authorization members and append them to the appConfig.Spec.AuthorizedUsers array.
-					for _, data := range cm.Data {
-						scanner := bufio.NewScanner(strings.NewReader(data))
-						for scanner.Scan() {
-							userPat := strings.TrimSpace(scanner.Text())
-							// Skip comment and empty lines.
-							if len(userPat) > 0 && !strings.HasPrefix(userPat, "#") {
-								_, err := regexp.Compile(userPat)
-								if err != nil {
-									log.Printf("WARN: invalid authorized user pattern found in ConfigMap %s: '%s', skipped.", authzCMName, userPat)
-								} else {
-									appConfig.Spec.AuthorizedUsers = append(appConfig.Spec.AuthorizedUsers, userPat)
-								}
-							}
-						}
-					}
-				}
-			}
-
-			// Add the metadata
-			appConfig.Spec.Metadata = getFilteredMetadataFromObject(appConfig, metadataFilterPattern)
-
-			if foundUserBundleCount == len(appConfig.Spec.UserBundles) {
-				foundAllUserBundles = true
-			}
+	f := newAppFinder(clusterClient, namespace, metadataFilterPattern, addEgressCIDRs, addEgressSRVRecords)
 
-			if !foundBundle {
-				log.Printf("Bundle manifests ConfigMap %s not found for app %s", bundleCMName, appName)
-			} else if len(appConfig.Spec.UserBundles) > 0 && !foundAllUserBundles {
-				log.Printf("Failed to find all spec.userBundles for app %s", appName)
-			} else {
-				if len(authzCMName) > 0 && !foundAuthzCM {
-					log.Printf("Failed to find authorization ConfigMap bundle %s for app %s", authzCMName, appName)
-				}
-				// App is valid and bundle is ready, add to registered apps.
-				if !appConfig.Spec.Disabled {
-					registeredApps.Add(appConfig.Spec)
-				}
-			}
-		}
+	// Watch the ConfigMaps in the namespace for bundle and authorization changes.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := f.configMaps.Run(stopCh); err != nil {
+		log.Fatalf("Error starting ConfigMap informer: %v", err)
+	}
 
-		// Prune build source directories
-		foundDirs, err := filepath.Glob(path.Join(broker.BundleSourceBaseDir, "*"))
-		if err != nil {
-			log.Printf("failed to list app directories to prune: %v", err)
-		}
-		for _, dirName := range foundDirs {
-			found := false
-			for _, appConfig := range appConfigs {
-				if appConfig.Metadata.Name == path.Base(dirName) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				log.Printf("removing build source: %s", dirName)
-				os.RemoveAll(dirName)
-			}
-		}
+	// Watch changes to BrokerAppConfigs with informer.
+	config, err := broker.GetClientConfig()
+	if err != nil {
+		log.Fatalf("failed to get cluster client config: %v", err)
+	}
+	appConfigInformer := broker.NewAppConfigInformer(f.addAppConfig, f.deleteAppConfig, f.updateAppConfig)
+	informerOpts := &broker.PodBrokerInformerOpts{
+		ResyncDuration: 0,
+		ClientConfig:   config,
+	}
+	if err := broker.RunPodBrokerInformer(appConfigInformer, stopCh, informerOpts); err != nil {
+		log.Fatalf("Error starting BrokerAppConfig informer: %v", err)
+	}
 
-		// Write registered app manifest
-		if err := registeredApps.WriteJSON(broker.RegisteredAppsManifestJSONFile); err != nil {
-			log.Printf("failed to write registered app manifest: %s: %v", broker.RegisteredAppsManifestJSONFile, err)
+	// Initial sync of all apps, retried until the network policy data can be fetched.
+	for {
+		err := f.syncAll()
+		if err == nil {
+			break
 		}
-
+		log.Printf("%v", err)
 		if singleIteration {
-			break
+			os.Exit(1)
 		}
-		time.Sleep(5 * time.Second)
+		time.Sleep(2 * time.Second)
 	}
+	if singleIteration {
+		return
+	}
+
+	go f.runResync(resyncPeriod)
+	f.runWorker()
 }
 
 // Helper function to get filtered appconfig annotation metadata fields.
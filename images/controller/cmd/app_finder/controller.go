@@ -0,0 +1,420 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	broker "selkies.io/controller/pkg"
+)
+
+// Queue key of the full resync, app keys are BrokerAppConfig names and are never empty.
+const resyncKey = ""
+
+/*
+Reconciles the BrokerAppConfigs into the bundle directories and the registered app manifest.
+BrokerAppConfig and ConfigMap events queue the affected apps, a single worker syncs them
+so that the manifest and the bundle directories are only written from one goroutine.
+*/
+type appFinder struct {
+	sync.Mutex
+	namespace     string
+	clusterClient broker.ClusterClient
+	statusWriter  *broker.AppConfigStatusWriter
+	configMaps    *broker.ConfigMapInformer
+	queue         workqueue.TypedRateLimitingInterface[string]
+	appRegistry   *broker.AppRegistry
+
+	metadataFilterPattern *regexp.Regexp
+	addEgressCIDRs        []string
+	addEgressSRVRecords   []string
+
+	// BrokerAppConfigs from the informer, guarded by the mutex.
+	appConfigs map[string]broker.AppConfigObject
+
+	// State owned by the worker.
+	registeredSpecs             map[string]broker.AppConfigSpec
+	networkPolicyData           broker.NetworkPolicyTemplateData
+	bundleManifestChecksums     map[string]string
+	userBundleManifestChecksums map[string]string
+	appCacheKeys                map[string][]string
+}
+
+func newAppFinder(clusterClient broker.ClusterClient, namespace string, metadataFilterPattern *regexp.Regexp, addEgressCIDRs, addEgressSRVRecords []string) *appFinder {
+	f := &appFinder{
+		namespace:                   namespace,
+		clusterClient:               clusterClient,
+		statusWriter:                broker.NewAppConfigStatusWriter(clusterClient, namespace),
+		queue:                       workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+		appRegistry:                 broker.NewAppRegistry(broker.RegisteredAppsManifestJSONFile),
+		metadataFilterPattern:       metadataFilterPattern,
+		addEgressCIDRs:              addEgressCIDRs,
+		addEgressSRVRecords:         addEgressSRVRecords,
+		appConfigs:                  make(map[string]broker.AppConfigObject, 0),
+		registeredSpecs:             make(map[string]broker.AppConfigSpec, 0),
+		bundleManifestChecksums:     make(map[string]string, 0),
+		userBundleManifestChecksums: make(map[string]string, 0),
+		appCacheKeys:                make(map[string][]string, 0),
+	}
+	f.configMaps = broker.NewConfigMapInformer(clusterClient, namespace, 0, f.configMapChanged)
+	return f
+}
+
+// Informer handlers
+
+func (f *appFinder) addAppConfig(appConfig broker.AppConfigObject) {
+	if appConfig.Metadata.Namespace != f.namespace {
+		return
+	}
+	f.Lock()
+	f.appConfigs[appConfig.Metadata.Name] = appConfig
+	f.Unlock()
+	f.queue.Add(appConfig.Metadata.Name)
+}
+
+func (f *appFinder) deleteAppConfig(appConfig broker.AppConfigObject) {
+	if appConfig.Metadata.Namespace != f.namespace {
+		return
+	}
+	f.Lock()
+	delete(f.appConfigs, appConfig.Metadata.Name)
+	f.Unlock()
+	f.queue.Add(appConfig.Metadata.Name)
+}
+
+func (f *appFinder) updateAppConfig(oldObj, newObj broker.AppConfigObject) {
+	if newObj.Metadata.Namespace != f.namespace {
+		return
+	}
+	f.Lock()
+	f.appConfigs[newObj.Metadata.Name] = newObj
+	f.Unlock()
+	// Status writes only change the status, skip them to not sync the app again.
+	if oldObj.Metadata.Generation == newObj.Metadata.Generation && oldObj.Metadata.Generation > 0 &&
+		reflect.DeepEqual(oldObj.Metadata.Annotations, newObj.Metadata.Annotations) {
+		return
+	}
+	f.queue.Add(newObj.Metadata.Name)
+}
+
+// Queues the apps that reference the ConfigMap as their bundle, user bundle or authorization ConfigMap.
+func (f *appFinder) configMapChanged(name string) {
+	f.Lock()
+	defer f.Unlock()
+	for appName, appConfig := range f.appConfigs {
+		refs := []string{appConfig.Spec.Bundle.ConfigMapRef.Name, appConfig.Spec.Authorization.ConfigMapRef.Name}
+		for _, userBundle := range appConfig.Spec.UserBundles {
+			refs = append(refs, userBundle.ConfigMapRef.Name)
+		}
+		for _, ref := range refs {
+			if ref == name {
+				f.queue.Add(appName)
+				break
+			}
+		}
+	}
+}
+
+// Returns the names of all BrokerAppConfigs in the informer cache.
+func (f *appFinder) appNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	names := make([]string, 0, len(f.appConfigs))
+	for name := range f.appConfigs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Worker
+
+/*
+Syncs all apps and writes the registered app manifest once.
+Called before the worker starts, so that the brokers never see a manifest with only part of the apps.
+*/
+func (f *appFinder) syncAll() error {
+	if err := f.refreshNetworkPolicyData(); err != nil {
+		return err
+	}
+	for _, appName := range f.appNames() {
+		if err := f.syncApp(appName); err != nil {
+			log.Printf("%v", err)
+			f.queue.AddRateLimited(appName)
+		}
+	}
+	f.pruneBundleDirs()
+	return f.writeManifest()
+}
+
+// Queues a full resync every period.
+func (f *appFinder) runResync(period time.Duration) {
+	for {
+		time.Sleep(period)
+		f.queue.Add(resyncKey)
+		for _, appName := range f.appNames() {
+			f.queue.Add(appName)
+		}
+	}
+}
+
+func (f *appFinder) runWorker() {
+	for f.processNextItem() {
+	}
+}
+
+func (f *appFinder) processNextItem() bool {
+	key, quit := f.queue.Get()
+	if quit {
+		return false
+	}
+	defer f.queue.Done(key)
+
+	var err error
+	if key == resyncKey {
+		if err = f.refreshNetworkPolicyData(); err == nil {
+			f.pruneBundleDirs()
+		}
+	} else {
+		err = f.syncApp(key)
+	}
+	if err == nil {
+		err = f.writeManifest()
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		f.queue.AddRateLimited(key)
+		return true
+	}
+	f.queue.Forget(key)
+	return true
+}
+
+// Fetches the data required for the egress NetworkPolicy templates, including the SRV record lookups.
+func (f *appFinder) refreshNetworkPolicyData() error {
+	networkPolicyData, err := broker.GetEgressNetworkPolicyData(f.clusterClient, f.addEgressCIDRs, f.addEgressSRVRecords)
+	if err != nil {
+		return fmt.Errorf("failed to fetch networkpolicy data: %v", err)
+	}
+	f.networkPolicyData = networkPolicyData
+	return nil
+}
+
+/*
+Syncs the bundle directories, registered spec and status of the app.
+Missing ConfigMaps are reported on the app status and are not errors, the app is queued again when they are created.
+*/
+func (f *appFinder) syncApp(appName string) error {
+	f.Lock()
+	appConfig, ok := f.appConfigs[appName]
+	f.Unlock()
+
+	bundleDestDir := path.Join(broker.BundleSourceBaseDir, appName)
+	userBundleDestDir := path.Join(broker.UserBundleSourceBaseDir, appName)
+
+	if !ok {
+		log.Printf("removing app: %s", appName)
+		delete(f.registeredSpecs, appName)
+		for _, cacheKey := range f.appCacheKeys[appName] {
+			delete(f.bundleManifestChecksums, cacheKey)
+			delete(f.userBundleManifestChecksums, cacheKey)
+		}
+		delete(f.appCacheKeys, appName)
+		f.statusWriter.Remove(appName)
+		os.RemoveAll(bundleDestDir)
+		os.RemoveAll(userBundleDestDir)
+		return nil
+	}
+
+	appConfig.SetDefaults()
+	bundleCMName := appConfig.Spec.Bundle.ConfigMapRef.Name
+	authzCMName := appConfig.Spec.Authorization.ConfigMapRef.Name
+
+	// Base dir for temp directory where updated files are staged.
+	tmpDirBase := path.Dir(broker.BundleSourceBaseDir)
+
+	var syncErr error
+	cacheKeys := make([]string, 0)
+
+	// Find and save configmap data for required bundle
+	foundBundle := false
+	bundleCM, found, err := f.configMaps.Get(f.namespace, bundleCMName)
+	if err != nil {
+		return fmt.Errorf("failed to get bundle ConfigMap %s for app %s: %v", bundleCMName, appName, err)
+	}
+	if found {
+		// Update working mainfests if bundle has changed.
+		cacheKey := fmt.Sprintf("%s-%s", appName, bundleCM.Metadata.Name)
+		cacheKeys = append(cacheKeys, cacheKey)
+		if err := copyConfigMapDataIfChanged(bundleCM, tmpDirBase, bundleDestDir, cacheKey, f.bundleManifestChecksums); err != nil {
+			syncErr = err
+		} else {
+			foundBundle = true
+		}
+	}
+
+	// Find and save configmap data for the user bundles
+	foundUserBundleCount := 0
+	for i, userBundle := range appConfig.Spec.UserBundles {
+		userBundleCM, found, err := f.configMaps.Get(f.namespace, userBundle.ConfigMapRef.Name)
+		if err != nil {
+			return fmt.Errorf("failed to get user bundle ConfigMap %s for app %s: %v", userBundle.ConfigMapRef.Name, appName, err)
+		}
+		if !found {
+			continue
+		}
+		destDir := path.Join(userBundleDestDir, fmt.Sprintf("%d", i))
+		cacheKey := fmt.Sprintf("%s-%s", appName, userBundleCM.Metadata.Name)
+		cacheKeys = append(cacheKeys, cacheKey)
+		if err := copyConfigMapDataIfChanged(userBundleCM, tmpDirBase, destDir, cacheKey, f.userBundleManifestChecksums); err != nil {
+			syncErr = err
+		} else {
+			foundUserBundleCount++
+		}
+	}
+	f.appCacheKeys[appName] = cacheKeys
+
+	// Extract authorization members and append them to a copy of the appConfig.Spec.AuthorizedUsers array.
+	foundAuthzCM := false
+	if len(authzCMName) > 0 {
+		authzCM, found, err := f.configMaps.Get(f.namespace, authzCMName)
+		if err != nil {
+			return fmt.Errorf("failed to get authorization ConfigMap %s for app %s: %v", authzCMName, appName, err)
+		}
+		if found {
+			foundAuthzCM = true
+			authorizedUsers := make([]string, 0, len(appConfig.Spec.AuthorizedUsers))
+			authorizedUsers = append(authorizedUsers, appConfig.Spec.AuthorizedUsers...)
+			for _, data := range authzCM.Data {
+				scanner := bufio.NewScanner(strings.NewReader(data))
+				for scanner.Scan() {
+					userPat := strings.TrimSpace(scanner.Text())
+					// Skip comment and empty lines.
+					if len(userPat) > 0 && !strings.HasPrefix(userPat, "#") {
+						// Lines are user regexps, or group:<name> and role:<name> rules.
+						if err := broker.ValidateAuthzRule(userPat); err != nil {
+							log.Printf("WARN: invalid authorization rule found in ConfigMap %s: '%s', skipped: %v", authzCMName, userPat, err)
+						} else {
+							authorizedUsers = append(authorizedUsers, userPat)
+						}
+					}
+				}
+			}
+			appConfig.Spec.AuthorizedUsers = authorizedUsers
+		}
+	}
+
+	// Add the metadata
+	appConfig.Spec.Metadata = getFilteredMetadataFromObject(appConfig, f.metadataFilterPattern)
+
+	// Conditions reported on the BrokerAppConfig status.
+	bundleCond := broker.NewAppConfigCondition(broker.AppConditionBundleFound, true, "Found", "")
+	authzCond := broker.NewAppConfigCondition(broker.AppConditionAuthzFound, true, "Found", "")
+	if len(authzCMName) == 0 {
+		authzCond.Reason = "NotConfigured"
+	} else if !foundAuthzCM {
+		authzCond = broker.NewAppConfigCondition(broker.AppConditionAuthzFound, false, "ConfigMapNotFound", fmt.Sprintf("Authorization ConfigMap %s not found", authzCMName))
+	}
+	var registeredCond broker.AppConfigCondition
+
+	// Apps stay registered with their last good spec while the bundle can not be synced, they are removed when the bundle is not found.
+	if syncErr != nil {
+		bundleCond = broker.NewAppConfigCondition(broker.AppConditionBundleFound, false, "SyncFailed", syncErr.Error())
+		registeredCond = broker.NewAppConfigCondition(broker.AppConditionRegistered, false, "BundleNotFound", bundleCond.Message)
+	} else if !foundBundle {
+		log.Printf("Bundle manifests ConfigMap %s not found for app %s", bundleCMName, appName)
+		delete(f.registeredSpecs, appName)
+		bundleCond = broker.NewAppConfigCondition(broker.AppConditionBundleFound, false, "ConfigMapNotFound", fmt.Sprintf("Bundle manifests ConfigMap %s not found", bundleCMName))
+		registeredCond = broker.NewAppConfigCondition(broker.AppConditionRegistered, false, "BundleNotFound", bundleCond.Message)
+	} else if foundUserBundleCount != len(appConfig.Spec.UserBundles) {
+		log.Printf("Failed to find all spec.userBundles for app %s", appName)
+		delete(f.registeredSpecs, appName)
+		bundleCond = broker.NewAppConfigCondition(broker.AppConditionBundleFound, false, "UserBundlesNotFound", "Failed to find all spec.userBundles")
+		registeredCond = broker.NewAppConfigCondition(broker.AppConditionRegistered, false, "BundleNotFound", bundleCond.Message)
+	} else {
+		if len(authzCMName) > 0 && !foundAuthzCM {
+			log.Printf("Failed to find authorization ConfigMap bundle %s for app %s", authzCMName, appName)
+		}
+		registeredCond = broker.NewAppConfigCondition(broker.AppConditionRegistered, true, "Registered", "")
+		// Specs are checked by the broker-webhook when applied, apps applied before it was installed may still be invalid.
+		if err := appConfig.Spec.Validate(); err != nil {
+			log.Printf("WARN: app %s spec is invalid, the brokers may skip it or fail its requests: %v", appName, err)
+			registeredCond.Reason = "InvalidSpec"
+			registeredCond.Message = err.Error()
+		}
+		// App is valid and bundle is ready, add to registered apps.
+		if !appConfig.Spec.Disabled {
+			f.registeredSpecs[appName] = appConfig.Spec
+		} else {
+			delete(f.registeredSpecs, appName)
+			registeredCond = broker.NewAppConfigCondition(broker.AppConditionRegistered, false, "Disabled", "App is disabled")
+		}
+	}
+
+	if err := f.statusWriter.Update(appName, broker.AppConfigStatusUpdate{
+		ObservedGeneration: appConfig.Metadata.Generation,
+		Conditions:         []broker.AppConfigCondition{bundleCond, authzCond, registeredCond},
+	}); err != nil {
+		log.Printf("%v", err)
+	}
+
+	return syncErr
+}
+
+// Prunes the build source directories of apps that no longer exist.
+func (f *appFinder) pruneBundleDirs() {
+	f.Lock()
+	defer f.Unlock()
+	for _, baseDir := range []string{broker.BundleSourceBaseDir, broker.UserBundleSourceBaseDir} {
+		foundDirs, err := filepath.Glob(path.Join(baseDir, "*"))
+		if err != nil {
+			log.Printf("failed to list app directories to prune: %v", err)
+		}
+		for _, dirName := range foundDirs {
+			if _, ok := f.appConfigs[path.Base(dirName)]; !ok {
+				log.Printf("removing build source: %s", dirName)
+				os.RemoveAll(dirName)
+			}
+		}
+	}
+}
+
+// Publishes the registered apps to the registry, a new generation is only written if they changed.
+// Apps without a bundle source directory are not published so the brokers do not have to check for it on each request.
+func (f *appFinder) writeManifest() error {
+	apps := make(map[string]broker.AppConfigSpec, len(f.registeredSpecs))
+	for _, spec := range f.registeredSpecs {
+		if _, err := os.Stat(path.Join(broker.BundleSourceBaseDir, spec.Name)); os.IsNotExist(err) {
+			log.Printf("WARN: missing bundle source directory for app: %s", spec.Name)
+			continue
+		}
+		apps[spec.Name] = spec
+	}
+	_, err := f.appRegistry.Publish(apps, f.networkPolicyData)
+	return err
+}
@@ -27,11 +27,18 @@ import (
 	"path"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig"
 	broker "selkies.io/controller/pkg"
 )
 
+// Cookie max-age in seconds, 5 days.
+const maxCookieAgeSeconds = 432000
+
+// Interval to check for finished app publish jobs.
+const publishJobPollInterval = 10 * time.Second
+
 type newAppData struct {
 	Name        string `json:"name"`
 	DisplayName string `json:"displayName"`
@@ -55,6 +62,9 @@ type appPublishJobTemplateData struct {
 func main() {
 	log.Printf("Starting broker app publisher service")
 
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9081")
+
 	// Set from downward API.
 	namespace := os.Getenv("NAMESPACE")
 	if len(namespace) == 0 {
@@ -70,26 +80,59 @@ func main() {
 	// Map of Name=Value
 	sysParams := broker.GetEnvPrefixedVars("POD_BROKER_PARAM_")
 
-	// AuthHeader from params
-	authHeaderName, ok := sysParams["AuthHeader"]
-	if !ok {
-		log.Fatal("Missing POD_BROKER_PARAM_AuthHeader env.")
+	// Authenticator from params
+	authenticator, err := broker.NewAuthenticatorFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	// Session tokens are verified with the same secrets as the brokers.
+	sessionTokens, err := broker.NewSessionTokenSignerFromEnv(maxCookieAgeSeconds * time.Second)
+	if err != nil {
+		log.Fatalf("failed to create session token signer: %v", err)
+	}
+
+	clusterClient, err := broker.NewKubeClusterClient()
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+
+	// Audit log of app publish jobs.
+	auditLog, err := broker.NewAuditLoggerFromParams(sysParams, "app-publisher")
+	if err != nil {
+		log.Fatalf("failed to create audit logger: %v", err)
+	}
+
+	// Outbound webhook notifications.
+	notifier, err := broker.NewWebhookNotifierFromParams(clusterClient, sysParams, namespace, "app-publisher")
+	if err != nil {
+		log.Fatalf("failed to create webhook notifier: %v", err)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Group and role based authorization of app editors.
+	authorizer, err := broker.NewAuthorizerFromParams(clusterClient, sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authorizer: %v", err)
+	}
+	go watchPublishJobs(clusterClient, namespace, notifier)
+
+	// Apps discovered by app_finder.
+	appRegistry := broker.NewAppRegistry(broker.RegisteredAppsManifestJSONFile)
+
+	http.Handle("/", broker.InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, ok := sysParams["Debug"]; ok {
 			data, _ := httputil.DumpRequest(r, false)
 			log.Println(string(data))
 		}
 
-		// Discover apps from their config specs located on the filesystem.
-		// TODO: look into caching this, large number of apps and http requests can slow down the broker.
-		registeredApps, err := broker.NewRegisteredAppManifestFromJSON(broker.RegisteredAppsManifestJSONFile, broker.AppTypeStatefulSet)
+		// Get the apps discovered by app_finder from the registry snapshot.
+		snapshot, err := appRegistry.Snapshot()
 		if err != nil {
 			log.Printf("failed to parse registered app manifest: %v", err)
 			writeResponse(w, http.StatusInternalServerError, "internal server error")
 			return
 		}
+		registeredApps := snapshot.OfType(broker.AppTypeStatefulSet)
 
 		// Extract app name from path
 		reqApp := strings.Split(r.URL.Path, "/")[1]
@@ -107,26 +150,16 @@ func main() {
 		cookieName := fmt.Sprintf("broker_%s", appName)
 
 		// Get user from cookie or header
-		user := broker.GetUserFromCookieOrAuthHeader(r, cookieName, authHeaderName)
-		if len(user) == 0 {
+		identity, err := broker.AuthenticateRequest(r, cookieName, appName, sessionTokens, authenticator)
+		if err != nil {
+			log.Printf("failed to authenticate request: %v", err)
 			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Failed to get user from cookie or auth header"))
 			return
 		}
-		// IAP uses a prefix of accounts.google.com:email, remove this to just get the email
-		userToks := strings.Split(user, ":")
-		user = userToks[len(userToks)-1]
-
-		// App is editable if user is in the list of editors.
-		editable := false
-		for _, appEditor := range app.Editors {
-			if appEditor == user {
-				editable = true
-				break
-			}
-		}
+		user := identity.User
 
-		// Return with error if user is unauthorized
-		if !editable {
+		// Return with error if user does not match the list of editors.
+		if !registeredApps.Policies[appName].Editors.Matches(authorizer.Resolve(identity)) {
 			writeResponse(w, http.StatusUnauthorized, "user is not authorized to publish")
 			return
 		}
@@ -146,7 +179,7 @@ func main() {
 
 		jobName := fmt.Sprintf("app-publish-%s", appName)
 
-		currJobs, err := broker.GetJobs(namespace, fmt.Sprintf("app=%s", jobName))
+		currJobs, err := clusterClient.GetJobs(namespace, fmt.Sprintf("app=%s", jobName))
 		if err != nil {
 			writeResponse(w, http.StatusInternalServerError, "failed to query image publish jobs")
 			return
@@ -187,7 +220,7 @@ func main() {
 			fullName := fmt.Sprintf("%s-%s", appName, id)
 
 			// Get current status of app pod.
-			podStatus, err := broker.GetPodStatus(userNamespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+			podStatus, err := clusterClient.GetPodStatus(userNamespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
 			if err != nil {
 				log.Printf("failed to get pod ips: %v", err)
 				writeResponse(w, http.StatusInternalServerError, "internal server error")
@@ -220,6 +253,14 @@ func main() {
 				return
 			}
 
+			auditLog.Emit(broker.AuditEvent{
+				Event: broker.AuditEventPublishJobCreated,
+				App:   appName,
+				User:  user,
+				Image: image,
+				Job:   jobName,
+			})
+
 			writeResponse(w, http.StatusCreated, fmt.Sprintf("Created app publish job: %s", jobName))
 
 			return
@@ -230,12 +271,73 @@ func main() {
 			writeResponse(w, http.StatusBadRequest, "NTI")
 			return
 		}
-	})
+	}), appRegistry.AppLabelFromPath))
 
 	log.Println("Listening on port 8081")
 	log.Fatal(http.ListenAndServe(":8081", nil))
 }
 
+/*
+Polls the app publish jobs and sends a webhook notification when a job finishes.
+Jobs that already finished when the publisher started are not notified.
+*/
+func watchPublishJobs(clusterClient broker.ClusterClient, namespace string, notifier *broker.WebhookNotifier) {
+	notified := make(map[string]bool, 0)
+	initialized := false
+	for {
+		jobs, err := clusterClient.GetJobs(namespace, "app.kubernetes.io/managed-by=pod-broker-app-publisher")
+		if err != nil {
+			log.Printf("failed to list app publish jobs: %v", err)
+			time.Sleep(publishJobPollInterval)
+			continue
+		}
+
+		found := make(map[string]bool, 0)
+		for _, job := range jobs {
+			jobName, _ := job.Metadata["name"].(string)
+			found[jobName] = true
+			if notified[jobName] {
+				continue
+			}
+
+			event := ""
+			if job.Status.Succeeded > 0 {
+				event = broker.WebhookEventPublishJobSucceeded
+			} else if job.IsFailed() {
+				event = broker.WebhookEventPublishJobFailed
+			} else {
+				continue
+			}
+			notified[jobName] = true
+			if !initialized {
+				continue
+			}
+
+			user := ""
+			if annotations, ok := job.Metadata["annotations"].(map[string]interface{}); ok {
+				user, _ = annotations["pod.broker/app-publish-user"].(string)
+			}
+			log.Printf("app publish job %s finished: %s", jobName, event)
+			notifier.Notify(broker.WebhookEvent{
+				Event: event,
+				App:   strings.TrimPrefix(jobName, "app-publish-"),
+				User:  user,
+				Data:  map[string]string{"job": jobName},
+			})
+		}
+
+		// Forget jobs that were removed.
+		for jobName := range notified {
+			if !found[jobName] {
+				delete(notified, jobName)
+			}
+		}
+
+		initialized = true
+		time.Sleep(publishJobPollInterval)
+	}
+}
+
 func writeResponse(w http.ResponseWriter, statusCode int, message string) {
 	status := broker.StatusResponse{
 		Code:   statusCode,
@@ -320,6 +422,7 @@ func makeAppPublishJob(namespace, jobName, appName, image, nodeName, containerID
 	cmd.Dir = path.Dir(destDir)
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
+		broker.RecordApplyError("kubectl-apply-job")
 		return fmt.Errorf("error calling kubectl to apply job: %v\n%s", err, string(stdoutStderr))
 	}
 
@@ -0,0 +1,180 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	broker "selkies.io/controller/pkg"
+)
+
+// Maximum size of an AdmissionReview request body.
+const maxAdmissionReviewBytes = 4 << 20
+
+func main() {
+	log.Printf("Starting broker validating admission and conversion webhook")
+
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9081")
+
+	// Set from downward API.
+	namespace := os.Getenv("NAMESPACE")
+	if len(namespace) == 0 {
+		log.Fatal("Missing NAMESPACE env.")
+	}
+
+	// Serving certificate, the API server only calls webhooks over TLS.
+	certFile := os.Getenv("TLS_CERT_FILE")
+	if len(certFile) == 0 {
+		certFile = "/run/broker-webhook/tls/tls.crt"
+	}
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if len(keyFile) == 0 {
+		keyFile = "/run/broker-webhook/tls/tls.key"
+	}
+
+	clusterClient, err := broker.NewKubeClusterClient()
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+
+	http.Handle("/validate", broker.InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "expected POST with content-type application/json", http.StatusBadRequest)
+			return
+		}
+
+		var review admissionv1.AdmissionReview
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdmissionReviewBytes)).Decode(&review); err != nil || review.Request == nil {
+			log.Printf("invalid admission review: %v", err)
+			http.Error(w, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = validate(clusterClient, namespace, review.Request)
+		review.Response.UID = review.Request.UID
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(review)
+	}), func(r *http.Request) string { return broker.MetricsAppNone }))
+
+	// CRD conversion webhook, converts BrokerAppConfigs between the v1 and v2 API versions.
+	http.Handle("/convert", broker.InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "expected POST with content-type application/json", http.StatusBadRequest)
+			return
+		}
+
+		var review broker.ConversionReview
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdmissionReviewBytes)).Decode(&review); err != nil || review.Request == nil {
+			log.Printf("invalid conversion review: %v", err)
+			http.Error(w, "invalid conversion review", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = broker.ConvertBrokerAppConfigs(review.Request)
+		if review.Response.Result.Status != metav1.StatusSuccess {
+			log.Printf("failed to convert %d object(s) to %s: %s", len(review.Request.Objects), review.Request.DesiredAPIVersion, review.Response.Result.Message)
+		}
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(review)
+	}), func(r *http.Request) string { return broker.MetricsAppNone }))
+
+	log.Println("Listening on port 8443")
+	log.Fatal(http.ListenAndServeTLS(":8443", certFile, keyFile, nil))
+}
+
+/*
+Validates the BrokerAppConfig or BrokerAppUserConfig in the admission request.
+Deletes are always allowed. User configs of apps that are not found are allowed with a warning,
+the app may be applied after its user configs.
+*/
+func validate(clusterClient broker.ClusterClient, namespace string, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation == admissionv1.Delete {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	switch req.Kind.Kind {
+	case broker.BrokerAppConfigKind:
+		var appConfig broker.AppConfigObject
+		if err := json.Unmarshal(req.Object.Raw, &appConfig); err != nil {
+			return deny(fmt.Sprintf("failed to parse %s: %v", req.Kind.Kind, err))
+		}
+		if err := appConfig.Spec.Validate(); err != nil {
+			log.Printf("denied %s %s/%s: %v", req.Kind.Kind, req.Namespace, req.Name, err)
+			return deny(fmt.Sprintf("invalid %s spec: %v", req.Kind.Kind, err))
+		}
+
+	case broker.BrokerAppUserConfigKind:
+		var userConfig broker.AppUserConfigObject
+		if err := json.Unmarshal(req.Object.Raw, &userConfig); err != nil {
+			return deny(fmt.Sprintf("failed to parse %s: %v", req.Kind.Kind, err))
+		}
+		appConfigs, err := clusterClient.FetchBrokerAppConfigs(namespace)
+		if err != nil {
+			log.Printf("failed to fetch BrokerAppConfigs: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Allowed: false,
+				Result: &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Message: "failed to fetch BrokerAppConfigs",
+					Code:    http.StatusInternalServerError,
+				},
+			}
+		}
+		for _, appConfig := range appConfigs {
+			if appConfig.Spec.Name == userConfig.Spec.AppName {
+				if err := userConfig.Spec.Validate(appConfig.Spec); err != nil {
+					log.Printf("denied %s %s/%s: %v", req.Kind.Kind, req.Namespace, req.Name, err)
+					return deny(fmt.Sprintf("invalid %s spec: %v", req.Kind.Kind, err))
+				}
+				return &admissionv1.AdmissionResponse{Allowed: true}
+			}
+		}
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("app '%s' not found, user config was not validated", userConfig.Spec.AppName)},
+		}
+
+	default:
+		log.Printf("WARN: unexpected admission request for kind %s", req.Kind.Kind)
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func deny(msg string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: msg,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
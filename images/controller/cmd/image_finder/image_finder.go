@@ -51,6 +51,9 @@ func main() {
 			time.Sleep(1000 * time.Second)
 		}
 	}
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9083")
+
 	project, err := broker.GetProjectID()
 	if err != nil {
 		log.Fatal(err)
@@ -102,7 +105,12 @@ func main() {
 		config = outOfClusterConfig
 	}
 
-	dockerConfigs := &broker.DockerConfigsSync{}
+	clusterClient, err := broker.NewKubeClusterClientForConfig(config)
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+
+	dockerConfigs := &broker.DockerConfigsSync{Client: clusterClient}
 	if err := dockerConfigs.Update(namespace); err != nil {
 		log.Fatalf("failed to fetch docker auth configs: %v", err)
 	}
@@ -119,7 +127,7 @@ func main() {
 	}()
 
 	// Perform initial check
-	checkUserConfigs(dockerConfigs)
+	checkUserConfigs(clusterClient, dockerConfigs)
 
 	// Watch BrokerAppUserConfigs with dynamic informer.
 	addFunc := func(obj broker.AppUserConfigObject) {
@@ -187,7 +195,7 @@ func main() {
 
 				if len(message.Tag) > 0 {
 					// Fetch all user app configs
-					userConfigs, err := broker.FetchAppUserConfigs()
+					userConfigs, err := clusterClient.FetchAppUserConfigs()
 					if err != nil {
 						log.Fatalf("failed to fetch user app configs: %v", err)
 					}
@@ -259,7 +267,7 @@ func main() {
 	log.Printf("starting user config refresher")
 	for {
 		// Check all user configs
-		checkUserConfigs(dockerConfigs)
+		checkUserConfigs(clusterClient, dockerConfigs)
 		time.Sleep(checkInterval * time.Second)
 	}
 }
@@ -281,9 +289,9 @@ func writeUserConfigJSON(userConfig broker.AppUserConfigObject, dockerConfigs *b
 	return nil
 }
 
-func checkUserConfigs(dockerConfigs *broker.DockerConfigsSync) {
+func checkUserConfigs(clusterClient broker.ClusterClient, dockerConfigs *broker.DockerConfigsSync) {
 	// Fetch all user app configs
-	userConfigs, err := broker.FetchAppUserConfigs()
+	userConfigs, err := clusterClient.FetchAppUserConfigs()
 	if err != nil {
 		log.Fatalf("failed to fetch user app configs: %v", err)
 	}
@@ -95,6 +95,9 @@ func main() {
 
 	log.Printf("starting image puller")
 
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9084")
+
 	// Set from downward API.
 	namespace := os.Getenv("NAMESPACE")
 	if len(namespace) == 0 {
@@ -158,6 +161,20 @@ func main() {
 		config = outOfClusterConfig
 	}
 
+	clusterClient, err := broker.NewKubeClusterClientForConfig(config)
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+
+	// Values from environment variables prefixed with POD_BROKER_PARAM_Name=Value
+	sysParams := broker.GetEnvPrefixedVars("POD_BROKER_PARAM_")
+
+	// Outbound webhook notifications.
+	notifier, err := broker.NewWebhookNotifierFromParams(clusterClient, sysParams, namespace, "image-puller")
+	if err != nil {
+		log.Fatalf("failed to create webhook notifier: %v", err)
+	}
+
 	// Go routine to cleanup dangling images on node.
 	log.Printf("Cleaning dangling images")
 	if o, err := broker.CleanupDockerImagesOnNode(); err != nil {
@@ -172,7 +189,7 @@ func main() {
 	}()
 
 	// Get docker config pull secrets
-	dockerConfigs := &broker.DockerConfigsSync{}
+	dockerConfigs := &broker.DockerConfigsSync{Client: clusterClient}
 	if err := dockerConfigs.Update(namespace); err != nil {
 		log.Fatalf("failed to fetch docker auth configs: %v", err)
 	}
@@ -239,7 +256,7 @@ func main() {
 					log.Printf("could not find valid docker auth config for image: %s: %v", image, err)
 				} else {
 					log.Printf("creating image pull job for: %s", imageWithDigest)
-					if err := pullImage(imageWithDigest, imageTag, namespace, nodeName, templatePath, dockerConfigJSON); err != nil {
+					if err := pullImage(clusterClient, imageWithDigest, imageTag, namespace, nodeName, templatePath, dockerConfigJSON); err != nil {
 						log.Printf("%v", err)
 					}
 				}
@@ -392,8 +409,10 @@ func main() {
 	// Go routine to cleanup completed jobs.
 	go func() {
 		log.Printf("starting job cleanup worker")
+		// Failed jobs are not deleted, track them so they are only counted once.
+		failedJobs := make(map[string]bool, 0)
 		for {
-			currJobs, err := broker.GetJobs(namespace, "app=image-pull")
+			currJobs, err := clusterClient.GetJobs(namespace, "app=image-pull")
 			if err != nil {
 				log.Fatalf("failed to get current jobs: %v", err)
 			}
@@ -403,16 +422,32 @@ func main() {
 				if metaValue, ok := job.Metadata["annotations"]; ok {
 					annotations := metaValue.(map[string]interface{})
 					if imagePullAnnotation, ok := annotations["pod.broker/image-pull"]; ok {
-						if strings.Split(imagePullAnnotation.(string), ",")[0] == nodeName {
+						toks := strings.Split(imagePullAnnotation.(string), ",")
+						if toks[0] == nodeName {
 							// Found job for node.
 							jobName := job.Metadata["name"].(string)
 							if job.Status.Succeeded > 0 {
+								broker.ImagePullJobsTotal.WithLabelValues("succeeded").Inc()
+								startTime, startErr := time.Parse(time.RFC3339, job.Status.StartTime)
+								completionTime, completionErr := time.Parse(time.RFC3339, job.Status.CompletionTime)
+								if startErr == nil && completionErr == nil {
+									broker.ImagePullDuration.Observe(completionTime.Sub(startTime).Seconds())
+								}
+
+								if len(toks) > 1 {
+									notifier.Notify(broker.WebhookEvent{
+										Event: broker.WebhookEventImagePullCompleted,
+										Data:  map[string]string{"node": nodeName, "image": toks[1]},
+									})
+								}
+
 								log.Printf("deleting completed job: %s", jobName)
-								cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl delete job -n %s %s 1>&2", namespace, jobName))
-								stdoutStderr, err := cmd.CombinedOutput()
-								if err != nil {
-									log.Printf("error calling kubectl to delete job: %v\n%s", err, string(stdoutStderr))
+								if err := clusterClient.DeleteJob(namespace, jobName); err != nil {
+									log.Printf("error deleting job: %v", err)
 								}
+							} else if job.IsFailed() && !failedJobs[jobName] {
+								failedJobs[jobName] = true
+								broker.ImagePullJobsTotal.WithLabelValues("failed").Inc()
 							}
 						}
 					} else {
@@ -441,9 +476,9 @@ func main() {
 }
 
 // Creates Job to pull image if one is not already running.
-func pullImage(imageWithDigest, imageTag, namespace, nodeName, templatePath, dockerConfigJSON string) error {
+func pullImage(clusterClient broker.ClusterClient, imageWithDigest, imageTag, namespace, nodeName, templatePath, dockerConfigJSON string) error {
 	// Check to see if job is active.
-	currJobs, err := broker.GetJobs(namespace, "app=image-pull")
+	currJobs, err := clusterClient.GetJobs(namespace, "app=image-pull")
 	if err != nil {
 		return err
 	}
@@ -467,8 +502,10 @@ func pullImage(imageWithDigest, imageTag, namespace, nodeName, templatePath, doc
 
 	if !jobFound {
 		if err := makeImagePullJob(imageWithDigest, imageTag, nodeName, namespace, templatePath, dockerConfigJSON); err != nil {
+			broker.ImagePullJobsTotal.WithLabelValues("error").Inc()
 			return fmt.Errorf("failed to make job: %v", err)
 		}
+		broker.ImagePullJobsTotal.WithLabelValues("created").Inc()
 	}
 	return nil
 }
@@ -541,6 +578,7 @@ func makeImagePullJob(image, tag, nodeName, namespace, templatePath, dockerConfi
 	cmd.Dir = path.Dir(destDir)
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
+		broker.RecordApplyError("kubectl-apply-job")
 		return fmt.Errorf("error calling kubectl to apply job: %v\n%s", err, string(stdoutStderr))
 	}
 
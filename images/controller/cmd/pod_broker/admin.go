@@ -0,0 +1,153 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	broker "selkies.io/controller/pkg"
+)
+
+// Handles the /admin/ API, requests must come from a user that matches the admin policy.
+type adminServer struct {
+	clusterClient broker.ClusterClient
+	authenticator broker.Authenticator
+	authorizer    *broker.Authorizer
+	sessionTokens *broker.SessionTokenSigner
+	policy        *broker.AuthzPolicy
+	drainer       *broker.AppDrainer
+	appRegistry   *broker.AppRegistry
+	sessionReaper *broker.SessionReaper
+	appSync       *appLockMap
+	auditLog      *broker.AuditLogger
+}
+
+/*
+Routes:
+
+	GET    /admin/sessions               lists the sessions of all apps and the drained apps.
+	GET    /admin/home-volumes/expired   dry-run report of the home volumes that the garbage collection deletes.
+	DELETE /admin/sessions/<app>/<user>  force deletes the session, reservation apps are redirected to the reservation-broker.
+	POST   /admin/apps/<app>/drain       drains the app, new sessions are refused.
+	DELETE /admin/apps/<app>/drain       undrains the app.
+*/
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity, statusCode, err := broker.AuthorizeAdminRequest(r, s.sessionTokens, s.authenticator, s.authorizer, s.policy)
+	if err != nil {
+		log.Printf("rejected admin request %s %s: %v", r.Method, r.URL.Path, err)
+		writeResponse(w, statusCode, http.StatusText(statusCode))
+		return
+	}
+
+	registeredApps, err := s.appRegistry.Snapshot()
+	if err != nil {
+		log.Printf("failed to parse registered app manifest: %v", err)
+		writeResponse(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	toks := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+
+	switch {
+	case len(toks) == 1 && toks[0] == "sessions" && r.Method == "GET":
+		if err := broker.WriteAdminSessionList(w, s.clusterClient, registeredApps.Apps, s.drainer); err != nil {
+			log.Printf("%v", err)
+			writeResponse(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+	case len(toks) == 2 && toks[0] == "home-volumes" && toks[1] == "expired" && r.Method == "GET":
+		entries, err := broker.ListExpiredHomeVolumes(s.clusterClient, registeredApps.Apps, time.Now())
+		if err != nil {
+			log.Printf("failed to list expired home volumes: %v", err)
+			writeResponse(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+
+	case len(toks) == 3 && toks[0] == "sessions" && r.Method == "DELETE":
+		app, ok := registeredApps.Apps[toks[1]]
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "app not found")
+			return
+		}
+		if app.Type != broker.AppTypeStatefulSet {
+			w.Header().Set("Location", fmt.Sprintf("/reservation-broker/admin/sessions/%s/%s", app.Name, toks[2]))
+			writeResponse(w, http.StatusTemporaryRedirect, "app is reservation type")
+			return
+		}
+		statusCode, msg := s.deleteSession(app, toks[2], identity.User)
+		writeResponse(w, statusCode, msg)
+
+	case len(toks) == 3 && toks[0] == "apps" && toks[2] == "drain" && (r.Method == "POST" || r.Method == "DELETE"):
+		if _, ok := registeredApps.Apps[toks[1]]; !ok {
+			writeResponse(w, http.StatusNotFound, "app not found")
+			return
+		}
+		statusCode, msg := broker.SetAppDrained(s.drainer, s.auditLog, toks[1], identity.User, r.Method == "POST")
+		writeResponse(w, statusCode, msg)
+
+	default:
+		writeResponse(w, http.StatusNotFound, "not found")
+	}
+}
+
+/*
+Shuts down the user session for the StatefulSet app on behalf of the admin.
+*/
+func (s *adminServer) deleteSession(app broker.AppConfigSpec, user, admin string) (int, string) {
+	id := broker.MakePodID(user)
+	namespace := fmt.Sprintf("user-%s", id)
+	fullName := fmt.Sprintf("%s-%s", app.Name, id)
+
+	lock := s.appSync.Get(fullName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	status, err := s.clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+	if err != nil {
+		log.Printf("failed to get pod status for %s: %v", fullName, err)
+		return http.StatusInternalServerError, "internal server error"
+	}
+	if status.Status == "shutdown" {
+		return http.StatusNotFound, "session not found"
+	}
+
+	log.Printf("admin %s deleting %s session for user %s", admin, app.Name, user)
+	if err := shutdownApp(s.clusterClient, app, user, status.BrokerObjects); err != nil {
+		log.Printf("%v", err)
+		return http.StatusInternalServerError, "internal server error"
+	}
+	s.sessionReaper.Remove(app.Name, user)
+	broker.RecordSessionDeleted(app.Name, user, broker.SessionDeleteReasonAdmin)
+	s.auditLog.Emit(broker.AuditEvent{
+		Event:  broker.AuditEventSessionDeleted,
+		App:    app.Name,
+		User:   user,
+		Reason: broker.SessionDeleteReasonAdmin,
+		Actor:  admin,
+	})
+	return http.StatusAccepted, "terminating"
+}
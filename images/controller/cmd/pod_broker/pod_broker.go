@@ -17,29 +17,61 @@
 package main
 
 import (
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+
 	broker "selkies.io/controller/pkg"
 )
 
 // Cookie max-age in seconds, 5 days.
 const maxCookieAgeSeconds = 432000
 
+// Period which to check for sessions that exceeded the app idleTimeout or maxSessionDuration.
+const sessionReapPeriod = 30 * time.Second
+
+// Period which to check for home volumes that were not launched within the app retentionDays.
+const homeVolumeGCPeriod = 1 * time.Hour
+
+// Period which the session pod informer re-lists the session pods of all brokers.
+const sessionCacheResyncPeriod = 10 * time.Minute
+
+// Serializes session quota admission across all users and apps.
+// Held from the quota check until the new session is recorded as pending, so that concurrent launches see each other.
+var quotaAdmission sync.Mutex
+
+// Mutex for serializing per-user/per-app operations.
+type appLock struct {
+	sync.RWMutex
+}
+
+// Map of named locks, safe for concurrent use.
+type appLockMap struct {
+	sync.Mutex
+	locks map[string]*appLock
+}
+
+// Returns the lock for the given name, creating it if needed.
+func (m *appLockMap) Get(name string) *appLock {
+	m.Lock()
+	defer m.Unlock()
+	if lock, ok := m.locks[name]; ok {
+		return lock
+	}
+	m.locks[name] = &appLock{}
+	return m.locks[name]
+}
+
 func main() {
 	brokerNamespace := os.Getenv("NAMESPACE")
 	if len(brokerNamespace) == 0 {
@@ -47,13 +79,10 @@ func main() {
 		brokerNamespace = "pod-broker-system"
 	}
 
-	cookieSecret := os.Getenv("COOKIE_SECRET")
-	if len(cookieSecret) == 0 {
-		// Generate random secret
-		log.Printf("no COOKIE_SECRET env var found, generating random secret value")
-		h := sha1.New()
-		io.WriteString(h, fmt.Sprintf("%d.%d", rand.Intn(10000), int32(time.Now().Unix())))
-		cookieSecret = fmt.Sprintf("%x", h.Sum(nil))
+	// Signed session tokens from the COOKIE_SECRET and COOKIE_SECRET_PREVIOUS env vars.
+	sessionTokens, err := broker.NewSessionTokenSignerFromEnv(maxCookieAgeSeconds * time.Second)
+	if err != nil {
+		log.Fatalf("failed to create session token signer: %v", err)
 	}
 
 	clientID := os.Getenv("OAUTH_CLIENT_ID")
@@ -103,14 +132,12 @@ func main() {
 		logoutURL = fmt.Sprintf("https://%s/_gcp_iap/clear_login_cookie", domain)
 	}
 
-	// AuthHeader from params
-	authHeaderName, ok := sysParams["AuthHeader"]
-	if !ok {
-		log.Fatal("Missing POD_BROKER_PARAM_AuthHeader env.")
+	// Authenticator from params
+	authenticator, err := broker.NewAuthenticatorFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authenticator: %v", err)
 	}
 
-	usernameHeader, _ := sysParams["UsernameHeader"]
-
 	// Authorized user image repo pattern regexp.
 	allowedRepoPatternParam, ok := sysParams["AuthorizedUserRepoPattern"]
 	if !ok {
@@ -118,24 +145,93 @@ func main() {
 	}
 	allowedRepoPattern := regexp.MustCompile(allowedRepoPatternParam)
 
-	// Mutex for serializing per-user/per-app operations.
-	type appLock struct {
-		sync.RWMutex
+	// Session quotas from params.
+	brokerQuota, err := broker.NewBrokerQuotaSpecFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("failed to parse quota params: %v", err)
 	}
-	appSync := make(map[string]*appLock, 0)
 
-	// Mutex for serializing per-user operations.
-	userSync := make(map[string]*appLock, 0)
+	clusterClient, err := broker.NewKubeClusterClient()
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+	applyEngine := broker.NewApplyEngine(clusterClient, broker.BrokerFieldManager, brokerNamespace)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Audit log of session lifecycle events.
+	auditLog, err := broker.NewAuditLoggerFromParams(sysParams, "pod-broker")
+	if err != nil {
+		log.Fatalf("failed to create audit logger: %v", err)
+	}
+
+	// Outbound webhook notifications.
+	notifier, err := broker.NewWebhookNotifierFromParams(clusterClient, sysParams, brokerNamespace, "pod-broker")
+	if err != nil {
+		log.Fatalf("failed to create webhook notifier: %v", err)
+	}
+
+	// Group and role based authorization of app access, editors and user config writes.
+	authorizer, err := broker.NewAuthorizerFromParams(clusterClient, sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authorizer: %v", err)
+	}
+
+	// Admin API authorization from params, the admin API is disabled if not set.
+	adminPolicy, err := broker.NewAdminPolicyFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Apps drained by an admin, shared with the reservation-broker.
+	appDrainer := broker.NewAppDrainer(clusterClient, brokerNamespace)
+
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9080")
+
+	// Locks for serializing per-user/per-app operations.
+	appSync := &appLockMap{locks: make(map[string]*appLock, 0)}
+
+	// Locks for serializing per-user operations.
+	userSync := &appLockMap{locks: make(map[string]*appLock, 0)}
+
+	// Sessions admitted by the quota check whose StatefulSet pod may not exist yet.
+	pendingSessions := broker.NewPendingSessions()
+
+	// Session pods of all brokers, counted by the quota check.
+	sessionCache := broker.NewActiveSessionCache(clusterClient, sessionCacheResyncPeriod)
+	if err := sessionCache.Run(make(chan struct{})); err != nil {
+		log.Fatalf("failed to start session pod informer: %v", err)
+	}
+
+	// Registered apps and their compiled authorization policies, reloaded when app_finder publishes a new generation.
+	appRegistry := broker.NewAppRegistry(broker.RegisteredAppsManifestJSONFile)
+
+	// Track session activity and shut down sessions that exceeded the app limits.
+	sessionReaper := broker.NewSessionReaper()
+	go reapSessions(clusterClient, sessionReaper, appSync, auditLog, appRegistry)
+
+	go collectHomeVolumes(clusterClient, appSync, auditLog, appRegistry)
+
+	http.Handle("/admin/", broker.InstrumentHandler(&adminServer{
+		clusterClient: clusterClient,
+		authenticator: authenticator,
+		authorizer:    authorizer,
+		sessionTokens: sessionTokens,
+		policy:        adminPolicy,
+		drainer:       appDrainer,
+		appRegistry:   appRegistry,
+		sessionReaper: sessionReaper,
+		appSync:       appSync,
+		auditLog:      auditLog,
+	}, appRegistry.AppLabelFromPath))
+
+	http.Handle("/", broker.InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, ok := sysParams["Debug"]; ok {
 			data, _ := httputil.DumpRequest(r, false)
 			log.Println(string(data))
 		}
 
-		// Discover apps from their config specs located on the filesystem.
-		// TODO: look into caching this, large number of apps and http requests can slow down the broker.
-		registeredApps, err := broker.NewRegisteredAppManifestFromJSON(broker.RegisteredAppsManifestJSONFile, broker.AppTypeAll)
+		// Get the apps discovered by app_finder from the registry snapshot.
+		registeredApps, err := appRegistry.Snapshot()
 		if err != nil {
 			log.Printf("failed to parse registered app manifest: %v", err)
 			writeResponse(w, http.StatusInternalServerError, "internal server error")
@@ -151,16 +247,16 @@ func main() {
 
 		if r.URL.Path == "/" {
 			// Get user from header. At this time the per-app cookie has not been set and is not required.
-			user := broker.GetUserFromCookieOrAuthHeader(r, "", authHeaderName)
-			if len(user) == 0 {
+			identity, err := broker.AuthenticateRequest(r, "", "", sessionTokens, authenticator)
+			if err != nil {
+				log.Printf("failed to authenticate request: %v", err)
 				writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Failed to get user from auth header"))
 				return
 			}
-			// IAP uses a prefix of accounts.google.com:email, remove this to just get the email
-			userToks := strings.Split(user, ":")
-			user = userToks[len(userToks)-1]
+			user := identity.User
 
-			username := broker.GetUsernameFromHeaderOrDefault(r, usernameHeader, user)
+			// Add the group directory groups and roles once for all apps.
+			identity = authorizer.Resolve(identity)
 
 			// Return list of apps
 			appList := broker.AppListResponse{
@@ -172,13 +268,8 @@ func main() {
 				LogoutURL:    logoutURL,
 			}
 
+			// Apps are only published by the app-finder once their bundle is synced.
 			for _, app := range registeredApps.Apps {
-				srcPath := path.Join(broker.BundleSourceBaseDir, app.Name)
-				if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-					log.Printf("WARN: missing bundle source directory for app: %s", app.Name)
-					continue
-				}
-
 				if app.UserParams == nil {
 					// default user params to empty list.
 					app.UserParams = make([]broker.AppConfigParam, 0)
@@ -189,38 +280,15 @@ func main() {
 					app.LaunchURL = fmt.Sprintf("/%s/", app.Name)
 				}
 
-				// App is editable if user is in the list of editors.
-				editable := false
-				for _, appEditor := range app.Editors {
-					re, err := regexp.Compile(appEditor)
-					if err != nil {
-						log.Printf("failed to parse app editor as regexp: '%s'.", appEditor)
-						continue
-					}
-					if re.MatchString(user) {
-						editable = true
-						break
-					}
-				}
+				policies := registeredApps.Policies[app.Name]
+
+				// App is editable if user matches the list of editors.
+				editable := policies.Editors.Matches(identity)
 
 				// Filter app by authorizedUsers if present.
-				if app.AuthorizedUsers != nil {
-					found := false
-					for _, u := range app.AuthorizedUsers {
-						re, err := regexp.Compile(u)
-						if err != nil {
-							log.Printf("failed to parse authorizedUser as regexp: '%s', skipping app.", u)
-							break
-						}
-						if re.MatchString(user) || re.MatchString(username) {
-							found = true
-							break
-						}
-					}
-					if !found {
-						// Skip this app.
-						continue
-					}
+				if policies.AuthorizedUsers != nil && !policies.AuthorizedUsers.Matches(identity) {
+					// Skip this app.
+					continue
 				}
 
 				appData := broker.AppDataResponse{
@@ -238,6 +306,7 @@ func main() {
 					Editable:       editable,
 					DisableOptions: app.DisableOptions,
 					Metadata:       app.Metadata,
+					Maintenance:    app.MaintenanceStatus(time.Now()),
 				}
 				appList.Apps = append(appList.Apps, appData)
 			}
@@ -277,49 +346,29 @@ func main() {
 		}
 
 		// Get user from cookie or header
-		user := broker.GetUserFromCookieOrAuthHeader(r, cookieName, authHeaderName)
-		if len(user) == 0 {
+		identity, err := broker.AuthenticateRequest(r, cookieName, appName, sessionTokens, authenticator)
+		if err != nil {
+			log.Printf("failed to authenticate request: %v", err)
 			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Failed to get user from cookie or auth header"))
 			return
 		}
-		// IAP uses a prefix of accounts.google.com:email, remove this to just get the email
-		userToks := strings.Split(user, ":")
-		user = userToks[len(userToks)-1]
+		user := identity.User
+		username := identity.Username
 
-		username := broker.GetUsernameFromHeaderOrDefault(r, usernameHeader, user)
+		// Session tokens carry the authenticated groups, the group directory is resolved on each request.
+		tokenIdentity := identity
 
-		// App is editable if user is in the list of editors.
-		editable := false
-		for _, appEditor := range app.Editors {
-			re, err := regexp.Compile(appEditor)
-			if err != nil {
-				log.Printf("failed to parse app editor as regexp: '%s'.", appEditor)
-				continue
-			}
-			if re.MatchString(user) || re.MatchString(username) {
-				editable = true
-				break
-			}
-		}
+		// Add the group directory groups and roles.
+		identity = authorizer.Resolve(identity)
+		policies := registeredApps.Policies[appName]
+
+		// App is editable if user matches the list of editors.
+		editable := policies.Editors.Matches(identity)
 
 		// Check per-app user authorization if present.
-		if app.AuthorizedUsers != nil {
-			found := false
-			for _, u := range app.AuthorizedUsers {
-				re, err := regexp.Compile(u)
-				if err != nil {
-					log.Printf("failed to parse authorizedUser as regexp: '%s', skipping app.", u)
-					break
-				}
-				if re.MatchString(user) || re.MatchString(username) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				writeResponse(w, http.StatusUnauthorized, fmt.Sprintf("user is not authorized"))
-				return
-			}
+		if policies.AuthorizedUsers != nil && !policies.AuthorizedUsers.Matches(identity) {
+			writeResponse(w, http.StatusUnauthorized, fmt.Sprintf("user is not authorized"))
+			return
 		}
 
 		// Compute pod ID from user and app, must conform to DNS-1035.
@@ -331,21 +380,16 @@ func main() {
 
 		destDir := path.Join(broker.BuildSourceBaseDir, user, appName)
 
-		cookieValue := broker.MakeCookieValue(user, appName, cookieSecret)
+		cookieValue := sessionTokens.RoutingValue(user, appName)
 
 		userConfigFile := path.Join(broker.AppUserConfigBaseDir, appName, user, broker.AppUserConfigJSONFile)
 
 		ts := fmt.Sprintf("%d", time.Now().Unix())
 
 		// Lock per-user/per-app operations.
-		if lock, ok := appSync[fullName]; ok {
-			lock.Lock()
-			defer lock.Unlock()
-		} else {
-			appSync[fullName] = &appLock{}
-			appSync[fullName].Lock()
-			defer appSync[fullName].Unlock()
-		}
+		lock := appSync.Get(fullName)
+		lock.Lock()
+		defer lock.Unlock()
 
 		// Default app params from app config
 		defaultAppParams := make(map[string]string, 0)
@@ -415,7 +459,7 @@ func main() {
 		// Handle requests for per-app session info requests
 		if regexp.MustCompile(fmt.Sprintf(".*%s/session/?$", appName)).MatchString(r.URL.Path) {
 			// Fetch pod status
-			status, err := broker.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+			status, err := clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
 			if err != nil {
 				log.Printf("failed to get pod status: %v", err)
 				writeResponse(w, http.StatusInternalServerError, "internal server error")
@@ -436,6 +480,9 @@ func main() {
 				User:         user,
 				SessionStart: broker.K8sTimestampToUnix(status.CreationTimestamp),
 			}
+			if status.Status != "shutdown" {
+				sessionReaper.Heartbeat(appName, user)
+			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			enc := json.NewEncoder(w)
@@ -447,12 +494,34 @@ func main() {
 		// Handle requests for per-app user configs
 		if regexp.MustCompile(fmt.Sprintf(".*%s/config/?$", appName)).MatchString(r.URL.Path) {
 			if getStatus {
+				// List the session snapshots that can be restored.
+				var snapshots []broker.SessionSnapshot
+				if app.Snapshots.Enabled {
+					snapshots, err = broker.ListSessionSnapshots(clusterClient, namespace, fullName)
+					if err != nil {
+						log.Printf("failed to list snapshots for user %s: %v", user, err)
+					}
+				}
+
+				// Report the size and usage of the home volume.
+				var homeVolume *broker.HomeVolumeResponse
+				if app.HomeVolume.Enabled {
+					homeVolume, err = broker.GetHomeVolumeStatus(clusterClient, app, namespace, fullName)
+					if err != nil {
+						log.Printf("failed to get home volume for user %s: %v", user, err)
+					}
+				}
+
 				statusCode := http.StatusOK
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(statusCode)
 				enc := json.NewEncoder(w)
 				enc.SetIndent("", "  ")
-				enc.Encode(userConfig.Spec)
+				enc.Encode(broker.AppUserConfigResponse{
+					AppUserConfigSpec: userConfig.Spec,
+					Snapshots:         snapshots,
+					HomeVolume:        homeVolume,
+				})
 				return
 
 			} else if create {
@@ -480,15 +549,16 @@ func main() {
 				inputConfigSpec.AppName = appName
 				inputConfigSpec.User = user
 				inputConfigSpec.Tags = userConfig.Spec.Tags
+				inputConfigSpec.RestoreSnapshot = userConfig.Spec.RestoreSnapshot
 
 				// Set default image repo
 				if len(inputConfigSpec.ImageRepo) == 0 {
 					inputConfigSpec.ImageRepo = userConfig.Spec.ImageRepo
 				} else if inputConfigSpec.ImageRepo != userConfig.Spec.ImageRepo {
 					fieldName := "imageRepo"
-					if !isUserFieldWritable(app, fieldName) {
+					if !isUserFieldWritable(app, policies, identity, fieldName) {
 						msg := fmt.Sprintf("user field '%s' is not writable.", fieldName)
-						log.Printf(msg)
+						log.Print(msg)
 						writeResponse(w, http.StatusBadRequest, msg)
 						return
 					}
@@ -499,9 +569,9 @@ func main() {
 					inputConfigSpec.ImageTag = userConfig.Spec.ImageTag
 				} else if inputConfigSpec.ImageTag != userConfig.Spec.ImageTag {
 					fieldName := "imageTag"
-					if !isUserFieldWritable(app, fieldName) {
+					if !isUserFieldWritable(app, policies, identity, fieldName) {
 						msg := fmt.Sprintf("user field '%s' is not writable.", fieldName)
-						log.Printf(msg)
+						log.Print(msg)
 						writeResponse(w, http.StatusBadRequest, msg)
 						return
 					}
@@ -512,9 +582,9 @@ func main() {
 					inputConfigSpec.NodeTier = userConfig.Spec.NodeTier
 				} else if inputConfigSpec.NodeTier != userConfig.Spec.NodeTier {
 					fieldName := "nodeTier"
-					if !isUserFieldWritable(app, fieldName) {
+					if !isUserFieldWritable(app, policies, identity, fieldName) {
 						msg := fmt.Sprintf("user field '%s' is not writable.", fieldName)
-						log.Printf(msg)
+						log.Print(msg)
 						writeResponse(w, http.StatusBadRequest, msg)
 						return
 					}
@@ -535,10 +605,10 @@ func main() {
 				for paramName, paramValue := range inputConfigSpec.Params {
 					// Return error if param is not found or not writable.
 
-					writable, param := isUserParamWritable(app, paramName)
+					writable, param := isUserParamWritable(app, policies, identity, paramName)
 					if !writable && paramValue != userConfig.Spec.Params[paramName] {
 						msg := fmt.Sprintf("user param '%s' is not writable.", paramName)
-						log.Printf(msg)
+						log.Print(msg)
 						writeResponse(w, http.StatusBadRequest, msg)
 						return
 					} else if writable {
@@ -552,7 +622,7 @@ func main() {
 							}
 							if !re.MatchString(paramValue) {
 								msg := fmt.Sprintf("invalid param value for user param: '%s' in app '%s'", param.Name, app.Name)
-								log.Printf(msg)
+								log.Print(msg)
 								writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid value for param '%s'", param.Name))
 								return
 							}
@@ -576,7 +646,7 @@ func main() {
 				if inputConfigSpec.ImageRepo != userConfig.Spec.ImageRepo || inputConfigSpec.ImageTag != userConfig.Spec.ImageTag {
 					log.Printf("user config image changed from %s:%s to %s:%s", userConfig.Spec.ImageRepo, userConfig.Spec.ImageTag, inputConfigSpec.ImageRepo, inputConfigSpec.ImageTag)
 					log.Printf("validating user image repo against pattern: %s:%s, pattern: %s", inputConfigSpec.ImageRepo, inputConfigSpec.ImageTag, allowedRepoPattern)
-					imageTags, err := broker.ValidateImageRepo(inputConfigSpec.ImageRepo, inputConfigSpec.ImageTag, allowedRepoPattern)
+					imageTags, err := broker.ValidateImageRepo(clusterClient, inputConfigSpec.ImageRepo, inputConfigSpec.ImageTag, allowedRepoPattern)
 					if err != nil {
 						log.Printf("user %s config image validation failed: %v", user, err)
 						writeResponse(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
@@ -603,11 +673,15 @@ func main() {
 				}
 
 				// Apply config to cluster
-				cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kustomize build %s | kubectl apply -f - && kubectl apply -f %s", destDirUser, userConfigFile))
-				cmd.Dir = path.Dir(destDirUser)
-				stdoutStderr, err := cmd.CombinedOutput()
-				if err != nil {
-					log.Printf("error calling kubectl to apply user config for %s: %v\n%s", user, err, stdoutStderr)
+				if _, err := applyEngine.ApplyKustomization(destDirUser); err != nil {
+					broker.RecordApplyError("apply-user-namespace")
+					broker.LogApplyError(fmt.Sprintf("error applying user namespace for %s", user), err)
+					writeResponse(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+				if _, err := applyEngine.ApplyPath(userConfigFile); err != nil {
+					broker.RecordApplyError("apply-user-config")
+					broker.LogApplyError(fmt.Sprintf("error applying user config for %s", user), err)
 					writeResponse(w, http.StatusInternalServerError, "internal server error")
 					return
 				}
@@ -621,8 +695,206 @@ func main() {
 			return
 		}
 
+		// Handle requests for per-app session snapshots
+		if regexp.MustCompile(fmt.Sprintf(".*%s/snapshot/?$", appName)).MatchString(r.URL.Path) {
+			if !create {
+				writeResponse(w, http.StatusBadRequest, "only POST method is supported.")
+				return
+			}
+			if !app.Snapshots.Enabled {
+				writeResponse(w, http.StatusBadRequest, "snapshots are not enabled for this app")
+				return
+			}
+			snapshot, err := broker.CreateSessionSnapshot(clusterClient, namespace, fullName, user, app.Snapshots)
+			if err == broker.ErrNoSessionVolumes {
+				writeResponse(w, http.StatusNotFound, "session has no volumes to snapshot")
+				return
+			} else if err == broker.ErrSnapshotExists {
+				writeResponse(w, http.StatusConflict, "a snapshot was just taken, try again shortly")
+				return
+			} else if err != nil {
+				log.Printf("failed to create snapshot for user %s: %v", user, err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			log.Printf("created snapshot %s for user: %s: %s", snapshot.ID, user, fullName)
+			auditLog.Emit(broker.AuditEvent{
+				Event:    broker.AuditEventSnapshotCreated,
+				App:      appName,
+				User:     user,
+				Username: username,
+				Snapshot: snapshot.ID,
+			})
+
+			// Keep only the newest snapshots.
+			deleted, err := broker.PruneSessionSnapshots(clusterClient, namespace, fullName, app.SnapshotRetention())
+			if err != nil {
+				log.Printf("failed to prune snapshots for user %s: %v", user, err)
+			} else if len(deleted) > 0 {
+				log.Printf("deleted snapshots %s for user: %s: %s", strings.Join(deleted, ","), user, fullName)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(snapshot)
+			return
+		}
+
+		// Handle requests to restore the session volumes from a snapshot.
+		// The volumes are deleted and the snapshot is saved in the user config, the next launch provisions them from it.
+		if regexp.MustCompile(fmt.Sprintf(".*%s/restore/?$", appName)).MatchString(r.URL.Path) {
+			if !create {
+				writeResponse(w, http.StatusBadRequest, "only POST method is supported.")
+				return
+			}
+			if !app.Snapshots.Enabled {
+				writeResponse(w, http.StatusBadRequest, "snapshots are not enabled for this app")
+				return
+			}
+			snapshotID := r.URL.Query().Get("id")
+			if len(snapshotID) == 0 {
+				writeResponse(w, http.StatusBadRequest, "missing snapshot id")
+				return
+			}
+
+			status, err := clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+			if err != nil {
+				log.Printf("failed to get pod status: %v", err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			if status.Status != "shutdown" {
+				writeResponse(w, http.StatusConflict, "session must be shutdown before restoring a snapshot")
+				return
+			}
+
+			snapshot, found, err := broker.GetSessionSnapshot(clusterClient, namespace, fullName, snapshotID)
+			if err != nil {
+				log.Printf("failed to get snapshot %s for user %s: %v", snapshotID, user, err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			if !found {
+				writeResponse(w, http.StatusNotFound, "snapshot not found")
+				return
+			}
+			if !snapshot.Ready {
+				writeResponse(w, http.StatusConflict, "snapshot is not ready to use")
+				return
+			}
+
+			if err := broker.DeleteSessionPVCs(clusterClient, namespace, fullName, snapshot); err == broker.ErrSnapshotIncomplete {
+				writeResponse(w, http.StatusConflict, "snapshot does not include all session volumes, restore another snapshot")
+				return
+			} else if err != nil {
+				log.Printf("%v", err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+
+			userConfig.Spec.RestoreSnapshot = snapshot.ID
+			if err := userConfig.WriteJSON(userConfigFile); err != nil {
+				log.Printf("failed to save copy of user config: %v", err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			if _, err := applyEngine.ApplyPath(userConfigFile); err != nil {
+				broker.RecordApplyError("apply-user-config")
+				broker.LogApplyError(fmt.Sprintf("error applying user config for %s", user), err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			log.Printf("restoring snapshot %s on next launch for user: %s: %s", snapshot.ID, user, fullName)
+
+			writeResponse(w, http.StatusAccepted, "snapshot will be restored on next launch")
+			return
+		}
+
+		// Handle requests to reset or resize the home volume.
+		if m := regexp.MustCompile(fmt.Sprintf(".*%s/home/(reset|resize)/?$", appName)).FindStringSubmatch(r.URL.Path); m != nil {
+			if !create {
+				writeResponse(w, http.StatusBadRequest, "only POST method is supported.")
+				return
+			}
+			if !app.HomeVolume.Enabled {
+				writeResponse(w, http.StatusBadRequest, "home volumes are not enabled for this app")
+				return
+			}
+			homeVolume, err := broker.GetHomeVolumeStatus(clusterClient, app, namespace, fullName)
+			if err != nil {
+				log.Printf("failed to get home volume for user %s: %v", user, err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			if homeVolume == nil {
+				writeResponse(w, http.StatusNotFound, "home volume not found")
+				return
+			}
+
+			if m[1] == "reset" {
+				status, err := clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+				if err != nil {
+					log.Printf("failed to get pod status: %v", err)
+					writeResponse(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+				if status.Status != "shutdown" {
+					writeResponse(w, http.StatusConflict, "session must be shutdown before resetting the home volume")
+					return
+				}
+				if err := broker.DeleteHomeVolume(clusterClient, namespace, fullName); err != nil {
+					log.Printf("%v", err)
+					writeResponse(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+				log.Printf("reset home volume for user: %s: %s", user, fullName)
+				auditLog.Emit(broker.AuditEvent{
+					Event:    broker.AuditEventHomeVolumeReset,
+					App:      appName,
+					User:     user,
+					Username: username,
+				})
+				writeResponse(w, http.StatusAccepted, "home volume will be recreated on next launch")
+				return
+			}
+
+			// Volumes can be expanded while the session is running.
+			requested, err := resource.ParseQuantity(r.URL.Query().Get("size"))
+			if err != nil {
+				writeResponse(w, http.StatusBadRequest, "invalid size")
+				return
+			}
+			current, err := resource.ParseQuantity(homeVolume.Size)
+			if err != nil {
+				log.Printf("invalid size of home volume %s for user %s: %v", homeVolume.Name, user, err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			if err := app.ValidateHomeVolumeResize(current, requested); err != nil {
+				writeResponse(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+				return
+			}
+			if err := broker.ResizeHomeVolume(clusterClient, namespace, fullName, requested); err != nil {
+				log.Printf("%v", err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			log.Printf("resized home volume from %s to %s for user: %s: %s", current.String(), requested.String(), user, fullName)
+			auditLog.Emit(broker.AuditEvent{
+				Event:    broker.AuditEventHomeVolumeResized,
+				App:      appName,
+				User:     user,
+				Username: username,
+				Reason:   fmt.Sprintf("%s to %s", current.String(), requested.String()),
+			})
+			writeResponse(w, http.StatusAccepted, "home volume resize requested")
+			return
+		}
+
 		// Fetch the current pod status
-		status, err := broker.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+		status, err := clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
 		if err != nil {
 			log.Printf("failed to get pod status: %v", err)
 			writeResponse(w, http.StatusInternalServerError, "internal server error")
@@ -701,20 +973,45 @@ func main() {
 			PullSecrets:               []string{},
 		}
 
+		// Templates mount the home volume by its claim name.
+		if app.HomeVolume.Enabled {
+			data.HomeVolume = broker.HomeVolumeName(fullName)
+		}
+
+		// New sessions get the list of snapshots and the snapshot to restore their volumes from, if any.
+		if create && status.Status == "shutdown" && app.Snapshots.Enabled {
+			snapshots, err := broker.ListSessionSnapshots(clusterClient, namespace, fullName)
+			if err != nil {
+				log.Printf("failed to list snapshots for user %s: %v", user, err)
+				if len(userConfig.Spec.RestoreSnapshot) > 0 {
+					// Launching without the snapshot would provision empty volumes.
+					writeResponse(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+			}
+			data.Snapshots = snapshots
+			for i := range snapshots {
+				if snapshots[i].ID == userConfig.Spec.RestoreSnapshot {
+					data.RestoreSnapshot = &snapshots[i]
+				}
+			}
+			if len(userConfig.Spec.RestoreSnapshot) > 0 && data.RestoreSnapshot == nil {
+				// The volumes were deleted by the restore, launching without the snapshot would provision empty volumes.
+				// The snapshot to restore is kept until the user restores another one.
+				log.Printf("snapshot %s to restore for user %s was not found", userConfig.Spec.RestoreSnapshot, user)
+				writeResponse(w, http.StatusConflict, fmt.Sprintf("snapshot %s to restore was not found, restore another snapshot", userConfig.Spec.RestoreSnapshot))
+				return
+			}
+		}
+
 		appPath := fmt.Sprintf("/%s/", appName)
 
 		// Lock per-user operation
-		var userLock *appLock
-		if lock, ok := userSync[user]; ok {
-			userLock = lock
-		} else {
-			userSync[user] = &appLock{}
-			userLock = userSync[user]
-		}
+		userLock := userSync.Get(user)
 		userLock.Lock()
 
 		// Copy all pull-secrets from the pod-broker-system namespace to the user namespace
-		pullSecrets, err := broker.CopyDockerRegistrySecrets(brokerNamespace, broker.BrokerCommonBuildSourceBaseDirStatefulSetApp)
+		pullSecrets, err := clusterClient.CopyDockerRegistrySecrets(brokerNamespace, broker.BrokerCommonBuildSourceBaseDirStatefulSetApp)
 		if err != nil {
 			log.Printf("failed to copy secrets from %s to user namespace: %v", brokerNamespace, err)
 			userLock.Unlock()
@@ -755,47 +1052,24 @@ func main() {
 				return
 			}
 
-			for i, hook := range app.ShutdownHooks {
-				selector := strings.Join([]string{"app.kubernetes.io/instance=" + fullName, hook.Selector}, ",")
-				tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("shutdown-hook-%d", i))
-				if err != nil {
-					log.Printf("failed to create tempfile for shutdown hook %d", i)
-					continue
-				}
-				defer os.Remove(tmpFile.Name())
-				// Write contents of hook to temp file.
-				tmpFile.WriteString(hook.Command)
-				tmpFile.Sync()
-				tmpFile.Close()
-				tmpFileDest := fmt.Sprintf("/tmp/broker_shutdown_hook_%s_%d", hook.Container, i)
-				tmpFileCmd := fmt.Sprintf("sh %s", tmpFileDest)
-				if err := broker.CopyFileToContainer(namespace, selector, hook.Container, tmpFile.Name(), tmpFileDest); err != nil {
-					log.Printf("error copying shutdown hook file to container: %v", err)
-				} else {
-					log.Printf("executing shutdown hook %d/%d for %s, selector=%s, container=%s, command=%s", i+1, len(app.ShutdownHooks), fullName, selector, hook.Container, hook.Command)
-					if err := broker.ExecPodCommand(namespace, selector, hook.Container, tmpFileCmd); err != nil {
-						log.Printf("error calling shutdown hook: %v", err)
-					} else {
-						log.Printf("finished shutdown hook %d/%d for %s", i+1, len(app.ShutdownHooks), fullName)
-					}
-				}
-			}
-
-			if len(status.BrokerObjects) > 0 {
-				log.Printf("shutting down %s pod for user: %s", appName, user)
-				objectTypes := strings.Join(status.BrokerObjects, ",")
-				cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kubectl delete %s -n %s -l \"app.kubernetes.io/instance=%s, app.broker/deletion-policy notin (abandon)\" --wait=false", objectTypes, namespace, fullName))
-				cmd.Dir = destDir
-				stdoutStderr, err := cmd.CombinedOutput()
-				if err != nil {
-					log.Printf("error calling kubectl for %s: %v\n%s", user, err, stdoutStderr)
-					writeResponse(w, http.StatusInternalServerError, "internal server error")
-					return
-				}
+			if err := shutdownApp(clusterClient, app, user, status.BrokerObjects); err != nil {
+				log.Printf("%v", err)
+				writeResponse(w, http.StatusInternalServerError, "internal server error")
+				return
 			}
+			sessionReaper.Remove(appName, user)
+			pendingSessions.Remove(appName, user)
+			broker.RecordSessionDeleted(appName, user, broker.SessionDeleteReasonUser)
+			auditLog.Emit(broker.AuditEvent{
+				Event:    broker.AuditEventSessionDeleted,
+				App:      appName,
+				User:     user,
+				Username: username,
+				Reason:   broker.SessionDeleteReasonUser,
+			})
 
 			// Delete the cookie by setting max-age to -1
-			broker.SetCookie(w, cookieName, cookieValue, appPath, -1)
+			broker.SetCookie(w, cookieName, "", appPath, -1)
 
 			writeResponse(w, http.StatusAccepted, "terminating")
 			return
@@ -809,9 +1083,18 @@ func main() {
 			}
 
 			if status.Status == "ready" {
-				broker.SetCookie(w, cookieName, cookieValue, appPath, maxCookieAgeSeconds)
+				broker.SetCookie(w, cookieName, sessionTokens.RenewToken(r, cookieName, tokenIdentity, appName), appPath, maxCookieAgeSeconds)
+				broker.RecordSessionReady(appName, user)
+				notifier.NotifySessionReady(clusterClient, namespace, appName, user, status)
 			}
 
+			if status.Status != "shutdown" {
+				sessionReaper.Heartbeat(appName, user)
+			}
+
+			// Warn running sessions about maintenance.
+			status.Maintenance = app.MaintenanceStatus(time.Now())
+
 			if redirectURL, ok := queryParams["r"]; ok {
 				// Add header to redirect.
 				w.Header().Set("Location", redirectURL)
@@ -829,41 +1112,283 @@ func main() {
 
 		if create {
 			if status.Status == "shutdown" {
+				// Apps in maintenance do not accept new sessions.
+				if app.InMaintenance(time.Now()) {
+					broker.RecordSessionCreateError(appName, broker.SessionCreateErrorMaintenance)
+					writeResponse(w, http.StatusServiceUnavailable, app.MaintenanceMessage())
+					return
+				}
+
+				// Drained apps do not accept new sessions.
+				if appDrainer.IsDrained(appName) {
+					broker.RecordSessionCreateError(appName, broker.SessionCreateErrorDrained)
+					writeResponse(w, http.StatusServiceUnavailable, "app is drained, new sessions are not allowed at this time")
+					return
+				}
+
 				userLock.Lock()
 				defer userLock.Unlock()
 
+				// Verify the new session is within the broker and app quotas.
+				// Sessions of all users and apps are admitted one at a time and count as pending until their pod is in the session cache.
+				if brokerQuota.AppliesTo(app) {
+					quotaAdmission.Lock()
+					sessions, err := sessionCache.List(registeredApps.Apps)
+					if err != nil {
+						quotaAdmission.Unlock()
+						log.Printf("failed to list active sessions: %v", err)
+						broker.RecordSessionCreateError(appName, broker.SessionCreateErrorInternal)
+						writeResponse(w, http.StatusInternalServerError, "internal server error")
+						return
+					}
+					if err := broker.CheckSessionQuota(brokerQuota, app, user, username, pendingSessions.Merge(sessions)); err != nil {
+						quotaAdmission.Unlock()
+						log.Printf("denied session for user %s: %s: %v", user, fullName, err)
+						if quotaErr, ok := err.(*broker.QuotaExceededError); ok {
+							broker.RecordSessionCreateError(appName, broker.SessionCreateErrorQuota)
+							writeQuotaExceededResponse(w, quotaErr)
+						} else {
+							writeResponse(w, http.StatusInternalServerError, "internal server error")
+						}
+						return
+					}
+					pendingSessions.Add(broker.ActiveSession{App: appName, User: user, Username: username})
+					quotaAdmission.Unlock()
+				}
+
 				log.Printf("creating pod for user: %s: %s", user, fullName)
-				cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kustomize build %s | kubectl apply -f - && kustomize build %s | kubectl apply -f -", destDirUser, destDir))
-				cmd.Dir = destDir
-				stdoutStderr, err := cmd.CombinedOutput()
-				if err != nil {
-					log.Printf("error calling kubectl for %s: %v\n%s", user, err, stdoutStderr)
+				if _, err := applyEngine.ApplyKustomization(destDirUser); err != nil {
+					pendingSessions.Remove(appName, user)
+					broker.RecordApplyError("apply-user-namespace")
+					broker.RecordSessionCreateError(appName, broker.SessionCreateErrorInternal)
+					broker.LogApplyError(fmt.Sprintf("error applying user namespace for %s", user), err)
 					writeResponse(w, http.StatusInternalServerError, "internal server error")
 					return
 				}
+				if app.HomeVolume.Enabled {
+					created, err := broker.EnsureHomeVolume(clusterClient, app, namespace, fullName, user, time.Now())
+					if err != nil {
+						pendingSessions.Remove(appName, user)
+						log.Printf("%v", err)
+						broker.RecordSessionCreateError(appName, broker.SessionCreateErrorInternal)
+						writeResponse(w, http.StatusInternalServerError, "internal server error")
+						return
+					}
+					if created {
+						log.Printf("created home volume for user: %s: %s", user, fullName)
+					}
+				}
+				if _, err := applyEngine.ApplyKustomization(destDir); err != nil {
+					pendingSessions.Remove(appName, user)
+					broker.RecordApplyError("apply-app")
+					broker.RecordSessionCreateError(appName, broker.SessionCreateErrorInternal)
+					broker.LogApplyError(fmt.Sprintf("error applying app manifests for %s", user), err)
+					writeResponse(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+				broker.RecordSessionCreated(appName, user)
+				auditLog.Emit(broker.AuditEvent{
+					Event:      broker.AuditEventSessionCreated,
+					App:        appName,
+					User:       user,
+					Username:   username,
+					Image:      fmt.Sprintf("%s:%s", userConfig.Spec.ImageRepo, userConfig.Spec.ImageTag),
+					NodeTier:   userConfig.Spec.NodeTier,
+					UserParams: userConfig.Spec.Params,
+				})
+
+				// The snapshot is restored once, later launches keep the restored volumes.
+				if data.RestoreSnapshot != nil {
+					auditLog.Emit(broker.AuditEvent{
+						Event:    broker.AuditEventSnapshotRestored,
+						App:      appName,
+						User:     user,
+						Username: username,
+						Snapshot: data.RestoreSnapshot.ID,
+					})
+					userConfig.Spec.RestoreSnapshot = ""
+					if err := userConfig.WriteJSON(userConfigFile); err != nil {
+						log.Printf("failed to save copy of user config: %v", err)
+					} else if _, err := applyEngine.ApplyPath(userConfigFile); err != nil {
+						broker.RecordApplyError("apply-user-config")
+						broker.LogApplyError(fmt.Sprintf("error applying user config for %s", user), err)
+					}
+				}
 
-				broker.SetCookie(w, cookieName, cookieValue, appPath, maxCookieAgeSeconds)
+				// New sessions are routed with the current secret.
+				broker.SetCookie(w, cookieName, sessionTokens.MakeToken(tokenIdentity, appName), appPath, maxCookieAgeSeconds)
 
 				writeResponse(w, http.StatusAccepted, "created")
 				log.Printf("pod created for user: %s: %s", user, fullName)
 			} else {
-				broker.SetCookie(w, cookieName, cookieValue, appPath, maxCookieAgeSeconds)
+				broker.SetCookie(w, cookieName, sessionTokens.RenewToken(r, cookieName, tokenIdentity, appName), appPath, maxCookieAgeSeconds)
 
 				writeResponse(w, http.StatusCreated, "created")
 				log.Printf("pod already created for user: %s: %s", user, fullName)
 			}
 		}
-	})
+	}), appRegistry.AppLabelFromPath))
 
 	log.Println("Listening on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
-func isUserFieldWritable(app broker.AppConfigSpec, fieldName string) bool {
+/*
+Runs the app shutdown hooks and deletes the per-user objects for the app.
+Used by user DELETE requests and by the session reaper.
+*/
+func shutdownApp(clusterClient broker.ClusterClient, app broker.AppConfigSpec, user string, brokerObjects []string) error {
+	id := broker.MakePodID(user)
+	namespace := fmt.Sprintf("user-%s", id)
+	fullName := fmt.Sprintf("%s-%s", app.Name, id)
+
+	broker.RunShutdownHooks(clusterClient, namespace, fullName, app.ShutdownHooks)
+
+	if len(brokerObjects) > 0 {
+		log.Printf("shutting down %s pod for user: %s", app.Name, user)
+		if err := clusterClient.DeleteCollection(namespace, brokerObjects, broker.UserObjectsSelector(fullName)); err != nil {
+			broker.RecordApplyError("delete-user-objects")
+			return fmt.Errorf("error deleting objects for %s: %v", user, err)
+		}
+	}
+	return nil
+}
+
+/*
+Periodically discovers running sessions for apps with an idleTimeout or maxSessionDuration and shuts down the expired sessions.
+*/
+func reapSessions(clusterClient broker.ClusterClient, sessionReaper *broker.SessionReaper, appSync *appLockMap, auditLog *broker.AuditLogger, appRegistry *broker.AppRegistry) {
+	for {
+		time.Sleep(sessionReapPeriod)
+
+		registeredApps, err := appRegistry.Snapshot()
+		if err != nil {
+			log.Printf("failed to parse registered app manifest: %v", err)
+			continue
+		}
+
+		for _, app := range registeredApps.Apps {
+			if app.Type != broker.AppTypeStatefulSet {
+				continue
+			}
+			sessions := make(map[string]time.Time, 0)
+
+			idleTimeout, maxSessionDuration, err := app.SessionTimeouts()
+			if err != nil {
+				log.Printf("failed to get session timeouts for app %s: %v", app.Name, err)
+			} else if idleTimeout > 0 || maxSessionDuration > 0 || app.Maintenance.Enabled {
+				// Find the running sessions for the app across all user namespaces.
+				selector := fmt.Sprintf("app.kubernetes.io/managed-by=pod-broker,app.kubernetes.io/name=%s,app=%s", app.Name, app.ServiceName)
+				pods, err := clusterClient.GetPods("", selector)
+				if err != nil {
+					log.Printf("failed to list sessions for app %s: %v", app.Name, err)
+					continue
+				}
+				for _, pod := range pods {
+					user, ok := pod.Annotations["app.broker/user"]
+					if !ok || pod.DeletionTimestamp != nil {
+						continue
+					}
+					if _, ok := sessions[user]; !ok {
+						sessions[user] = pod.CreationTimestamp.Time
+					}
+				}
+			}
+			sessionReaper.Sync(app.Name, sessions)
+		}
+
+		for _, session := range sessionReaper.Expired(registeredApps.Apps, time.Now()) {
+			app := registeredApps.Apps[session.App]
+			id := broker.MakePodID(session.User)
+			namespace := fmt.Sprintf("user-%s", id)
+			fullName := fmt.Sprintf("%s-%s", app.Name, id)
+
+			lock := appSync.Get(fullName)
+			lock.Lock()
+			status, err := clusterClient.GetPodStatus(namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+			if err != nil {
+				log.Printf("failed to get pod status for expired session %s: %v", fullName, err)
+			} else if status.Status != "shutdown" {
+				log.Printf("reaping %s session for user %s, reason: %s", app.Name, session.User, session.Reason)
+				if err := shutdownApp(clusterClient, app, session.User, status.BrokerObjects); err != nil {
+					log.Printf("failed to reap session %s: %v", fullName, err)
+					lock.Unlock()
+					continue
+				}
+				broker.RecordSessionDeleted(app.Name, session.User, session.Reason)
+				auditLog.Emit(broker.AuditEvent{
+					Event:  broker.AuditEventSessionDeleted,
+					App:    app.Name,
+					User:   session.User,
+					Reason: session.Reason,
+				})
+			}
+			sessionReaper.Remove(app.Name, session.User)
+			lock.Unlock()
+		}
+	}
+}
+
+/*
+Periodically deletes the home volumes that were not launched within the app retentionDays.
+Volumes of apps with gcDryRun are only logged, volumes of running sessions are kept.
+*/
+func collectHomeVolumes(clusterClient broker.ClusterClient, appSync *appLockMap, auditLog *broker.AuditLogger, appRegistry *broker.AppRegistry) {
+	for {
+		time.Sleep(homeVolumeGCPeriod)
+
+		registeredApps, err := appRegistry.Snapshot()
+		if err != nil {
+			log.Printf("failed to parse registered app manifest: %v", err)
+			continue
+		}
+
+		entries, err := broker.ListExpiredHomeVolumes(clusterClient, registeredApps.Apps, time.Now())
+		if err != nil {
+			log.Printf("failed to list expired home volumes: %v", err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.DryRun {
+				log.Printf("dry-run: would delete %s home volume %s/%s for user %s, last launched %d days ago", entry.App, entry.Namespace, entry.Name, entry.User, entry.IdleDays)
+				continue
+			}
+			app := registeredApps.Apps[entry.App]
+			fullName := fmt.Sprintf("%s-%s", app.Name, broker.MakePodID(entry.User))
+
+			lock := appSync.Get(fullName)
+			lock.Lock()
+			status, err := clusterClient.GetPodStatus(entry.Namespace, fmt.Sprintf("app.kubernetes.io/instance=%s,app=%s", fullName, app.ServiceName))
+			if err != nil {
+				log.Printf("failed to get pod status for %s: %v", fullName, err)
+			} else if status.Status == "shutdown" {
+				log.Printf("deleting %s home volume %s/%s for user %s, last launched %d days ago", entry.App, entry.Namespace, entry.Name, entry.User, entry.IdleDays)
+				if err := broker.DeleteHomeVolume(clusterClient, entry.Namespace, fullName); err != nil {
+					log.Printf("%v", err)
+				} else {
+					auditLog.Emit(broker.AuditEvent{
+						Event:  broker.AuditEventHomeVolumeDeleted,
+						App:    entry.App,
+						User:   entry.User,
+						Reason: fmt.Sprintf("not launched for %d days", entry.IdleDays),
+					})
+				}
+			}
+			lock.Unlock()
+		}
+	}
+}
+
+func isUserFieldWritable(app broker.AppConfigSpec, policies broker.AppAuthzPolicies, identity broker.AuthIdentity, fieldName string) bool {
 	if !app.EnableUserConfigAuth {
 		return true
 	}
 
+	if !isUserConfigWriter(policies, identity) {
+		return false
+	}
+
 	for _, supportedField := range app.UserWritableFields {
 		if fieldName == supportedField {
 			return true
@@ -872,12 +1397,15 @@ func isUserFieldWritable(app broker.AppConfigSpec, fieldName string) bool {
 	return false
 }
 
-func isUserParamWritable(app broker.AppConfigSpec, paramName string) (bool, *broker.AppConfigParam) {
+func isUserParamWritable(app broker.AppConfigSpec, policies broker.AppAuthzPolicies, identity broker.AuthIdentity, paramName string) (bool, *broker.AppConfigParam) {
 	for _, param := range app.UserParams {
 		if param.Name == paramName {
 			if !app.EnableUserConfigAuth {
 				return true, &param
 			}
+			if !isUserConfigWriter(policies, identity) {
+				return false, nil
+			}
 			for _, supportedParam := range app.UserWritableParams {
 				if paramName == supportedParam {
 					return true, &param
@@ -888,6 +1416,14 @@ func isUserParamWritable(app broker.AppConfigSpec, paramName string) (bool, *bro
 	return false, nil
 }
 
+// Returns true if the resolved identity matches the app userConfigWriters rules, all users are writers if the list is empty.
+func isUserConfigWriter(policies broker.AppAuthzPolicies, identity broker.AuthIdentity) bool {
+	if policies.UserConfigWriters == nil {
+		return true
+	}
+	return policies.UserConfigWriters.Matches(identity)
+}
+
 func writeResponse(w http.ResponseWriter, statusCode int, message string) {
 	status := broker.StatusResponse{
 		Code:   statusCode,
@@ -913,3 +1449,20 @@ func writeResponseWithIPs(w http.ResponseWriter, statusCode int, message string,
 	enc.SetIndent("", "  ")
 	enc.Encode(status)
 }
+
+func writeQuotaExceededResponse(w http.ResponseWriter, quotaErr *broker.QuotaExceededError) {
+	status := broker.QuotaExceededResponse{
+		Code:    http.StatusTooManyRequests,
+		Status:  quotaErr.Error(),
+		Limit:   quotaErr.Limit,
+		Group:   quotaErr.Group,
+		Max:     quotaErr.Max,
+		Current: quotaErr.Current,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
@@ -0,0 +1,104 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestShutdownApp(t *testing.T) {
+	user := "user@example.com"
+	id := broker.MakePodID(user)
+	namespace := fmt.Sprintf("user-%s", id)
+	fullName := fmt.Sprintf("desktop-%s", id)
+	instance := map[string]string{"app.kubernetes.io/instance": fullName}
+	podLabels := map[string]string{"app.kubernetes.io/instance": fullName, "app": "desktop"}
+	abandoned := map[string]string{"app.kubernetes.io/instance": fullName, "app.broker/deletion-policy": "abandon"}
+	other := map[string]string{"app.kubernetes.io/instance": "desktop-other"}
+
+	statefulSetGVR := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	serviceGVR := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	pvcGVR := schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+
+	client := brokertest.NewFakeClusterClient(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: fullName + "-0", Labels: podLabels}},
+		brokertest.NewObject("apps/v1", "StatefulSet", namespace, fullName, instance),
+		brokertest.NewObject("v1", "Service", namespace, fullName, instance),
+		brokertest.NewObject("v1", "Service", namespace, "desktop-other", other),
+		brokertest.NewObject("v1", "PersistentVolumeClaim", namespace, fullName+"-data", abandoned),
+	)
+
+	app := broker.AppConfigSpec{
+		Name: "desktop",
+		ShutdownHooks: []broker.ShutdownHookSpec{
+			{Selector: "app=desktop", Container: "desktop", Command: "echo bye"},
+		},
+	}
+
+	if err := shutdownApp(client, app, user, []string{"PersistentVolumeClaim", "Service", "StatefulSet"}); err != nil {
+		t.Fatalf("shutdownApp returned error: %v", err)
+	}
+
+	tests := []struct {
+		gvr     schema.GroupVersionResource
+		name    string
+		deleted bool
+	}{
+		{statefulSetGVR, fullName, true},
+		{serviceGVR, fullName, true},
+		{serviceGVR, "desktop-other", false},
+		{pvcGVR, fullName + "-data", false},
+	}
+	for _, tc := range tests {
+		_, err := client.Dynamic().Resource(tc.gvr).Namespace(namespace).Get(context.TODO(), tc.name, metav1.GetOptions{})
+		if tc.deleted && !apierrors.IsNotFound(err) {
+			t.Errorf("expected %s %s to be deleted, got err: %v", tc.gvr.Resource, tc.name, err)
+		}
+		if !tc.deleted && err != nil {
+			t.Errorf("expected %s %s to be kept, got err: %v", tc.gvr.Resource, tc.name, err)
+		}
+	}
+
+	// The hook script is copied to the container and then run.
+	if len(client.Execs) != 2 {
+		t.Fatalf("expected 2 pod execs for the shutdown hook, got %d", len(client.Execs))
+	}
+	if got := string(client.Execs[0].Stdin); got != "echo bye" {
+		t.Errorf("unexpected shutdown hook script: %q", got)
+	}
+	if client.Execs[1].Pod != fullName+"-0" || client.Execs[1].Container != "desktop" {
+		t.Errorf("shutdown hook ran in unexpected pod/container: %s/%s", client.Execs[1].Pod, client.Execs[1].Container)
+	}
+}
+
+func TestShutdownAppUnknownKind(t *testing.T) {
+	client := brokertest.NewFakeClusterClient()
+	app := broker.AppConfigSpec{Name: "desktop"}
+	if err := shutdownApp(client, app, "user@example.com", []string{"NotAKind"}); err == nil {
+		t.Errorf("expected error for unknown object kind")
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	broker "selkies.io/controller/pkg"
+)
+
+// Handles the /admin/ API, requests must come from a user that matches the admin policy.
+type adminServer struct {
+	clusterClient broker.ClusterClient
+	authenticator broker.Authenticator
+	authorizer    *broker.Authorizer
+	sessionTokens *broker.SessionTokenSigner
+	policy        *broker.AuthzPolicy
+	drainer       *broker.AppDrainer
+	auditLog      *broker.AuditLogger
+	appContexts   *appContextMap
+	appRegistry   *broker.AppRegistry
+}
+
+/*
+Routes:
+
+	GET    /admin/sessions                              lists the sessions of all apps and the drained apps.
+	GET    /admin/pools                                 lists the last warm pool size recommendation of apps with pool autoscaling.
+	DELETE /admin/sessions/<app>/<user>                 force deletes the reservation, StatefulSet apps are redirected to the pod-broker.
+	POST   /admin/reservations/<app>/<user>/release     releases a stuck reservation.
+	POST   /admin/apps/<app>/drain                      drains the app, new reservations are refused.
+	DELETE /admin/apps/<app>/drain                      undrains the app.
+*/
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity, statusCode, err := broker.AuthorizeAdminRequest(r, s.sessionTokens, s.authenticator, s.authorizer, s.policy)
+	if err != nil {
+		log.Printf("rejected admin request %s %s: %v", r.Method, r.URL.Path, err)
+		writeResponse(w, statusCode, http.StatusText(statusCode))
+		return
+	}
+
+	registeredApps, err := s.appRegistry.Snapshot()
+	if err != nil {
+		log.Printf("failed to parse registered app manifest: %v", err)
+		writeResponse(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	toks := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+
+	switch {
+	case len(toks) == 1 && toks[0] == "sessions" && r.Method == "GET":
+		if err := broker.WriteAdminSessionList(w, s.clusterClient, registeredApps.Apps, s.drainer); err != nil {
+			log.Printf("%v", err)
+			writeResponse(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+	case len(toks) == 1 && toks[0] == "pools" && r.Method == "GET":
+		recommendations := make([]broker.PoolRecommendation, 0)
+		for _, appCtx := range s.appContexts.List() {
+			appCtx.RLock()
+			if appCtx.PoolRecommendation != nil {
+				recommendations = append(recommendations, *appCtx.PoolRecommendation)
+			}
+			appCtx.RUnlock()
+		}
+		sort.Slice(recommendations, func(i, j int) bool {
+			return recommendations[i].App < recommendations[j].App
+		})
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(recommendations)
+
+	case len(toks) == 3 && toks[0] == "sessions" && r.Method == "DELETE":
+		if app, ok := registeredApps.Apps[toks[1]]; ok && app.Type == broker.AppTypeStatefulSet {
+			w.Header().Set("Location", fmt.Sprintf("/broker/admin/sessions/%s/%s", app.Name, toks[2]))
+			writeResponse(w, http.StatusTemporaryRedirect, "app is statefulset type")
+			return
+		}
+		appCtx, ok := s.appContexts.Get(toks[1])
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "app not found")
+			return
+		}
+		appCtx.RLock()
+		_, reserved := appCtx.ReservedPods[toks[2]]
+		appCtx.RUnlock()
+		if !reserved {
+			writeResponse(w, http.StatusNotFound, "session not found")
+			return
+		}
+		log.Printf("admin %s deleting %s reservation for user %s", identity.User, appCtx.Name, toks[2])
+		statusCode, msg := deleteApp(appCtx, toks[2], broker.SessionDeleteReasonAdmin, identity.User)
+		writeResponse(w, statusCode, msg)
+
+	case len(toks) == 4 && toks[0] == "reservations" && toks[3] == "release" && r.Method == "POST":
+		appCtx, ok := s.appContexts.Get(toks[1])
+		if !ok {
+			writeResponse(w, http.StatusNotFound, "app not found")
+			return
+		}
+		statusCode, msg := releaseReservation(appCtx, toks[2], identity.User)
+		writeResponse(w, statusCode, msg)
+
+	case len(toks) == 3 && toks[0] == "apps" && toks[2] == "drain" && (r.Method == "POST" || r.Method == "DELETE"):
+		if _, ok := registeredApps.Apps[toks[1]]; !ok {
+			writeResponse(w, http.StatusNotFound, "app not found")
+			return
+		}
+		statusCode, msg := broker.SetAppDrained(s.drainer, s.auditLog, toks[1], identity.User, r.Method == "POST")
+		writeResponse(w, statusCode, msg)
+
+	default:
+		writeResponse(w, http.StatusNotFound, "not found")
+	}
+}
+
+/*
+Releases a stuck reservation on behalf of the admin, for example one left pending by a failed assignment or whose pod no longer exists.
+Reservations in the table are deleted like a user DELETE, a missing pod is not an error.
+Reservations that are only in the store or the wait queue are removed from them.
+*/
+func releaseReservation(appCtx *AppContext, user, admin string) (int, string) {
+	appCtx.RLock()
+	_, reserved := appCtx.ReservedPods[user]
+	appCtx.RUnlock()
+
+	log.Printf("admin %s releasing %s reservation for user %s", admin, appCtx.Name, user)
+	if reserved {
+		return deleteApp(appCtx, user, broker.SessionDeleteReasonAdmin, admin)
+	}
+
+	appCtx.WaitQueue.Remove(user)
+	if err := appCtx.Store.Delete(appCtx.Name, user); err != nil {
+		log.Printf("failed to remove reservation for user %s from store: %v", user, err)
+		return http.StatusInternalServerError, "internal server error"
+	}
+	return http.StatusOK, "released"
+}
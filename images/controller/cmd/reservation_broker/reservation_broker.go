@@ -17,32 +17,46 @@
 package main
 
 import (
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	broker "selkies.io/controller/pkg"
 )
 
 // Cookie max-age in seconds, 5 days.
 const maxCookieAgeSeconds = 432000
 
+// Period which the pod informer re-lists the app pods.
+const podResyncPeriod = 60 * time.Second
+
+// Period which to check for sessions that exceeded the app idleTimeout or maxSessionDuration.
+const sessionReapPeriod = 30 * time.Second
+
+// Period which the session pod informer re-lists the session pods of all brokers.
+const sessionCacheResyncPeriod = 10 * time.Minute
+
+// Serializes session quota admission across all apps.
+// Held from the quota check until the new reservation is recorded as pending, so that concurrent reservations see each other.
+var quotaAdmission sync.Mutex
+
 // Wraps server muxer, dynamic map of handlers, and listen port.
 type Server struct {
+	sync.RWMutex
 	Dispatcher *mux.Router
 	Urls       map[string]func(w http.ResponseWriter, r *http.Request)
 	Port       string
@@ -55,46 +69,99 @@ type BrokerPod struct {
 	UserObjects  []string          `json:"user_objects"`
 	SessionStart string            `json:"session_start"`
 	UserParams   map[string]string `json:"user_params"`
+	Pending      bool              `json:"pending,omitempty"`
 }
 
 type AppContext struct {
 	sync.RWMutex
 	Name              string
-	AuthHeaderName    string
-	UsernameHeader    string
-	CookieSecret      string
+	Authenticator     broker.Authenticator
+	Authorizer        *broker.Authorizer
+	SessionTokens     *broker.SessionTokenSigner
 	PodData           broker.UserPodData
 	AvailablePods     []BrokerPod
 	ReservedPods      map[string]BrokerPod
 	PodWatcherRunning bool
+	ReservationsReady bool
+	Client            broker.ClusterClient
+	AuditLog          *broker.AuditLogger
+	Notifier          *broker.WebhookNotifier
+	Drainer           *broker.AppDrainer
+	Store             broker.ReservationStore
+	Quota             broker.BrokerQuotaSpec
+	PendingSessions   *broker.PendingSessions
+	SessionCache      *broker.ActiveSessionCache
+	SessionReaper     *broker.SessionReaper
+	Registry          *broker.AppRegistry
+	WaitQueue         *broker.WaitQueue
+	PoolSizer         broker.PoolSizer
+	PoolSizerName     string
+	// Last warm pool size recommendation, nil unless pool autoscaling is enabled.
+	PoolRecommendation *broker.PoolRecommendation
+	waitQueueDispatch  sync.Mutex
+	// Pods that were seen available, used to observe the pool refill time once per pod.
+	availablePodsSeen map[string]bool
+	podWatcherStop    chan struct{}
+	podInformer       *broker.PodInformer
+	ApplyEngine       *broker.ApplyEngine
+}
+
+// App contexts by app name, shared by the sync loop and the request handlers.
+type appContextMap struct {
+	sync.RWMutex
+	apps map[string]*AppContext
+}
+
+func newAppContextMap() *appContextMap {
+	return &appContextMap{
+		apps: make(map[string]*AppContext, 0),
+	}
+}
+
+func (m *appContextMap) Get(name string) (*AppContext, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	appCtx, ok := m.apps[name]
+	return appCtx, ok
 }
 
-type GetPodsSpec struct {
-	Items []struct {
-		Metadata struct {
-			Name              string            `json:"name"`
-			Namespace         string            `json:"namespace"`
-			CreationTimestamp string            `json:"creationTimestamp"`
-			DeletionTimestamp *string           `json:"deletionTimestamp"`
-			Annotations       map[string]string `json:"annotations"`
-			Labels            map[string]string `json:"labels"`
-		} `json:"metadata"`
-		Status struct {
-			PodIPs []struct {
-				IP string `json:"ip"`
-			} `json:"podIPs"`
-		} `json:"status"`
-	} `json:"items"`
+func (m *appContextMap) Set(name string, appCtx *AppContext) {
+	m.Lock()
+	defer m.Unlock()
+	m.apps[name] = appCtx
+}
+
+func (m *appContextMap) Delete(name string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.apps, name)
+}
+
+// Returns the app contexts sorted by app name.
+func (m *appContextMap) List() []*AppContext {
+	m.RLock()
+	defer m.RUnlock()
+	resp := make([]*AppContext, 0, len(m.apps))
+	for _, appCtx := range m.apps {
+		resp = append(resp, appCtx)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].Name < resp[j].Name
+	})
+	return resp
 }
 
 func main() {
-	cookieSecret := os.Getenv("COOKIE_SECRET")
-	if len(cookieSecret) == 0 {
-		// Generate random secret
-		log.Printf("no COOKIE_SECRET env var found, generating random secret value")
-		h := sha1.New()
-		io.WriteString(h, fmt.Sprintf("%d.%d", rand.Intn(10000), int32(time.Now().Unix())))
-		cookieSecret = fmt.Sprintf("%x", h.Sum(nil))
+	brokerNamespace := os.Getenv("NAMESPACE")
+	if len(brokerNamespace) == 0 {
+		log.Printf("no NAMESPACE env var found, using default of '%s'", broker.DefaultBrokerNamespace)
+		brokerNamespace = broker.DefaultBrokerNamespace
+	}
+
+	// Signed session tokens from the COOKIE_SECRET and COOKIE_SECRET_PREVIOUS env vars.
+	sessionTokens, err := broker.NewSessionTokenSignerFromEnv(maxCookieAgeSeconds * time.Second)
+	if err != nil {
+		log.Fatalf("failed to create session token signer: %v", err)
 	}
 
 	clientID := os.Getenv("OAUTH_CLIENT_ID")
@@ -124,13 +191,65 @@ func main() {
 		log.Fatal("Missing POD_BROKER_PARAM_Domain env.")
 	}
 
-	// AuthHeader from params
-	authHeaderName, ok := sysParams["AuthHeader"]
-	if !ok {
-		log.Fatal("Missing POD_BROKER_PARAM_AuthHeader env.")
+	// Authenticator from params
+	authenticator, err := broker.NewAuthenticatorFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authenticator: %v", err)
 	}
 
-	usernameHeader, _ := sysParams["UsernameHeader"]
+	// Session quotas from params.
+	brokerQuota, err := broker.NewBrokerQuotaSpecFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("failed to parse quota params: %v", err)
+	}
+
+	clusterClient, err := broker.NewKubeClusterClient()
+	if err != nil {
+		log.Fatalf("failed to create cluster client: %v", err)
+	}
+	applyEngine := broker.NewApplyEngine(clusterClient, broker.BrokerFieldManager, brokerNamespace)
+
+	// Serve prometheus metrics
+	broker.StartMetricsServer("9082")
+
+	// Audit log of session lifecycle events.
+	auditLog, err := broker.NewAuditLoggerFromParams(sysParams, "reservation-broker")
+	if err != nil {
+		log.Fatalf("failed to create audit logger: %v", err)
+	}
+
+	// Outbound webhook notifications.
+	notifier, err := broker.NewWebhookNotifierFromParams(clusterClient, sysParams, brokerNamespace, "reservation-broker")
+	if err != nil {
+		log.Fatalf("failed to create webhook notifier: %v", err)
+	}
+
+	// Group and role based authorization of app access.
+	authorizer, err := broker.NewAuthorizerFromParams(clusterClient, sysParams)
+	if err != nil {
+		log.Fatalf("failed to create authorizer: %v", err)
+	}
+
+	// Admin API authorization from params, the admin API is disabled if not set.
+	adminPolicy, err := broker.NewAdminPolicyFromParams(sysParams)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Apps drained by an admin, shared with the pod-broker.
+	appDrainer := broker.NewAppDrainer(clusterClient, brokerNamespace)
+
+	// Store used to persist reservations across restarts, from params.
+	var reservationStore broker.ReservationStore
+	switch sysParams["ReservationStore"] {
+	case "memory":
+		log.Printf("using in-memory reservation store, reservations will not survive a restart")
+		reservationStore = broker.NewMemoryReservationStore()
+	case "", "configmap":
+		reservationStore = broker.NewConfigMapReservationStore(clusterClient)
+	default:
+		log.Fatalf("invalid POD_BROKER_PARAM_ReservationStore: %s, must be one of: configmap, memory", sysParams["ReservationStore"])
+	}
 
 	// Period which to scan for apps
 	scanPeriod := 5 * time.Second
@@ -141,6 +260,9 @@ func main() {
 	// Map of cached app manifest checksums
 	manifestChecksums := make(map[string]string, 0)
 
+	// Map of the last applied warm pool size of apps with pool autoscaling.
+	poolReplicas := make(map[string]int, 0)
+
 	// Muxed server to handle per-app routes.
 	server := &Server{
 		Port:       "8082",
@@ -149,24 +271,53 @@ func main() {
 	}
 
 	// Map of app contexts.
-	appContexts := make(map[string]*AppContext, 0)
+	appContexts := newAppContextMap()
+
+	// Tracks session activity for all apps.
+	sessionReaper := broker.NewSessionReaper()
+
+	// Reservations of all apps that were admitted by the quota check and are being assigned.
+	pendingSessions := broker.NewPendingSessions()
+
+	// Session pods of all brokers, counted by the quota check.
+	sessionCache := broker.NewActiveSessionCache(clusterClient, sessionCacheResyncPeriod)
+	if err := sessionCache.Run(make(chan struct{})); err != nil {
+		log.Fatalf("failed to start session pod informer: %v", err)
+	}
+
+	// Apps discovered by app_finder, the sync loop runs early when a new generation is published.
+	appRegistry := broker.NewAppRegistry(broker.RegisteredAppsManifestJSONFile)
+	appsChanged := appRegistry.Subscribe()
+
+	// Writes the ManifestsApplied condition to the BrokerAppConfig status.
+	statusWriter := broker.NewAppConfigStatusWriter(clusterClient, brokerNamespace)
+	setManifestsApplied := func(appName string, ok bool, reason, message string) {
+		if err := statusWriter.Update(appName, broker.AppConfigStatusUpdate{
+			AppliedChecksum: manifestChecksums[appName],
+			Conditions:      []broker.AppConfigCondition{broker.NewAppConfigCondition(broker.AppConditionManifestsApplied, ok, reason, message)},
+		}); err != nil {
+			log.Printf("%v", err)
+		}
+	}
 
 	// Sync loop for app resources
 	go func() {
 		lastSync := time.Now()
+		lastReap := time.Now()
 		for {
-			// Discover apps from their config specs located on the filesystem.
-			// TODO: look into caching this, large number of apps and http requests can slow down the broker.
-			registeredApps, err := broker.NewRegisteredAppManifestFromJSON(broker.RegisteredAppsManifestJSONFile, broker.AppTypeDeployment)
+			// Discover apps from the registry snapshot.
+			snapshot, err := appRegistry.Snapshot()
 			if err != nil {
 				log.Printf("failed to parse registered app manifest: %v", err)
 				time.Sleep(2 * time.Second)
 				continue
 			}
+			registeredApps := snapshot.OfType(broker.AppTypeDeployment)
 
 			for _, app := range registeredApps.Apps {
 				if len(app.Deployment.Selector) == 0 {
 					log.Printf("error app is missing deployment.selector: %s, skipping", app.Name)
+					setManifestsApplied(app.Name, false, "MissingSelector", "Missing deployment.selector")
 					continue
 				}
 
@@ -188,6 +339,7 @@ func main() {
 				}
 				if !found {
 					log.Printf("Default tier '%s' not found in list of app node tiers", app.DefaultTier)
+					setManifestsApplied(app.Name, false, "DefaultTierNotFound", fmt.Sprintf("Default tier '%s' not found in list of app node tiers", app.DefaultTier))
 					continue
 				}
 
@@ -232,34 +384,80 @@ func main() {
 				srcDirApp := path.Join(broker.BundleSourceBaseDir, app.Name)
 				if err := broker.BuildDeploy(broker.BrokerCommonBuildSourceBaseDirDeploymentApp, srcDirApp, destDir, data); err != nil {
 					log.Printf("%v", err)
+					setManifestsApplied(app.Name, false, "BuildFailed", err.Error())
 					continue
 				}
 
 				var appCtx *AppContext
-				if c, ok := appContexts[app.Name]; ok {
+				if c, ok := appContexts.Get(app.Name); ok {
 					appCtx = c
+					// Refresh the template data so that spec changes, like maintenance, apply to new reservations.
+					appCtx.Lock()
+					appCtx.PodData = *data
+					appCtx.Unlock()
 				} else {
 					appCtx = &AppContext{
 						Name:              app.Name,
-						AuthHeaderName:    authHeaderName,
-						UsernameHeader:    usernameHeader,
-						CookieSecret:      cookieSecret,
+						Authenticator:     authenticator,
+						Authorizer:        authorizer,
+						SessionTokens:     sessionTokens,
 						PodData:           *data,
 						AvailablePods:     make([]BrokerPod, 0),
 						ReservedPods:      make(map[string]BrokerPod),
 						PodWatcherRunning: false,
+						Client:            clusterClient,
+						AuditLog:          auditLog,
+						Notifier:          notifier,
+						Drainer:           appDrainer,
+						Store:             reservationStore,
+						Quota:             brokerQuota,
+						PendingSessions:   pendingSessions,
+						SessionCache:      sessionCache,
+						SessionReaper:     sessionReaper,
+						Registry:          appRegistry,
+						WaitQueue:         broker.NewWaitQueue(),
+						PoolSizer:         &broker.HeadroomPoolSizer{},
+						PoolSizerName:     broker.PoolSizerHeadroom,
+						ApplyEngine:       applyEngine,
+						availablePodsSeen: make(map[string]bool),
 					}
-					appContexts[app.Name] = appCtx
+					appContexts.Set(app.Name, appCtx)
+				}
+
+				// Update the wait queue settings from the app spec.
+				if err := appCtx.WaitQueue.Configure(app.WaitQueue); err != nil {
+					log.Printf("invalid wait queue settings for app %s: %v", app.Name, err)
 				}
 
 				// Register the app handler
-				registerAppHandler(server, app, appCtx)
+				registerAppHandler(server, app, registeredApps.Policies[app.Name], appCtx)
 
 				// Start the pod watcher
 				if !appCtx.PodWatcherRunning {
 					watchPods(app, appCtx)
 				}
 
+				// Compute the warm pool size, the manifests are re-applied when it changes.
+				prevReplicas, applied := poolReplicas[app.Name]
+				replicas := -1
+				if app.Deployment.Autoscaling.Enabled {
+					rec, err := computePoolSize(app, appCtx, prevReplicas, applied)
+					if err != nil {
+						log.Printf("failed to compute pool size for app %s, using the bundle replicas: %v", app.Name, err)
+					} else {
+						replicas = rec.Replicas
+						recordPoolRecommendation(rec)
+						if !applied || prevReplicas != replicas {
+							log.Printf("scaling %s warm pool to %d replicas, min: %d, max: %d, window: '%s', sizer: %s: %s", app.Name, replicas, rec.MinReplicas, rec.MaxReplicas, rec.Window, rec.Sizer, rec.Reason)
+						}
+					}
+				} else {
+					appCtx.Lock()
+					appCtx.PoolRecommendation = nil
+					appCtx.Unlock()
+				}
+				poolChanged := replicas >= 0 && (!applied || prevReplicas != replicas)
+
 				// Compute and cache checksum to know if we need to re-apply the manifests.
 				prevChecksum := manifestChecksums[app.Name]
 				if manifestChecksums[app.Name], err = broker.ChecksumDeploy(destDir); err != nil {
@@ -268,7 +466,7 @@ func main() {
 				}
 				if prevChecksum != manifestChecksums[app.Name] {
 					log.Printf("%s manifest checksum: %s", app.Name, manifestChecksums[app.Name])
-				} else {
+				} else if !poolChanged {
 					now := time.Now()
 					if now.Sub(lastSync) >= resyncPeriod {
 						lastSync = now
@@ -279,13 +477,38 @@ func main() {
 
 				// Apply manifests them to the cluster.
 				log.Printf("deploying manifests for app: %s", destDir)
-				cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kustomize build %s | kubectl apply -f -", destDir))
-				cmd.Dir = destDir
-				stdoutStderr, err := cmd.CombinedOutput()
+				objs, err := broker.RenderKustomization(destDir)
 				if err != nil {
-					log.Printf("error calling kubectl for %s: %v\n%s", app.Name, err, stdoutStderr)
+					broker.RecordApplyError("apply-app")
+					log.Printf("error rendering manifests for %s: %v", app.Name, err)
+					setManifestsApplied(app.Name, false, "RenderFailed", err.Error())
+					continue
+				}
+				if replicas >= 0 && setDeploymentReplicas(objs, app.Deployment.Selector, replicas) == 0 {
+					log.Printf("WARN: no Deployment matching selector '%s' found in manifests for %s, pool size not applied", app.Deployment.Selector, app.Name)
+				}
+				if _, err := applyEngine.ApplyObjects(objs); err != nil {
+					broker.RecordApplyError("apply-app")
+					broker.LogApplyError(fmt.Sprintf("error applying manifests for %s", app.Name), err)
+					setManifestsApplied(app.Name, false, "ApplyFailed", err.Error())
 					continue
 				}
+				setManifestsApplied(app.Name, true, "Applied", "")
+				if replicas >= 0 {
+					poolReplicas[app.Name] = replicas
+				} else {
+					delete(poolReplicas, app.Name)
+				}
+			}
+
+			// Shut down sessions that exceeded the app idleTimeout or maxSessionDuration.
+			if now := time.Now(); now.Sub(lastReap) >= sessionReapPeriod {
+				lastReap = now
+				for _, app := range registeredApps.Apps {
+					if appCtx, ok := appContexts.Get(app.Name); ok {
+						reapSessions(app, appCtx)
+					}
+				}
 			}
 
 			// Prune deleted BrokerAppConfigs, delete namespace and files.
@@ -306,20 +529,29 @@ func main() {
 					appName := path.Base(dirName)
 					log.Printf("removing app: %s", appName)
 
-					// Stop the pod watcher
-					appContexts[appName].PodWatcherRunning = false
-
-					// Remove app context
-					delete(appContexts, appName)
+					// Stop the pod watcher and remove the app context
+					if appCtx, ok := appContexts.Get(appName); ok {
+						appCtx.StopPodWatcher()
+						appContexts.Delete(appName)
+					}
 
 					// Remove app from checksum cache
 					delete(manifestChecksums, appName)
+					delete(poolReplicas, appName)
+					statusWriter.Remove(appName)
+
+					// Remove app metrics
+					broker.ReservationPods.DeleteLabelValues(appName, "available")
+					broker.ReservationPods.DeleteLabelValues(appName, "reserved")
+					broker.WaitQueueLength.DeleteLabelValues(appName)
+					broker.ReservationPoolTargetReplicas.DeleteLabelValues(appName)
+					broker.ReservationPoolReservationRate.DeleteLabelValues(appName)
+					broker.ReservationPoolRefillSeconds.DeleteLabelValues(appName)
+					broker.ReservationPoolEmptyProbability.DeleteLabelValues(appName)
 
 					// Delete the app namespace
-					cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kubectl delete --wait=false ns %s", appName))
-					stdoutStderr, err := cmd.CombinedOutput()
-					if err != nil {
-						log.Printf("error calling kubectl to delete namespace %s: %v\n%s", appName, err, stdoutStderr)
+					if err := clusterClient.DeleteNamespace(appName); err != nil {
+						log.Printf("error deleting namespace %s: %v", appName, err)
 					}
 
 					// Delete the app directory
@@ -327,10 +559,26 @@ func main() {
 				}
 			}
 
-			time.Sleep(scanPeriod)
+			select {
+			case <-appsChanged:
+			case <-time.After(scanPeriod):
+			}
 		}
 	}()
 
+	// Admin API routes are registered first so they take precedence over the per-app routes.
+	server.Dispatcher.PathPrefix("/admin/").Handler(&adminServer{
+		clusterClient: clusterClient,
+		authenticator: authenticator,
+		authorizer:    authorizer,
+		sessionTokens: sessionTokens,
+		policy:        adminPolicy,
+		drainer:       appDrainer,
+		auditLog:      auditLog,
+		appContexts:   appContexts,
+		appRegistry:   appRegistry,
+	})
+
 	server.InitDispatch()
 	log.Printf("Initializing request routes...\n")
 
@@ -341,44 +589,41 @@ func main() {
 
 		if r.Method == "GET" {
 			// Check reserved pods to match requestor IP.
-			for _, appCtx := range appContexts {
-				for user, pod := range appCtx.ReservedPods {
-					if srcIP == pod.IP || fwdIP == pod.IP {
-						metadata := broker.ReservationMetadataSpec{
-							IP:           pod.IP,
-							SessionKey:   pod.SessionKey,
-							User:         user,
-							SessionStart: pod.SessionStart,
-							UserParams:   pod.UserParams,
-						}
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(http.StatusOK)
-						enc := json.NewEncoder(w)
-						enc.SetIndent("", "  ")
-						enc.Encode(metadata)
-						return
-					}
+			for _, appCtx := range appContexts.List() {
+				user, pod, found := appCtx.findReservedPodByIP(srcIP, fwdIP)
+				if !found {
+					continue
+				}
+				appCtx.SessionReaper.Heartbeat(appCtx.Name, user)
+				metadata := broker.ReservationMetadataSpec{
+					IP:           pod.IP,
+					SessionKey:   pod.SessionKey,
+					User:         user,
+					SessionStart: pod.SessionStart,
+					UserParams:   pod.UserParams,
 				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				enc.Encode(metadata)
+				return
 			}
 			writeResponse(w, http.StatusNotFound, fmt.Sprintf("reservation metadata not found for IP: %s", srcIP))
 		} else if r.Method == "DELETE" {
 			srcIP := strings.Split(r.RemoteAddr, ":")[0]
 			fwdIP := r.Header.Get("X-Forwarded-For")
 			// Check reserved pods to match requestor IP.
-			for _, appCtx := range appContexts {
-				for _, pod := range appCtx.AvailablePods {
-					if srcIP == pod.IP || fwdIP == pod.IP {
-						statusCode, msg := deletePod(appCtx.Name, pod)
-						writeResponse(w, statusCode, msg)
-						return
-					}
+			for _, appCtx := range appContexts.List() {
+				if pod, found := appCtx.findAvailablePodByIP(srcIP, fwdIP); found {
+					statusCode, msg := deletePod(appCtx, pod)
+					writeResponse(w, statusCode, msg)
+					return
 				}
-				for user, pod := range appCtx.ReservedPods {
-					if srcIP == pod.IP || fwdIP == pod.IP {
-						statusCode, msg := deleteApp(appCtx, user)
-						writeResponse(w, statusCode, msg)
-						return
-					}
+				if user, _, found := appCtx.findReservedPodByIP(srcIP, fwdIP); found {
+					statusCode, msg := deleteApp(appCtx, user, broker.SessionDeleteReasonSelf, "")
+					writeResponse(w, statusCode, msg)
+					return
 				}
 			}
 			writeResponse(w, http.StatusNotFound, fmt.Sprintf("managed pod not found with IP: %s", srcIP))
@@ -387,18 +632,18 @@ func main() {
 			return
 		}
 	}
-	server.Urls["session"] = sessionFunc
+	server.SetURL("session", sessionFunc)
 
 	// DEPRECATED routes.
-	server.Urls["metadata"] = sessionFunc
-	server.Urls["shutdown"] = sessionFunc
+	server.SetURL("metadata", sessionFunc)
+	server.SetURL("shutdown", sessionFunc)
 
-	server.Start()
+	server.Start(appRegistry.AppLabelFromPath)
 }
 
-func (s *Server) Start() {
+func (s *Server) Start(appLabel func(r *http.Request) string) {
 	log.Printf("Starting server on port: %s \n", s.Port)
-	http.ListenAndServe(":"+s.Port, s.Dispatcher)
+	http.ListenAndServe(":"+s.Port, broker.InstrumentHandler(s.Dispatcher, appLabel))
 }
 
 func (s *Server) InitDispatch() {
@@ -423,11 +668,21 @@ func (s *Server) InitDispatch() {
 }
 
 func (s *Server) ProxyCall(w http.ResponseWriter, r *http.Request, fName string) {
-	if s.Urls[fName] != nil {
-		s.Urls[fName](w, r)
+	s.RLock()
+	handler := s.Urls[fName]
+	s.RUnlock()
+	if handler != nil {
+		handler(w, r)
 	}
 }
 
+// Sets the handler for the route, handlers are replaced by the sync loop while requests are served.
+func (s *Server) SetURL(fName string, handler func(w http.ResponseWriter, r *http.Request)) {
+	s.Lock()
+	defer s.Unlock()
+	s.Urls[fName] = handler
+}
+
 func writeResponse(w http.ResponseWriter, statusCode int, message string) {
 	status := broker.StatusResponse{
 		Code:   statusCode,
@@ -441,16 +696,33 @@ func writeResponse(w http.ResponseWriter, statusCode int, message string) {
 	enc.Encode(status)
 }
 
+/*
+Writes the reservation status, including the maintenance banner so that running sessions are warned.
+*/
+func writeAppStatusResponse(w http.ResponseWriter, app broker.AppConfigSpec, statusCode int, message string) {
+	status := broker.StatusResponse{
+		Code:        statusCode,
+		Status:      message,
+		Maintenance: app.MaintenanceStatus(time.Now()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
 /*
 Registers handler for app.
 Handler dispatches requests for HTTP verbs, POST, DELETE, GET.
 */
-func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext) {
+func registerAppHandler(s *Server, app broker.AppConfigSpec, policies broker.AppAuthzPolicies, appCtx *AppContext) {
 	// Register app route handler function
 	appName := app.Name
 	cookieName := fmt.Sprintf("broker_%s", appName)
 
-	s.Urls[fmt.Sprintf("%s/config", app.Name)] = func(w http.ResponseWriter, r *http.Request) {
+	s.SetURL(fmt.Sprintf("%s/config", app.Name), func(w http.ResponseWriter, r *http.Request) {
 
 		defaultAppParams := make(map[string]string, 0)
 		for _, param := range app.UserParams {
@@ -472,11 +744,12 @@ func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext)
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
 		enc.Encode(config)
-	}
+	})
 
-	s.Urls[app.Name] = func(w http.ResponseWriter, r *http.Request) {
+	s.SetURL(app.Name, func(w http.ResponseWriter, r *http.Request) {
 		// Get user from cookie or header, or check to see if request is coming from a managed pod.
-		user := broker.GetUserFromCookieOrAuthHeader(r, cookieName, appCtx.AuthHeaderName)
+		identity, _ := broker.AuthenticateRequest(r, cookieName, appName, appCtx.SessionTokens, appCtx.Authenticator)
+		user := identity.User
 		var pod BrokerPod
 		foundAvailablePod := false
 		foundReservedPod := false
@@ -486,23 +759,17 @@ func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext)
 			srcIP := strings.Split(r.RemoteAddr, ":")[0]
 			fwdIP := r.Header.Get("X-Forwarded-For")
 			// Check available pods to match requestor IP.
-			for _, p := range appCtx.AvailablePods {
-				if srcIP == p.IP || fwdIP == p.IP {
-					pod = p
-					podUser = "none"
-					foundAvailablePod = true
-					break
-				}
+			if p, found := appCtx.findAvailablePodByIP(srcIP, fwdIP); found {
+				pod = p
+				podUser = "none"
+				foundAvailablePod = true
 			}
 			// Check reserved pods to match requestor IP.
 			if !foundAvailablePod {
-				for u, p := range appCtx.ReservedPods {
-					if srcIP == p.IP || fwdIP == p.IP {
-						pod = p
-						podUser = u
-						foundReservedPod = true
-						break
-					}
+				if u, p, found := appCtx.findReservedPodByIP(srcIP, fwdIP); found {
+					pod = p
+					podUser = u
+					foundReservedPod = true
 				}
 			}
 
@@ -519,7 +786,7 @@ func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext)
 			case "POST":
 				writeResponse(w, http.StatusBadRequest, fmt.Sprintf("unsupported request method from source pod without reservation: %s", r.Method))
 			case "DELETE":
-				status, msg := deletePod(app.Name, pod)
+				status, msg := deletePod(appCtx, pod)
 				writeResponse(w, status, msg)
 			case "GET":
 				msg := "pod has not been reserved"
@@ -531,20 +798,21 @@ func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext)
 			case "POST":
 				writeResponse(w, http.StatusBadRequest, fmt.Sprintf("unsupported request method from source pod with reservation: %s", r.Method))
 			case "DELETE":
-				status, msg := deleteApp(appCtx, user)
+				status, msg := deleteApp(appCtx, podUser, broker.SessionDeleteReasonSelf, "")
 				writeResponse(w, status, msg)
 			case "GET":
-				status, msg := getAppStatus(w, app, appCtx, user, podUser)
-				writeResponse(w, status, msg)
+				status, msg := getAppStatus(w, r, app, appCtx, broker.AuthIdentity{User: podUser, Username: podUser})
+				writeAppStatusResponse(w, app, status, msg)
 			}
 		} else {
 			// Handle request from user
+			username := identity.Username
 
-			// IAP uses a prefix of accounts.google.com:email, remove this to just get the email
-			userToks := strings.Split(user, ":")
-			user = userToks[len(userToks)-1]
-
-			username := broker.GetUsernameFromHeaderOrDefault(r, appCtx.UsernameHeader, user)
+			// Check per-app user authorization if present, using the policies compiled with the registered app.
+			if policies.AuthorizedUsers != nil && !policies.AuthorizedUsers.Matches(appCtx.Authorizer.Resolve(identity)) {
+				writeResponse(w, http.StatusUnauthorized, "user is not authorized")
+				return
+			}
 
 			// Extract any user param values from the request.
 			userParams := getUserParams(r, appCtx)
@@ -552,205 +820,471 @@ func registerAppHandler(s *Server, app broker.AppConfigSpec, appCtx *AppContext)
 			// Handle each verb
 			switch r.Method {
 			case "POST":
-				status, msg := createApp(app, appCtx, user, username, userParams)
+				status, msg, err := createApp(app, appCtx, user, username, userParams)
+				if quotaErr, ok := err.(*broker.QuotaExceededError); ok {
+					writeQuotaExceededResponse(w, quotaErr)
+					return
+				}
+				if pos := appCtx.WaitQueue.Poll(user); status == http.StatusAccepted && pos > 0 {
+					writeWaitQueueResponse(w, appCtx, pos)
+					return
+				}
 				writeResponse(w, status, msg)
 			case "DELETE":
-				status, msg := deleteApp(appCtx, user)
+				status, msg := deleteApp(appCtx, user, broker.SessionDeleteReasonUser, "")
 				writeResponse(w, status, msg)
 			case "GET":
-				status, msg := getAppStatus(w, app, appCtx, user, username)
-				writeResponse(w, status, msg)
+				// Users waiting in the queue get their position, polling keeps them in the queue.
+				if pos := appCtx.WaitQueue.Poll(user); pos > 0 {
+					writeWaitQueueResponse(w, appCtx, pos)
+					return
+				}
+				status, msg := getAppStatus(w, r, app, appCtx, identity)
+				writeAppStatusResponse(w, app, status, msg)
 			}
 		}
-	}
+	})
 }
 
 /*
-Watches a deployment for pods
-TODO: convert this to use the K8S watch API.
+Watches the app namespace for pods and maintains the pool of available and reserved pods.
 */
 func watchPods(app broker.AppConfigSpec, appCtx *AppContext) {
 	appCtx.PodWatcherRunning = true
+	appCtx.podWatcherStop = make(chan struct{})
 
-	// Get current pod reservations, those not managed by Deployment, reserved for users.
-	selector := fmt.Sprintf("%s, app.kubernetes.io/managed-by notin (pod-broker)", app.Deployment.Selector)
-	podResp, err := listBrokerPods(app.Name, selector)
-	if err != nil {
-		log.Printf("failed to list initial reserved pods: %v", err)
-	} else {
-		appCtx.Lock()
-		for _, pod := range podResp.Items {
-			if pod.Metadata.DeletionTimestamp != nil {
-				// Skip terminating pods
-				continue
-			}
-			podName := pod.Metadata.Name
-			podIP := pod.Status.PodIPs[0].IP
-			if podUser, ok := pod.Metadata.Annotations["app.broker/user"]; ok {
-				sessionKey, ok := pod.Metadata.Annotations["app.broker/session-key"]
-				if !ok {
-					log.Printf("Warning: missing app.broker/session-key on existing reservation: %s", podName)
-				}
-				userObjects, ok := pod.Metadata.Annotations["app.broker/last-applied-object-types"]
-				if !ok {
-					log.Printf("Warning: missing app.broker/last-applied-object-types on existing reservation: %s", podName)
-				}
-				userParams, ok := pod.Metadata.Annotations["app.broker/user-params"]
-				if !ok {
-					log.Printf("Warning: missing app.broker/user-params on existing reservation: %s", podName)
-				}
-				var userParamsDecoded map[string]string
-				if err := json.Unmarshal([]byte(userParams), &userParamsDecoded); err != nil {
-					log.Printf("Warning: failed to decode JSON user params from app.broker/user-params annotation on pod: %s", podName)
-				}
-
-				log.Printf("Found existing reservation: %s: %s", podName, podUser)
-				appCtx.ReservedPods[podUser] = BrokerPod{
-					Name:        podName,
-					IP:          podIP,
-					SessionKey:  sessionKey,
-					UserObjects: strings.Split(userObjects, ","),
-					UserParams:  userParamsDecoded,
-				}
-			}
-		}
-		appCtx.Unlock()
-	}
+	// Watch all pods for the app, both those managed by the Deployment and those reserved for users.
+	appCtx.podInformer = broker.NewPodInformer(appCtx.Client, app.Name, app.Deployment.Selector, podResyncPeriod, func() {
+		syncPods(appCtx)
+	})
 
 	go func() {
 		log.Printf("started pod watcher for %s", app.Name)
+		if err := appCtx.podInformer.Run(appCtx.podWatcherStop); err != nil {
+			log.Printf("failed to start pod watcher for %s: %v", app.Name, err)
+			return
+		}
+
+		// Reservations are not handed out until they have been restored from the store.
 		for {
-			if !appCtx.PodWatcherRunning {
-				log.Printf("stopping pod watcher for: %s", app.Name)
+			err := loadReservations(appCtx)
+			if err == nil {
 				break
 			}
+			log.Printf("failed to load reservations for %s, retrying: %v", app.Name, err)
+			select {
+			case <-appCtx.podWatcherStop:
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+		syncPods(appCtx)
+	}()
+}
 
-			appCtx.Lock()
+// Stops the pod watcher for the app.
+func (appCtx *AppContext) StopPodWatcher() {
+	if appCtx.PodWatcherRunning {
+		close(appCtx.podWatcherStop)
+		appCtx.PodWatcherRunning = false
+	}
+}
 
-			// Find available pods, those currently managed by Deployment.
-			selector := fmt.Sprintf("%s,app.kubernetes.io/managed-by=pod-broker", app.Deployment.Selector)
-			podResp, err := listBrokerPods(app.Name, selector)
-			if err != nil {
-				log.Printf("failed to list pods for app: %s: %v", app.Name, err)
-				time.Sleep(2 * time.Second)
-				appCtx.Unlock()
-				continue
-			}
+// Returns the user and reserved pod matching either IP.
+func (appCtx *AppContext) findReservedPodByIP(ips ...string) (string, BrokerPod, bool) {
+	appCtx.RLock()
+	defer appCtx.RUnlock()
+	for user, pod := range appCtx.ReservedPods {
+		if containsIP(ips, pod.IP) {
+			return user, pod, true
+		}
+	}
+	return "", BrokerPod{}, false
+}
 
-			// Sort by creation time, descending order.
-			sort.Slice(podResp.Items, func(i, j int) bool {
-				return podResp.Items[i].Metadata.CreationTimestamp < podResp.Items[j].Metadata.CreationTimestamp
-			})
+// Returns the available pod matching either IP.
+func (appCtx *AppContext) findAvailablePodByIP(ips ...string) (BrokerPod, bool) {
+	appCtx.RLock()
+	defer appCtx.RUnlock()
+	for _, pod := range appCtx.AvailablePods {
+		if containsIP(ips, pod.IP) {
+			return pod, true
+		}
+	}
+	return BrokerPod{}, false
+}
 
-			appCtx.AvailablePods = make([]BrokerPod, 0)
-			for _, pod := range podResp.Items {
-				if len(pod.Status.PodIPs) == 0 {
-					continue
-				}
-				if pod.Metadata.DeletionTimestamp != nil {
-					// Skip terminating pods
-					continue
-				}
-				appCtx.AvailablePods = append(appCtx.AvailablePods, BrokerPod{
-					Name: pod.Metadata.Name,
-					IP:   pod.Status.PodIPs[0].IP,
-				})
-			}
+func containsIP(ips []string, ip string) bool {
+	for _, v := range ips {
+		if v == ip {
+			return true
+		}
+	}
+	return false
+}
 
-			// Write current list of tracked pods for debugging.
-			appCtx.WriteCacheFiles()
+/*
+Restores the reservation table from the reservation store.
+Reservations whose pod no longer exists are removed from the store.
+Reserved pods that are only recorded in their annotations, from before the store was used, are added to the store.
+*/
+func loadReservations(appCtx *AppContext) error {
+	reservations, err := appCtx.Store.List(appCtx.Name)
+	if err != nil {
+		return err
+	}
 
-			// Get all reserved pods and verify their reservations are still valid.
-			deleteUsers := make([]string, 0)
-			selector = fmt.Sprintf("%s, app.kubernetes.io/managed-by notin (pod-broker)", app.Deployment.Selector)
-			podResp, err = listBrokerPods(app.Name, selector)
-			if err != nil {
-				log.Printf("failed to list reserved pods: %v", err)
-			} else {
-				for user, reservedPod := range appCtx.ReservedPods {
-					found := false
-					for _, pod := range podResp.Items {
-						if reservedPod.Name == pod.Metadata.Name {
-							found = true
-						}
-					}
-					if !found {
-						log.Printf("reserved pod '%s' for user '%s' disappeared, clearing reservation", reservedPod.Name, user)
-						deleteUsers = append(deleteUsers, user)
-					}
-				}
-			}
+	pods, err := appCtx.podInformer.Lister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
 
-			appCtx.Unlock()
+	// Map of pod names to pod IPs, terminating pods are skipped.
+	podIPs := make(map[string]string, len(pods))
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || len(pod.Status.PodIPs) == 0 {
+			continue
+		}
+		podIPs[pod.Name] = pod.Status.PodIPs[0].IP
+	}
+
+	appCtx.Lock()
+	defer appCtx.Unlock()
 
-			for _, user := range deleteUsers {
-				deleteApp(appCtx, user)
+	for _, r := range reservations {
+		podIP, ok := podIPs[r.PodName]
+		if !ok {
+			log.Printf("reserved pod '%s' for user '%s' no longer exists, removing reservation", r.PodName, r.User)
+			if err := appCtx.Store.Delete(appCtx.Name, r.User); err != nil {
+				return fmt.Errorf("failed to remove reservation for %s: %v", r.User, err)
 			}
+			continue
+		}
+		log.Printf("Restored reservation: %s: %s", r.PodName, r.User)
+		appCtx.ReservedPods[r.User] = BrokerPod{
+			Name:         r.PodName,
+			IP:           podIP,
+			SessionKey:   r.SessionKey,
+			UserObjects:  r.UserObjects,
+			SessionStart: r.SessionStart,
+			UserParams:   r.UserParams,
+			Pending:      r.Pending,
+		}
+	}
 
-			time.Sleep(2 * time.Second)
+	for _, pod := range pods {
+		if pod.Labels["app.kubernetes.io/managed-by"] == "pod-broker" {
+			continue
 		}
-		log.Printf("stopped pod watcher for %s", app.Name)
-	}()
+		if _, ok := podIPs[pod.Name]; !ok {
+			continue
+		}
+		podName := pod.Name
+		podUser, ok := pod.Annotations["app.broker/user"]
+		if !ok {
+			continue
+		}
+		if _, ok := appCtx.ReservedPods[podUser]; ok {
+			continue
+		}
+		sessionKey, ok := pod.Annotations["app.broker/session-key"]
+		if !ok {
+			log.Printf("Warning: missing app.broker/session-key on existing reservation: %s", podName)
+		}
+		userObjects, ok := pod.Annotations["app.broker/last-applied-object-types"]
+		if !ok {
+			log.Printf("Warning: missing app.broker/last-applied-object-types on existing reservation: %s", podName)
+		}
+		userParams, ok := pod.Annotations["app.broker/user-params"]
+		if !ok {
+			log.Printf("Warning: missing app.broker/user-params on existing reservation: %s", podName)
+		}
+		var userParamsDecoded map[string]string
+		if err := json.Unmarshal([]byte(userParams), &userParamsDecoded); err != nil {
+			log.Printf("Warning: failed to decode JSON user params from app.broker/user-params annotation on pod: %s", podName)
+		}
+
+		log.Printf("Found existing reservation: %s: %s", podName, podUser)
+		bPod := BrokerPod{
+			Name:        podName,
+			IP:          podIPs[podName],
+			SessionKey:  sessionKey,
+			UserObjects: strings.Split(userObjects, ","),
+			UserParams:  userParamsDecoded,
+		}
+		if err := appCtx.Store.Put(appCtx.Name, makeReservation(podUser, bPod)); err != nil {
+			return fmt.Errorf("failed to store existing reservation for %s: %v", podUser, err)
+		}
+		appCtx.ReservedPods[podUser] = bPod
+	}
+
+	appCtx.ReservationsReady = true
+
+	return nil
 }
 
-func updatePodForUser(app broker.AppConfigSpec, user, sessionKey, pod string, objectTypes []string, userParams map[string]string) error {
-	// Remove label from the pod that releases it from the K8S Deployment controller.
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl label pod -n %s %s app.kubernetes.io/managed-by=reservation-broker --overwrite=true 1>&2", app.Name, pod))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+// Converts the reservation table entry to the persisted form.
+func makeReservation(user string, pod BrokerPod) broker.Reservation {
+	return broker.Reservation{
+		User:         user,
+		PodName:      pod.Name,
+		PodIP:        pod.IP,
+		SessionKey:   pod.SessionKey,
+		SessionStart: pod.SessionStart,
+		UserObjects:  pod.UserObjects,
+		UserParams:   pod.UserParams,
+		Pending:      pod.Pending,
 	}
+}
 
-	// Add broker user annotation
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl annotate pod --overwrite=true -n %s %s 'app.broker/user=%s' 1>&2", app.Name, pod, user))
-	stdoutStderr, err = cmd.CombinedOutput()
+/*
+Rebuilds the list of available pods from the informer cache and clears reservations for pods that disappeared.
+Called for every pod event.
+*/
+func syncPods(appCtx *AppContext) {
+	pods, err := appCtx.podInformer.Lister.List(labels.Everything())
 	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+		log.Printf("failed to list pods for app: %s: %v", appCtx.Name, err)
+		return
 	}
 
-	// Add session key annotation
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl annotate pod --overwrite=true -n %s %s 'app.broker/session-key=%s' 1>&2", app.Name, pod, sessionKey))
-	stdoutStderr, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+	// Sort by creation time, ascending order.
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+
+	appCtx.Lock()
+
+	reservedPodNames := make(map[string]bool, len(appCtx.ReservedPods))
+	for _, reservedPod := range appCtx.ReservedPods {
+		reservedPodNames[reservedPod.Name] = true
 	}
 
-	// Add annotation with found object types
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl annotate pod --overwrite=true -n %s %s 'app.broker/last-applied-object-types=%s' 1>&2", app.Name, pod, strings.Join(objectTypes, ",")))
-	stdoutStderr, err = cmd.CombinedOutput()
+	// Find available pods, those currently managed by Deployment that are ready.
+	// Pods that were just reserved are skipped in case the cache has not seen the label change yet.
+	foundPods := make(map[string]bool, len(pods))
+	appCtx.AvailablePods = make([]BrokerPod, 0)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			// Skip terminating pods
+			continue
+		}
+		foundPods[pod.Name] = true
+
+		if pod.Labels["app.kubernetes.io/managed-by"] != "pod-broker" || reservedPodNames[pod.Name] {
+			continue
+		}
+		if len(pod.Status.PodIPs) == 0 || !broker.IsPodReady(pod) {
+			continue
+		}
+		if !appCtx.availablePodsSeen[pod.Name] {
+			appCtx.availablePodsSeen[pod.Name] = true
+			if readyTime, ok := broker.PodReadyTime(pod); ok && readyTime.After(pod.CreationTimestamp.Time) {
+				appCtx.PoolSizer.ObserveRefill(readyTime.Sub(pod.CreationTimestamp.Time))
+			}
+		}
+		appCtx.AvailablePods = append(appCtx.AvailablePods, BrokerPod{
+			Name: pod.Name,
+			IP:   pod.Status.PodIPs[0].IP,
+		})
+	}
+
+	for name := range appCtx.availablePodsSeen {
+		if !foundPods[name] {
+			delete(appCtx.availablePodsSeen, name)
+		}
+	}
+
+	// Verify reservations are still valid.
+	deleteUsers := make([]string, 0)
+	for user, reservedPod := range appCtx.ReservedPods {
+		if !foundPods[reservedPod.Name] {
+			log.Printf("reserved pod '%s' for user '%s' disappeared, clearing reservation", reservedPod.Name, user)
+			deleteUsers = append(deleteUsers, user)
+		}
+	}
+
+	// Write current list of tracked pods for debugging.
+	appCtx.WriteCacheFiles()
+
+	broker.ReservationPods.WithLabelValues(appCtx.Name, "available").Set(float64(len(appCtx.AvailablePods)))
+	broker.ReservationPods.WithLabelValues(appCtx.Name, "reserved").Set(float64(len(appCtx.ReservedPods)))
+	broker.WaitQueueLength.WithLabelValues(appCtx.Name).Set(float64(appCtx.WaitQueue.Len()))
+
+	appCtx.Unlock()
+
+	for _, user := range deleteUsers {
+		deleteApp(appCtx, user, broker.SessionDeleteReasonPodGone, "")
+	}
+
+	// Hand available pods to the users waiting in the queue.
+	go dispatchWaitQueue(appCtx)
+}
+
+/*
+Computes the warm pool size of the app from its current reservations and wait queue with the sizer selected by the app.
+The sizer is replaced when the app selects a different one, its history is then lost.
+Apps in maintenance do not grow the pool past its last applied size.
+*/
+func computePoolSize(app broker.AppConfigSpec, appCtx *AppContext, prevReplicas int, applied bool) (broker.PoolRecommendation, error) {
+	appCtx.Lock()
+	sizerName := app.Deployment.Autoscaling.Sizer
+	if len(sizerName) == 0 {
+		sizerName = broker.PoolSizerHeadroom
+	}
+	if sizerName != appCtx.PoolSizerName {
+		sizer, err := broker.NewPoolSizer(app)
+		if err != nil {
+			appCtx.Unlock()
+			return broker.PoolRecommendation{}, err
+		}
+		log.Printf("using %s pool sizer for app %s", sizerName, app.Name)
+		appCtx.PoolSizer = sizer
+		appCtx.PoolSizerName = sizerName
+	}
+	sizer := appCtx.PoolSizer
+	demand := broker.PoolDemand{
+		Reserved: len(appCtx.ReservedPods),
+		Queued:   appCtx.WaitQueue.Len(),
+	}
+	appCtx.Unlock()
+
+	now := time.Now()
+	rec, err := app.ComputePoolSize(sizer, demand, now)
 	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+		return rec, err
+	}
+	if applied && rec.Replicas > prevReplicas && app.InMaintenance(now) {
+		rec.Replicas = prevReplicas
+		rec.Reason = fmt.Sprintf("%s, held at %d while in maintenance", rec.Reason, prevReplicas)
 	}
 
-	// Add annotation for user params.
-	encodedUserParams, _ := json.Marshal(&userParams)
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl annotate pod --overwrite=true -n %s %s 'app.broker/user-params=%s' 1>&2", app.Name, pod, string(encodedUserParams)))
-	stdoutStderr, err = cmd.CombinedOutput()
+	appCtx.Lock()
+	appCtx.PoolRecommendation = &rec
+	appCtx.Unlock()
+	return rec, nil
+}
+
+/*
+Exports the pool recommendation as metrics so that operators can see why the pool was scaled.
+*/
+func recordPoolRecommendation(rec broker.PoolRecommendation) {
+	broker.ReservationPoolTargetReplicas.WithLabelValues(rec.App).Set(float64(rec.Replicas))
+	broker.ReservationPoolReservationRate.WithLabelValues(rec.App).Set(rec.ReservationsPerMinute)
+	broker.ReservationPoolRefillSeconds.WithLabelValues(rec.App).Set(rec.RefillSeconds)
+	broker.ReservationPoolEmptyProbability.WithLabelValues(rec.App).Set(rec.EmptyPoolProbability)
+}
+
+/*
+Sets the replicas of the Deployments whose pod template matches the app selector, returns the number of Deployments updated.
+*/
+func setDeploymentReplicas(objs []*unstructured.Unstructured, selector string, replicas int) int {
+	sel, err := labels.Parse(selector)
 	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+		log.Printf("invalid deployment selector '%s': %v", selector, err)
+		return 0
+	}
+	count := 0
+	for _, obj := range objs {
+		if obj.GetKind() != "Deployment" {
+			continue
+		}
+		podLabels, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels")
+		if !sel.Matches(labels.Set(podLabels)) {
+			continue
+		}
+		if err := unstructured.SetNestedField(obj.Object, int64(replicas), "spec", "replicas"); err != nil {
+			log.Printf("failed to set replicas of Deployment %s: %v", obj.GetName(), err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+/*
+Reserves available pods for the users at the head of the wait queue.
+Only one dispatch runs at a time per app.
+*/
+func dispatchWaitQueue(appCtx *AppContext) {
+	if !appCtx.waitQueueDispatch.TryLock() {
+		return
+	}
+	defer appCtx.waitQueueDispatch.Unlock()
+
+	for {
+		head, ok := appCtx.WaitQueue.Head()
+		if !ok {
+			return
+		}
+
+		appCtx.RLock()
+		available := len(appCtx.AvailablePods)
+		ready := appCtx.ReservationsReady
+		app := appCtx.PodData.AppSpec
+		appCtx.RUnlock()
+		if available == 0 || !ready || appCtx.Drainer.IsDrained(appCtx.Name) || app.InMaintenance(time.Now()) {
+			return
+		}
+
+		status, msg, _ := createApp(app, appCtx, head.User, head.Username, head.UserParams)
+		switch status {
+		case http.StatusOK:
+		case http.StatusTooManyRequests, http.StatusInternalServerError:
+			// Remove the user so that the rest of the queue is not blocked.
+			log.Printf("failed to reserve pod for queued user %s: %s", head.User, msg)
+			appCtx.WaitQueue.Remove(head.User)
+		default:
+			// The pool drained or the reservation was released before the pod was assigned, the user keeps their place.
+			log.Printf("no pod reserved for queued user %s: %s", head.User, msg)
+			return
+		}
 	}
+}
 
-	// Add label for instance ID
+func updatePodForUser(client broker.ClusterClient, app broker.AppConfigSpec, user, username, sessionKey, sessionStart, pod string, objectTypes []string, userParams map[string]string) error {
+	encodedUserParams, _ := json.Marshal(&userParams)
 	instanceID := fmt.Sprintf("%s-%s", app.Name, broker.MakePodID(user))
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl label pod -n %s %s app.kubernetes.io/instance=%s --overwrite=true 1>&2", app.Name, pod, instanceID))
-	stdoutStderr, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s\n%v", stdoutStderr, err)
+	managedBy := "reservation-broker"
+	userObjectTypes := strings.Join(objectTypes, ",")
+	userParamsValue := string(encodedUserParams)
+
+	labels := map[string]*string{
+		// Change the managed-by label to release the pod from the K8S Deployment controller.
+		"app.kubernetes.io/managed-by": &managedBy,
+		// Add label for instance ID
+		"app.kubernetes.io/instance": &instanceID,
 	}
 
-	return nil
+	annotations := map[string]*string{
+		// Add broker user annotation
+		"app.broker/user": &user,
+		// Add username annotation, used to match the session against quota groups.
+		"app.broker/username": &username,
+		// Add session key annotation
+		"app.broker/session-key": &sessionKey,
+		// Add session start annotation
+		broker.SessionStartAnnotation: &sessionStart,
+		// Add annotation with found object types
+		"app.broker/last-applied-object-types": &userObjectTypes,
+		// Add annotation for user params.
+		"app.broker/user-params": &userParamsValue,
+	}
+
+	return client.PatchPodMetadata(app.Name, pod, labels, annotations)
 }
 
 /*
 Get status of reservation.
 */
-func getAppStatus(w http.ResponseWriter, app broker.AppConfigSpec, appCtx *AppContext, user, username string) (int, string) {
+func getAppStatus(w http.ResponseWriter, r *http.Request, app broker.AppConfigSpec, appCtx *AppContext, identity broker.AuthIdentity) (int, string) {
 	statusCode := http.StatusOK
 	msg := ""
+	user := identity.User
 
 	instanceID := fmt.Sprintf("%s-%s", app.Name, broker.MakePodID(user))
 	selector := fmt.Sprintf("app.kubernetes.io/instance=%s", instanceID)
-	status, err := broker.GetPodStatus(app.Name, selector)
+	status, err := appCtx.Client.GetPodStatus(app.Name, selector)
 	if err != nil {
 		log.Printf("failed to get pod status for selector: %s: %v", selector, err)
 		statusCode = http.StatusInternalServerError
@@ -760,6 +1294,10 @@ func getAppStatus(w http.ResponseWriter, app broker.AppConfigSpec, appCtx *AppCo
 
 	msg = status.Status
 
+	if status.Status != "shutdown" {
+		appCtx.SessionReaper.Heartbeat(app.Name, user)
+	}
+
 	if status.Status == "waiting" {
 		statusCode = http.StatusCreated
 	}
@@ -767,9 +1305,10 @@ func getAppStatus(w http.ResponseWriter, app broker.AppConfigSpec, appCtx *AppCo
 	if status.Status == "ready" {
 		statusCode = http.StatusOK
 		cookieName := fmt.Sprintf("broker_%s", app.Name)
-		cookieValue := broker.MakeCookieValue(user, app.Name, appCtx.CookieSecret)
+		broker.RecordSessionReady(app.Name, user)
+		appCtx.Notifier.NotifySessionReady(appCtx.Client, app.Name, app.Name, user, status)
 		appPath := fmt.Sprintf("/%s/", app.Name)
-		broker.SetCookie(w, cookieName, cookieValue, appPath, maxCookieAgeSeconds)
+		broker.SetCookie(w, cookieName, appCtx.SessionTokens.RenewToken(r, cookieName, identity, app.Name), appPath, maxCookieAgeSeconds)
 	}
 
 	return statusCode, msg
@@ -777,45 +1316,156 @@ func getAppStatus(w http.ResponseWriter, app broker.AppConfigSpec, appCtx *AppCo
 
 /*
 Obtain a reservation for the user.
+A *QuotaExceededError is returned if the reservation would exceed a session quota.
 */
-func createApp(app broker.AppConfigSpec, appCtx *AppContext, user, username string, userParams map[string]string) (int, string) {
+func createApp(app broker.AppConfigSpec, appCtx *AppContext, user, username string, userParams map[string]string) (int, string, error) {
 	statusCode := http.StatusOK
 	msg := ""
 
+	appCtx.RLock()
+	ready := appCtx.ReservationsReady
+	pod, ok := appCtx.ReservedPods[user]
+	appCtx.RUnlock()
+
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+		msg = "Reservations are being restored, try again shortly"
+		return statusCode, msg, nil
+	}
+
+	if ok && !pod.Pending {
+		// Users that were queued before their reservation completed no longer wait.
+		appCtx.WaitQueue.Remove(user)
+		msg = fmt.Sprintf("pod for %s: %s", user, pod.Name)
+		return statusCode, msg, nil
+	}
+
+	// New reservations are admitted before locking the reservation table, so that listing the sessions does not block the app.
+	admitted := false
+	if !ok {
+		// Apps in maintenance do not accept new reservations.
+		// Reserving a pod releases it from the Deployment, which then creates a replacement, so this also keeps the pool from growing.
+		if app.InMaintenance(time.Now()) {
+			broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorMaintenance)
+			statusCode = http.StatusServiceUnavailable
+			msg = app.MaintenanceMessage()
+			return statusCode, msg, nil
+		}
+
+		// Drained apps do not accept new reservations.
+		if appCtx.Drainer.IsDrained(app.Name) {
+			broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorDrained)
+			statusCode = http.StatusServiceUnavailable
+			msg = "app is drained, new sessions are not allowed at this time"
+			return statusCode, msg, nil
+		}
+
+		// Verify the new reservation is within the broker and app quotas.
+		if err := admitSession(app, appCtx, user, username); err != nil {
+			if _, ok := err.(*broker.QuotaExceededError); ok {
+				log.Printf("denied reservation for user %s: %s: %v", user, app.Name, err)
+				broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorQuota)
+				statusCode = http.StatusTooManyRequests
+				msg = err.Error()
+				return statusCode, msg, err
+			}
+			log.Printf("failed to check quota for user %s: %s: %v", user, app.Name, err)
+			broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
+			statusCode = http.StatusInternalServerError
+			msg = "error creating app"
+			return statusCode, msg, nil
+		}
+		admitted = true
+
+		// A failed reservation no longer counts, a completed one is pending until its reserved pod is in the session cache.
+		defer func() {
+			if statusCode != http.StatusOK {
+				appCtx.PendingSessions.Remove(app.Name, user)
+			}
+		}()
+	}
+
 	// Lock the reservation table so that users get an atomic reservation and they can't reserve multiple pods.
 	appCtx.Lock()
 	defer appCtx.Unlock()
 
-	if pod, ok := appCtx.ReservedPods[user]; ok {
+	pod, ok = appCtx.ReservedPods[user]
+	if ok && !pod.Pending {
+		// Users that were queued before their reservation completed no longer wait.
+		appCtx.WaitQueue.Remove(user)
 		msg = fmt.Sprintf("pod for %s: %s", user, pod.Name)
-		return statusCode, msg
+		return statusCode, msg, nil
 	}
 
-	if len(appCtx.AvailablePods) == 0 {
-		statusCode = http.StatusNotFound
-		msg = "No available instances at this time"
-		return statusCode, msg
-	}
+	if ok {
+		// Resume an assignment that did not complete, the pod and session are kept.
+		log.Printf("resuming pending assignment of pod %s to user: %s", pod.Name, user)
+	} else {
+		if !admitted {
+			// The pending assignment was released while waiting for the lock.
+			statusCode = http.StatusServiceUnavailable
+			msg = "Reservation was released, try again shortly"
+			return statusCode, msg, nil
+		}
 
-	// Generate session key
-	sessionKey := broker.MakeSessionKey()
+		// When the wait queue is enabled, users are only assigned a pod once they reach the head of the queue.
+		if appCtx.WaitQueue.Enabled() {
+			head, queued := appCtx.WaitQueue.Head()
+			if len(appCtx.AvailablePods) == 0 || (queued && head.User != user) {
+				pos, err := appCtx.WaitQueue.Enqueue(user, username, userParams)
+				if err != nil {
+					log.Printf("failed to enqueue user %s for %s: %v", user, app.Name, err)
+					statusCode = http.StatusServiceUnavailable
+					msg = "No available instances and the wait queue is full at this time"
+					return statusCode, msg, nil
+				}
+				log.Printf("queued user %s for %s at position %d", user, app.Name, pos)
+				statusCode = http.StatusAccepted
+				msg = fmt.Sprintf("queued at position %d", pos)
+				return statusCode, msg, nil
+			}
+		}
 
-	// Generate session start timestamp
-	ts := fmt.Sprintf("%d", time.Now().Unix())
+		if len(appCtx.AvailablePods) == 0 {
+			broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorCapacity)
+			statusCode = http.StatusNotFound
+			msg = "No available instances at this time"
+			return statusCode, msg, nil
+		}
 
-	// Assign user a pod and remove it from the list
-	pod := appCtx.AvailablePods[0]
-	appCtx.AvailablePods = appCtx.AvailablePods[1:]
-	pod.SessionKey = sessionKey
-	pod.SessionStart = ts
+		// Assign user a pod and remove it from the list
+		pod = appCtx.AvailablePods[0]
+		appCtx.AvailablePods = appCtx.AvailablePods[1:]
+
+		// Generate session key
+		pod.SessionKey = broker.MakeSessionKey()
+
+		// Generate session start timestamp
+		pod.SessionStart = fmt.Sprintf("%d", time.Now().Unix())
+
+		// add user params to the pod
+		pod.UserParams = userParams
+
+		// Persist the pending assignment before modifying the pod so that it is recovered after a restart.
+		pod.Pending = true
+		if err := appCtx.Store.Put(app.Name, makeReservation(user, pod)); err != nil {
+			log.Printf("failed to store pending reservation of pod %s for user %s: %v", pod.Name, user, err)
+			broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
+			statusCode = http.StatusInternalServerError
+			msg = "error creating app"
+			return statusCode, msg, nil
+		}
+		appCtx.ReservedPods[user] = pod
+	}
 
 	// Build the per-user manifest templates
 	destDir, err := buildUserBundle(app, appCtx, user, username, pod)
 	if err != nil {
 		log.Printf("failed to build user bundle for %s/%s: %v", app.Name, user, err)
+		broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
 		statusCode = http.StatusInternalServerError
 		msg = "error creating app"
-		return statusCode, msg
+		return statusCode, msg, nil
 	}
 
 	// Determine the unique kinds of objects being applied and add them to a json patch that will add the list to an annotation.
@@ -824,41 +1474,98 @@ func createApp(app broker.AppConfigSpec, appCtx *AppContext, user, username stri
 	userObjects, err := broker.GetObjectTypes(destDir)
 	if err != nil {
 		log.Printf("failed to determine object types in bundle: %v", err)
+		broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
 		statusCode = http.StatusInternalServerError
 		msg = "error creating app"
-		return statusCode, msg
+		return statusCode, msg, nil
 	}
 	pod.UserObjects = userObjects
 
-	// add user params to the pod
-	pod.UserParams = userParams
-
 	// Update the pod for the user
-	if err := updatePodForUser(app, user, pod.SessionKey, pod.Name, pod.UserObjects, userParams); err != nil {
+	if err := updatePodForUser(appCtx.Client, app, user, username, pod.SessionKey, pod.SessionStart, pod.Name, pod.UserObjects, pod.UserParams); err != nil {
 		log.Printf("failed to update pod for user %s: %s: %v", user, pod.Name, err)
+		broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
 		statusCode = http.StatusInternalServerError
 		msg = "error creating app"
-		return statusCode, msg
+		return statusCode, msg, nil
 	}
 
 	// Apply the per-user manifests
-	cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kustomize build %s | kubectl apply -f -", destDir))
-	cmd.Dir = destDir
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("error applying per-user manifests for %s: %v\n%s", user, err, stdoutStderr)
+	if _, err := appCtx.ApplyEngine.ApplyKustomization(destDir); err != nil {
+		broker.RecordApplyError("apply-user")
+		broker.LogApplyError(fmt.Sprintf("error applying per-user manifests for %s", user), err)
+		broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
 		statusCode = http.StatusInternalServerError
 		msg = "error creating app"
-		return statusCode, msg
+		return statusCode, msg, nil
+	}
+
+	// Complete the reservation
+	pod.Pending = false
+	if err := appCtx.Store.Put(app.Name, makeReservation(user, pod)); err != nil {
+		log.Printf("failed to store reservation of pod %s for user %s: %v", pod.Name, user, err)
+		broker.RecordSessionCreateError(app.Name, broker.SessionCreateErrorInternal)
+		statusCode = http.StatusInternalServerError
+		msg = "error creating app"
+		return statusCode, msg, nil
 	}
 
 	log.Printf("assigned pod %s to user: %s", pod.Name, user)
+	broker.RecordSessionCreated(app.Name, user)
+	appCtx.PoolSizer.ObserveReservation(time.Now())
+	appCtx.AuditLog.Emit(broker.AuditEvent{
+		Event:      broker.AuditEventSessionCreated,
+		App:        app.Name,
+		User:       user,
+		Username:   username,
+		Image:      fmt.Sprintf("%s:%s", appCtx.PodData.ImageRepo, appCtx.PodData.ImageTag),
+		NodeTier:   appCtx.PodData.NodeTier.Name,
+		UserParams: pod.UserParams,
+		Pod:        pod.Name,
+	})
+	appCtx.Notifier.Notify(broker.WebhookEvent{
+		Event: broker.WebhookEventReservationAssigned,
+		App:   app.Name,
+		User:  user,
+		Data:  map[string]string{"pod": pod.Name},
+	})
+
+	// Remove the user from the wait queue, if they were waiting.
+	appCtx.WaitQueue.Served(user)
 
 	// Reserve pod for user in map
 	appCtx.ReservedPods[user] = pod
 
 	msg = fmt.Sprintf("assigned pod: %s", pod.Name)
-	return statusCode, msg
+	return statusCode, msg, nil
+}
+
+/*
+Verifies that a new reservation of the app for the user is within the broker and app quotas.
+Admitted reservations count as pending sessions until the reserved pod is in the session cache with the user.
+Returns a *QuotaExceededError if a quota would be exceeded.
+*/
+func admitSession(app broker.AppConfigSpec, appCtx *AppContext, user, username string) error {
+	if !appCtx.Quota.AppliesTo(app) {
+		return nil
+	}
+
+	quotaAdmission.Lock()
+	defer quotaAdmission.Unlock()
+
+	registeredApps, err := appCtx.Registry.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to parse registered app manifest: %v", err)
+	}
+	sessions, err := appCtx.SessionCache.List(registeredApps.Apps)
+	if err != nil {
+		return fmt.Errorf("failed to list active sessions: %v", err)
+	}
+	if err := broker.CheckSessionQuota(appCtx.Quota, app, user, username, appCtx.PendingSessions.Merge(sessions)); err != nil {
+		return err
+	}
+	appCtx.PendingSessions.Add(broker.ActiveSession{App: app.Name, User: user, Username: username})
+	return nil
 }
 
 /*
@@ -869,7 +1576,7 @@ func buildUserBundle(app broker.AppConfigSpec, appCtx *AppContext, user, usernam
 	data := appCtx.PodData
 	data.User = user
 	data.Username = username
-	data.CookieValue = broker.MakeCookieValue(user, app.Name, appCtx.CookieSecret)
+	data.CookieValue = appCtx.SessionTokens.RoutingValue(user, app.Name)
 	data.ID = broker.MakePodID(user)
 	data.FullName = fmt.Sprintf("%s-%s", app.Name, data.ID)
 	data.Timestamp = fmt.Sprintf("%d", time.Now().Unix())
@@ -898,36 +1605,57 @@ func buildUserBundle(app broker.AppConfigSpec, appCtx *AppContext, user, usernam
 
 /*
 Release a reservation and delete the pod.
+The actor is the admin that requested the deletion, empty otherwise.
 */
-func deleteApp(appCtx *AppContext, user string) (int, string) {
+func deleteApp(appCtx *AppContext, user, reason, actor string) (int, string) {
 	statusCode := http.StatusOK
 	msg := "shutdown"
 
+	// Users that are waiting leave the queue.
+	appCtx.WaitQueue.Remove(user)
+
 	// Lock the reservation table
 	appCtx.Lock()
-
-	// Remove the reservation from the table.
-	defer delete(appCtx.ReservedPods, user)
-
 	defer appCtx.Unlock()
 
+	// Remove the reservation from the table and the store.
+	defer func() {
+		bPod, ok := appCtx.ReservedPods[user]
+		if !ok {
+			return
+		}
+		delete(appCtx.ReservedPods, user)
+		appCtx.SessionReaper.Remove(appCtx.Name, user)
+		appCtx.PendingSessions.Remove(appCtx.Name, user)
+		broker.RecordSessionDeleted(appCtx.Name, user, reason)
+		appCtx.AuditLog.Emit(broker.AuditEvent{
+			Event:  broker.AuditEventSessionDeleted,
+			App:    appCtx.Name,
+			User:   user,
+			Pod:    bPod.Name,
+			Reason: reason,
+			Actor:  actor,
+		})
+		if err := appCtx.Store.Delete(appCtx.Name, user); err != nil {
+			log.Printf("failed to remove reservation for user %s from store: %v", user, err)
+		}
+	}()
+
 	if bPod, ok := appCtx.ReservedPods[user]; ok {
 		podName := bPod.Name
 		// Remove instance label from the pod.
 		// This is done so that subsequest GET requests don't return the terminating pod.
-		cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl label pod -n %s %s app.kubernetes.io/instance- 1>&2", appCtx.Name, podName))
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("warning: failed to remove instance label from pod: %s: %s\n%v", podName, stdoutStderr, err)
+		if err := appCtx.Client.PatchPodMetadata(appCtx.Name, podName, map[string]*string{"app.kubernetes.io/instance": nil}, nil); err != nil {
+			log.Printf("warning: failed to remove instance label from pod: %s: %v", podName, err)
 		}
 
 		// Delete the pod from K8S
 		log.Printf("deleting pod for user %s: %s", user, podName)
 
-		cmd = exec.Command("sh", "-c", fmt.Sprintf("kubectl delete pod -n %s %s --wait=false 1>&2", appCtx.Name, podName))
-		stdoutStderr, err = cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("failed to delete pod for user %s: %s: %s\n%v", user, podName, stdoutStderr, err)
+		if err := appCtx.Client.DeletePod(appCtx.Name, podName); apierrors.IsNotFound(err) {
+			log.Printf("pod for user %s was already deleted: %s", user, podName)
+		} else if err != nil {
+			log.Printf("failed to delete pod for user %s: %s: %v", user, podName, err)
 			statusCode = http.StatusInternalServerError
 			msg = "error deleting app"
 			return statusCode, msg
@@ -935,13 +1663,10 @@ func deleteApp(appCtx *AppContext, user string) (int, string) {
 
 		// Delete the per-user resources
 		if len(bPod.UserObjects) > 0 {
-			objectTypes := strings.Join(bPod.UserObjects, ",")
 			fullName := fmt.Sprintf("%s-%s", appCtx.Name, broker.MakePodID(user))
-			cmdStr := fmt.Sprintf("kubectl delete %s -n %s -l \"app.kubernetes.io/instance=%s, app.broker/deletion-policy notin (abandon)\" --wait=false", objectTypes, appCtx.Name, fullName)
-			cmd = exec.Command("sh", "-o", "pipefail", "-c", cmdStr)
-			stdoutStderr, err = cmd.CombinedOutput()
-			if err != nil {
-				log.Printf("error deleting per-user resources for %s: %v\n%s", user, err, stdoutStderr)
+			if err := appCtx.Client.DeleteCollection(appCtx.Name, bPod.UserObjects, broker.UserObjectsSelector(fullName)); err != nil {
+				broker.RecordApplyError("delete-user-objects")
+				log.Printf("error deleting per-user resources for %s: %v", user, err)
 				statusCode = http.StatusInternalServerError
 				msg = "error deleting app"
 				return statusCode, msg
@@ -951,7 +1676,47 @@ func deleteApp(appCtx *AppContext, user string) (int, string) {
 	return statusCode, msg
 }
 
-func deletePod(appName string, pod BrokerPod) (int, string) {
+/*
+Syncs the tracked sessions with the reservation table and shuts down sessions that exceeded the app limits.
+Expired sessions run the app shutdown hooks and are then released the same way as a user DELETE.
+*/
+func reapSessions(app broker.AppConfigSpec, appCtx *AppContext) {
+	sessions := make(map[string]time.Time, 0)
+	idleTimeout, maxSessionDuration, err := app.SessionTimeouts()
+	if err != nil {
+		log.Printf("failed to get session timeouts for app %s: %v", app.Name, err)
+	} else if idleTimeout > 0 || maxSessionDuration > 0 || app.Maintenance.Enabled {
+		appCtx.RLock()
+		for user, pod := range appCtx.ReservedPods {
+			start := time.Now()
+			if ts, err := strconv.ParseInt(pod.SessionStart, 10, 64); err == nil {
+				start = time.Unix(ts, 0)
+			}
+			sessions[user] = start
+		}
+		appCtx.RUnlock()
+	}
+	appCtx.SessionReaper.Sync(app.Name, sessions)
+
+	for _, session := range appCtx.SessionReaper.Expired(map[string]broker.AppConfigSpec{app.Name: app}, time.Now()) {
+		// Stop tracking now so the session is not reaped twice, it is tracked again on the next sync if the shutdown fails.
+		appCtx.SessionReaper.Remove(app.Name, session.User)
+
+		go func(user, reason string) {
+			log.Printf("reaping %s session for user %s, reason: %s", app.Name, user, reason)
+			fullName := fmt.Sprintf("%s-%s", app.Name, broker.MakePodID(user))
+			broker.RunShutdownHooks(appCtx.Client, app.Name, fullName, app.ShutdownHooks)
+			if statusCode, msg := deleteApp(appCtx, user, reason, ""); statusCode != http.StatusOK {
+				log.Printf("failed to reap session for user %s: %s", user, msg)
+			}
+		}(session.User, session.Reason)
+	}
+}
+
+/*
+Deletes an unreserved pod, used when a pod in the pool shuts itself down.
+*/
+func deletePod(appCtx *AppContext, pod BrokerPod) (int, string) {
 	statusCode := http.StatusOK
 	msg := "shutdown"
 	podName := pod.Name
@@ -959,32 +1724,21 @@ func deletePod(appName string, pod BrokerPod) (int, string) {
 	// Delete the pod from K8S
 	log.Printf("deleting pod %s", podName)
 
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl delete pod -n %s %s --wait=false 1>&2", appName, podName))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("failed to delete pod %s: %s\n%v", podName, stdoutStderr, err)
+	if err := appCtx.Client.DeletePod(appCtx.Name, podName); err != nil {
+		log.Printf("failed to delete pod %s: %v", podName, err)
 		statusCode = http.StatusInternalServerError
 		msg = "error deleting app"
 		return statusCode, msg
 	}
 
-	return statusCode, msg
-}
-
-func listBrokerPods(namespace, selector string) (GetPodsSpec, error) {
-	var resp GetPodsSpec
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get pod -n %s -l \"%s\" -o json 1>&2", namespace, selector))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return resp, fmt.Errorf("failed to list pods: %s, %v", string(stdoutStderr), err)
-	}
+	appCtx.AuditLog.Emit(broker.AuditEvent{
+		Event:  broker.AuditEventPodDeleted,
+		App:    appCtx.Name,
+		Pod:    podName,
+		Reason: broker.SessionDeleteReasonSelf,
+	})
 
-	var podResp GetPodsSpec
-	if err := json.Unmarshal(stdoutStderr, &podResp); err != nil {
-		return resp, fmt.Errorf("failed to parse pod spec in initial pod list: %v", err)
-	}
-	return podResp, nil
+	return statusCode, msg
 }
 
 // WriteCacheFiles is not thread-safe, should be run within the context of a mutex lock.
@@ -1017,12 +1771,17 @@ func getUserParams(r *http.Request, appCtx *AppContext) map[string]string {
 		queryParams[k] = v[0]
 	}
 
+	// The pod data is replaced when the app config is reloaded.
+	appCtx.RLock()
+	appSpec := appCtx.PodData.AppSpec
+	appCtx.RUnlock()
+
 	// Validate input parameters
 	// Only write parameters that were found in the app config and are writable.
-	for _, appParam := range appCtx.PodData.AppSpec.UserParams {
+	for _, appParam := range appSpec.UserParams {
 		// Return error if param is not found or not writable.
 		if v, ok := queryParams[appParam.Name]; ok {
-			for _, p := range appCtx.PodData.AppSpec.UserWritableParams {
+			for _, p := range appSpec.UserWritableParams {
 				if p == appParam.Name {
 					// Param is writable, add to return map
 					resp[appParam.Name] = v
@@ -1034,3 +1793,35 @@ func getUserParams(r *http.Request, appCtx *AppContext) map[string]string {
 
 	return resp
 }
+
+func writeQuotaExceededResponse(w http.ResponseWriter, quotaErr *broker.QuotaExceededError) {
+	status := broker.QuotaExceededResponse{
+		Code:    http.StatusTooManyRequests,
+		Status:  quotaErr.Error(),
+		Limit:   quotaErr.Limit,
+		Group:   quotaErr.Group,
+		Max:     quotaErr.Max,
+		Current: quotaErr.Current,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+func writeWaitQueueResponse(w http.ResponseWriter, appCtx *AppContext, position int) {
+	status := broker.WaitQueueStatusResponse{
+		Code:       http.StatusAccepted,
+		Status:     "queued",
+		Position:   position,
+		ETASeconds: int64(appCtx.WaitQueue.ETA(position).Seconds()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
@@ -0,0 +1,162 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+const testApp = "desktop"
+
+func newTestAppContext(objects ...runtime.Object) *AppContext {
+	client := brokertest.NewFakeClusterClient(objects...)
+	sessionCache := broker.NewActiveSessionCache(client, 0)
+	if err := sessionCache.Run(make(chan struct{})); err != nil {
+		panic(err)
+	}
+	return &AppContext{
+		Name:            testApp,
+		ReservedPods:    make(map[string]BrokerPod, 0),
+		Client:          client,
+		Drainer:         broker.NewAppDrainer(client, broker.DefaultBrokerNamespace),
+		Store:           broker.NewMemoryReservationStore(),
+		SessionReaper:   broker.NewSessionReaper(),
+		PendingSessions: broker.NewPendingSessions(),
+		SessionCache:    sessionCache,
+		WaitQueue:       broker.NewWaitQueue(),
+	}
+}
+
+func TestDeleteApp(t *testing.T) {
+	user := "user@example.com"
+	fullName := fmt.Sprintf("%s-%s", testApp, broker.MakePodID(user))
+	podName := testApp + "-pool-0"
+
+	appCtx := newTestAppContext(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: testApp, Name: podName, Labels: map[string]string{"app.kubernetes.io/instance": fullName}}},
+		brokertest.NewObject("v1", "Service", testApp, fullName, map[string]string{"app.kubernetes.io/instance": fullName}),
+		brokertest.NewObject("v1", "Service", testApp, testApp+"-pool", map[string]string{"app": testApp}),
+	)
+	appCtx.ReservedPods[user] = BrokerPod{Name: podName, UserObjects: []string{"Service"}}
+	if err := appCtx.Store.Put(testApp, broker.Reservation{User: user, PodName: podName}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, msg := deleteApp(appCtx, user, "user", ""); status != http.StatusOK {
+		t.Fatalf("deleteApp returned %d: %s", status, msg)
+	}
+
+	if _, ok := appCtx.ReservedPods[user]; ok {
+		t.Errorf("expected reservation to be removed from the table")
+	}
+	if reservations, _ := appCtx.Store.List(testApp); len(reservations) != 0 {
+		t.Errorf("expected reservation to be removed from the store, found %v", reservations)
+	}
+
+	client := appCtx.Client
+	if _, err := client.Kubernetes().CoreV1().Pods(testApp).Get(context.TODO(), podName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected reserved pod to be deleted, got err: %v", err)
+	}
+	services := client.Dynamic().Resource(schema.GroupVersionResource{Version: "v1", Resource: "services"}).Namespace(testApp)
+	if _, err := services.Get(context.TODO(), fullName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected per-user service to be deleted, got err: %v", err)
+	}
+	if _, err := services.Get(context.TODO(), testApp+"-pool", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected pool service to be kept, got err: %v", err)
+	}
+}
+
+func TestDeleteAppNotReserved(t *testing.T) {
+	appCtx := newTestAppContext()
+	if status, msg := deleteApp(appCtx, "user@example.com", "user", ""); status != http.StatusOK {
+		t.Errorf("expected deleting a missing reservation to succeed, got %d: %s", status, msg)
+	}
+}
+
+func TestDispatchWaitQueueReservedHead(t *testing.T) {
+	user := "user@example.com"
+	appCtx := newTestAppContext()
+	appCtx.ReservationsReady = true
+	appCtx.AvailablePods = []BrokerPod{{Name: testApp + "-pool-1"}}
+	appCtx.ReservedPods[user] = BrokerPod{Name: testApp + "-pool-0"}
+	if err := appCtx.WaitQueue.Configure(broker.WaitQueueSpec{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appCtx.WaitQueue.Enqueue(user, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued user already has a reservation, dispatching must remove them instead of retrying forever.
+	done := make(chan struct{})
+	go func() {
+		dispatchWaitQueue(appCtx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatchWaitQueue did not return for a head user with a reservation")
+	}
+	if _, ok := appCtx.WaitQueue.Head(); ok {
+		t.Errorf("expected reserved user to be removed from the wait queue")
+	}
+	if len(appCtx.AvailablePods) != 1 {
+		t.Errorf("expected available pod to be kept, got %v", appCtx.AvailablePods)
+	}
+}
+
+func TestDispatchWaitQueueQuotaExceeded(t *testing.T) {
+	user := "user@example.com"
+	appCtx := newTestAppContext()
+	appCtx.ReservationsReady = true
+	appCtx.AvailablePods = []BrokerPod{{Name: testApp + "-pool-0"}}
+	appCtx.Registry = broker.NewAppRegistry(filepath.Join(t.TempDir(), "apps.json"))
+	if _, err := appCtx.Registry.Publish(map[string]broker.AppConfigSpec{}, broker.NetworkPolicyTemplateData{}); err != nil {
+		t.Fatal(err)
+	}
+	appCtx.Quota = broker.BrokerQuotaSpec{MaxSessionsPerUser: 1}
+	appCtx.PendingSessions.Add(broker.ActiveSession{App: "other", User: user})
+	if err := appCtx.WaitQueue.Configure(broker.WaitQueueSpec{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appCtx.WaitQueue.Enqueue(user, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user cannot be admitted by waiting for a pod, they are removed so that the queue is not blocked.
+	dispatchWaitQueue(appCtx)
+	if _, ok := appCtx.WaitQueue.Head(); ok {
+		t.Errorf("expected user over quota to be removed from the wait queue")
+	}
+	if len(appCtx.AvailablePods) != 1 {
+		t.Errorf("expected available pod to be kept, got %v", appCtx.AvailablePods)
+	}
+}
@@ -0,0 +1,418 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Name of the ConfigMap in the broker namespace that holds the drained apps.
+const AppDrainConfigMapName = "pod-broker-drained-apps"
+
+// Annotation with the unix time a reservation was assigned to the user.
+const SessionStartAnnotation = "app.broker/session-start"
+
+// Status values of an admin session.
+const (
+	AdminSessionStatusReady       = "ready"
+	AdminSessionStatusWaiting     = "waiting"
+	AdminSessionStatusTerminating = "terminating"
+)
+
+const appDrainReloadPeriod = 10 * time.Second
+
+// Session as reported by the admin API.
+type AdminSession struct {
+	App       string    `json:"app"`
+	User      string    `json:"user"`
+	Broker    string    `json:"broker"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Node      string    `json:"node"`
+	NodeTier  string    `json:"nodeTier"`
+	Image     string    `json:"image"`
+	StartTime time.Time `json:"startTime"`
+	Status    string    `json:"status"`
+}
+
+// Response of the admin sessions list.
+type AdminSessionListResponse struct {
+	Sessions    []AdminSession `json:"sessions"`
+	DrainedApps []DrainedApp   `json:"drainedApps"`
+}
+
+// Lists the sessions of all brokers with their pod details, sorted by app and user.
+// Sessions are found the same way as ActiveSessionCache.List, a session with multiple pods is reported once per pod.
+func ListAdminSessions(client ClusterClient, apps map[string]AppConfigSpec) ([]AdminSession, error) {
+	resp := make([]AdminSession, 0)
+
+	pods, err := client.GetPods("", ActiveSessionPodSelector)
+	if err != nil {
+		return resp, err
+	}
+
+	for _, pod := range pods {
+		user, ok := pod.Annotations["app.broker/user"]
+		if !ok {
+			continue
+		}
+		managedBy := pod.Labels["app.kubernetes.io/managed-by"]
+		var appName string
+		switch managedBy {
+		case "reservation-broker":
+			// Reserved pods run in the app namespace.
+			appName = pod.Namespace
+		case "pod-broker":
+			appName = pod.Labels["app.kubernetes.io/name"]
+			if app, ok := apps[appName]; !ok || app.Type != AppTypeStatefulSet {
+				// Skip pods in the reservation pool and unknown apps.
+				continue
+			}
+		}
+		app := apps[appName]
+
+		startTime := pod.CreationTimestamp.Time
+		if ts, err := strconv.ParseInt(pod.Annotations[SessionStartAnnotation], 10, 64); err == nil {
+			startTime = time.Unix(ts, 0)
+		}
+
+		resp = append(resp, AdminSession{
+			App:       appName,
+			User:      user,
+			Broker:    managedBy,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Node:      pod.Spec.NodeName,
+			NodeTier:  podNodeTier(app, pod),
+			Image:     podAppImage(app, pod),
+			StartTime: startTime.UTC(),
+			Status:    adminSessionStatus(pod),
+		})
+	}
+
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].App != resp[j].App {
+			return resp[i].App < resp[j].App
+		}
+		if resp[i].User != resp[j].User {
+			return resp[i].User < resp[j].User
+		}
+		return resp[i].Pod < resp[j].Pod
+	})
+
+	return resp, nil
+}
+
+// Writes the sessions of all brokers and the drained apps, the response of GET /admin/sessions on both brokers.
+// Returns an error without writing the response if the sessions cannot be listed.
+func WriteAdminSessionList(w http.ResponseWriter, client ClusterClient, apps map[string]AppConfigSpec, drainer *AppDrainer) error {
+	sessions, err := ListAdminSessions(client, apps)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(AdminSessionListResponse{
+		Sessions:    sessions,
+		DrainedApps: drainer.List(),
+	})
+	return nil
+}
+
+// Returns the name of the app node tier selected by the pod, or the node selector value if it does not match a tier.
+func podNodeTier(app AppConfigSpec, pod corev1.Pod) string {
+	label := pod.Spec.NodeSelector["app.broker/tier"]
+	for _, tier := range app.NodeTiers {
+		if len(label) > 0 && tier.NodeLabel == label {
+			return tier.Name
+		}
+	}
+	return label
+}
+
+// Returns the image of the pod container that runs the app default repo, or of the first container.
+func podAppImage(app AppConfigSpec, pod corev1.Pod) string {
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	for _, c := range pod.Spec.Containers {
+		repo := strings.SplitN(c.Image, "@", 2)[0]
+		if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+			repo = repo[:idx]
+		}
+		if len(app.DefaultRepo) > 0 && repo == app.DefaultRepo {
+			return c.Image
+		}
+	}
+	return pod.Spec.Containers[0].Image
+}
+
+func adminSessionStatus(pod corev1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return AdminSessionStatusTerminating
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return AdminSessionStatusWaiting
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !cs.Ready {
+			return AdminSessionStatusWaiting
+		}
+	}
+	return AdminSessionStatusReady
+}
+
+// Compiles the authorization rules of the admin API from the comma separated AdminAuthorizedUsers sysParam, for example: group:broker-admins@corp
+// The admin API is disabled if the sysParam is empty.
+func NewAdminPolicyFromParams(sysParams map[string]string) (*AuthzPolicy, error) {
+	rules := make([]string, 0)
+	for _, rule := range strings.Split(sysParams["AdminAuthorizedUsers"], ",") {
+		if rule = strings.TrimSpace(rule); len(rule) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	policy, errs := CompileAuthzPolicy(rules)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid POD_BROKER_PARAM_AdminAuthorizedUsers: %v", errs[0])
+	}
+	return policy, nil
+}
+
+// Authenticates the request and verifies that the user matches the admin policy.
+// Returns the identity and http.StatusOK if the request is allowed, otherwise the status code to respond with and the reason.
+func AuthorizeAdminRequest(r *http.Request, signer *SessionTokenSigner, auth Authenticator, authorizer *Authorizer, policy *AuthzPolicy) (AuthIdentity, int, error) {
+	if policy == nil {
+		return AuthIdentity{}, http.StatusNotFound, fmt.Errorf("admin API is disabled")
+	}
+	identity, err := AuthenticateRequest(r, "", "", signer, auth)
+	if err != nil {
+		return identity, http.StatusUnauthorized, err
+	}
+	if !policy.Matches(authorizer.Resolve(identity)) {
+		return identity, http.StatusForbidden, fmt.Errorf("user %s is not an admin", identity.User)
+	}
+	return identity, http.StatusOK, nil
+}
+
+// App that was drained by an admin, new sessions are refused until it is undrained.
+type DrainedApp struct {
+	App       string    `json:"app"`
+	DrainedBy string    `json:"drainedBy"`
+	Time      time.Time `json:"time"`
+}
+
+// AppDrainer tracks drained apps in a ConfigMap shared by the brokers.
+// The drained apps are cached and re-read in the background so that checks on each launch do not call the API server.
+type AppDrainer struct {
+	sync.Mutex
+	client    ClusterClient
+	namespace string
+	drained   map[string]DrainedApp
+}
+
+// Creates the drainer and starts reloading the drained apps, the first load happens right away.
+func NewAppDrainer(client ClusterClient, namespace string) *AppDrainer {
+	d := &AppDrainer{
+		client:    client,
+		namespace: namespace,
+		drained:   make(map[string]DrainedApp, 0),
+	}
+	d.reload()
+	go func() {
+		for {
+			time.Sleep(appDrainReloadPeriod)
+			d.reload()
+		}
+	}()
+	return d
+}
+
+// Returns the drain ConfigMap and if it exists, a new object is returned if it was not found.
+func (d *AppDrainer) get() (*corev1.ConfigMap, bool, error) {
+	cm, err := d.client.Kubernetes().CoreV1().ConfigMaps(d.namespace).Get(context.TODO(), AppDrainConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      AppDrainConfigMapName,
+				Namespace: d.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "pod-broker",
+				},
+			},
+			Data: make(map[string]string, 0),
+		}
+		return cm, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 0)
+	}
+	return cm, true, nil
+}
+
+func (d *AppDrainer) save(cm *corev1.ConfigMap, exists bool) error {
+	var err error
+	if !exists {
+		_, err = d.client.Kubernetes().CoreV1().ConfigMaps(d.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Created by another broker, retry the update against the current copy.
+			return apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, err)
+		}
+	} else {
+		_, err = d.client.Kubernetes().CoreV1().ConfigMaps(d.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Replaces the cache with the ConfigMap data, must be called with the lock held.
+func (d *AppDrainer) setCache(cm *corev1.ConfigMap) {
+	drained := make(map[string]DrainedApp, len(cm.Data))
+	for app, data := range cm.Data {
+		var da DrainedApp
+		if err := json.Unmarshal([]byte(data), &da); err != nil {
+			log.Printf("WARN: invalid drained app entry for %s in ConfigMap %s/%s: %v", app, d.namespace, AppDrainConfigMapName, err)
+			da = DrainedApp{App: app}
+		}
+		drained[app] = da
+	}
+	d.drained = drained
+}
+
+// Re-reads the drained apps, the previous state is kept if the ConfigMap cannot be read.
+func (d *AppDrainer) reload() {
+	cm, _, err := d.get()
+	if err != nil {
+		log.Printf("failed to reload drained apps, using previous state: %v", err)
+		return
+	}
+	d.Lock()
+	d.setCache(cm)
+	d.Unlock()
+}
+
+// Returns true if the app is drained.
+func (d *AppDrainer) IsDrained(app string) bool {
+	d.Lock()
+	defer d.Unlock()
+	_, ok := d.drained[app]
+	return ok
+}
+
+// Returns the drained apps sorted by name.
+func (d *AppDrainer) List() []DrainedApp {
+	d.Lock()
+	defer d.Unlock()
+	resp := make([]DrainedApp, 0, len(d.drained))
+	for _, da := range d.drained {
+		resp = append(resp, da)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].App < resp[j].App
+	})
+	return resp
+}
+
+// Marks the app as drained by the user.
+func (d *AppDrainer) Drain(app, user string) error {
+	data, err := json.Marshal(DrainedApp{App: app, DrainedBy: user, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return d.update(func(cm *corev1.ConfigMap) bool {
+		if _, ok := cm.Data[app]; ok {
+			return false
+		}
+		cm.Data[app] = string(data)
+		return true
+	})
+}
+
+// Removes the drained mark from the app.
+func (d *AppDrainer) Undrain(app string) error {
+	return d.update(func(cm *corev1.ConfigMap) bool {
+		if _, ok := cm.Data[app]; !ok {
+			return false
+		}
+		delete(cm.Data, app)
+		return true
+	})
+}
+
+// Drains or undrains the app on behalf of the admin and emits the audit event.
+// Returns the status code and message of the admin API response.
+func SetAppDrained(drainer *AppDrainer, auditLog *AuditLogger, appName, admin string, drained bool) (int, string) {
+	event := AuditEventAppDrained
+	msg := "drained"
+	var err error
+	if drained {
+		err = drainer.Drain(appName, admin)
+	} else {
+		event = AuditEventAppUndrained
+		msg = "undrained"
+		err = drainer.Undrain(appName)
+	}
+	if err != nil {
+		log.Printf("failed to update drain state of app %s: %v", appName, err)
+		return http.StatusInternalServerError, "internal server error"
+	}
+	log.Printf("admin %s %s app %s", admin, msg, appName)
+	auditLog.Emit(AuditEvent{
+		Event: event,
+		App:   appName,
+		Actor: admin,
+	})
+	return http.StatusOK, msg
+}
+
+// Applies the mutation to the ConfigMap, retrying on conflicts, and refreshes the cache.
+func (d *AppDrainer) update(mutate func(cm *corev1.ConfigMap) bool) error {
+	d.Lock()
+	defer d.Unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, exists, err := d.get()
+		if err != nil {
+			return err
+		}
+		if mutate(cm) {
+			if err := d.save(cm, exists); err != nil {
+				return err
+			}
+		}
+		d.setCache(cm)
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestAuthorizeAdminRequest(t *testing.T) {
+	signer, err := broker.NewSessionTokenSigner([]string{"secret"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &broker.HeaderAuthenticator{UserHeader: "X-User", GroupsHeader: "X-Groups"}
+	policy, err := broker.NewAdminPolicyFromParams(map[string]string{"AdminAuthorizedUsers": "admin@example.com, group:platform@corp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		policy  *broker.AuthzPolicy
+		want    int
+	}{
+		{"admin user", map[string]string{"X-User": "admin@example.com"}, policy, http.StatusOK},
+		{"admin group", map[string]string{"X-User": "alice@example.com", "X-Groups": "platform@corp"}, policy, http.StatusOK},
+		{"not an admin", map[string]string{"X-User": "alice@example.com"}, policy, http.StatusForbidden},
+		{"not authenticated", map[string]string{}, policy, http.StatusUnauthorized},
+		{"admin API disabled", map[string]string{"X-User": "admin@example.com"}, nil, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/sessions", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if _, status, _ := broker.AuthorizeAdminRequest(r, signer, auth, nil, tc.policy); status != tc.want {
+				t.Errorf("expected status %d, got %d", tc.want, status)
+			}
+		})
+	}
+
+	if policy, err := broker.NewAdminPolicyFromParams(map[string]string{}); err != nil || policy != nil {
+		t.Errorf("expected admin API to be disabled without AdminAuthorizedUsers, got %v, %v", policy, err)
+	}
+	if _, err := broker.NewAdminPolicyFromParams(map[string]string{"AdminAuthorizedUsers": "("}); err == nil {
+		t.Errorf("expected error for invalid AdminAuthorizedUsers")
+	}
+}
+
+func TestAppDrainer(t *testing.T) {
+	client := brokertest.NewFakeClusterClient()
+	drainer := broker.NewAppDrainer(client, "pod-broker-system")
+
+	if err := drainer.Drain("desktop", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Draining again keeps the first admin.
+	if err := drainer.Drain("desktop", "other@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !drainer.IsDrained("desktop") || drainer.IsDrained("ide") {
+		t.Errorf("expected only desktop to be drained")
+	}
+
+	// Brokers started later load the drained apps from the ConfigMap.
+	other := broker.NewAppDrainer(client, "pod-broker-system")
+	drained := other.List()
+	if len(drained) != 1 || drained[0].App != "desktop" || drained[0].DrainedBy != "admin@example.com" {
+		t.Errorf("expected desktop drained by admin@example.com, got %+v", drained)
+	}
+
+	if err := other.Undrain("desktop"); err != nil {
+		t.Fatal(err)
+	}
+	if other.IsDrained("desktop") {
+		t.Errorf("expected desktop to be undrained")
+	}
+	if err := other.Undrain("desktop"); err != nil {
+		t.Errorf("expected undraining an app that is not drained to succeed, got %v", err)
+	}
+}
+
+func TestSetAppDrained(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := broker.NewAuditLoggerFromParams(map[string]string{"AuditLog": logFile}, "pod-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainer := broker.NewAppDrainer(brokertest.NewFakeClusterClient(), "pod-broker-system")
+
+	if status, msg := broker.SetAppDrained(drainer, auditLog, "desktop", "admin@example.com", true); status != http.StatusOK || msg != "drained" {
+		t.Errorf("expected desktop to be drained, got %d: %s", status, msg)
+	}
+	if !drainer.IsDrained("desktop") {
+		t.Errorf("expected desktop to be drained")
+	}
+	if status, msg := broker.SetAppDrained(drainer, auditLog, "desktop", "admin@example.com", false); status != http.StatusOK || msg != "undrained" {
+		t.Errorf("expected desktop to be undrained, got %d: %s", status, msg)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], broker.AuditEventAppDrained) || !strings.Contains(lines[1], broker.AuditEventAppUndrained) {
+		t.Errorf("expected drained and undrained audit events, got %v", lines)
+	}
+}
+
+func TestWriteAdminSessionList(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "desktop",
+		Name:        "desktop-pool-0",
+		Labels:      map[string]string{"app.kubernetes.io/managed-by": "reservation-broker"},
+		Annotations: map[string]string{"app.broker/user": "alice@example.com"},
+	}}
+	client := brokertest.NewFakeClusterClient(pod)
+	drainer := broker.NewAppDrainer(client, "pod-broker-system")
+	if err := drainer.Drain("desktop", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := broker.WriteAdminSessionList(w, client, map[string]broker.AppConfigSpec{"desktop": {Name: "desktop"}}, drainer); err != nil {
+		t.Fatal(err)
+	}
+	var resp broker.AdminSessionListResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || len(resp.Sessions) != 1 || resp.Sessions[0].User != "alice@example.com" {
+		t.Errorf("expected the reserved session, got %+v", resp.Sessions)
+	}
+	if len(resp.DrainedApps) != 1 || resp.DrainedApps[0].App != "desktop" {
+		t.Errorf("expected desktop to be listed as drained, got %+v", resp.DrainedApps)
+	}
+}
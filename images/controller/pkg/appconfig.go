@@ -17,9 +17,8 @@
 package pod_broker
 
 import (
-	"encoding/json"
 	"fmt"
-	"os/exec"
+	"time"
 )
 
 func (spec *AppConfigSpec) NodeTierNames() []string {
@@ -30,49 +29,142 @@ func (spec *AppConfigSpec) NodeTierNames() []string {
 	return tierNames
 }
 
-func FetchBrokerAppConfigs(namespace string) ([]AppConfigObject, error) {
-	appConfigs := make([]AppConfigObject, 0)
+// Returns the parsed idleTimeout and maxSessionDuration, a value of 0 means the limit is disabled.
+func (spec *AppConfigSpec) SessionTimeouts() (time.Duration, time.Duration, error) {
+	var idleTimeout, maxSessionDuration time.Duration
+	var err error
+	if len(spec.IdleTimeout) > 0 {
+		if idleTimeout, err = time.ParseDuration(spec.IdleTimeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid idleTimeout '%s': %v", spec.IdleTimeout, err)
+		}
+	}
+	if len(spec.MaxSessionDuration) > 0 {
+		if maxSessionDuration, err = time.ParseDuration(spec.MaxSessionDuration); err != nil {
+			return 0, 0, fmt.Errorf("invalid maxSessionDuration '%s': %v", spec.MaxSessionDuration, err)
+		}
+	}
+	return idleTimeout, maxSessionDuration, nil
+}
 
-	type appConfigItems struct {
-		Items []AppConfigObject `yaml:"items"`
+// Returns the parsed maintenance startTime, endTime and gracePeriod, zero values mean they are not set.
+// The gracePeriod is counted from the startTime, so it requires one.
+func (spec *AppConfigSpec) MaintenanceWindow() (time.Time, time.Time, time.Duration, error) {
+	var start, end time.Time
+	var gracePeriod time.Duration
+	var err error
+	m := spec.Maintenance
+	if len(m.StartTime) > 0 {
+		if start, err = time.Parse(time.RFC3339, m.StartTime); err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid maintenance startTime '%s': %v", m.StartTime, err)
+		}
+	}
+	if len(m.EndTime) > 0 {
+		if end, err = time.Parse(time.RFC3339, m.EndTime); err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid maintenance endTime '%s': %v", m.EndTime, err)
+		}
 	}
+	if len(m.GracePeriod) > 0 {
+		if gracePeriod, err = time.ParseDuration(m.GracePeriod); err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid maintenance gracePeriod '%s': %v", m.GracePeriod, err)
+		}
+		if start.IsZero() {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("maintenance gracePeriod requires a startTime")
+		}
+	}
+	return start, end, gracePeriod, nil
+}
 
-	// Fetch all broker app configs
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get brokerappconfigs -n %s -o json", namespace))
-	output, err := cmd.Output()
+// Returns true if maintenance is enabled and the time is within the maintenance window.
+// An invalid window is ignored, the app is then in maintenance for as long as it is enabled.
+func (spec *AppConfigSpec) InMaintenance(now time.Time) bool {
+	if !spec.Maintenance.Enabled {
+		return false
+	}
+	start, end, _, err := spec.MaintenanceWindow()
 	if err != nil {
-		return appConfigs, err
+		return true
 	}
+	return !now.Before(start) && (end.IsZero() || now.Before(end))
+}
 
-	var items appConfigItems
-	err = json.Unmarshal(output, &items)
+// Returns the time after which running sessions are shut down for maintenance, zero if they keep running.
+func (spec *AppConfigSpec) MaintenanceSessionDeadline() time.Time {
+	if !spec.Maintenance.Enabled {
+		return time.Time{}
+	}
+	start, _, gracePeriod, err := spec.MaintenanceWindow()
+	if err != nil || gracePeriod == 0 {
+		return time.Time{}
+	}
+	return start.Add(gracePeriod)
+}
 
-	// Set default values
-	for i := range items.Items {
-		// Default app type to StatefulSet
-		if items.Items[i].Spec.Type == "" {
-			items.Items[i].Spec.Type = AppTypeStatefulSet
-		}
+// Returns the maintenance banner for the app, nil if maintenance is not enabled or has already ended.
+// Maintenance that is scheduled to start later is returned as inactive so that users can be warned ahead of time.
+func (spec *AppConfigSpec) MaintenanceStatus(now time.Time) *AppMaintenanceResponse {
+	if !spec.Maintenance.Enabled {
+		return nil
+	}
+	resp := &AppMaintenanceResponse{
+		Active:  spec.InMaintenance(now),
+		Message: spec.Maintenance.Message,
+	}
+	start, end, _, err := spec.MaintenanceWindow()
+	if err != nil {
+		return resp
+	}
+	if !end.IsZero() && !now.Before(end) {
+		return nil
+	}
+	if !start.IsZero() {
+		resp.StartTime = start.Format(time.RFC3339)
+	}
+	if !end.IsZero() {
+		resp.EndTime = end.Format(time.RFC3339)
+	}
+	if deadline := spec.MaintenanceSessionDeadline(); !deadline.IsZero() {
+		resp.SessionDeadline = deadline.Format(time.RFC3339)
+	}
+	return resp
+}
+
+// Returns the message for requests refused because the app is in maintenance.
+func (spec *AppConfigSpec) MaintenanceMessage() string {
+	msg := "app is in maintenance, new sessions are not allowed at this time"
+	if len(spec.Maintenance.Message) > 0 {
+		msg = fmt.Sprintf("%s: %s", msg, spec.Maintenance.Message)
+	}
+	if _, end, _, err := spec.MaintenanceWindow(); err == nil && !end.IsZero() {
+		msg = fmt.Sprintf("%s, expected to end at %s", msg, end.Format(time.RFC3339))
+	}
+	return msg
+}
 
-		// Default userBundles to empty list if not provided.
-		if items.Items[i].Spec.UserBundles == nil {
-			items.Items[i].Spec.UserBundles = make([]UserBundleSpec, 0)
+// Sets default values for fields omitted from the BrokerAppConfig spec.
+func (appConfig *AppConfigObject) SetDefaults() {
+	spec := &appConfig.Spec
+
+	// Default app type to StatefulSet
+	if spec.Type == "" {
+		spec.Type = AppTypeStatefulSet
+	}
+
+	// Default userBundles to empty list if not provided.
+	if spec.UserBundles == nil {
+		spec.UserBundles = make([]UserBundleSpec, 0)
+	}
+
+	if spec.Type == AppTypeDeployment {
+		// Default deployment selector to match app name.
+		if len(spec.Deployment.Selector) == 0 {
+			spec.Deployment.Selector = fmt.Sprintf("app=%s", spec.Name)
 		}
 
-		if items.Items[i].Spec.Type == AppTypeDeployment {
-			// Default deployment selector to match app name.
-			if len(items.Items[i].Spec.Deployment.Selector) == 0 {
-				items.Items[i].Spec.Deployment.Selector = fmt.Sprintf("app=%s", items.Items[i].Spec.Name)
-			}
-
-			if items.Items[i].Spec.Deployment.Replicas == nil {
-				// Default number of deployment replicas.
-				// This value is a pointer so that it can accept 0 as a valid value.
-				defaultReplicas := DefaultDeploymentReplicas
-				items.Items[i].Spec.Deployment.Replicas = &defaultReplicas
-			}
+		if spec.Deployment.Replicas == nil {
+			// Default number of deployment replicas.
+			// This value is a pointer so that it can accept 0 as a valid value.
+			defaultReplicas := DefaultDeploymentReplicas
+			spec.Deployment.Replicas = &defaultReplicas
 		}
 	}
-
-	return items.Items, err
 }
@@ -0,0 +1,100 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+	window := MaintenanceSpec{
+		Enabled:     true,
+		Message:     "upgrading",
+		StartTime:   start.Format(time.RFC3339),
+		EndTime:     end.Format(time.RFC3339),
+		GracePeriod: "30m",
+	}
+	scheduled := &AppMaintenanceResponse{
+		Message:         "upgrading",
+		StartTime:       "2021-06-01T10:00:00Z",
+		EndTime:         "2021-06-01T12:00:00Z",
+		SessionDeadline: "2021-06-01T10:30:00Z",
+	}
+	active := *scheduled
+	active.Active = true
+
+	tests := []struct {
+		name       string
+		spec       MaintenanceSpec
+		now        time.Time
+		wantActive bool
+		wantStatus *AppMaintenanceResponse
+	}{
+		{"disabled", MaintenanceSpec{StartTime: window.StartTime}, start, false, nil},
+		{"before window", window, start.Add(-time.Minute), false, scheduled},
+		{"window start", window, start, true, &active},
+		{"within window", window, end.Add(-time.Minute), true, &active},
+		{"window end", window, end, false, nil},
+		{"no window", MaintenanceSpec{Enabled: true, Message: "down"}, start, true, &AppMaintenanceResponse{Active: true, Message: "down"}},
+		{"open ended", MaintenanceSpec{Enabled: true, StartTime: window.StartTime}, end.Add(24 * time.Hour), true, &AppMaintenanceResponse{Active: true, StartTime: "2021-06-01T10:00:00Z"}},
+		{"invalid window", MaintenanceSpec{Enabled: true, StartTime: "tomorrow"}, start, true, &AppMaintenanceResponse{Active: true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := AppConfigSpec{Maintenance: tc.spec}
+			if got := spec.InMaintenance(tc.now); got != tc.wantActive {
+				t.Errorf("expected InMaintenance = %v, got %v", tc.wantActive, got)
+			}
+			if got := spec.MaintenanceStatus(tc.now); !reflect.DeepEqual(got, tc.wantStatus) {
+				t.Errorf("expected status %+v, got %+v", tc.wantStatus, got)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    MaintenanceSpec
+		wantErr bool
+	}{
+		{"empty", MaintenanceSpec{}, false},
+		{"valid", MaintenanceSpec{StartTime: "2021-06-01T10:00:00Z", EndTime: "2021-06-01T12:00:00+02:00", GracePeriod: "1h"}, false},
+		{"invalid start", MaintenanceSpec{StartTime: "2021-06-01 10:00"}, true},
+		{"invalid end", MaintenanceSpec{EndTime: "noon"}, true},
+		{"invalid grace period", MaintenanceSpec{StartTime: "2021-06-01T10:00:00Z", GracePeriod: "1 hour"}, true},
+		{"grace period without start", MaintenanceSpec{GracePeriod: "1h"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := AppConfigSpec{Maintenance: tc.spec}
+			if _, _, _, err := spec.MaintenanceWindow(); (err != nil) != tc.wantErr {
+				t.Errorf("expected error: %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	// Sessions only have a deadline when a grace period is set.
+	spec := AppConfigSpec{Maintenance: MaintenanceSpec{Enabled: true, StartTime: "2021-06-01T10:00:00Z"}}
+	if deadline := spec.MaintenanceSessionDeadline(); !deadline.IsZero() {
+		t.Errorf("expected no session deadline without a grace period, got %v", deadline)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// API version of the BrokerAppConfig with the grouped spec sections.
+// The v1 ApiVersion is the storage version and the one the brokers read, v2 objects are converted by the broker-webhook.
+const ApiVersionV2 = "gcp.solutions/v2"
+
+// Spec of the v2 BrokerAppConfig, the flat v1 access, user option, image and lifecycle fields are grouped into sections.
+type AppConfigSpecV2 struct {
+	Type        AppType            `yaml:"type" json:"type"`
+	Name        string             `yaml:"name" json:"name"`
+	Metadata    map[string]string  `yaml:"metadata" json:"metadata"`
+	DisplayName string             `yaml:"displayName" json:"displayName"`
+	Description string             `yaml:"description" json:"description"`
+	Icon        string             `yaml:"icon,omitempty" json:"icon,omitempty"`
+	LaunchURL   string             `yaml:"launchURL,omitempty" json:"launchURL,omitempty"`
+	Disabled    bool               `yaml:"disabled" json:"disabled"`
+	Version     string             `yaml:"version" json:"version"`
+	Deployment  DeploymentTypeSpec `yaml:"deployment" json:"deployment"`
+	Bundle      BundleSpec         `yaml:"bundle" json:"bundle"`
+	UserBundles []UserBundleSpec   `yaml:"userBundles" json:"userBundles"`
+	ServiceName string             `yaml:"serviceName" json:"serviceName"`
+	NodeTiers   []NodeTierSpec     `yaml:"nodeTiers,omitempty" json:"nodeTiers,omitempty"`
+	DefaultTier string             `yaml:"defaultTier,omitempty" json:"defaultTier,omitempty"`
+	AppParams   []AppConfigParam   `yaml:"appParams" json:"appParams"`
+	AppEnv      []AppEnvSpec       `yaml:"appEnv" json:"appEnv"`
+	Quota       AppQuotaSpec       `yaml:"quota,omitempty" json:"quota,omitempty"`
+	WaitQueue   WaitQueueSpec      `yaml:"waitQueue,omitempty" json:"waitQueue,omitempty"`
+	Access      AppAccessSpec      `yaml:"access" json:"access"`
+	UserOptions AppUserOptionsSpec `yaml:"userOptions" json:"userOptions"`
+	Images      AppImagesSpec      `yaml:"images" json:"images"`
+	Lifecycle   AppLifecycleSpec   `yaml:"lifecycle" json:"lifecycle"`
+}
+
+// Who can launch, edit and configure the app.
+type AppAccessSpec struct {
+	AuthorizedUsers   []string       `yaml:"authorizedUsers" json:"authorizedUsers"`
+	Authorization     AuthZUsersSpec `yaml:"authorization" json:"authorization"`
+	Editors           []string       `yaml:"editors" json:"editors"`
+	UserConfigWriters []string       `yaml:"userConfigWriters,omitempty" json:"userConfigWriters,omitempty"`
+}
+
+// The options users can set in their BrokerAppUserConfig.
+type AppUserOptionsSpec struct {
+	Disabled        bool             `yaml:"disabled" json:"disabled"`
+	Params          []AppConfigParam `yaml:"params" json:"params"`
+	EnforceWritable bool             `yaml:"enforceWritable" json:"enforceWritable"`
+	WritableFields  []string         `yaml:"writableFields" json:"writableFields"`
+	WritableParams  []string         `yaml:"writableParams" json:"writableParams"`
+}
+
+// The default app image and the image overrides.
+type AppImagesSpec struct {
+	DefaultRepo string                  `yaml:"defaultRepo" json:"defaultRepo"`
+	DefaultTag  string                  `yaml:"defaultTag" json:"defaultTag"`
+	Overrides   map[string]AppImageSpec `yaml:"overrides,omitempty" json:"overrides,omitempty"`
+}
+
+// Session timeouts, shutdown hooks and the session data kept across launches.
+type AppLifecycleSpec struct {
+	IdleTimeout        string             `yaml:"idleTimeout,omitempty" json:"idleTimeout,omitempty"`
+	MaxSessionDuration string             `yaml:"maxSessionDuration,omitempty" json:"maxSessionDuration,omitempty"`
+	ShutdownHooks      []ShutdownHookSpec `yaml:"shutdownHooks" json:"shutdownHooks"`
+	Maintenance        MaintenanceSpec    `yaml:"maintenance,omitempty" json:"maintenance,omitempty"`
+	Snapshots          SnapshotSpec       `yaml:"snapshots,omitempty" json:"snapshots,omitempty"`
+	HomeVolume         HomeVolumeSpec     `yaml:"homeVolume,omitempty" json:"homeVolume,omitempty"`
+}
+
+// Converts the v1 spec to v2, every v1 field has a v2 field so the conversion is lossless.
+func ConvertAppConfigSpecToV2(spec AppConfigSpec) AppConfigSpecV2 {
+	return AppConfigSpecV2{
+		Type:        spec.Type,
+		Name:        spec.Name,
+		Metadata:    spec.Metadata,
+		DisplayName: spec.DisplayName,
+		Description: spec.Description,
+		Icon:        spec.Icon,
+		LaunchURL:   spec.LaunchURL,
+		Disabled:    spec.Disabled,
+		Version:     spec.Version,
+		Deployment:  spec.Deployment,
+		Bundle:      spec.Bundle,
+		UserBundles: spec.UserBundles,
+		ServiceName: spec.ServiceName,
+		NodeTiers:   spec.NodeTiers,
+		DefaultTier: spec.DefaultTier,
+		AppParams:   spec.AppParams,
+		AppEnv:      spec.AppEnv,
+		Quota:       spec.Quota,
+		WaitQueue:   spec.WaitQueue,
+		Access: AppAccessSpec{
+			AuthorizedUsers:   spec.AuthorizedUsers,
+			Authorization:     spec.Authorization,
+			Editors:           spec.Editors,
+			UserConfigWriters: spec.UserConfigWriters,
+		},
+		UserOptions: AppUserOptionsSpec{
+			Disabled:        spec.DisableOptions,
+			Params:          spec.UserParams,
+			EnforceWritable: spec.EnableUserConfigAuth,
+			WritableFields:  spec.UserWritableFields,
+			WritableParams:  spec.UserWritableParams,
+		},
+		Images: AppImagesSpec{
+			DefaultRepo: spec.DefaultRepo,
+			DefaultTag:  spec.DefaultTag,
+			Overrides:   spec.Images,
+		},
+		Lifecycle: AppLifecycleSpec{
+			IdleTimeout:        spec.IdleTimeout,
+			MaxSessionDuration: spec.MaxSessionDuration,
+			ShutdownHooks:      spec.ShutdownHooks,
+			Maintenance:        spec.Maintenance,
+			Snapshots:          spec.Snapshots,
+			HomeVolume:         spec.HomeVolume,
+		},
+	}
+}
+
+// Converts the v2 spec to v1.
+func ConvertAppConfigSpecFromV2(spec AppConfigSpecV2) AppConfigSpec {
+	return AppConfigSpec{
+		Type:                 spec.Type,
+		Name:                 spec.Name,
+		Metadata:             spec.Metadata,
+		DisplayName:          spec.DisplayName,
+		Description:          spec.Description,
+		Icon:                 spec.Icon,
+		LaunchURL:            spec.LaunchURL,
+		Disabled:             spec.Disabled,
+		Version:              spec.Version,
+		Deployment:           spec.Deployment,
+		Bundle:               spec.Bundle,
+		DefaultRepo:          spec.Images.DefaultRepo,
+		DefaultTag:           spec.Images.DefaultTag,
+		Images:               spec.Images.Overrides,
+		NodeTiers:            spec.NodeTiers,
+		DefaultTier:          spec.DefaultTier,
+		ServiceName:          spec.ServiceName,
+		UserParams:           spec.UserOptions.Params,
+		EnableUserConfigAuth: spec.UserOptions.EnforceWritable,
+		UserWritableFields:   spec.UserOptions.WritableFields,
+		UserWritableParams:   spec.UserOptions.WritableParams,
+		UserConfigWriters:    spec.Access.UserConfigWriters,
+		AppParams:            spec.AppParams,
+		AppEnv:               spec.AppEnv,
+		ShutdownHooks:        spec.Lifecycle.ShutdownHooks,
+		Editors:              spec.Access.Editors,
+		AuthorizedUsers:      spec.Access.AuthorizedUsers,
+		Authorization:        spec.Access.Authorization,
+		DisableOptions:       spec.UserOptions.Disabled,
+		UserBundles:          spec.UserBundles,
+		IdleTimeout:          spec.Lifecycle.IdleTimeout,
+		MaxSessionDuration:   spec.Lifecycle.MaxSessionDuration,
+		Quota:                spec.Quota,
+		WaitQueue:            spec.WaitQueue,
+		Maintenance:          spec.Lifecycle.Maintenance,
+		Snapshots:            spec.Lifecycle.Snapshots,
+		HomeVolume:           spec.Lifecycle.HomeVolume,
+	}
+}
+
+/*
+Converts the BrokerAppConfig object to the desired API version.
+Only the spec is converted, the metadata and status are the same in all versions.
+*/
+func ConvertBrokerAppConfig(obj map[string]interface{}, desiredAPIVersion string) (map[string]interface{}, error) {
+	apiVersion, _ := obj["apiVersion"].(string)
+	if apiVersion != ApiVersion && apiVersion != ApiVersionV2 {
+		return nil, fmt.Errorf("unsupported BrokerAppConfig apiVersion: '%s'", apiVersion)
+	}
+	if desiredAPIVersion != ApiVersion && desiredAPIVersion != ApiVersionV2 {
+		return nil, fmt.Errorf("unsupported desired BrokerAppConfig apiVersion: '%s'", desiredAPIVersion)
+	}
+
+	resp := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		resp[k] = v
+	}
+	resp["apiVersion"] = desiredAPIVersion
+	if apiVersion == desiredAPIVersion {
+		return resp, nil
+	}
+
+	specData, err := json.Marshal(obj["spec"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode BrokerAppConfig spec: %v", err)
+	}
+	var spec interface{}
+	if desiredAPIVersion == ApiVersionV2 {
+		var specV1 AppConfigSpec
+		if err := json.Unmarshal(specData, &specV1); err != nil {
+			return nil, fmt.Errorf("failed to parse %s BrokerAppConfig spec: %v", apiVersion, err)
+		}
+		specV2 := ConvertAppConfigSpecToV2(specV1)
+		spec = &specV2
+	} else {
+		var specV2 AppConfigSpecV2
+		if err := json.Unmarshal(specData, &specV2); err != nil {
+			return nil, fmt.Errorf("failed to parse %s BrokerAppConfig spec: %v", apiVersion, err)
+		}
+		specV1 := ConvertAppConfigSpecFromV2(specV2)
+		spec = &specV1
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert BrokerAppConfig spec: %v", err)
+	}
+	resp["spec"] = dropEmptyValues(content)
+	return resp, nil
+}
+
+// Removes the null values, empty strings and the objects left empty by removing them, they decode to the same Go values.
+// Empty arrays and objects that were empty to begin with are kept, a nil authorizedUsers does not restrict the app while
+// an empty one does, and an empty node tier resources.requests is not the same as none in templates.
+// The zero values of the other version would otherwise fail the schema, like the empty type enum.
+func dropEmptyValues(obj map[string]interface{}) map[string]interface{} {
+	for k, v := range obj {
+		switch t := v.(type) {
+		case nil:
+			delete(obj, k)
+		case string:
+			if len(t) == 0 {
+				delete(obj, k)
+			}
+		case map[string]interface{}:
+			if len(t) > 0 && len(dropEmptyValues(t)) == 0 {
+				delete(obj, k)
+			}
+		case []interface{}:
+			for _, item := range t {
+				if m, ok := item.(map[string]interface{}); ok {
+					dropEmptyValues(m)
+				}
+			}
+		}
+	}
+	return obj
+}
+
+// ConversionReview of the apiextensions.k8s.io/v1 API, sent by the API server to the CRD conversion webhook.
+type ConversionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *ConversionRequest  `json:"request,omitempty"`
+	Response        *ConversionResponse `json:"response,omitempty"`
+}
+
+type ConversionRequest struct {
+	UID               types.UID              `json:"uid"`
+	DesiredAPIVersion string                 `json:"desiredAPIVersion"`
+	Objects           []runtime.RawExtension `json:"objects"`
+}
+
+type ConversionResponse struct {
+	UID              types.UID              `json:"uid"`
+	ConvertedObjects []runtime.RawExtension `json:"convertedObjects"`
+	Result           metav1.Status          `json:"result"`
+}
+
+// Converts all objects in the request, the conversion fails if any object can not be converted.
+func ConvertBrokerAppConfigs(req *ConversionRequest) *ConversionResponse {
+	resp := &ConversionResponse{
+		UID:              req.UID,
+		ConvertedObjects: make([]runtime.RawExtension, 0, len(req.Objects)),
+	}
+	for _, raw := range req.Objects {
+		// Integers are decoded as int64, not float64, so that they convert without loss of precision.
+		var obj map[string]interface{}
+		if err := utiljson.Unmarshal(raw.Raw, &obj); err != nil {
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: fmt.Sprintf("failed to parse object: %v", err)}
+			resp.ConvertedObjects = nil
+			return resp
+		}
+		converted, err := ConvertBrokerAppConfig(obj, req.DesiredAPIVersion)
+		if err != nil {
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			resp.ConvertedObjects = nil
+			return resp
+		}
+		data, err := json.Marshal(converted)
+		if err != nil {
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: fmt.Sprintf("failed to encode converted object: %v", err)}
+			resp.ConvertedObjects = nil
+			return resp
+		}
+		resp.ConvertedObjects = append(resp.ConvertedObjects, runtime.RawExtension{Raw: data})
+	}
+	resp.Result = metav1.Status{Status: metav1.StatusSuccess}
+	return resp
+}
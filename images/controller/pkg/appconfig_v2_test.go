@@ -0,0 +1,220 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// Larger than the integers a float64 holds exactly, so that a conversion through float64 changes it.
+const conversionTestInt = 1<<53 + 1
+
+// Sets every exported field of the value, so that a field missing from the conversion fails the round trip.
+func fillConversionTestValue(v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(path)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(conversionTestInt)
+	case reflect.Int32:
+		v.SetInt(42)
+	case reflect.Float64:
+		v.SetFloat(0.25)
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(path))
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillConversionTestValue(v.Elem(), path)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillConversionTestValue(v.Index(0), path+"[0]")
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillConversionTestValue(elem, path+".value")
+		v.SetMapIndex(reflect.ValueOf(path+".key").Convert(v.Type().Key()), elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				fillConversionTestValue(v.Field(i), fmt.Sprintf("%s.%s", path, v.Type().Field(i).Name))
+			}
+		}
+	}
+}
+
+// Converts the object with ConvertBrokerAppConfigs and returns the converted object.
+func convertTestObject(t *testing.T, obj map[string]interface{}, desiredAPIVersion string) map[string]interface{} {
+	t.Helper()
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := ConvertBrokerAppConfigs(&ConversionRequest{
+		UID:               "1234",
+		DesiredAPIVersion: desiredAPIVersion,
+		Objects:           []runtime.RawExtension{{Raw: raw}},
+	})
+	if resp.Result.Status != metav1.StatusSuccess || len(resp.ConvertedObjects) != 1 {
+		t.Fatalf("conversion to %s failed: %+v", desiredAPIVersion, resp.Result)
+	}
+	var converted map[string]interface{}
+	if err := utiljson.Unmarshal(resp.ConvertedObjects[0].Raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted["apiVersion"] != desiredAPIVersion {
+		t.Errorf("expected apiVersion %s, got %v", desiredAPIVersion, converted["apiVersion"])
+	}
+	return converted
+}
+
+// Returns the BrokerAppConfig object with the spec, as the API server sends it to the webhook.
+func newConversionTestObject(t *testing.T, apiVersion string, spec interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Integers are decoded as int64 like the webhook does, encoding/json would round them through float64.
+	var specObj map[string]interface{}
+	if err := utiljson.Unmarshal(data, &specObj); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       BrokerAppConfigKind,
+		"metadata":   map[string]interface{}{"name": "desktop", "namespace": "pod-broker-system"},
+		"spec":       specObj,
+		"status":     map[string]interface{}{"lastSyncTime": "2021-06-01T10:00:00Z"},
+	}
+}
+
+// Decodes the spec of the converted object into the v1 or v2 spec.
+func decodeConvertedSpec(t *testing.T, obj map[string]interface{}, spec interface{}) {
+	t.Helper()
+	data, err := json.Marshal(obj["spec"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, spec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvertBrokerAppConfigsRoundTrip(t *testing.T) {
+	t.Run("v1 to v2 to v1", func(t *testing.T) {
+		var spec AppConfigSpec
+		fillConversionTestValue(reflect.ValueOf(&spec).Elem(), "spec")
+		spec.Type = AppTypeDeployment
+
+		obj := newConversionTestObject(t, ApiVersion, spec)
+		v2 := convertTestObject(t, obj, ApiVersionV2)
+		v1 := convertTestObject(t, v2, ApiVersion)
+
+		var got AppConfigSpec
+		decodeConvertedSpec(t, v1, &got)
+		if !reflect.DeepEqual(got, spec) {
+			want, _ := json.Marshal(spec)
+			gotData, _ := json.Marshal(got)
+			t.Errorf("round trip changed the spec:\nwant: %s\ngot:  %s", want, gotData)
+		}
+		if !reflect.DeepEqual(v1["metadata"], obj["metadata"]) || !reflect.DeepEqual(v1["status"], obj["status"]) {
+			t.Errorf("expected metadata and status to be kept, got %v, %v", v1["metadata"], v1["status"])
+		}
+	})
+
+	t.Run("v2 to v1 to v2", func(t *testing.T) {
+		var spec AppConfigSpecV2
+		fillConversionTestValue(reflect.ValueOf(&spec).Elem(), "spec")
+		spec.Type = AppTypeStatefulSet
+
+		v1 := convertTestObject(t, newConversionTestObject(t, ApiVersionV2, spec), ApiVersion)
+		v2 := convertTestObject(t, v1, ApiVersionV2)
+
+		var got AppConfigSpecV2
+		decodeConvertedSpec(t, v2, &got)
+		if !reflect.DeepEqual(got, spec) {
+			want, _ := json.Marshal(spec)
+			gotData, _ := json.Marshal(got)
+			t.Errorf("round trip changed the spec:\nwant: %s\ngot:  %s", want, gotData)
+		}
+	})
+}
+
+func TestConvertBrokerAppConfigsEmptyValues(t *testing.T) {
+	// A nil authorizedUsers does not restrict the app, an empty one denies everyone.
+	tests := []struct {
+		name            string
+		authorizedUsers []string
+	}{
+		{"nil authorizedUsers", nil},
+		{"empty authorizedUsers", []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := AppConfigSpec{
+				Name:            "desktop",
+				AuthorizedUsers: tc.authorizedUsers,
+				NodeTiers:       []NodeTierSpec{{Name: "standard", Resources: NodeResourceRequestSpec{Requests: &NodeResource{}}}},
+			}
+			v2 := convertTestObject(t, newConversionTestObject(t, ApiVersion, spec), ApiVersionV2)
+
+			// The empty type is not a valid value of the v2 enum, empty strings are left out.
+			specV2 := v2["spec"].(map[string]interface{})
+			if _, ok := specV2["type"]; ok {
+				t.Errorf("expected empty type to be left out, got %v", specV2["type"])
+			}
+			if _, ok := specV2["images"]; ok {
+				t.Errorf("expected images left empty to be left out, got %v", specV2["images"])
+			}
+			if disabled, ok := specV2["disabled"]; !ok || disabled != false {
+				t.Errorf("expected false values to be kept, got %v", disabled)
+			}
+
+			var got AppConfigSpec
+			decodeConvertedSpec(t, convertTestObject(t, v2, ApiVersion), &got)
+			if (got.AuthorizedUsers == nil) != (tc.authorizedUsers == nil) || len(got.AuthorizedUsers) != 0 {
+				t.Errorf("expected authorizedUsers %#v, got %#v", tc.authorizedUsers, got.AuthorizedUsers)
+			}
+			// Templates check if the tier sets requests, the empty requests are kept.
+			if resources := got.NodeTiers[0].Resources; resources.Requests == nil || resources.Limits != nil {
+				t.Errorf("expected empty requests and no limits, got %+v", resources)
+			}
+		})
+	}
+}
+
+func TestConvertBrokerAppConfigsErrors(t *testing.T) {
+	obj := newConversionTestObject(t, "gcp.solutions/v3", AppConfigSpec{Name: "desktop"})
+	raw, _ := json.Marshal(obj)
+	resp := ConvertBrokerAppConfigs(&ConversionRequest{
+		UID:               "1234",
+		DesiredAPIVersion: ApiVersion,
+		Objects:           []runtime.RawExtension{{Raw: raw}},
+	})
+	if resp.Result.Status != metav1.StatusFailure || resp.ConvertedObjects != nil || resp.UID != "1234" {
+		t.Errorf("expected failure for an unsupported apiVersion, got %+v", resp)
+	}
+}
@@ -17,13 +17,9 @@
 package pod_broker
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
-
-	"gopkg.in/yaml.v2"
 )
 
 func (cm *ConfigMapObject) SaveDataToDirectory(destDir string) error {
@@ -39,37 +35,3 @@ func (cm *ConfigMapObject) SaveDataToDirectory(destDir string) error {
 	}
 	return nil
 }
-
-func GetConfigMaps(namespace string) ([]ConfigMapObject, error) {
-	objs := make([]ConfigMapObject, 0)
-
-	type configMapItems struct {
-		Items []ConfigMapObject `yaml:"items,omitempty"`
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get configmaps -n %s -o yaml", namespace))
-	output, err := cmd.Output()
-	if err != nil {
-		return objs, err
-	}
-
-	var items configMapItems
-	err = yaml.Unmarshal(output, &items)
-	if err != nil {
-		return objs, err
-	}
-	if items.Items == nil {
-		// Possible single-value query.
-		var obj ConfigMapObject
-		err = yaml.Unmarshal(output, &obj)
-		if err != nil {
-			return objs, err
-		}
-		objs = append(objs, obj)
-	} else {
-		for _, item := range items.Items {
-			objs = append(objs, item)
-		}
-	}
-	return objs, err
-}
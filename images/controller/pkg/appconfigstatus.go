@@ -0,0 +1,174 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+)
+
+// Types of the BrokerAppConfig status conditions.
+// BundleFound, AuthzFound and Registered are written by the app-finder, ManifestsApplied by the reservation-broker.
+const (
+	AppConditionBundleFound      = "BundleFound"
+	AppConditionAuthzFound       = "AuthzFound"
+	AppConditionRegistered       = "Registered"
+	AppConditionManifestsApplied = "ManifestsApplied"
+)
+
+// Values of the condition status.
+const (
+	AppConditionTrue  = "True"
+	AppConditionFalse = "False"
+)
+
+// Period which to refresh the status lastSyncTime when the conditions have not changed.
+const AppConfigStatusSyncPeriod = 60 * time.Second
+
+// Returns the condition of the given type, nil if it is not set.
+func (s *AppConfigStatus) GetCondition(condType string) *AppConfigCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == condType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Sets the condition, the lastTransitionTime only changes when the condition status does.
+func (s *AppConfigStatus) SetCondition(cond AppConfigCondition, now time.Time) {
+	cond.LastTransitionTime = now.UTC().Format(time.RFC3339)
+	if prev := s.GetCondition(cond.Type); prev != nil {
+		if prev.Status == cond.Status {
+			cond.LastTransitionTime = prev.LastTransitionTime
+		}
+		*prev = cond
+		return
+	}
+	s.Conditions = append(s.Conditions, cond)
+}
+
+// Returns a condition with the status True if ok is true, False otherwise.
+func NewAppConfigCondition(condType string, ok bool, reason, message string) AppConfigCondition {
+	status := AppConditionFalse
+	if ok {
+		status = AppConditionTrue
+	}
+	return AppConfigCondition{
+		Type:    condType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+// Update of the status fields owned by a broker component, zero values are left unchanged.
+type AppConfigStatusUpdate struct {
+	ObservedGeneration int64
+	AppliedChecksum    string
+	Conditions         []AppConfigCondition
+}
+
+// AppConfigStatusWriter writes the status of the BrokerAppConfigs through the status subresource.
+// Each broker component writes its own conditions, the conditions of other components are preserved.
+// Writes are skipped while the update is the same as the last one written, until the AppConfigStatusSyncPeriod has passed.
+type AppConfigStatusWriter struct {
+	sync.Mutex
+	client    ClusterClient
+	namespace string
+	written   map[string]appConfigStatusWrite
+}
+
+type appConfigStatusWrite struct {
+	key  string
+	time time.Time
+}
+
+func NewAppConfigStatusWriter(client ClusterClient, namespace string) *AppConfigStatusWriter {
+	return &AppConfigStatusWriter{
+		client:    client,
+		namespace: namespace,
+		written:   make(map[string]appConfigStatusWrite, 0),
+	}
+}
+
+// Writes the update to the status of the named BrokerAppConfig, a missing BrokerAppConfig is not an error.
+func (w *AppConfigStatusWriter) Update(name string, update AppConfigStatusUpdate) error {
+	key := fmt.Sprintf("%d/%s/%v", update.ObservedGeneration, update.AppliedChecksum, update.Conditions)
+	now := time.Now()
+
+	w.Lock()
+	defer w.Unlock()
+	if prev, ok := w.written[name]; ok && prev.key == key && now.Sub(prev.time) < AppConfigStatusSyncPeriod {
+		return nil
+	}
+
+	resource := w.client.Dynamic().Resource(BrokerAppConfigGVR).Namespace(w.namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resource.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var appConfig AppConfigObject
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &appConfig); err != nil {
+			return fmt.Errorf("failed to convert BrokerAppConfig %s: %v", name, err)
+		}
+
+		status := appConfig.Status
+		for _, cond := range update.Conditions {
+			status.SetCondition(cond, now)
+		}
+		if update.ObservedGeneration > 0 {
+			status.ObservedGeneration = update.ObservedGeneration
+		}
+		if len(update.AppliedChecksum) > 0 {
+			status.AppliedChecksum = update.AppliedChecksum
+		}
+		status.LastSyncTime = now.UTC().Format(time.RFC3339)
+
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return fmt.Errorf("failed to convert BrokerAppConfig %s status: %v", name, err)
+		}
+		obj.Object["status"] = content
+		_, err = resource.UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		delete(w.written, name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update BrokerAppConfig %s status: %v", name, err)
+	}
+	w.written[name] = appConfigStatusWrite{key: key, time: now}
+	return nil
+}
+
+// Forgets the last write for the named BrokerAppConfig, so that the next update is written.
+func (w *AppConfigStatusWriter) Remove(name string) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.written, name)
+}
@@ -0,0 +1,252 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/restmapper"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+)
+
+// Field manager used for server-side apply of broker managed objects.
+const BrokerFieldManager = "pod-broker"
+
+// Result of applying a single object.
+type ObjectApplyResult struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Error     error  `json:"-"`
+}
+
+func (r ObjectApplyResult) String() string {
+	if len(r.Namespace) > 0 {
+		return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+	}
+	return fmt.Sprintf("%s %s", r.Kind, r.Name)
+}
+
+// ApplyError is returned when one or more objects failed to apply.
+// Objects that applied successfully are not included.
+type ApplyError struct {
+	Failed []ObjectApplyResult
+}
+
+func (e *ApplyError) Error() string {
+	msgs := make([]string, 0)
+	for _, r := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", r.String(), r.Error))
+	}
+	return fmt.Sprintf("failed to apply %d object(s): %s", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// ApplyEngine renders kustomize bundles and applies the objects using server-side apply.
+type ApplyEngine struct {
+	client       ClusterClient
+	mapper       *restmapper.DeferredDiscoveryRESTMapper
+	FieldManager string
+	// Namespace for namespaced objects that do not set one, like kubectl run in the broker pod.
+	Namespace string
+}
+
+func NewApplyEngine(client ClusterClient, fieldManager, namespace string) *ApplyEngine {
+	discoveryClient := memory.NewMemCacheClient(client.Kubernetes().Discovery())
+	return &ApplyEngine{
+		client:       client,
+		mapper:       restmapper.NewDeferredDiscoveryRESTMapper(discoveryClient),
+		FieldManager: fieldManager,
+		Namespace:    namespace,
+	}
+}
+
+// Builds the kustomization in srcDir and returns the rendered objects.
+func RenderKustomization(srcDir string) ([]*unstructured.Unstructured, error) {
+	resp := make([]*unstructured.Unstructured, 0)
+
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resMap, err := k.Run(filesys.MakeFsOnDisk(), srcDir)
+	if err != nil {
+		return resp, fmt.Errorf("error running kustomize build on directory %s: %v", srcDir, err)
+	}
+
+	for _, res := range resMap.Resources() {
+		m, err := res.Map()
+		if err != nil {
+			return resp, fmt.Errorf("failed to convert resource %s: %v", res.CurId(), err)
+		}
+		resp = append(resp, &unstructured.Unstructured{Object: m})
+	}
+
+	return resp, nil
+}
+
+// Decodes all objects from a multi-document YAML or JSON stream.
+func DecodeObjects(r io.Reader) ([]*unstructured.Unstructured, error) {
+	resp := make([]*unstructured.Unstructured, 0)
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err == io.EOF {
+			break
+		} else if err != nil {
+			return resp, err
+		}
+		if len(obj.Object) == 0 {
+			// Skip empty documents.
+			continue
+		}
+		resp = append(resp, obj)
+	}
+	return resp, nil
+}
+
+// Renders the kustomization in srcDir and applies all objects.
+func (ae *ApplyEngine) ApplyKustomization(srcDir string) ([]ObjectApplyResult, error) {
+	objs, err := RenderKustomization(srcDir)
+	if err != nil {
+		return nil, err
+	}
+	return ae.ApplyObjects(objs)
+}
+
+// Applies all of the objects in the given file, or in all .yaml, .yml and .json files if the path is a directory.
+func (ae *ApplyEngine) ApplyPath(srcPath string) ([]ObjectApplyResult, error) {
+	files := []string{srcPath}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files = make([]string, 0)
+		for _, ext := range []string{"*.yaml", "*.yml", "*.json"} {
+			matches, err := filepath.Glob(filepath.Join(srcPath, ext))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+	}
+
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fileObjs, err := DecodeObjects(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode objects in %s: %v", f, err)
+		}
+		objs = append(objs, fileObjs...)
+	}
+
+	return ae.ApplyObjects(objs)
+}
+
+// Applies each object with server-side apply.
+// All objects are attempted, if any fail an *ApplyError is returned with the per-object errors.
+func (ae *ApplyEngine) ApplyObjects(objs []*unstructured.Unstructured) ([]ObjectApplyResult, error) {
+	results := make([]ObjectApplyResult, 0)
+	failed := make([]ObjectApplyResult, 0)
+
+	for _, obj := range objs {
+		res := ObjectApplyResult{
+			Kind:      obj.GetKind(),
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+		}
+		res.Error = ae.applyObject(obj)
+		if res.Error != nil {
+			failed = append(failed, res)
+		}
+		results = append(results, res)
+	}
+
+	if len(failed) > 0 {
+		return results, &ApplyError{Failed: failed}
+	}
+	return results, nil
+}
+
+func (ae *ApplyEngine) applyObject(obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := ae.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// Kind may have been registered by a CRD since the discovery cache was populated.
+		ae.mapper.Reset()
+		mapping, err = ae.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find resource for %s: %v", gvk.String(), err)
+	}
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	// Force is used so that fields previously owned by 'kubectl apply' are taken over by the broker.
+	force := true
+	opts := metav1.PatchOptions{
+		FieldManager: ae.FieldManager,
+		Force:        &force,
+	}
+
+	resource := ae.client.Dynamic().Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace := obj.GetNamespace()
+		if len(namespace) == 0 {
+			namespace = ae.Namespace
+		}
+		_, err = resource.Namespace(namespace).Patch(context.TODO(), obj.GetName(), types.ApplyPatchType, data, opts)
+	} else {
+		_, err = resource.Patch(context.TODO(), obj.GetName(), types.ApplyPatchType, data, opts)
+	}
+	return err
+}
+
+// Helper to log the result of an apply, including each object that failed.
+func LogApplyError(prefix string, err error) {
+	if applyErr, ok := err.(*ApplyError); ok {
+		log.Printf("%s: %d object(s) failed to apply", prefix, len(applyErr.Failed))
+		for _, r := range applyErr.Failed {
+			log.Printf("%s:   %s: %v", prefix, r.String(), r.Error)
+		}
+		return
+	}
+	log.Printf("%s: %v", prefix, err)
+}
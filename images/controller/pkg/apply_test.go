@@ -0,0 +1,105 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+const applyTestManifest = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: desktop
+  namespace: user-1234
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: user-1234
+---
+apiVersion: example.com/v1
+kind: Unknown
+metadata:
+  name: unknown
+`
+
+func TestApplyObjects(t *testing.T) {
+	objs, err := broker.DecodeObjects(strings.NewReader(applyTestManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 4 {
+		t.Fatalf("expected 4 objects, got %d", len(objs))
+	}
+
+	client := brokertest.NewFakeClusterClient()
+	// The fake tracker does not support apply patches of unstructured objects, the patched object is returned as is.
+	client.Dynamic().(*dynamicfake.FakeDynamicClient).PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := &unstructured.Unstructured{}
+		err := obj.UnmarshalJSON(action.(k8stesting.PatchAction).GetPatch())
+		return true, obj, err
+	})
+	ae := broker.NewApplyEngine(client, "pod-broker", "broker-ns")
+	results, err := ae.ApplyObjects(objs)
+
+	// The other objects are applied when one fails.
+	applyErr, ok := err.(*broker.ApplyError)
+	if !ok || len(applyErr.Failed) != 1 || applyErr.Failed[0].Kind != "Unknown" {
+		t.Fatalf("expected only the unknown kind to fail, got %v", err)
+	}
+	if len(results) != 4 {
+		t.Errorf("expected a result for each object, got %v", results)
+	}
+
+	// Namespaced objects without a namespace are applied to the broker namespace, not default.
+	want := map[string]string{"configmaps/settings": "broker-ns", "services/desktop": "user-1234", "namespaces/user-1234": ""}
+	for _, action := range client.Dynamic().(*dynamicfake.FakeDynamicClient).Actions() {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok {
+			continue
+		}
+		key := action.GetResource().Resource + "/" + patch.GetName()
+		namespace, ok := want[key]
+		if !ok {
+			t.Errorf("unexpected patch of %s", key)
+			continue
+		}
+		if action.GetNamespace() != namespace || patch.GetPatchType() != types.ApplyPatchType {
+			t.Errorf("expected %s to be applied in namespace '%s', got %s patch in '%s'", key, namespace, patch.GetPatchType(), action.GetNamespace())
+		}
+		delete(want, key)
+	}
+	if len(want) > 0 {
+		t.Errorf("expected objects to be applied: %v", want)
+	}
+}
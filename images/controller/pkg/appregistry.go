@@ -0,0 +1,277 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period between checks of the registered apps manifest file for changes.
+const appRegistryPollPeriod = 1 * time.Second
+
+// Consistent view of the registered apps, the NetworkPolicyData and the compiled app policies at one generation.
+// Snapshots are shared between readers and must not be modified.
+type AppRegistrySnapshot struct {
+	RegisteredAppsManifest
+	Policies map[string]AppAuthzPolicies
+}
+
+func newAppRegistrySnapshot(manifest RegisteredAppsManifest) *AppRegistrySnapshot {
+	if manifest.Apps == nil {
+		manifest.Apps = make(map[string]AppConfigSpec, 0)
+	}
+	policies := make(map[string]AppAuthzPolicies, len(manifest.Apps))
+	for name, app := range manifest.Apps {
+		policies[name] = NewAppAuthzPolicies(app)
+
+		// Compile the quota group patterns once per generation, invalid patterns are reported by the app validation.
+		app.Quota.Groups, _ = CompileQuotaGroups(app.Quota.Groups)
+		manifest.Apps[name] = app
+	}
+	return &AppRegistrySnapshot{
+		RegisteredAppsManifest: manifest,
+		Policies:               policies,
+	}
+}
+
+// Returns a snapshot at the same generation with only the apps of the given type.
+func (s *AppRegistrySnapshot) OfType(appType AppType) *AppRegistrySnapshot {
+	if appType == AppTypeAll {
+		return s
+	}
+	resp := &AppRegistrySnapshot{
+		RegisteredAppsManifest: RegisteredAppsManifest{
+			Generation:        s.Generation,
+			Apps:              make(map[string]AppConfigSpec, 0),
+			NetworkPolicyData: s.NetworkPolicyData,
+		},
+		Policies: make(map[string]AppAuthzPolicies, 0),
+	}
+	for name, app := range s.Apps {
+		if app.Type == appType {
+			resp.Apps[name] = app
+			resp.Policies[name] = s.Policies[name]
+		}
+	}
+	return resp
+}
+
+// AppRegistry is the registry of the apps discovered by the app-finder, shared with the brokers through the manifest file.
+// The app-finder publishes new generations of the manifest with an atomic write and rename, so readers never see a partial file.
+// Readers poll the file for changes and are notified of new generations through their subscriptions.
+type AppRegistry struct {
+	sync.RWMutex
+	srcFile     string
+	snapshot    *AppRegistrySnapshot
+	modTime     time.Time
+	size        int64
+	err         error
+	subscribers []chan int64
+}
+
+// Creates the registry backed by srcFile, loads the current manifest and starts watching the file.
+func NewAppRegistry(srcFile string) *AppRegistry {
+	r := &AppRegistry{
+		srcFile:  srcFile,
+		snapshot: newAppRegistrySnapshot(RegisteredAppsManifest{}),
+		err:      fmt.Errorf("registered app manifest %s has not been loaded", srcFile),
+	}
+	r.reloadIfChanged()
+	go func() {
+		for {
+			time.Sleep(appRegistryPollPeriod)
+			r.reloadIfChanged()
+		}
+	}()
+	return r
+}
+
+// Returns the current snapshot.
+// Returns an error if the manifest has never been loaded or published.
+func (r *AppRegistry) Snapshot() (*AppRegistrySnapshot, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.snapshot, r.err
+}
+
+// Returns the first path segment of the request if it names a registered app, MetricsAppNone otherwise.
+// Used as the app label of instrumented handlers, so that the label cardinality is bounded by the registered apps.
+func (r *AppRegistry) AppLabelFromPath(req *http.Request) string {
+	appName := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")[0]
+	r.RLock()
+	defer r.RUnlock()
+	if _, ok := r.snapshot.Apps[appName]; !ok || len(appName) == 0 {
+		return MetricsAppNone
+	}
+	return appName
+}
+
+// Returns a channel that receives the generation of each new snapshot.
+// Notifications are coalesced, a slow subscriber only receives the latest generation.
+func (r *AppRegistry) Subscribe() <-chan int64 {
+	ch := make(chan int64, 1)
+	r.Lock()
+	r.subscribers = append(r.subscribers, ch)
+	r.Unlock()
+	return ch
+}
+
+/*
+Publishes the apps and NetworkPolicyData as the next generation of the manifest.
+The manifest is only written if the content changed, the returned generation is the current one.
+*/
+func (r *AppRegistry) Publish(apps map[string]AppConfigSpec, networkPolicyData NetworkPolicyTemplateData) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// Copy the apps, snapshots are shared and must not change with the caller map.
+	manifest := RegisteredAppsManifest{
+		Apps:              make(map[string]AppConfigSpec, len(apps)),
+		NetworkPolicyData: networkPolicyData,
+	}
+	for name, app := range apps {
+		manifest.Apps[name] = app
+	}
+	if r.err == nil && r.snapshot != nil {
+		current := r.snapshot.RegisteredAppsManifest
+		manifest.Generation = current.Generation
+		if sameManifestContent(manifest, current) {
+			return current.Generation, nil
+		}
+	}
+	manifest.Generation++
+
+	data, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode registered app manifest: %v", err)
+	}
+	info, err := writeFileAtomic(r.srcFile, data, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write registered app manifest %s: %v", r.srcFile, err)
+	}
+
+	r.setSnapshot(newAppRegistrySnapshot(manifest), info)
+	return manifest.Generation, nil
+}
+
+// Reloads the manifest if the file modification time or size changed.
+// If the new file cannot be parsed, the previous snapshot is kept.
+func (r *AppRegistry) reloadIfChanged() {
+	info, err := os.Stat(r.srcFile)
+	if err != nil {
+		r.Lock()
+		if r.modTime.IsZero() {
+			r.err = err
+		}
+		r.Unlock()
+		return
+	}
+
+	r.RLock()
+	changed := !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+	r.RUnlock()
+	if !changed {
+		return
+	}
+
+	data, err := ioutil.ReadFile(r.srcFile)
+	if err != nil {
+		log.Printf("failed to read registered app manifest %s, using previous manifest: %v", r.srcFile, err)
+		return
+	}
+	var manifest RegisteredAppsManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		log.Printf("failed to parse registered app manifest %s, using previous manifest: %v", r.srcFile, err)
+		return
+	}
+	snapshot := newAppRegistrySnapshot(manifest)
+
+	r.Lock()
+	r.setSnapshot(snapshot, info)
+	r.Unlock()
+}
+
+// Sets the snapshot and notifies the subscribers if the generation changed, must be called with the lock held.
+func (r *AppRegistry) setSnapshot(snapshot *AppRegistrySnapshot, info os.FileInfo) {
+	changed := r.err != nil || snapshot.Generation != r.snapshot.Generation
+	r.snapshot = snapshot
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	r.err = nil
+	if !changed {
+		return
+	}
+	for _, ch := range r.subscribers {
+		// Replace the pending notification, if any, with the latest generation.
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- snapshot.Generation:
+		default:
+		}
+	}
+}
+
+// Returns true if the manifests have the same apps and NetworkPolicyData.
+func sameManifestContent(a, b RegisteredAppsManifest) bool {
+	a.Generation = 0
+	b.Generation = 0
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// Writes the data to a temporary file in the same directory and renames it to destFile.
+// Returns the info of the written file.
+func writeFileAtomic(destFile string, data []byte, perm os.FileMode) (os.FileInfo, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(destFile), "."+filepath.Base(destFile)+".")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return nil, err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpFile.Name(), destFile); err != nil {
+		return nil, err
+	}
+	return os.Stat(destFile)
+}
@@ -0,0 +1,123 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the pending notification of the subscription, 0 if there is none.
+func pendingGeneration(ch <-chan int64) int64 {
+	select {
+	case generation := <-ch:
+		return generation
+	default:
+		return 0
+	}
+}
+
+func TestAppRegistryPublish(t *testing.T) {
+	srcFile := filepath.Join(t.TempDir(), "apps.json")
+	registry := NewAppRegistry(srcFile)
+	if _, err := registry.Snapshot(); err == nil {
+		t.Errorf("expected error before the manifest is published")
+	}
+	updates := registry.Subscribe()
+
+	apps := map[string]AppConfigSpec{
+		"desktop": {Name: "desktop", Editors: []string{"alice@example.com"}},
+	}
+	generation, err := registry.Publish(apps, NetworkPolicyTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generation != 1 || pendingGeneration(updates) != 1 {
+		t.Errorf("expected generation 1 to be published and notified, got %d", generation)
+	}
+	snapshot, err := registry.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Generation != 1 || !snapshot.Policies["desktop"].Editors.Matches(AuthIdentity{User: "alice@example.com"}) {
+		t.Errorf("expected snapshot with the compiled app policies, got %+v", snapshot)
+	}
+
+	// Snapshots do not change with the caller map.
+	apps["ide"] = AppConfigSpec{Name: "ide"}
+	if _, ok := snapshot.Apps["ide"]; ok {
+		t.Errorf("expected snapshot not to change with the published map")
+	}
+	delete(apps, "ide")
+
+	// Publishing the same content keeps the generation and does not rewrite the file.
+	before, _ := ioutil.ReadFile(srcFile)
+	if generation, err := registry.Publish(apps, NetworkPolicyTemplateData{}); err != nil || generation != 1 {
+		t.Errorf("expected unchanged content to keep generation 1, got %d, %v", generation, err)
+	}
+	if after, _ := ioutil.ReadFile(srcFile); string(after) != string(before) {
+		t.Errorf("expected unchanged content not to rewrite the manifest")
+	}
+	if generation := pendingGeneration(updates); generation != 0 {
+		t.Errorf("expected no notification for unchanged content, got %d", generation)
+	}
+
+	apps["ide"] = AppConfigSpec{Name: "ide"}
+	if generation, err := registry.Publish(apps, NetworkPolicyTemplateData{}); err != nil || generation != 2 {
+		t.Errorf("expected changed content to publish generation 2, got %d, %v", generation, err)
+	}
+	if generation := pendingGeneration(updates); generation != 2 {
+		t.Errorf("expected notification of generation 2, got %d", generation)
+	}
+}
+
+func TestAppRegistryReload(t *testing.T) {
+	srcFile := filepath.Join(t.TempDir(), "apps.json")
+	publisher := NewAppRegistry(srcFile)
+	if _, err := publisher.Publish(map[string]AppConfigSpec{"desktop": {Name: "desktop"}}, NetworkPolicyTemplateData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers in other processes load the published manifest.
+	reader := NewAppRegistry(srcFile)
+	updates := reader.Subscribe()
+	if snapshot, err := reader.Snapshot(); err != nil || snapshot.Generation != 1 {
+		t.Fatalf("expected reader to load generation 1, got %+v, %v", snapshot, err)
+	}
+
+	if _, err := publisher.Publish(map[string]AppConfigSpec{"ide": {Name: "ide"}}, NetworkPolicyTemplateData{}); err != nil {
+		t.Fatal(err)
+	}
+	reader.reloadIfChanged()
+	snapshot, _ := reader.Snapshot()
+	if _, ok := snapshot.Apps["ide"]; !ok || snapshot.Generation != 2 {
+		t.Errorf("expected reader to reload generation 2, got %+v", snapshot)
+	}
+	if generation := pendingGeneration(updates); generation != 2 {
+		t.Errorf("expected reader notification of generation 2, got %d", generation)
+	}
+
+	// A manifest that cannot be parsed keeps the previous snapshot.
+	if err := ioutil.WriteFile(srcFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader.reloadIfChanged()
+	if snapshot, err := reader.Snapshot(); err != nil || snapshot.Generation != 2 {
+		t.Errorf("expected previous snapshot to be kept, got %+v, %v", snapshot, err)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"gopkg.in/yaml.v2"
@@ -72,30 +71,6 @@ func NewAppUserConfigFromJSON(srcFile string) (AppUserConfigObject, error) {
 	return userConfig, err
 }
 
-func FetchAppUserConfigs() ([]AppUserConfigObject, error) {
-	userConfigs := make([]AppUserConfigObject, 0)
-
-	type appUserConfigItems struct {
-		Items []AppUserConfigObject `json:"items"`
-	}
-
-	// Fetch all app user config objects
-	// 	 kubectl get brokerappuserconfigs -l app.kubernetes.io/managed-by=pod-broker
-	cmd := exec.Command("sh", "-c", "kubectl get brokerappuserconfigs --all-namespaces -l app.kubernetes.io/managed-by=pod-broker -o json")
-	output, err := cmd.Output()
-	if err != nil {
-		return userConfigs, err
-	}
-
-	var items appUserConfigItems
-	if err := json.Unmarshal(output, &items); err != nil {
-		return userConfigs, err
-	}
-	userConfigs = items.Items
-
-	return userConfigs, nil
-}
-
 func GetAppUserConfig(srcFile string) (AppUserConfigObject, error) {
 	userConfig := AppUserConfigObject{}
 
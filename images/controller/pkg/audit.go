@@ -0,0 +1,156 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event types.
+const (
+	AuditEventSessionCreated    = "session.created"
+	AuditEventSessionDeleted    = "session.deleted"
+	AuditEventPodDeleted        = "pod.deleted"
+	AuditEventPublishJobCreated = "publish-job.created"
+	AuditEventAppDrained        = "app.drained"
+	AuditEventAppUndrained      = "app.undrained"
+	AuditEventSnapshotCreated   = "snapshot.created"
+	AuditEventSnapshotRestored  = "snapshot.restored"
+	AuditEventHomeVolumeReset   = "home-volume.reset"
+	AuditEventHomeVolumeResized = "home-volume.resized"
+	AuditEventHomeVolumeDeleted = "home-volume.deleted"
+)
+
+// Values of the AuditLog sysParam that are not file paths.
+const (
+	AuditLogStdout   = "stdout"
+	AuditLogDisabled = "none"
+)
+
+// Timeout for posting an audit event to the webhook.
+const auditWebhookTimeout = 10 * time.Second
+
+// Audit record of a session lifecycle event, written as a single JSON line.
+type AuditEvent struct {
+	Time       time.Time         `json:"time"`
+	Source     string            `json:"source"`
+	Event      string            `json:"event"`
+	App        string            `json:"app"`
+	User       string            `json:"user,omitempty"`
+	Username   string            `json:"username,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	NodeTier   string            `json:"nodeTier,omitempty"`
+	UserParams map[string]string `json:"userParams,omitempty"`
+	Pod        string            `json:"pod,omitempty"`
+	Job        string            `json:"job,omitempty"`
+	Snapshot   string            `json:"snapshot,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	// Admin that performed the action, empty for actions by the session user or the broker.
+	Actor string `json:"actor,omitempty"`
+}
+
+// AuditLogger writes audit events as JSON lines and optionally posts each event to a webhook.
+type AuditLogger struct {
+	sync.Mutex
+	source     string
+	out        io.Writer
+	webhookURL string
+	client     *http.Client
+}
+
+// Creates an audit logger from the AuditLog and AuditWebhookURL sysParams.
+// AuditLog is one of stdout (default), none, or the path of a file that events are appended to.
+// source is recorded in each event and identifies the broker service that emitted it.
+func NewAuditLoggerFromParams(sysParams map[string]string, source string) (*AuditLogger, error) {
+	al := &AuditLogger{
+		source:     source,
+		webhookURL: sysParams["AuditWebhookURL"],
+		client:     &http.Client{Timeout: auditWebhookTimeout},
+	}
+
+	dest, ok := sysParams["AuditLog"]
+	if !ok || len(dest) == 0 {
+		dest = AuditLogStdout
+	}
+	switch dest {
+	case AuditLogStdout:
+		al.out = os.Stdout
+	case AuditLogDisabled:
+		al.out = nil
+	default:
+		f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log file %s: %v", dest, err)
+		}
+		al.out = f
+	}
+
+	return al, nil
+}
+
+// Records the event, the time and source are filled in if not set.
+// The webhook is called asynchronously so that it does not delay the request being audited.
+func (al *AuditLogger) Emit(event AuditEvent) {
+	if al == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if len(event.Source) == 0 {
+		event.Source = al.source
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal audit event: %v", err)
+		return
+	}
+
+	if al.out != nil {
+		al.Lock()
+		if _, err := al.out.Write(append(data, '\n')); err != nil {
+			log.Printf("failed to write audit event: %v", err)
+		}
+		al.Unlock()
+	}
+
+	if len(al.webhookURL) > 0 {
+		go al.post(data)
+	}
+}
+
+func (al *AuditLogger) post(data []byte) {
+	resp, err := al.client.Post(al.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("failed to post audit event to webhook: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("audit webhook returned status %d", resp.StatusCode)
+	}
+}
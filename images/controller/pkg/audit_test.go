@@ -0,0 +1,87 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogger(t *testing.T) {
+	posted := make(chan AuditEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AuditEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		posted <- event
+	}))
+	defer srv.Close()
+
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	al, err := NewAuditLoggerFromParams(map[string]string{"AuditLog": logFile, "AuditWebhookURL": srv.URL}, "pod-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Emit(AuditEvent{Event: AuditEventSessionCreated, App: "desktop", User: "user@example.com"})
+	al.Emit(AuditEvent{Event: AuditEventSessionDeleted, App: "desktop", User: "user@example.com", Reason: SessionReapReasonIdle})
+
+	// Each event is a JSON line with the time and source filled in.
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit lines, got %q", data)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != AuditEventSessionDeleted || event.Source != "pod-broker" || event.Reason != SessionReapReasonIdle || event.Time.IsZero() {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-posted:
+			if event.App != "desktop" || event.Source != "pod-broker" {
+				t.Errorf("unexpected posted audit event: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit event was not posted to the webhook")
+		}
+	}
+
+	// Disabled and nil loggers drop events.
+	al, err = NewAuditLoggerFromParams(map[string]string{"AuditLog": AuditLogDisabled}, "pod-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Emit(AuditEvent{Event: AuditEventSessionCreated, App: "desktop"})
+	var none *AuditLogger
+	none.Emit(AuditEvent{Event: AuditEventSessionCreated, App: "desktop"})
+
+	if _, err := NewAuditLoggerFromParams(map[string]string{"AuditLog": filepath.Join(t.TempDir(), "missing", "audit.log")}, "pod-broker"); err == nil {
+		t.Errorf("expected error for an audit log in a missing directory")
+	}
+}
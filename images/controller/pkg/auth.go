@@ -0,0 +1,249 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Values of the AuthProvider sysParam.
+const (
+	AuthProviderHeader = "header"
+	AuthProviderIAPJWT = "iap-jwt"
+	AuthProviderOIDC   = "oidc"
+)
+
+const (
+	// Header containing the signed IAP JWT assertion.
+	IAPJWTHeader = "x-goog-iap-jwt-assertion"
+	// Issuer of IAP JWT assertions.
+	IAPJWTIssuer = "https://cloud.google.com/iap"
+	// Public keys used to sign IAP JWT assertions.
+	IAPJWKSURL = "https://www.gstatic.com/iap/verify/public_key-jwk"
+)
+
+// Returned when the request does not contain valid credentials.
+var ErrNotAuthenticated = errors.New("request is not authenticated")
+
+// Identity of the user making a request.
+type AuthIdentity struct {
+	User     string
+	Username string
+	Groups   []string
+	// Roles are assigned by the group directory, see Authorizer.
+	Roles []string
+}
+
+// Authenticator returns the identity of the user making the request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (AuthIdentity, error)
+}
+
+// HeaderAuthenticator trusts the user from a header set by an authenticating proxy, like the IAP x-goog-authenticated-user-email header.
+// Groups are read from the optional GroupsHeader as a comma separated list, the proxy must strip this header from client requests.
+type HeaderAuthenticator struct {
+	UserHeader     string
+	UsernameHeader string
+	GroupsHeader   string
+}
+
+func (a *HeaderAuthenticator) Authenticate(r *http.Request) (AuthIdentity, error) {
+	user := r.Header.Get(a.UserHeader)
+	if len(user) == 0 {
+		return AuthIdentity{}, ErrNotAuthenticated
+	}
+	// IAP uses a prefix of accounts.google.com:email, remove this to just get the email
+	userToks := strings.Split(user, ":")
+	user = userToks[len(userToks)-1]
+
+	groups := make([]string, 0)
+	if len(a.GroupsHeader) > 0 {
+		for _, g := range strings.Split(r.Header.Get(a.GroupsHeader), ",") {
+			if g = strings.TrimSpace(g); len(g) > 0 {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	return AuthIdentity{
+		User:     user,
+		Username: GetUsernameFromHeaderOrDefault(r, a.UsernameHeader, user),
+		Groups:   groups,
+	}, nil
+}
+
+// JWTAuthenticator verifies a signed JWT from a request header and maps its claims to the user identity.
+// It is used for IAP signed assertions and for OIDC ID or access tokens.
+type JWTAuthenticator struct {
+	// Header containing the token, tokens in the Authorization header must use the Bearer scheme.
+	TokenHeader string
+	Issuer      string
+	Audience    string
+	Keys        *JWKSKeySet
+	// Claim containing the user, usually email.
+	UserClaim string
+	// Optional claim containing the username, the user is used if not set.
+	UsernameClaim string
+	// Optional claim containing the list of groups.
+	GroupsClaim string
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (AuthIdentity, error) {
+	token := r.Header.Get(a.TokenHeader)
+	if strings.EqualFold(a.TokenHeader, "Authorization") {
+		if !strings.HasPrefix(strings.ToLower(token), "bearer ") {
+			return AuthIdentity{}, ErrNotAuthenticated
+		}
+		token = strings.TrimSpace(token[len("bearer "):])
+	}
+	if len(token) == 0 {
+		return AuthIdentity{}, ErrNotAuthenticated
+	}
+
+	claims, err := VerifyJWT(token, a.Keys, a.Issuer, a.Audience, time.Now())
+	if err != nil {
+		return AuthIdentity{}, fmt.Errorf("%w: %v", ErrNotAuthenticated, err)
+	}
+
+	user, _ := claims[a.UserClaim].(string)
+	if len(user) == 0 {
+		return AuthIdentity{}, fmt.Errorf("%w: token is missing the %s claim", ErrNotAuthenticated, a.UserClaim)
+	}
+
+	username := user
+	if len(a.UsernameClaim) > 0 {
+		if v, ok := claims[a.UsernameClaim].(string); ok && len(v) > 0 {
+			username = v
+		}
+	}
+
+	groups := make([]string, 0)
+	if len(a.GroupsClaim) > 0 {
+		switch v := claims[a.GroupsClaim].(type) {
+		case []interface{}:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		case string:
+			groups = strings.Fields(v)
+		}
+	}
+
+	return AuthIdentity{
+		User:     user,
+		Username: username,
+		Groups:   groups,
+	}, nil
+}
+
+// Creates the authenticator selected by the AuthProvider sysParam, one of header (default), iap-jwt or oidc.
+//
+// header: AuthHeader names the trusted user header, UsernameHeader the optional username header and GroupsHeader the optional groups header.
+// iap-jwt: AuthAudience is the IAP backend service audience, AuthJWKS defaults to the IAP public keys.
+// oidc: AuthIssuer, AuthAudience and AuthJWKS, a file path or URL, are required. The token is read from the AuthTokenHeader header, default Authorization.
+//
+// For iap-jwt and oidc, AuthUserClaim (default email), AuthUsernameClaim and AuthGroupsClaim (default groups) map the token claims.
+func NewAuthenticatorFromParams(sysParams map[string]string) (Authenticator, error) {
+	paramOrDefault := func(name, defaultValue string) string {
+		if v, ok := sysParams[name]; ok && len(v) > 0 {
+			return v
+		}
+		return defaultValue
+	}
+
+	provider := paramOrDefault("AuthProvider", AuthProviderHeader)
+	switch provider {
+	case AuthProviderHeader:
+		authHeaderName, ok := sysParams["AuthHeader"]
+		if !ok {
+			return nil, fmt.Errorf("missing POD_BROKER_PARAM_AuthHeader env")
+		}
+		return &HeaderAuthenticator{
+			UserHeader:     authHeaderName,
+			UsernameHeader: sysParams["UsernameHeader"],
+			GroupsHeader:   sysParams["GroupsHeader"],
+		}, nil
+
+	case AuthProviderIAPJWT:
+		audience := paramOrDefault("AuthAudience", "")
+		if len(audience) == 0 {
+			return nil, fmt.Errorf("missing POD_BROKER_PARAM_AuthAudience env, required for the %s auth provider", provider)
+		}
+		return &JWTAuthenticator{
+			TokenHeader:   IAPJWTHeader,
+			Issuer:        IAPJWTIssuer,
+			Audience:      audience,
+			Keys:          NewJWKSKeySet(paramOrDefault("AuthJWKS", IAPJWKSURL)),
+			UserClaim:     paramOrDefault("AuthUserClaim", "email"),
+			UsernameClaim: paramOrDefault("AuthUsernameClaim", ""),
+			GroupsClaim:   paramOrDefault("AuthGroupsClaim", "groups"),
+		}, nil
+
+	case AuthProviderOIDC:
+		for _, name := range []string{"AuthIssuer", "AuthAudience", "AuthJWKS"} {
+			if len(paramOrDefault(name, "")) == 0 {
+				return nil, fmt.Errorf("missing POD_BROKER_PARAM_%s env, required for the %s auth provider", name, provider)
+			}
+		}
+		return &JWTAuthenticator{
+			TokenHeader:   paramOrDefault("AuthTokenHeader", "Authorization"),
+			Issuer:        sysParams["AuthIssuer"],
+			Audience:      sysParams["AuthAudience"],
+			Keys:          NewJWKSKeySet(sysParams["AuthJWKS"]),
+			UserClaim:     paramOrDefault("AuthUserClaim", "email"),
+			UsernameClaim: paramOrDefault("AuthUsernameClaim", ""),
+			GroupsClaim:   paramOrDefault("AuthGroupsClaim", "groups"),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid POD_BROKER_PARAM_AuthProvider: %s, must be one of: %s, %s, %s", provider, AuthProviderHeader, AuthProviderIAPJWT, AuthProviderOIDC)
+	}
+}
+
+// Returns the identity from the authenticator, or from the session token in the cookie or query parameter
+// when the authenticator returns ErrNotAuthenticated, as for requests that only carry the cookie.
+// A token issued to a different user than the authenticated one is ignored, so that a link with another user's token
+// cannot run the authenticated user in that session.
+func AuthenticateRequest(r *http.Request, cookieName, app string, signer *SessionTokenSigner, auth Authenticator) (AuthIdentity, error) {
+	identity, authErr := auth.Authenticate(r)
+	if authErr == nil {
+		return identity, nil
+	}
+	if !errors.Is(authErr, ErrNotAuthenticated) {
+		return identity, fmt.Errorf("%w: %v", ErrNotAuthenticated, authErr)
+	}
+
+	if len(cookieName) > 0 {
+		if token := getSessionTokenFromRequest(r, cookieName); len(token) > 0 {
+			tokenIdentity, err := signer.Verify(token, app)
+			if err != nil {
+				log.Printf("rejected %s session token: %v", cookieName, err)
+			} else {
+				return tokenIdentity, nil
+			}
+		}
+	}
+
+	return identity, authErr
+}
@@ -0,0 +1,87 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateRequest(t *testing.T) {
+	signer, err := NewSessionTokenSigner([]string{"secret"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &HeaderAuthenticator{UserHeader: "X-User", GroupsHeader: "X-Groups"}
+	policy, _ := CompileAuthzPolicy([]string{"group:gpu-users@corp"})
+
+	// The first request is authenticated by the proxy headers, the token carries the groups.
+	r := httptest.NewRequest("GET", "/desktop/", nil)
+	r.Header.Set("X-User", "accounts.google.com:alice@example.com")
+	r.Header.Set("X-Groups", "gpu-users@corp, staff@corp")
+	identity, err := AuthenticateRequest(r, "broker_desktop", "desktop", signer, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AuthIdentity{User: "alice@example.com", Username: "alice@example.com", Groups: []string{"gpu-users@corp", "staff@corp"}}
+	if !reflect.DeepEqual(identity, want) {
+		t.Fatalf("expected identity from headers %+v, got %+v", want, identity)
+	}
+	token := signer.MakeToken(identity, "desktop")
+
+	// Requests with only the cookie keep the groups for group rules.
+	r = httptest.NewRequest("GET", "/desktop/", nil)
+	r.AddCookie(&http.Cookie{Name: "broker_desktop", Value: token})
+	identity, err = AuthenticateRequest(r, "broker_desktop", "desktop", signer, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("expected identity from cookie %+v, got %+v", want, identity)
+	}
+	if !policy.Matches(identity) {
+		t.Errorf("expected group rule to match cookie-only request")
+	}
+
+	// The authenticator wins when it returns the same user.
+	r.Header.Set("X-User", "alice@example.com")
+	r.Header.Set("X-Groups", "staff@corp")
+	if identity, _ := AuthenticateRequest(r, "broker_desktop", "desktop", signer, auth); policy.Matches(identity) {
+		t.Errorf("expected groups from the authenticator to replace the token groups, got %+v", identity)
+	}
+
+	// A token of another user in a link does not replace the authenticated user.
+	r = httptest.NewRequest("GET", "/desktop/?broker_desktop="+token, nil)
+	r.Header.Set("X-User", "mallory@example.com")
+	identity, err = AuthenticateRequest(r, "broker_desktop", "desktop", signer, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.User != "mallory@example.com" || policy.Matches(identity) {
+		t.Errorf("expected authenticated user to be kept over the token of another user, got %+v", identity)
+	}
+
+	// Requests without credentials are not authenticated.
+	r = httptest.NewRequest("GET", "/desktop/", nil)
+	r.AddCookie(&http.Cookie{Name: "broker_desktop", Value: "alice@example.com#invalid"})
+	if _, err := AuthenticateRequest(r, "broker_desktop", "desktop", signer, auth); err == nil {
+		t.Errorf("expected error for request with an invalid token and no auth header")
+	}
+}
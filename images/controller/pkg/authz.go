@@ -0,0 +1,339 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Prefixes of authorization rules that match group or role membership instead of the user.
+const (
+	AuthzGroupPrefix = "group:"
+	AuthzRolePrefix  = "role:"
+)
+
+// Key in the group directory ConfigMap that holds the groups and roles.
+const GroupDirectoryConfigMapKey = "groups.yaml"
+
+const groupDirectoryReloadPeriod = 60 * time.Second
+
+// Group and role membership read from the group directory ConfigMap.
+// Group members are user patterns, role members are authorization rules and may reference groups.
+//
+// Example:
+//
+//	groups:
+//	  gpu-users@corp:
+//	    - alice@corp.example.com
+//	    - .*@gpu-team.corp.example.com
+//	roles:
+//	  admin:
+//	    - group:platform@corp
+//	    - bob@corp.example.com
+type GroupDirectorySpec struct {
+	Groups map[string][]string `yaml:"groups" json:"groups"`
+	Roles  map[string][]string `yaml:"roles" json:"roles"`
+}
+
+// Precompiled authorization rules.
+type AuthzPolicy struct {
+	users         []*regexp.Regexp
+	groups        []string
+	roles         []string
+	matchUsername bool
+}
+
+// Compiles the authorization rules, invalid rules are returned as errors and left out of the policy.
+// User patterns are matched against the user only.
+func CompileAuthzPolicy(rules []string) (*AuthzPolicy, []error) {
+	policy := &AuthzPolicy{
+		users:  make([]*regexp.Regexp, 0),
+		groups: make([]string, 0),
+		roles:  make([]string, 0),
+	}
+	errs := make([]error, 0)
+	for _, rule := range rules {
+		if err := ValidateAuthzRule(rule); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(rule, AuthzGroupPrefix):
+			policy.groups = append(policy.groups, strings.TrimPrefix(rule, AuthzGroupPrefix))
+		case strings.HasPrefix(rule, AuthzRolePrefix):
+			policy.roles = append(policy.roles, strings.TrimPrefix(rule, AuthzRolePrefix))
+		default:
+			policy.users = append(policy.users, regexp.MustCompile(rule))
+		}
+	}
+	return policy, errs
+}
+
+// Same as CompileAuthzPolicy, but user patterns also match the username, as the AppConfig authorizedUsers list always did.
+func CompileUsernameAuthzPolicy(rules []string) (*AuthzPolicy, []error) {
+	policy, errs := CompileAuthzPolicy(rules)
+	policy.matchUsername = true
+	return policy, errs
+}
+
+// Returns true if the identity matches any of the rules, group and role rules are matched against the identity groups and roles as is.
+func (p *AuthzPolicy) Matches(identity AuthIdentity) bool {
+	if p == nil {
+		return false
+	}
+	for _, re := range p.users {
+		if re.MatchString(identity.User) || (p.matchUsername && len(identity.Username) > 0 && re.MatchString(identity.Username)) {
+			return true
+		}
+	}
+	for _, g := range p.groups {
+		if containsString(identity.Groups, g) {
+			return true
+		}
+	}
+	for _, r := range p.roles {
+		if containsString(identity.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorization policies of an app, compiled from its AppConfigSpec.
+type AppAuthzPolicies struct {
+	// Nil if the app does not restrict access with authorizedUsers.
+	AuthorizedUsers *AuthzPolicy
+	Editors         *AuthzPolicy
+	// Nil if the app does not restrict user config writes with userConfigWriters.
+	UserConfigWriters *AuthzPolicy
+}
+
+// Compiles the app authorization rules, invalid rules are logged and left out of the policies.
+func NewAppAuthzPolicies(app AppConfigSpec) AppAuthzPolicies {
+	compile := func(field string, rules []string, compileRules func([]string) (*AuthzPolicy, []error)) *AuthzPolicy {
+		policy, errs := compileRules(rules)
+		for _, err := range errs {
+			log.Printf("WARN: app %s: %s: %v, skipped.", app.Name, field, err)
+		}
+		return policy
+	}
+	policies := AppAuthzPolicies{
+		Editors: compile("editors", app.Editors, CompileAuthzPolicy),
+	}
+	if app.AuthorizedUsers != nil {
+		policies.AuthorizedUsers = compile("authorizedUsers", app.AuthorizedUsers, CompileUsernameAuthzPolicy)
+	}
+	if len(app.UserConfigWriters) > 0 {
+		policies.UserConfigWriters = compile("userConfigWriters", app.UserConfigWriters, CompileAuthzPolicy)
+	}
+	return policies
+}
+
+// Returns an error if the rule is a user pattern that is not a valid regexp, or a group or role rule without a name.
+func ValidateAuthzRule(rule string) error {
+	for _, prefix := range []string{AuthzGroupPrefix, AuthzRolePrefix} {
+		if strings.HasPrefix(rule, prefix) {
+			if len(strings.TrimPrefix(rule, prefix)) == 0 {
+				return fmt.Errorf("missing name in authorization rule '%s'", rule)
+			}
+			return nil
+		}
+	}
+	if _, err := regexp.Compile(rule); err != nil {
+		return fmt.Errorf("invalid user pattern in authorization rule '%s': %v", rule, err)
+	}
+	return nil
+}
+
+// Group directory with the member rules compiled.
+type compiledGroupDirectory struct {
+	groups map[string]*AuthzPolicy
+	roles  map[string]*AuthzPolicy
+}
+
+// Compiles the group directory, invalid members are logged and skipped.
+// Group members must be user patterns and role members must not be role rules, so that membership is resolved in a single pass.
+func compileGroupDirectory(directory GroupDirectorySpec) compiledGroupDirectory {
+	compiled := compiledGroupDirectory{
+		groups: make(map[string]*AuthzPolicy, len(directory.Groups)),
+		roles:  make(map[string]*AuthzPolicy, len(directory.Roles)),
+	}
+	compile := func(kind, name string, members []string, disallowed ...string) *AuthzPolicy {
+		rules := make([]string, 0, len(members))
+		for _, member := range members {
+			skip := false
+			for _, prefix := range disallowed {
+				if strings.HasPrefix(member, prefix) {
+					log.Printf("WARN: rule '%s' is not supported as a member of %s '%s', skipped.", member, kind, name)
+					skip = true
+				}
+			}
+			if !skip {
+				rules = append(rules, member)
+			}
+		}
+		policy, errs := CompileAuthzPolicy(rules)
+		for _, err := range errs {
+			log.Printf("WARN: invalid member of %s '%s' in group directory, skipped: %v", kind, name, err)
+		}
+		return policy
+	}
+	for group, members := range directory.Groups {
+		compiled.groups[group] = compile("group", group, members, AuthzGroupPrefix, AuthzRolePrefix)
+	}
+	for role, members := range directory.Roles {
+		compiled.roles[role] = compile("role", role, members, AuthzRolePrefix)
+	}
+	return compiled
+}
+
+// Authorizer matches users against the authorization rules in the AppConfig authorizedUsers, editors and userConfigWriters lists.
+//
+// A rule is one of:
+// group:<name> matches users in the group, from the token groups claim, the trusted groups header or the group directory.
+// role:<name> matches users that have the role in the group directory.
+// Any other rule is a regexp matched against the user, authorizedUsers rules also match the username.
+type Authorizer struct {
+	sync.Mutex
+	client    ClusterClient
+	configMap string
+	namespace string
+	spec      GroupDirectorySpec
+	directory compiledGroupDirectory
+}
+
+// Creates an authorizer with the group directory ConfigMap named by the GroupDirectoryConfigMap sysParam, optionally prefixed with its namespace.
+// Without a group directory, group rules only match the groups from the authenticator and role rules never match.
+func NewAuthorizerFromParams(client ClusterClient, sysParams map[string]string) (*Authorizer, error) {
+	a := &Authorizer{
+		client:    client,
+		namespace: DefaultBrokerNamespace,
+		directory: compileGroupDirectory(GroupDirectorySpec{}),
+	}
+
+	if v, ok := sysParams["GroupDirectoryConfigMap"]; ok && len(v) > 0 {
+		a.configMap = v
+		if toks := strings.SplitN(v, "/", 2); len(toks) == 2 {
+			a.namespace = toks[0]
+			a.configMap = toks[1]
+		}
+		directory, err := a.loadConfigMap()
+		if err != nil {
+			return nil, err
+		}
+		a.spec = directory
+		a.directory = compileGroupDirectory(directory)
+
+		go func() {
+			for {
+				time.Sleep(groupDirectoryReloadPeriod)
+				a.reload()
+			}
+		}()
+	}
+
+	return a, nil
+}
+
+// Re-reads the group directory from the ConfigMap, the previous directory is kept if it cannot be read.
+func (a *Authorizer) reload() {
+	directory, err := a.loadConfigMap()
+	if err != nil {
+		log.Printf("failed to reload group directory, using previous config: %v", err)
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if !reflect.DeepEqual(directory, a.spec) {
+		a.spec = directory
+		a.directory = compileGroupDirectory(directory)
+	}
+}
+
+// Reads the group directory from the ConfigMap, a missing ConfigMap or key is an empty directory.
+func (a *Authorizer) loadConfigMap() (GroupDirectorySpec, error) {
+	var directory GroupDirectorySpec
+	cm, err := a.client.Kubernetes().CoreV1().ConfigMaps(a.namespace).Get(context.TODO(), a.configMap, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return directory, nil
+		}
+		return directory, fmt.Errorf("failed to get group directory ConfigMap %s/%s: %v", a.namespace, a.configMap, err)
+	}
+	if data, ok := cm.Data[GroupDirectoryConfigMapKey]; ok {
+		if err := yaml.Unmarshal([]byte(data), &directory); err != nil {
+			return directory, fmt.Errorf("invalid YAML in group directory ConfigMap %s/%s: %v", a.namespace, a.configMap, err)
+		}
+	}
+	return directory, nil
+}
+
+// Returns the compiled group directory, the compiled policies are replaced but never modified on reload.
+func (a *Authorizer) getDirectory() compiledGroupDirectory {
+	a.Lock()
+	defer a.Unlock()
+	return a.directory
+}
+
+// Returns the identity with the groups and roles from the group directory added.
+// Resolve once per request and match the result against each policy with AuthzPolicy.Matches.
+func (a *Authorizer) Resolve(identity AuthIdentity) AuthIdentity {
+	resolved := AuthIdentity{
+		User:     identity.User,
+		Username: identity.Username,
+		Groups:   append([]string{}, identity.Groups...),
+		Roles:    append([]string{}, identity.Roles...),
+	}
+	if a == nil {
+		return resolved
+	}
+	directory := a.getDirectory()
+
+	for group, members := range directory.groups {
+		if !containsString(resolved.Groups, group) && members.Matches(resolved) {
+			resolved.Groups = append(resolved.Groups, group)
+		}
+	}
+
+	for role, members := range directory.roles {
+		if !containsString(resolved.Roles, role) && members.Matches(resolved) {
+			resolved.Roles = append(resolved.Roles, role)
+		}
+	}
+
+	return resolved
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
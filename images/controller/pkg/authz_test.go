@@ -0,0 +1,111 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompileAuthzPolicy(t *testing.T) {
+	policy, errs := CompileAuthzPolicy([]string{"alice@example.com", ".*@gpu-team.example.com", "group:staff@corp", "role:admin", "group:", "(invalid"})
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors for the invalid rules, got %v", errs)
+	}
+
+	tests := []struct {
+		name     string
+		identity AuthIdentity
+		want     bool
+	}{
+		{"user", AuthIdentity{User: "alice@example.com"}, true},
+		{"user pattern", AuthIdentity{User: "bob@gpu-team.example.com"}, true},
+		{"group", AuthIdentity{User: "carol@example.com", Groups: []string{"staff@corp"}}, true},
+		{"role", AuthIdentity{User: "carol@example.com", Roles: []string{"admin"}}, true},
+		{"other user", AuthIdentity{User: "carol@example.com", Groups: []string{"admin"}, Roles: []string{"staff@corp"}}, false},
+		{"username only", AuthIdentity{User: "carol@example.com", Username: "alice@example.com"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy.Matches(tc.identity); got != tc.want {
+				t.Errorf("expected Matches(%+v) = %v, got %v", tc.identity, tc.want, got)
+			}
+		})
+	}
+
+	// authorizedUsers rules also match the username.
+	policy, _ = CompileUsernameAuthzPolicy([]string{"alice@example.com"})
+	if !policy.Matches(AuthIdentity{User: "carol@example.com", Username: "alice@example.com"}) {
+		t.Errorf("expected username to match authorizedUsers policy")
+	}
+
+	// Apps without editors match nobody.
+	var nilPolicy *AuthzPolicy
+	if nilPolicy.Matches(AuthIdentity{User: "alice@example.com"}) {
+		t.Errorf("expected nil policy to match nobody")
+	}
+}
+
+func TestAuthorizerResolve(t *testing.T) {
+	a := &Authorizer{
+		directory: compileGroupDirectory(GroupDirectorySpec{
+			Groups: map[string][]string{
+				"gpu-users@corp": {".*@gpu-team.example.com", "alice@example.com"},
+				// Nested groups are not supported.
+				"nested@corp": {"group:gpu-users@corp"},
+			},
+			Roles: map[string][]string{
+				"admin":  {"group:platform@corp", "bob@example.com"},
+				"nested": {"role:admin"},
+			},
+		}),
+	}
+
+	tests := []struct {
+		name       string
+		identity   AuthIdentity
+		wantGroups []string
+		wantRoles  []string
+	}{
+		{"directory group", AuthIdentity{User: "carol@gpu-team.example.com"}, []string{"gpu-users@corp"}, []string{}},
+		{"authenticator group grants role", AuthIdentity{User: "dave@example.com", Groups: []string{"platform@corp"}}, []string{"platform@corp"}, []string{"admin"}},
+		{"user role", AuthIdentity{User: "bob@example.com"}, []string{}, []string{"admin"}},
+		{"group and role", AuthIdentity{User: "alice@example.com", Groups: []string{"platform@corp"}}, []string{"gpu-users@corp", "platform@corp"}, []string{"admin"}},
+		{"no membership", AuthIdentity{User: "eve@example.com"}, []string{}, []string{}},
+		{"username is not a member", AuthIdentity{User: "eve@example.com", Username: "alice@example.com"}, []string{}, []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := a.Resolve(tc.identity)
+			sort.Strings(got.Groups)
+			if !reflect.DeepEqual(got.Groups, tc.wantGroups) {
+				t.Errorf("expected groups %v, got %v", tc.wantGroups, got.Groups)
+			}
+			if !reflect.DeepEqual(got.Roles, tc.wantRoles) {
+				t.Errorf("expected roles %v, got %v", tc.wantRoles, got.Roles)
+			}
+		})
+	}
+
+	// Without a group directory the identity is returned as is.
+	var none *Authorizer
+	identity := AuthIdentity{User: "alice@example.com", Groups: []string{"staff@corp"}, Roles: []string{}}
+	if got := none.Resolve(identity); !reflect.DeepEqual(got, identity) {
+		t.Errorf("expected identity %+v, got %+v", identity, got)
+	}
+}
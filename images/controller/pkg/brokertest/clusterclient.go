@@ -0,0 +1,239 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package brokertest provides a fake ClusterClient and object fixtures for broker tests.
+package brokertest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	broker "selkies.io/controller/pkg"
+)
+
+// Resources served by the fake discovery client, used to resolve the kinds of broker managed objects.
+var fakeAPIResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pods", SingularName: "pod", Namespaced: true, Kind: "Pod"},
+			{Name: "services", SingularName: "service", Namespaced: true, Kind: "Service"},
+			{Name: "configmaps", SingularName: "configmap", Namespaced: true, Kind: "ConfigMap"},
+			{Name: "secrets", SingularName: "secret", Namespaced: true, Kind: "Secret"},
+			{Name: "serviceaccounts", SingularName: "serviceaccount", Namespaced: true, Kind: "ServiceAccount"},
+			{Name: "persistentvolumeclaims", SingularName: "persistentvolumeclaim", Namespaced: true, Kind: "PersistentVolumeClaim"},
+			{Name: "namespaces", SingularName: "namespace", Namespaced: false, Kind: "Namespace"},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Namespaced: true, Kind: "Deployment"},
+			{Name: "statefulsets", SingularName: "statefulset", Namespaced: true, Kind: "StatefulSet"},
+		},
+	},
+	{
+		GroupVersion: "batch/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "jobs", SingularName: "job", Namespaced: true, Kind: "Job"},
+		},
+	},
+	{
+		GroupVersion: "networking.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "networkpolicies", SingularName: "networkpolicy", Namespaced: true, Kind: "NetworkPolicy"},
+		},
+	},
+}
+
+// FakePodExec records a command executed in a pod by the FakeClusterClient.
+type FakePodExec struct {
+	Namespace string
+	Pod       string
+	Container string
+	Command   []string
+	Stdin     []byte
+}
+
+// FakeClusterClient is a ClusterClient backed by the client-go fake clientsets.
+// Pod exec calls are recorded instead of being run.
+type FakeClusterClient struct {
+	*broker.KubeClusterClient
+
+	mu    sync.Mutex
+	Execs []FakePodExec
+}
+
+// NewFakeClusterClient creates a FakeClusterClient seeded with the given objects.
+// Unstructured objects are added to the dynamic client, all others are added to the typed client.
+func NewFakeClusterClient(objects ...runtime.Object) *FakeClusterClient {
+	typedObjects := make([]runtime.Object, 0)
+	dynamicObjects := make([]runtime.Object, 0)
+	for _, obj := range objects {
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			dynamicObjects = append(dynamicObjects, obj)
+		} else {
+			typedObjects = append(typedObjects, obj)
+		}
+	}
+
+	fc := &FakeClusterClient{
+		Execs: make([]FakePodExec, 0),
+	}
+
+	listKinds := map[schema.GroupVersionResource]string{
+		broker.BrokerAppConfigGVR:     broker.BrokerAppConfigKind + "List",
+		broker.BrokerAppUserConfigGVR: broker.BrokerAppUserConfigKind + "List",
+		broker.VolumeSnapshotGVR:      "VolumeSnapshotList",
+	}
+	for _, resources := range fakeAPIResources {
+		gv, _ := schema.ParseGroupVersion(resources.GroupVersion)
+		for _, r := range resources.APIResources {
+			listKinds[gv.WithResource(r.Name)] = r.Kind + "List"
+		}
+	}
+
+	clientset := kubefake.NewSimpleClientset(typedObjects...)
+	clientset.Resources = fakeAPIResources
+	// The fake tracker does not check resourceVersions, enforce them so that conflicting updates fail like they do on the API server.
+	clientset.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return false, nil, bumpResourceVersion(action.(k8stesting.CreateAction).GetObject(), "")
+	})
+	clientset.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return checkResourceVersion(clientset.Tracker(), action.(k8stesting.UpdateAction))
+	})
+
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, dynamicObjects...)
+	// The fake dynamic client does not implement DeleteCollection, delete the matching objects from the tracker.
+	dc.PrependReactor("delete-collection", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, deleteTrackedCollection(dc.Tracker(), listKinds, action.(k8stesting.DeleteCollectionAction))
+	})
+
+	fc.KubeClusterClient = broker.NewKubeClusterClientForClients(clientset, dc, fc.recordExec)
+
+	return fc
+}
+
+// Sets the resourceVersion of obj to the one following current.
+func bumpResourceVersion(obj runtime.Object, current string) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	version, _ := strconv.ParseInt(current, 10, 64)
+	accessor.SetResourceVersion(strconv.FormatInt(version+1, 10))
+	return nil
+}
+
+// Rejects updates with a stale resourceVersion and bumps it otherwise, the update itself is left to the tracker.
+func checkResourceVersion(tracker k8stesting.ObjectTracker, action k8stesting.UpdateAction) (bool, runtime.Object, error) {
+	obj := action.GetObject()
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return true, nil, err
+	}
+	existing, err := tracker.Get(action.GetResource(), action.GetNamespace(), accessor.GetName())
+	if err != nil {
+		// Let the tracker return the not found error.
+		return false, nil, nil
+	}
+	existingAccessor, err := meta.Accessor(existing)
+	if err != nil {
+		return true, nil, err
+	}
+	current := existingAccessor.GetResourceVersion()
+	if len(accessor.GetResourceVersion()) > 0 && accessor.GetResourceVersion() != current {
+		gr := action.GetResource().GroupResource()
+		return true, nil, apierrors.NewConflict(gr, accessor.GetName(), fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	return false, nil, bumpResourceVersion(obj, current)
+}
+
+func deleteTrackedCollection(tracker k8stesting.ObjectTracker, listKinds map[schema.GroupVersionResource]string, action k8stesting.DeleteCollectionAction) error {
+	gvr := action.GetResource()
+	gvk := gvr.GroupVersion().WithKind(strings.TrimSuffix(listKinds[gvr], "List"))
+	listObj, err := tracker.List(gvr, gvk, action.GetNamespace())
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(listObj)
+	if err != nil {
+		return err
+	}
+	selector := action.GetListRestrictions().Labels
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	for _, item := range items {
+		obj, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		if err := tracker.Delete(gvr, obj.GetNamespace(), obj.GetName()); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fc *FakeClusterClient) recordExec(namespace, pod, container string, command []string, stdin io.Reader) ([]byte, error) {
+	e := FakePodExec{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Command:   command,
+	}
+	if stdin != nil {
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		e.Stdin = data
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.Execs = append(fc.Execs, e)
+	return []byte{}, nil
+}
+
+// NewObject creates an unstructured object with the given labels, as applied by the broker for a user.
+func NewObject(apiVersion, kind, namespace, name string, labels map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetLabels(labels)
+	return obj
+}
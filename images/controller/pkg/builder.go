@@ -17,18 +17,14 @@
 package pod_broker
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
-	"regexp"
 	"sort"
 	"strings"
 	"text/template"
@@ -234,23 +230,14 @@ func ChecksumDeploy(srcDir string) (string, error) {
 func GetObjectTypes(srcDir string) ([]string, error) {
 	resp := make([]string, 0)
 
-	cmd := exec.Command("sh", "-o", "pipefail", "-c", fmt.Sprintf("kustomize build %s", srcDir))
-	cmd.Dir = srcDir
-	stdoutStderr, err := cmd.CombinedOutput()
+	objs, err := RenderKustomization(srcDir)
 	if err != nil {
-		return resp, fmt.Errorf("error running kustomize build on directory %s: %v\n%s", srcDir, err, stdoutStderr)
+		return resp, err
 	}
 
 	kindMap := make(map[string]int, 0)
-	scanner := bufio.NewScanner(bytes.NewReader(stdoutStderr))
-	kindPat := regexp.MustCompile(`^kind: (?P<kind>.*)`)
-	for scanner.Scan() {
-		line := scanner.Text()
-		match := kindPat.FindStringSubmatch(line)
-		if len(match) > 1 {
-			kind := match[1]
-			kindMap[kind] += 1
-		}
+	for _, obj := range objs {
+		kindMap[obj.GetKind()] += 1
 	}
 
 	for k := range kindMap {
@@ -279,6 +266,11 @@ func GenerateObjectTypePatch(srcDir string) error {
 	return ioutil.WriteFile(destFile, []byte(data), 0644)
 }
 
+// Returns the label selector for the per-user objects of an app instance, objects with the abandon deletion policy are excluded.
+func UserObjectsSelector(instance string) string {
+	return fmt.Sprintf("app.kubernetes.io/instance=%s,app.broker/deletion-policy notin (abandon)", instance)
+}
+
 // MD5All reads all the files in the file tree rooted at root and returns a map
 // from file path to the MD5 sum of the file's contents.  If the directory walk
 // fails or any read operation fails, MD5All returns an error.
@@ -0,0 +1,625 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/homedir"
+
+	"gopkg.in/yaml.v2"
+)
+
+var BrokerAppConfigGVR = schema.GroupVersionResource{Group: "gcp.solutions", Version: "v1", Resource: "brokerappconfigs"}
+var BrokerAppUserConfigGVR = schema.GroupVersionResource{Group: "gcp.solutions", Version: "v1", Resource: "brokerappuserconfigs"}
+
+// ClusterClient wraps all of the cluster operations performed by the broker services.
+type ClusterClient interface {
+	// Typed and dynamic clients for callers that need direct API access, like informers.
+	Kubernetes() kubernetes.Interface
+	Dynamic() dynamic.Interface
+
+	GetPodStatus(namespace, selector string) (StatusResponse, error)
+	GetPods(namespace, selector string) ([]corev1.Pod, error)
+	ListPods(namespace, selector string) ([]string, error)
+	PatchPodMetadata(namespace, name string, labels, annotations map[string]*string) error
+	DeletePod(namespace, name string) error
+	DeleteNamespace(name string) error
+	DeleteCollection(namespace string, kinds []string, selector string) error
+	GetJobs(namespace, selector string) ([]GetJobSpec, error)
+	DeleteJob(namespace, name string) error
+	GetDockerConfigs(namespace string) ([]DockerConfigJSON, []string, error)
+	CopyDockerRegistrySecrets(namespace, destDir string) ([]string, error)
+	GetServiceClusterIP(namespace, selector string) (ServiceClusterIPList, error)
+	GetConfigMaps(namespace string) ([]ConfigMapObject, error)
+	FetchBrokerAppConfigs(namespace string) ([]AppConfigObject, error)
+	FetchAppUserConfigs() ([]AppUserConfigObject, error)
+	CopyFileToContainer(namespace, selector, container, srcPath, destPath string) error
+	ExecPodCommand(namespace, selector, container, command string) error
+}
+
+// PodExecFunc runs a command in a pod container, optionally streaming stdin to it.
+type PodExecFunc func(namespace, pod, container string, command []string, stdin io.Reader) ([]byte, error)
+
+// KubeClusterClient implements ClusterClient using client-go.
+type KubeClusterClient struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+	exec      PodExecFunc
+}
+
+// GetClientConfig returns the in-cluster config if available, otherwise the config from KUBECONFIG or ~/.kube/config.
+func GetClientConfig() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if len(kubeconfig) == 0 {
+		if home := homedir.HomeDir(); home != "" {
+			kubeconfig = filepath.Join(home, ".kube", "config")
+		}
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// NewKubeClusterClient creates a ClusterClient from the default client config.
+func NewKubeClusterClient() (*KubeClusterClient, error) {
+	config, err := GetClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster client config: %v", err)
+	}
+	return NewKubeClusterClientForConfig(config)
+}
+
+// NewKubeClusterClientForConfig creates a ClusterClient from the given rest config.
+func NewKubeClusterClientForConfig(config *rest.Config) (*KubeClusterClient, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &KubeClusterClient{
+		clientset: clientset,
+		dynamic:   dc,
+		mapper:    newDiscoveryRESTMapper(clientset),
+		exec:      makeRemotePodExecFunc(config, clientset),
+	}, nil
+}
+
+// NewKubeClusterClientForClients creates a ClusterClient from existing clientsets, pod exec calls are run with exec.
+func NewKubeClusterClientForClients(clientset kubernetes.Interface, dc dynamic.Interface, exec PodExecFunc) *KubeClusterClient {
+	return &KubeClusterClient{
+		clientset: clientset,
+		dynamic:   dc,
+		mapper:    newDiscoveryRESTMapper(clientset),
+		exec:      exec,
+	}
+}
+
+func newDiscoveryRESTMapper(clientset kubernetes.Interface) *restmapper.DeferredDiscoveryRESTMapper {
+	return restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+}
+
+func makeRemotePodExecFunc(config *rest.Config, clientset kubernetes.Interface) PodExecFunc {
+	return func(namespace, pod, container string, command []string, stdin io.Reader) ([]byte, error) {
+		req := clientset.CoreV1().RESTClient().Post().
+			Resource("pods").
+			Namespace(namespace).
+			Name(pod).
+			SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{
+				Container: container,
+				Command:   command,
+				Stdin:     stdin != nil,
+				Stdout:    true,
+				Stderr:    true,
+			}, scheme.ParameterCodec)
+
+		executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+		if err != nil {
+			return nil, err
+		}
+
+		var out bytes.Buffer
+		err = executor.Stream(remotecommand.StreamOptions{
+			Stdin:  stdin,
+			Stdout: &out,
+			Stderr: &out,
+		})
+		return out.Bytes(), err
+	}
+}
+
+func (c *KubeClusterClient) Kubernetes() kubernetes.Interface {
+	return c.clientset
+}
+
+func (c *KubeClusterClient) Dynamic() dynamic.Interface {
+	return c.dynamic
+}
+
+func (c *KubeClusterClient) GetPodStatus(namespace, selector string) (StatusResponse, error) {
+	var resp StatusResponse
+
+	pods, err := c.GetPods(namespace, selector)
+	if err != nil {
+		return resp, err
+	}
+
+	resp.Code = 200
+	resp.Nodes = make([]string, 0)
+	resp.Containers = make(map[string]string, 0)
+	resp.Images = make(map[string]string, 0)
+	resp.SessionKeys = make([]string, 0)
+	resp.BrokerObjects = make([]string, 0)
+
+	podStatus := PodStatusResponse{}
+
+	for _, item := range pods {
+		// Status is terminating if metadata.deletionTimestamp is set.
+		// https://github.com/kubernetes/kubernetes/issues/22839
+		if item.DeletionTimestamp != nil {
+			resp.Status = "terminating"
+			return resp, nil
+		}
+
+		if sessionKey, ok := item.Annotations["app.broker/session-key"]; ok {
+			resp.SessionKeys = append(resp.SessionKeys, sessionKey)
+		}
+
+		if brokerObjects, ok := item.Annotations["app.broker/last-applied-object-types"]; ok {
+			resp.BrokerObjects = strings.Split(brokerObjects, ",")
+		}
+
+		if !item.CreationTimestamp.IsZero() {
+			resp.CreationTimestamp = item.CreationTimestamp.UTC().Format("2006-01-02T15:04:05Z")
+		}
+
+		for _, cond := range item.Status.Conditions {
+			if cond.Type == corev1.PodReady {
+				if cond.Status == corev1.ConditionTrue {
+					resp.PodIPs = append(resp.PodIPs, item.Status.PodIP)
+					if len(item.Spec.NodeName) > 0 {
+						resp.Nodes = append(resp.Nodes, item.Spec.NodeName)
+					}
+					podStatus.Ready++
+					if _, ok := item.Annotations[SessionReadyNotifiedAnnotation]; !ok {
+						resp.UnnotifiedReadyPods = append(resp.UnnotifiedReadyPods, item.Name)
+					}
+				} else {
+					podStatus.Waiting++
+				}
+			} else if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse {
+				podStatus.Waiting++
+			}
+		}
+
+		for _, containerStatus := range item.Status.ContainerStatuses {
+			resp.Containers[containerStatus.Name] = containerStatus.ContainerID
+			resp.Images[containerStatus.Name] = containerStatus.Image
+		}
+	}
+
+	// Status is shutdown if no pods matched selector
+	if len(pods) == 0 {
+		resp.Status = "shutdown"
+	}
+
+	// Populate status when we have at least 1 ready pod.
+	if podStatus.Ready > 0 {
+		resp.PodStatus = &podStatus
+	}
+
+	// Status is waiting until all pods are ready.
+	if podStatus.Waiting > 0 {
+		resp.Status = "waiting"
+	}
+
+	// Status is ready when no pods are waiting and we have at least 1 ready pod.
+	if podStatus.Waiting == 0 && podStatus.Ready > 0 {
+		resp.Status = "ready"
+	}
+
+	return resp, nil
+}
+
+// Returns pods matching the label selector, sorted by creation time in ascending order.
+func (c *KubeClusterClient) GetPods(namespace, selector string) ([]corev1.Pod, error) {
+	podList, err := c.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pods: %v", err)
+	}
+	pods := podList.Items
+	sort.SliceStable(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+	return pods, nil
+}
+
+func (c *KubeClusterClient) ListPods(namespace, selector string) ([]string, error) {
+	resp := make([]string, 0)
+	pods, err := c.GetPods(namespace, selector)
+	if err != nil {
+		return resp, err
+	}
+	for _, pod := range pods {
+		resp = append(resp, pod.Name)
+	}
+	return resp, nil
+}
+
+// Patches the labels and annotations on a pod.
+// Keys with nil values are removed from the pod.
+func (c *KubeClusterClient) PatchPodMetadata(namespace, name string, labels, annotations map[string]*string) error {
+	metadata := make(map[string]interface{}, 0)
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+	if _, err := c.clientset.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch pod %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+func (c *KubeClusterClient) DeletePod(namespace, name string) error {
+	return c.clientset.CoreV1().Pods(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
+func (c *KubeClusterClient) DeleteNamespace(name string) error {
+	return c.clientset.CoreV1().Namespaces().Delete(context.TODO(), name, metav1.DeleteOptions{})
+}
+
+/*
+Deletes the objects of each kind matching the label selector without waiting for them to be removed.
+Kinds are the object kinds recorded by the broker, like StatefulSet or Service, and are resolved through discovery.
+All kinds are attempted, the first error is returned.
+*/
+func (c *KubeClusterClient) DeleteCollection(namespace string, kinds []string, selector string) error {
+	var firstErr error
+	propagation := metav1.DeletePropagationBackground
+	for _, kind := range kinds {
+		mapping, err := c.kindMapping(kind)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		resource := c.dynamic.Resource(mapping.Resource)
+		opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+		listOpts := metav1.ListOptions{LabelSelector: selector}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			err = resource.Namespace(namespace).DeleteCollection(context.TODO(), opts, listOpts)
+		} else {
+			err = resource.DeleteCollection(context.TODO(), opts, listOpts)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to delete %s objects matching %q: %v", kind, selector, err)
+		}
+	}
+	return firstErr
+}
+
+// Returns the REST mapping for the kind, resolved in the preferred group that serves it.
+func (c *KubeClusterClient) kindMapping(kind string) (*meta.RESTMapping, error) {
+	partial := schema.GroupVersionResource{Resource: strings.ToLower(kind)}
+	gvk, err := c.mapper.KindFor(partial)
+	if meta.IsNoMatchError(err) {
+		// Kind may have been registered by a CRD since the discovery cache was populated.
+		c.mapper.Reset()
+		gvk, err = c.mapper.KindFor(partial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find resource for kind %s: %v", kind, err)
+	}
+	return c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+func (c *KubeClusterClient) GetJobs(namespace, selector string) ([]GetJobSpec, error) {
+	resp := make([]GetJobSpec, 0)
+
+	jobList, err := c.clientset.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return resp, fmt.Errorf("failed to get jobs: %v", err)
+	}
+
+	// Round trip through JSON to preserve the generic metadata map used by callers.
+	data, err := json.Marshal(jobList.Items)
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, fmt.Errorf("failed to parse jobs spec: %v", err)
+	}
+
+	return resp, nil
+}
+
+// Returns true if the job has a Failed condition.
+func (job *GetJobSpec) IsFailed() bool {
+	for _, condition := range job.Status.Conditions {
+		if condition["type"] == "Failed" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *KubeClusterClient) DeleteJob(namespace, name string) error {
+	propagation := metav1.DeletePropagationBackground
+	return c.clientset.BatchV1().Jobs(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+}
+
+func (c *KubeClusterClient) getDockerConfigSecrets(namespace string) ([]corev1.Secret, error) {
+	resp := make([]corev1.Secret, 0)
+	secretList, err := c.clientset.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("type=%s", corev1.SecretTypeDockerConfigJson),
+	})
+	if err != nil {
+		return resp, err
+	}
+	for _, secret := range secretList.Items {
+		if secret.Type == corev1.SecretTypeDockerConfigJson {
+			resp = append(resp, secret)
+		}
+	}
+	return resp, nil
+}
+
+// Returns a list of all the dockerconfigjson type secrets found in the given namespace.
+func (c *KubeClusterClient) GetDockerConfigs(namespace string) ([]DockerConfigJSON, []string, error) {
+	resp := make([]DockerConfigJSON, 0)
+	secrets := make([]string, 0)
+
+	dockerSecrets, err := c.getDockerConfigSecrets(namespace)
+	if err != nil {
+		return resp, secrets, fmt.Errorf("failed to get secrets: %v", err)
+	}
+
+	for _, secret := range dockerSecrets {
+		secrets = append(secrets, secret.Name)
+		if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+			var dockerConfig DockerConfigJSON
+			if err := json.Unmarshal(data, &dockerConfig); err != nil {
+				return resp, secrets, fmt.Errorf("failed to parse docker config from secret %s: %v", secret.Name, err)
+			}
+			resp = append(resp, dockerConfig)
+		}
+	}
+
+	return resp, secrets, nil
+}
+
+// Saves all of the dockerconfigjson type secrets from the given namespace to destDir as kustomize resources.
+// Returns the list of secret names saved.
+func (c *KubeClusterClient) CopyDockerRegistrySecrets(namespace, destDir string) ([]string, error) {
+	resp := []string{}
+	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
+		return resp, err
+	}
+
+	dockerSecrets, err := c.getDockerConfigSecrets(namespace)
+	if err != nil {
+		return resp, fmt.Errorf("failed to copy secret: %v", err)
+	}
+
+	for _, secret := range dockerSecrets {
+		// Only keep the fields required to re-create the secret in another namespace.
+		obj := map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name": secret.Name,
+			},
+			"type": string(secret.Type),
+			"data": encodeSecretData(secret.Data),
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return resp, fmt.Errorf("failed to copy secret %s: %v", secret.Name, err)
+		}
+		destFile := path.Join(destDir, fmt.Sprintf("resource-%s.yaml", secret.Name))
+		if err := ioutil.WriteFile(destFile, data, 0644); err != nil {
+			return resp, fmt.Errorf("failed to copy secret %s: %v", secret.Name, err)
+		}
+		resp = append(resp, secret.Name)
+	}
+
+	return resp, nil
+}
+
+func encodeSecretData(data map[string][]byte) map[string]string {
+	resp := make(map[string]string, len(data))
+	for k, v := range data {
+		resp[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return resp
+}
+
+func (c *KubeClusterClient) GetServiceClusterIP(namespace, selector string) (ServiceClusterIPList, error) {
+	resp := ServiceClusterIPList{
+		Services: make([]ServiceClusterIP, 0),
+	}
+
+	serviceList, err := c.clientset.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return resp, fmt.Errorf("failed to get services: %v", err)
+	}
+
+	for _, service := range serviceList.Items {
+		resp.Services = append(resp.Services, ServiceClusterIP{
+			ServiceName: service.Name,
+			ClusterIP:   service.Spec.ClusterIP,
+		})
+	}
+
+	return resp, nil
+}
+
+func (c *KubeClusterClient) GetConfigMaps(namespace string) ([]ConfigMapObject, error) {
+	objs := make([]ConfigMapObject, 0)
+
+	cmList, err := c.clientset.CoreV1().ConfigMaps(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return objs, err
+	}
+
+	for i := range cmList.Items {
+		objs = append(objs, NewConfigMapObject(&cmList.Items[i]))
+	}
+	return objs, nil
+}
+
+// Converts the ConfigMap to a ConfigMapObject.
+func NewConfigMapObject(cm *corev1.ConfigMap) ConfigMapObject {
+	return ConfigMapObject{
+		KubeObjectBase: KubeObjectBase{
+			ApiVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		Metadata: KubeObjectMeta{
+			Name:        cm.Name,
+			Namespace:   cm.Namespace,
+			Annotations: cm.Annotations,
+			Labels:      cm.Labels,
+		},
+		Data: ConfigMapData(cm.Data),
+	}
+}
+
+func (c *KubeClusterClient) FetchBrokerAppConfigs(namespace string) ([]AppConfigObject, error) {
+	appConfigs := make([]AppConfigObject, 0)
+
+	list, err := c.dynamic.Resource(BrokerAppConfigGVR).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return appConfigs, err
+	}
+
+	for _, item := range list.Items {
+		var appConfig AppConfigObject
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &appConfig); err != nil {
+			return appConfigs, fmt.Errorf("failed to convert BrokerAppConfig %s: %v", item.GetName(), err)
+		}
+		appConfig.SetDefaults()
+		appConfigs = append(appConfigs, appConfig)
+	}
+
+	return appConfigs, nil
+}
+
+func (c *KubeClusterClient) FetchAppUserConfigs() ([]AppUserConfigObject, error) {
+	userConfigs := make([]AppUserConfigObject, 0)
+
+	list, err := c.dynamic.Resource(BrokerAppUserConfigGVR).Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/managed-by=pod-broker",
+	})
+	if err != nil {
+		return userConfigs, err
+	}
+
+	for _, item := range list.Items {
+		var userConfig AppUserConfigObject
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &userConfig); err != nil {
+			return userConfigs, fmt.Errorf("failed to convert BrokerAppUserConfig %s: %v", item.GetName(), err)
+		}
+		userConfigs = append(userConfigs, userConfig)
+	}
+
+	return userConfigs, nil
+}
+
+// Returns the name of the first running pod matching the selector.
+func (c *KubeClusterClient) findPodName(namespace, selector string) (string, error) {
+	pods, err := c.GetPods(namespace, selector)
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("could not find pod with given selector")
+}
+
+func (c *KubeClusterClient) CopyFileToContainer(namespace, selector, container, srcPath, destPath string) error {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return fmt.Errorf("cannot copy file to container, failed to read srcPath: %s: %v", srcPath, err)
+	}
+
+	podName, err := c.findPodName(namespace, selector)
+	if err != nil {
+		return err
+	}
+
+	// Stream the file contents to the destination path in the container.
+	if out, err := c.exec(namespace, podName, container, []string{"tee", destPath}, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to copy file to pod: %s, %v", string(out), err)
+	}
+	return nil
+}
+
+func (c *KubeClusterClient) ExecPodCommand(namespace, selector, container, command string) error {
+	podName, err := c.findPodName(namespace, selector)
+	if err != nil {
+		return err
+	}
+
+	// Execute command in pod container.
+	if out, err := c.exec(namespace, podName, container, strings.Split(command, " "), nil); err != nil {
+		return fmt.Errorf("failed to exec pod command: %s, %v", string(out), err)
+	}
+	return nil
+}
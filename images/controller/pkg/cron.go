@@ -0,0 +1,126 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed 5 field cron expression: minute, hour, day of month, month and day of week.
+// Each field supports '*', values, ranges 'a-b', lists 'a,b' and steps '*/n' or 'a-b/n'. Day of week 0 and 7 are Sunday.
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	daysRestricted, weekdaysRestricted     bool
+}
+
+// Parses a 5 field cron expression, for example '0 8 * * 1-5' for 8:00 on weekdays.
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron schedule '%s': must have 5 fields", expr)
+	}
+	s := &CronSchedule{}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute in cron schedule '%s': %v", expr, err)
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour in cron schedule '%s': %v", expr, err)
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month in cron schedule '%s': %v", expr, err)
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month in cron schedule '%s': %v", expr, err)
+	}
+	if s.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week in cron schedule '%s': %v", expr, err)
+	}
+	if s.weekdays[7] {
+		s.weekdays[0] = true
+	}
+	// Like cron, fields that start with '*' such as '*/2' do not restrict the day.
+	s.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	s.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if toks := strings.SplitN(part, "/", 2); len(toks) == 2 {
+			n, err := strconv.Atoi(toks[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step '%s'", toks[1])
+			}
+			part = toks[0]
+			step = n
+		}
+		lo, hi := min, max
+		if part != "*" {
+			toks := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(toks[0]); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", toks[0])
+			}
+			hi = lo
+			if len(toks) == 2 {
+				if hi, err = strconv.Atoi(toks[1]); err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", toks[1])
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Returns true if the schedule fires at the minute of the given time.
+// Like cron, when both day of month and day of week are restricted, either one matching is enough.
+func (s *CronSchedule) Matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	dayMatch := s.days[t.Day()]
+	weekdayMatch := s.weekdays[int(t.Weekday())]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return dayMatch || weekdayMatch
+	}
+	return dayMatch && weekdayMatch
+}
+
+// Returns the most recent time the schedule fired within the duration before the given time, and false if it did not.
+func (s *CronSchedule) LastFiredWithin(now time.Time, duration time.Duration) (time.Time, bool) {
+	now = now.Truncate(time.Minute)
+	for t := now; now.Sub(t) < duration; t = t.Add(-time.Minute) {
+		if s.Matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,94 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	// 2021-06-07 is a Monday.
+	monday := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+	sunday := time.Date(2021, 6, 6, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		expr  string
+		times map[time.Time]bool
+	}{
+		{"every minute", "* * * * *", map[time.Time]bool{monday: true, monday.Add(37 * time.Minute): true}},
+		{"weekdays", "0 8 * * 1-5", map[time.Time]bool{monday: true, sunday: false, monday.Add(time.Minute): false, monday.Add(time.Hour): false}},
+		{"list and step", "0,30 */4 * * *", map[time.Time]bool{monday: true, monday.Add(30 * time.Minute): true, monday.Add(15 * time.Minute): false, monday.Add(time.Hour): false}},
+		{"range step", "0 8-18/5 * * *", map[time.Time]bool{monday: true, monday.Add(5 * time.Hour): true, monday.Add(10 * time.Hour): true, monday.Add(2 * time.Hour): false}},
+		{"value step", "0 3/5 * * *", map[time.Time]bool{monday: true, monday.Add(-5 * time.Hour): true, monday.Add(-time.Hour): false}},
+		{"sunday as 7", "0 8 * * 7", map[time.Time]bool{sunday: true, monday: false}},
+		{"day of month or week", "0 8 1 * 1", map[time.Time]bool{monday: true, time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC): true, sunday: false}},
+		{"day of month step and week", "0 8 */2 * 1", map[time.Time]bool{monday: true, sunday: false, time.Date(2021, 6, 9, 8, 0, 0, 0, time.UTC): false}},
+		{"month", "0 8 * 7 *", map[time.Time]bool{monday: false, monday.AddDate(0, 1, 0): true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseCronSchedule(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for at, want := range tc.times {
+				if got := s.Matches(at); got != want {
+					t.Errorf("expected Matches(%v) = %v, got %v", at, want, got)
+				}
+			}
+		})
+	}
+
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-b * * * *"} {
+		if _, err := ParseCronSchedule(expr); err == nil {
+			t.Errorf("expected error for cron schedule '%s'", expr)
+		}
+	}
+}
+
+func TestCronScheduleLastFiredWithin(t *testing.T) {
+	s, err := ParseCronSchedule("0 8 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fired := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		duration time.Duration
+		want     bool
+	}{
+		{"at schedule", fired.Add(30 * time.Second), time.Minute, true},
+		{"within duration", fired.Add(59 * time.Minute), time.Hour, true},
+		{"after duration", fired.Add(time.Hour), time.Hour, false},
+		{"before schedule", fired.Add(-time.Minute), 24 * time.Hour, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			at, ok := s.LastFiredWithin(tc.now, tc.duration)
+			if ok != tc.want {
+				t.Fatalf("expected fired %v, got %v at %v", tc.want, ok, at)
+			}
+			if ok && !at.Equal(fired) {
+				t.Errorf("expected fired at %v, got %v", fired, at)
+			}
+		})
+	}
+}
@@ -33,6 +33,7 @@ type DockerConfigJSON struct {
 
 type DockerConfigsSync struct {
 	sync.Mutex
+	Client  ClusterClient
 	Configs []DockerConfigJSON
 	Secrets []string
 }
@@ -59,7 +60,7 @@ func (dc *DockerConfigsSync) GetAuthConfigsForRepo(image string) ([]registry_aut
 }
 
 func (dc *DockerConfigsSync) Update(namespace string) error {
-	dockerConfigs, secrets, err := GetDockerConfigs(namespace)
+	dockerConfigs, secrets, err := dc.Client.GetDockerConfigs(namespace)
 	if err != nil {
 		return err
 	}
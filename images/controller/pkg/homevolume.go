@@ -0,0 +1,341 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// Label with the app name of a home volume, home volumes do not have the instance label so that session shutdown does not delete them.
+const HomeVolumeLabel = "app.broker/home-volume"
+
+// Annotation with the RFC3339 time of the last launch that used a home volume.
+const HomeVolumeLastLaunchAnnotation = "app.broker/last-launch"
+
+// Size of home volumes when the app does not set one.
+const DefaultHomeVolumeSize = "10Gi"
+
+// Home volume of a user session, reported in the user config response.
+type HomeVolumeResponse struct {
+	Name         string `json:"name"`
+	Phase        string `json:"phase"`
+	StorageClass string `json:"storageClass,omitempty"`
+	// Requested size, the capacity is lower while a resize is pending.
+	Size     string `json:"size"`
+	Capacity string `json:"capacity,omitempty"`
+	MaxSize  string `json:"maxSize"`
+	// Bytes used on the volume, only reported while a session has it mounted.
+	UsedBytes  *int64 `json:"usedBytes,omitempty"`
+	LastLaunch string `json:"lastLaunch,omitempty"`
+}
+
+// Home volume not launched within the app retentionDays.
+type HomeVolumeGCEntry struct {
+	App        string    `json:"app"`
+	User       string    `json:"user"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Size       string    `json:"size"`
+	LastLaunch time.Time `json:"lastLaunch"`
+	IdleDays   int       `json:"idleDays"`
+	// True if the app has gcDryRun set, its volumes are only reported.
+	DryRun bool `json:"dryRun"`
+}
+
+// Returns the name of the home volume PVC of the session.
+func HomeVolumeName(fullName string) string {
+	return fmt.Sprintf("%s-home", fullName)
+}
+
+// Returns the initial and maximum size of the app home volumes, the maxSize defaults to the size.
+func (spec *AppConfigSpec) HomeVolumeSizes() (resource.Quantity, resource.Quantity, error) {
+	sizeStr := spec.HomeVolume.Size
+	if len(sizeStr) == 0 {
+		sizeStr = DefaultHomeVolumeSize
+	}
+	size, err := resource.ParseQuantity(sizeStr)
+	if err != nil {
+		return size, size, fmt.Errorf("invalid home volume size '%s': %v", sizeStr, err)
+	}
+	maxSize := size
+	if len(spec.HomeVolume.MaxSize) > 0 {
+		if maxSize, err = resource.ParseQuantity(spec.HomeVolume.MaxSize); err != nil {
+			return size, size, fmt.Errorf("invalid home volume maxSize '%s': %v", spec.HomeVolume.MaxSize, err)
+		}
+	}
+	if maxSize.Cmp(size) < 0 {
+		return size, size, fmt.Errorf("invalid home volume maxSize '%s', must not be less than size '%s'", maxSize.String(), size.String())
+	}
+	return size, maxSize, nil
+}
+
+// Returns an error if the home volume spec is invalid.
+func (spec *AppConfigSpec) ValidateHomeVolume() error {
+	if !spec.HomeVolume.Enabled {
+		return nil
+	}
+	if _, _, err := spec.HomeVolumeSizes(); err != nil {
+		return err
+	}
+	if spec.HomeVolume.RetentionDays < 0 {
+		return fmt.Errorf("invalid home volume retentionDays: %d", spec.HomeVolume.RetentionDays)
+	}
+	return nil
+}
+
+// Returns an error if the home volume cannot be resized from the current to the requested size.
+// Volumes can only grow, up to the app maxSize.
+func (spec *AppConfigSpec) ValidateHomeVolumeResize(current, requested resource.Quantity) error {
+	_, maxSize, err := spec.HomeVolumeSizes()
+	if err != nil {
+		return err
+	}
+	if requested.Cmp(current) <= 0 {
+		return fmt.Errorf("requested size %s must be greater than the current size %s", requested.String(), current.String())
+	}
+	if requested.Cmp(maxSize) > 0 {
+		return fmt.Errorf("requested size %s exceeds the maximum size %s", requested.String(), maxSize.String())
+	}
+	return nil
+}
+
+// Creates the home volume of the session if it does not exist and records the launch time on it.
+// Returns true if the volume was created.
+func EnsureHomeVolume(client ClusterClient, app AppConfigSpec, namespace, fullName, user string, now time.Time) (bool, error) {
+	name := HomeVolumeName(fullName)
+	pvcs := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace)
+	lastLaunch := now.UTC().Format(time.RFC3339)
+
+	_, err := pvcs.Get(context.TODO(), name, metav1.GetOptions{})
+	if err == nil {
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{HomeVolumeLastLaunchAnnotation: lastLaunch},
+			},
+		})
+		if _, err := pvcs.Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return false, fmt.Errorf("failed to update home volume %s/%s: %v", namespace, name, err)
+		}
+		return false, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get home volume %s/%s: %v", namespace, name, err)
+	}
+
+	size, _, err := app.HomeVolumeSizes()
+	if err != nil {
+		return false, err
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				HomeVolumeLabel:                app.Name,
+				"app.kubernetes.io/name":       app.Name,
+				"app.kubernetes.io/managed-by": "pod-broker",
+			},
+			Annotations: map[string]string{
+				"app.broker/user":              user,
+				HomeVolumeLastLaunchAnnotation: lastLaunch,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if len(app.HomeVolume.StorageClass) > 0 {
+		pvc.Spec.StorageClassName = &app.HomeVolume.StorageClass
+	}
+	if _, err := pvcs.Create(context.TODO(), pvc, metav1.CreateOptions{}); err != nil {
+		return false, fmt.Errorf("failed to create home volume %s/%s: %v", namespace, name, err)
+	}
+	return true, nil
+}
+
+// Returns the home volume of the session, nil if it does not exist yet.
+func GetHomeVolumeStatus(client ClusterClient, app AppConfigSpec, namespace, fullName string) (*HomeVolumeResponse, error) {
+	name := HomeVolumeName(fullName)
+	pvc, err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get home volume %s/%s: %v", namespace, name, err)
+	}
+	_, maxSize, err := app.HomeVolumeSizes()
+	if err != nil {
+		return nil, err
+	}
+	resp := &HomeVolumeResponse{
+		Name:       pvc.Name,
+		Phase:      string(pvc.Status.Phase),
+		MaxSize:    maxSize.String(),
+		LastLaunch: pvc.Annotations[HomeVolumeLastLaunchAnnotation],
+	}
+	if pvc.Spec.StorageClassName != nil {
+		resp.StorageClass = *pvc.Spec.StorageClassName
+	}
+	if size, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		resp.Size = size.String()
+	}
+	if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		resp.Capacity = capacity.String()
+	}
+	if used, ok := homeVolumeUsedBytes(client, namespace, name); ok {
+		resp.UsedBytes = &used
+	}
+	return resp, nil
+}
+
+// Subset of the kubelet stats summary with the volume usage of the pods.
+type kubeletStatsSummary struct {
+	Pods []struct {
+		VolumeStats []struct {
+			UsedBytes *int64 `json:"usedBytes"`
+			PVCRef    *struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"pvcRef"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+// Returns the bytes used on the volume from the stats of the kubelet running the pod that mounts it.
+func homeVolumeUsedBytes(client ClusterClient, namespace, claimName string) (int64, bool) {
+	pods, err := client.Kubernetes().CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return 0, false
+	}
+	nodeName := ""
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || len(pod.Spec.NodeName) == 0 {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claimName {
+				nodeName = pod.Spec.NodeName
+			}
+		}
+	}
+	if len(nodeName) == 0 {
+		return 0, false
+	}
+
+	// The fake clientset has no REST client.
+	restClient, ok := client.Kubernetes().CoreV1().RESTClient().(*rest.RESTClient)
+	if !ok || restClient == nil {
+		return 0, false
+	}
+	data, err := restClient.Get().AbsPath("/api/v1/nodes", nodeName, "proxy", "stats", "summary").DoRaw(context.TODO())
+	if err != nil {
+		return 0, false
+	}
+	var summary kubeletStatsSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return 0, false
+	}
+	for _, pod := range summary.Pods {
+		for _, vol := range pod.VolumeStats {
+			if vol.PVCRef != nil && vol.PVCRef.Namespace == namespace && vol.PVCRef.Name == claimName && vol.UsedBytes != nil {
+				return *vol.UsedBytes, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Requests a new size for the home volume of the session, the storage class must allow volume expansion.
+func ResizeHomeVolume(client ClusterClient, namespace, fullName string, size resource.Quantity) error {
+	name := HomeVolumeName(fullName)
+	patch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]string{string(corev1.ResourceStorage): size.String()},
+			},
+		},
+	})
+	if _, err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to resize home volume %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// Deletes the home volume of the session, a new empty one is created on the next launch.
+func DeleteHomeVolume(client ClusterClient, namespace, fullName string) error {
+	name := HomeVolumeName(fullName)
+	err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete home volume %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// Returns the home volumes of apps with a retentionDays that were not launched within it, oldest first.
+// Volumes of apps that are no longer registered are kept.
+func ListExpiredHomeVolumes(client ClusterClient, apps map[string]AppConfigSpec, now time.Time) ([]HomeVolumeGCEntry, error) {
+	pvcs, err := client.Kubernetes().CoreV1().PersistentVolumeClaims("").List(context.TODO(), metav1.ListOptions{LabelSelector: HomeVolumeLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list home volumes: %v", err)
+	}
+	entries := make([]HomeVolumeGCEntry, 0)
+	for _, pvc := range pvcs.Items {
+		app, ok := apps[pvc.Labels[HomeVolumeLabel]]
+		if !ok || !app.HomeVolume.Enabled || app.HomeVolume.RetentionDays <= 0 || pvc.DeletionTimestamp != nil {
+			continue
+		}
+		lastLaunch, err := time.Parse(time.RFC3339, pvc.Annotations[HomeVolumeLastLaunchAnnotation])
+		if err != nil {
+			lastLaunch = pvc.CreationTimestamp.Time
+		}
+		idleDays := int(now.Sub(lastLaunch).Hours() / 24)
+		if idleDays < app.HomeVolume.RetentionDays {
+			continue
+		}
+		entry := HomeVolumeGCEntry{
+			App:        app.Name,
+			User:       pvc.Annotations["app.broker/user"],
+			Namespace:  pvc.Namespace,
+			Name:       pvc.Name,
+			LastLaunch: lastLaunch,
+			IdleDays:   idleDays,
+			DryRun:     app.HomeVolume.GCDryRun,
+		}
+		if size, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+			entry.Size = size.String()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastLaunch.Before(entries[j].LastLaunch)
+	})
+	return entries, nil
+}
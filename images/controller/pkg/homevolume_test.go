@@ -0,0 +1,92 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestListExpiredHomeVolumes(t *testing.T) {
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	homeVolume := func(namespace, app string, created time.Time, lastLaunch string) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         namespace,
+				Name:              broker.HomeVolumeName(app + "-" + namespace),
+				Labels:            map[string]string{broker.HomeVolumeLabel: app},
+				Annotations:       map[string]string{"app.broker/user": namespace + "@example.com"},
+				CreationTimestamp: metav1.NewTime(created),
+			},
+		}
+		if len(lastLaunch) > 0 {
+			pvc.Annotations[broker.HomeVolumeLastLaunchAnnotation] = lastLaunch
+		}
+		pvc.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}
+		return pvc
+	}
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+
+	objects := []runtime.Object{
+		// Expired by the last launch, and by the creation time when it was never launched.
+		homeVolume("alice", "desktop", daysAgo(100), daysAgo(40).Format(time.RFC3339)),
+		homeVolume("bob", "desktop", daysAgo(50), ""),
+		// Launched within the retention.
+		homeVolume("carol", "desktop", daysAgo(100), daysAgo(29).Format(time.RFC3339)),
+		// Apps without retention and apps that are no longer registered keep their volumes.
+		homeVolume("alice", "ide", daysAgo(100), daysAgo(90).Format(time.RFC3339)),
+		homeVolume("alice", "removed", daysAgo(100), daysAgo(90).Format(time.RFC3339)),
+		// Other PVCs are ignored.
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "alice", Name: "data", CreationTimestamp: metav1.NewTime(daysAgo(100))}},
+	}
+	client := brokertest.NewFakeClusterClient(objects...)
+
+	apps := map[string]broker.AppConfigSpec{
+		"desktop": {Name: "desktop", HomeVolume: broker.HomeVolumeSpec{Enabled: true, RetentionDays: 30, GCDryRun: true}},
+		"ide":     {Name: "ide", HomeVolume: broker.HomeVolumeSpec{Enabled: true}},
+	}
+	entries, err := broker.ListExpiredHomeVolumes(client, apps, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []broker.HomeVolumeGCEntry{
+		{App: "desktop", User: "bob@example.com", Namespace: "bob", Name: broker.HomeVolumeName("desktop-bob"), LastLaunch: daysAgo(50), IdleDays: 50, Size: "10Gi", DryRun: true},
+		{App: "desktop", User: "alice@example.com", Namespace: "alice", Name: broker.HomeVolumeName("desktop-alice"), LastLaunch: daysAgo(40), IdleDays: 40, Size: "10Gi", DryRun: true},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d expired home volumes, got %+v", len(want), entries)
+	}
+	for i := range want {
+		// Compare times separately, the creation timestamp loses its location.
+		if !entries[i].LastLaunch.Equal(want[i].LastLaunch) {
+			t.Errorf("expected last launch %v, got %v", want[i].LastLaunch, entries[i].LastLaunch)
+		}
+		entries[i].LastLaunch = want[i].LastLaunch
+		if !reflect.DeepEqual(entries[i], want[i]) {
+			t.Errorf("expected entry %+v, got %+v", want[i], entries[i])
+		}
+	}
+}
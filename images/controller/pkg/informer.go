@@ -22,10 +22,13 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
@@ -107,3 +110,117 @@ func getDynamicInformer(cfg *rest.Config, resourceType string, resyncDuration ti
 	informer := factory.ForResource(*gvr)
 	return informer, nil
 }
+
+// Watches pods in a single namespace matching the label selector.
+// The handler is called for every add, update and delete event, after the lister has been updated.
+type PodInformer struct {
+	informer cache.SharedIndexInformer
+	Lister   corelisters.PodLister
+}
+
+func NewPodInformer(client ClusterClient, namespace, selector string, resyncDuration time.Duration, handler func()) *PodInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(client.Kubernetes(), resyncDuration,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		}),
+	)
+	podInformer := factory.Core().V1().Pods()
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { handler() },
+		UpdateFunc: func(oldObj, newObj interface{}) { handler() },
+		DeleteFunc: func(obj interface{}) { handler() },
+	})
+	return &PodInformer{
+		informer: podInformer.Informer(),
+		Lister:   podInformer.Lister(),
+	}
+}
+
+// Starts the informer and waits for the initial cache sync.
+func (pi *PodInformer) Run(stopCh <-chan struct{}) error {
+	go pi.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, pi.informer.HasSynced) {
+		return fmt.Errorf("failed to sync pod informer")
+	}
+	return nil
+}
+
+// Watches the ConfigMaps in a single namespace.
+// The handler is called with the ConfigMap name for every add, update and delete event, after the lister has been updated.
+type ConfigMapInformer struct {
+	informer cache.SharedIndexInformer
+	Lister   corelisters.ConfigMapLister
+}
+
+func NewConfigMapInformer(client ClusterClient, namespace string, resyncDuration time.Duration, handler func(name string)) *ConfigMapInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(client.Kubernetes(), resyncDuration,
+		informers.WithNamespace(namespace),
+	)
+	cmInformer := factory.Core().V1().ConfigMaps()
+	cmInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				handler(cm.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if cm, ok := newObj.(*corev1.ConfigMap); ok {
+				handler(cm.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				handler(cm.Name)
+			}
+		},
+	})
+	return &ConfigMapInformer{
+		informer: cmInformer.Informer(),
+		Lister:   cmInformer.Lister(),
+	}
+}
+
+// Starts the informer and waits for the initial cache sync.
+func (ci *ConfigMapInformer) Run(stopCh <-chan struct{}) error {
+	go ci.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, ci.informer.HasSynced) {
+		return fmt.Errorf("failed to sync configmap informer")
+	}
+	return nil
+}
+
+// Returns the ConfigMap from the informer cache, false if it does not exist.
+func (ci *ConfigMapInformer) Get(namespace, name string) (ConfigMapObject, bool, error) {
+	cm, err := ci.Lister.ConfigMaps(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return ConfigMapObject{}, false, nil
+	}
+	if err != nil {
+		return ConfigMapObject{}, false, err
+	}
+	return NewConfigMapObject(cm), true, nil
+}
+
+// Returns true if the pod has the Ready condition set to True.
+func IsPodReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Returns the time the pod became ready, false if it is not ready.
+func PodReadyTime(pod *corev1.Pod) (time.Time, bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return cond.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,373 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Period after which the JWKS keys are re-fetched.
+	jwksRefreshPeriod = 1 * time.Hour
+	// Min period between re-fetching the JWKS keys when a token has an unknown key ID.
+	jwksMinRefreshPeriod = 1 * time.Minute
+	// Allowed clock skew when validating token times.
+	jwtLeeway = 60 * time.Second
+	// Max size of a JWKS document fetched from a URL.
+	jwksMaxBytes = 1 << 20
+)
+
+// JSON Web Key, only the fields for RSA and EC public keys are used.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Returns the RSA or ECDSA public key.
+func (k *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus for key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent for key %s: %v", k.Kid, err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s for key %s", k.Crv, k.Kid)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate for key %s: %v", k.Kid, err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate for key %s: %v", k.Kid, err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s for key %s", k.Kty, k.Kid)
+	}
+}
+
+// JWKSKeySet is a cached set of public keys read from a JWKS file or URL.
+// Keys are refreshed in the background while the cached keys are served, only lookups of unknown keys wait for a refresh.
+type JWKSKeySet struct {
+	sync.Mutex
+	source      string
+	httpClient  *http.Client
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	lastErr     error
+	// Closed when the refresh in progress completes, nil if no refresh is running.
+	refreshDone chan struct{}
+}
+
+// Creates a key set from a JWKS file path or http(s) URL.
+func NewJWKSKeySet(source string) *JWKSKeySet {
+	return &JWKSKeySet{
+		source:     source,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]crypto.PublicKey, 0),
+	}
+}
+
+func (ks *JWKSKeySet) fetch() ([]byte, error) {
+	if strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://") {
+		resp, err := ks.httpClient.Get(ks.source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS from %s: %v", ks.source, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch JWKS from %s: status %d", ks.source, resp.StatusCode)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS from %s: %v", ks.source, err)
+		}
+		if len(data) > jwksMaxBytes {
+			return nil, fmt.Errorf("JWKS from %s exceeds max size of %d bytes", ks.source, jwksMaxBytes)
+		}
+		return data, nil
+	}
+	return ioutil.ReadFile(ks.source)
+}
+
+// Reads the keys from the source.
+func (ks *JWKSKeySet) load() (map[string]crypto.PublicKey, error) {
+	data, err := ks.fetch()
+	if err != nil {
+		return nil, err
+	}
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS from %s: %v", ks.source, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(keySet.Keys))
+	for _, k := range keySet.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			log.Printf("skipping JWKS key: %v", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+// Starts a refresh of the keys unless one is already running, must be called with the lock held.
+// Returns a channel that is closed when the refresh completes.
+func (ks *JWKSKeySet) startRefresh() chan struct{} {
+	if ks.refreshDone != nil {
+		return ks.refreshDone
+	}
+	done := make(chan struct{})
+	ks.refreshDone = done
+	ks.lastRefresh = time.Now()
+	go func() {
+		keys, err := ks.load()
+		ks.Lock()
+		if err != nil {
+			log.Printf("failed to refresh JWKS, using cached keys: %v", err)
+		} else {
+			ks.keys = keys
+		}
+		ks.lastErr = err
+		ks.refreshDone = nil
+		ks.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// Returns the public key with the given key ID.
+// Stale key sets are refreshed in the background, a lookup only waits for a refresh if the key is not found.
+func (ks *JWKSKeySet) Key(kid string) (crypto.PublicKey, error) {
+	ks.Lock()
+	if time.Since(ks.lastRefresh) > jwksRefreshPeriod {
+		ks.startRefresh()
+	}
+	if key, ok := ks.keys[kid]; ok {
+		ks.Unlock()
+		return key, nil
+	}
+
+	// Unknown keys wait for the running refresh, or start one if the keys were not refreshed recently.
+	done := ks.refreshDone
+	if done == nil && time.Since(ks.lastRefresh) > jwksMinRefreshPeriod {
+		done = ks.startRefresh()
+	}
+	ks.Unlock()
+	if done == nil {
+		return nil, fmt.Errorf("no JWKS key found with kid '%s'", kid)
+	}
+	<-done
+
+	ks.Lock()
+	defer ks.Unlock()
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	if ks.lastErr != nil {
+		return nil, ks.lastErr
+	}
+	return nil, fmt.Errorf("no JWKS key found with kid '%s'", kid)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verifies the signature, issuer, audience and times of a compact JWS token and returns its claims.
+// Supported algorithms are RS256, RS384, RS512, ES256 and ES384.
+func VerifyJWT(token string, keys *JWKSKeySet, issuer, audience string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	key, err := keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+	claims := make(map[string]interface{}, 0)
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+
+	if err := validateJWTClaims(claims, issuer, audience, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm: %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("token algorithm %s does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is only defined for one curve.
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384"}
+		if curve, ok := curves[alg]; !ok || pub.Curve.Params().Name != curve {
+			return fmt.Errorf("token algorithm %s does not match EC key with curve %s", alg, pub.Curve.Params().Name)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type")
+	}
+	return nil
+}
+
+func validateJWTClaims(claims map[string]interface{}, issuer, audience string, now time.Time) error {
+	if len(issuer) > 0 {
+		if iss, _ := claims["iss"].(string); iss != issuer {
+			return fmt.Errorf("invalid token issuer: %s", iss)
+		}
+	}
+
+	if len(audience) > 0 {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == audience
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok && s == audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid token audience")
+		}
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token is missing exp claim")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(iat), 0)) {
+		return fmt.Errorf("token was issued in the future")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testJWKS(kid string, key *ecdsa.PrivateKey) []byte {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	data, _ := json.Marshal(jsonWebKeySet{Keys: []JSONWebKey{{
+		Kty: "EC",
+		Kid: kid,
+		Crv: key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}}})
+	return data
+}
+
+// Signs the claims with the key, alg sets the token header and the hash independently of the key curve.
+func signTestJWT(t *testing.T, alg, kid string, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := crypto.SHA256
+	if alg == "ES384" {
+		hash = crypto.SHA384
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyJWTECDSACurve(t *testing.T) {
+	p256 := newTestECKey(t, elliptic.P256())
+	p384 := newTestECKey(t, elliptic.P384())
+	now := time.Now()
+	claims := map[string]interface{}{"iss": "issuer", "aud": "audience", "exp": now.Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name    string
+		alg     string
+		key     *ecdsa.PrivateKey
+		wantErr bool
+	}{
+		{"ES256 with P-256 key", "ES256", p256, false},
+		{"ES384 with P-384 key", "ES384", p384, false},
+		{"ES256 with P-384 key", "ES256", p384, true},
+		{"ES384 with P-256 key", "ES384", p256, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := NewJWKSKeySet("")
+			keys.keys["kid"] = &tc.key.PublicKey
+			keys.lastRefresh = now
+
+			token := signTestJWT(t, tc.alg, "kid", tc.key, claims)
+			_, err := VerifyJWT(token, keys, "issuer", "audience", now)
+			if tc.wantErr && err == nil {
+				t.Errorf("expected token to be rejected")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("expected token to be valid, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestJWKSKeySetServesCachedKeysDuringRefresh(t *testing.T) {
+	key := newTestECKey(t, elliptic.P256())
+	jwks := testJWKS("kid", key)
+
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests after the first one block, like a slow identity provider.
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	keys := NewJWKSKeySet(server.URL)
+	if _, err := keys.Key("kid"); err != nil {
+		t.Fatalf("initial lookup failed: %v", err)
+	}
+
+	// Make the key set stale, lookups of cached keys must not wait for the refresh.
+	keys.Lock()
+	keys.lastRefresh = time.Now().Add(-2 * jwksRefreshPeriod)
+	keys.Unlock()
+
+	result := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := keys.Key("kid")
+			result <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Errorf("expected cached key, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("lookup of cached key blocked on the JWKS refresh")
+		}
+	}
+
+	// Concurrent lookups of a stale key set start a single refresh.
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected a single background refresh, got %d requests", n)
+	}
+}
+
+func TestJWKSKeySetMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [], "padding": "` + strings.Repeat("a", jwksMaxBytes) + `"}`))
+	}))
+	defer server.Close()
+
+	keys := NewJWKSKeySet(server.URL)
+	_, err := keys.Key("kid")
+	if err == nil || !strings.Contains(err.Error(), "exceeds max size") {
+		t.Errorf("expected max size error, got: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Label value used for requests that do not map to a registered app.
+const MetricsAppNone = "none"
+
+// Reasons recorded when a session is deleted.
+const (
+	SessionDeleteReasonUser    = "user"
+	SessionDeleteReasonSelf    = "self"
+	SessionDeleteReasonPodGone = "pod-gone"
+	SessionDeleteReasonAdmin   = "admin"
+)
+
+// Reasons recorded when a session fails to be created.
+const (
+	SessionCreateErrorQuota       = "quota"
+	SessionCreateErrorCapacity    = "capacity"
+	SessionCreateErrorInternal    = "error"
+	SessionCreateErrorDrained     = "drained"
+	SessionCreateErrorMaintenance = "maintenance"
+)
+
+var (
+	HTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_http_requests_total",
+		Help: "Number of HTTP requests by app, method and response code.",
+	}, []string{"app", "method", "code"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "broker_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by app and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"app", "method"})
+
+	SessionsCreatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_sessions_created_total",
+		Help: "Number of sessions created by app.",
+	}, []string{"app"})
+
+	SessionsDeletedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_sessions_deleted_total",
+		Help: "Number of sessions deleted by app and reason.",
+	}, []string{"app", "reason"})
+
+	SessionCreateErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_session_create_errors_total",
+		Help: "Number of failed session launches by app and reason.",
+	}, []string{"app", "reason"})
+
+	SessionTimeToReady = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "broker_session_time_to_ready_seconds",
+		Help:    "Time from session creation until the session was first reported as ready.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"app"})
+
+	ReservationPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_reservation_pods",
+		Help: "Number of pods in the reservation pool by app and state, available or reserved.",
+	}, []string{"app", "state"})
+
+	WaitQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_wait_queue_length",
+		Help: "Number of users waiting for a reservation by app.",
+	}, []string{"app"})
+
+	ReservationPoolTargetReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_reservation_pool_target_replicas",
+		Help: "Warm pool size computed by the pool autoscaler by app.",
+	}, []string{"app"})
+
+	ReservationPoolReservationRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_reservation_pool_reservations_per_minute",
+		Help: "Smoothed reservation rate used by the ewma pool sizer by app.",
+	}, []string{"app"})
+
+	ReservationPoolRefillSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_reservation_pool_refill_seconds",
+		Help: "Smoothed time for a new pool pod to become available used by the ewma pool sizer by app.",
+	}, []string{"app"})
+
+	ReservationPoolEmptyProbability = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "broker_reservation_pool_empty_probability",
+		Help: "Estimated probability that a reservation finds the recommended pool empty by app.",
+	}, []string{"app"})
+
+	ImagePullJobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_image_pull_jobs_total",
+		Help: "Number of image pull jobs by result.",
+	}, []string{"result"})
+
+	ImagePullDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "broker_image_pull_duration_seconds",
+		Help:    "Duration of successful image pull jobs.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+	})
+
+	ApplyErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_apply_errors_total",
+		Help: "Number of failed kubectl calls and manifest applies by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequestsTotal,
+		HTTPRequestDuration,
+		SessionsCreatedTotal,
+		SessionsDeletedTotal,
+		SessionCreateErrorsTotal,
+		SessionTimeToReady,
+		ReservationPods,
+		WaitQueueLength,
+		ReservationPoolTargetReplicas,
+		ReservationPoolReservationRate,
+		ReservationPoolRefillSeconds,
+		ReservationPoolEmptyProbability,
+		ImagePullJobsTotal,
+		ImagePullDuration,
+		ApplyErrorsTotal,
+	)
+}
+
+// Serves /metrics on the port from the METRICS_PORT env var, or the default port if not set.
+func StartMetricsServer(defaultPort string) {
+	port := os.Getenv("METRICS_PORT")
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Serving metrics on port %s", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// Captures the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Wraps the handler to record request counts and latencies.
+// appLabel returns the app name for the request, it should return MetricsAppNone for unknown apps to keep the label cardinality bounded.
+func InstrumentHandler(next http.Handler, appLabel func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		app := appLabel(r)
+		HTTPRequestsTotal.WithLabelValues(app, r.Method, fmt.Sprintf("%d", rec.status)).Inc()
+		HTTPRequestDuration.WithLabelValues(app, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Sessions waiting to become ready, keyed by app and user.
+var pendingSessions = struct {
+	sync.Mutex
+	created map[string]time.Time
+}{created: make(map[string]time.Time, 0)}
+
+// Records a new session, the time to ready is observed by the first call to RecordSessionReady.
+func RecordSessionCreated(app, user string) {
+	SessionsCreatedTotal.WithLabelValues(app).Inc()
+	pendingSessions.Lock()
+	defer pendingSessions.Unlock()
+	pendingSessions.created[sessionActivityKey(app, user)] = time.Now()
+}
+
+// Records that the session is ready, only the first call after the session was created is observed.
+func RecordSessionReady(app, user string) {
+	pendingSessions.Lock()
+	defer pendingSessions.Unlock()
+	key := sessionActivityKey(app, user)
+	created, ok := pendingSessions.created[key]
+	if !ok {
+		return
+	}
+	SessionTimeToReady.WithLabelValues(app).Observe(time.Since(created).Seconds())
+	delete(pendingSessions.created, key)
+}
+
+// Records a deleted session.
+func RecordSessionDeleted(app, user, reason string) {
+	SessionsDeletedTotal.WithLabelValues(app, reason).Inc()
+	pendingSessions.Lock()
+	defer pendingSessions.Unlock()
+	delete(pendingSessions.created, sessionActivityKey(app, user))
+}
+
+// Records a failed session launch.
+func RecordSessionCreateError(app, reason string) {
+	SessionCreateErrorsTotal.WithLabelValues(app, reason).Inc()
+}
+
+// Records a failed kubectl call or manifest apply.
+func RecordApplyError(operation string) {
+	ApplyErrorsTotal.WithLabelValues(operation).Inc()
+}
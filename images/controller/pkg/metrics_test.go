@@ -0,0 +1,105 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestAppLabelFromPath(t *testing.T) {
+	registry := broker.NewAppRegistry(filepath.Join(t.TempDir(), "apps.json"))
+	if _, err := registry.Publish(map[string]broker.AppConfigSpec{"desktop": {Name: "desktop"}}, broker.NetworkPolicyTemplateData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/desktop/":        "desktop",
+		"/desktop/config":  "desktop",
+		"/unknown/":        broker.MetricsAppNone,
+		"/":                broker.MetricsAppNone,
+		"/admin/sessions/": broker.MetricsAppNone,
+	}
+	for path, want := range tests {
+		r := httptest.NewRequest("GET", path, nil)
+		if got := registry.AppLabelFromPath(r); got != want {
+			t.Errorf("AppLabelFromPath(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestNotifySessionReady(t *testing.T) {
+	events := make(chan broker.WebhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event broker.WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer srv.Close()
+
+	namespace := "user-1234"
+	labels := map[string]string{"app": "desktop"}
+	client := brokertest.NewFakeClusterClient(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "desktop-1234-0", Labels: labels},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	})
+	notifier, err := broker.NewWebhookNotifierFromParams(client, map[string]string{
+		"Webhooks": fmt.Sprintf(`[{"name": "test", "url": "%s"}]`, srv.URL),
+	}, broker.DefaultBrokerNamespace, "pod-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event is sent once per session, even when the broker restarted and has no record of the session.
+	for i := 0; i < 2; i++ {
+		status, err := client.GetPodStatus(namespace, "app=desktop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != "ready" {
+			t.Fatalf("expected ready status, got %s", status.Status)
+		}
+		notifier.NotifySessionReady(client, namespace, "desktop", "user@example.com", status)
+	}
+
+	select {
+	case event := <-events:
+		if event.Event != broker.WebhookEventSessionReady || event.User != "user@example.com" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session.ready event was not sent")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("expected a single session.ready event, got another: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// Current demand on the reservation pool of an app.
+type PoolDemand struct {
+	Reserved int
+	Queued   int
+}
+
+// Warm pool size recommended for an app and the inputs it was computed from, the warm pool is the number of Deployment replicas.
+type PoolRecommendation struct {
+	App         string `json:"app"`
+	Sizer       string `json:"sizer"`
+	Replicas    int    `json:"replicas"`
+	MinReplicas int    `json:"minReplicas"`
+	MaxReplicas int    `json:"maxReplicas"`
+	// Name of the active schedule window, empty when the autoscaling defaults apply.
+	Window   string `json:"window,omitempty"`
+	Reserved int    `json:"reserved"`
+	Queued   int    `json:"queued"`
+	// Smoothed reservation rate and time for a new pod to become available, set by the ewma sizer.
+	ReservationsPerMinute float64 `json:"reservationsPerMinute,omitempty"`
+	RefillSeconds         float64 `json:"refillSeconds,omitempty"`
+	// Time for the recommended pool to drain at the reservation rate, without refills.
+	DrainSeconds float64 `json:"drainSeconds,omitempty"`
+	// Estimated probability that a reservation finds the recommended pool empty.
+	EmptyPoolProbability float64   `json:"emptyPoolProbability,omitempty"`
+	Reason               string    `json:"reason"`
+	Time                 time.Time `json:"time"`
+}
+
+// Returns an error if the pool autoscaling spec is invalid.
+func (spec *AppConfigSpec) ValidatePoolAutoscaling() error {
+	as := spec.Deployment.Autoscaling
+	if !as.Enabled {
+		return nil
+	}
+	min, max := spec.defaultPoolBounds()
+	if min < 0 || max < min {
+		return fmt.Errorf("invalid pool autoscaling bounds: minReplicas %d, maxReplicas %d", min, max)
+	}
+	switch as.Sizer {
+	case "", PoolSizerHeadroom, PoolSizerEWMA:
+	default:
+		return fmt.Errorf("invalid pool autoscaling sizer '%s', must be one of: %s, %s", as.Sizer, PoolSizerHeadroom, PoolSizerEWMA)
+	}
+	if as.HeadroomPercent < 0 {
+		return fmt.Errorf("invalid pool autoscaling headroomPercent: %d", as.HeadroomPercent)
+	}
+	if as.EmptyPoolTarget < 0 || as.EmptyPoolTarget >= 1 {
+		return fmt.Errorf("invalid pool autoscaling emptyPoolTarget: %v, must be between 0 and 1", as.EmptyPoolTarget)
+	}
+	if len(as.RateWindow) > 0 {
+		if d, err := time.ParseDuration(as.RateWindow); err != nil || d <= 0 {
+			return fmt.Errorf("invalid pool autoscaling rateWindow '%s'", as.RateWindow)
+		}
+	}
+	for i, window := range as.Schedules {
+		if _, err := ParseCronSchedule(window.Schedule); err != nil {
+			return fmt.Errorf("invalid pool schedule %s: %v", poolScheduleName(window, i), err)
+		}
+		if d, err := time.ParseDuration(window.Duration); err != nil || d <= 0 {
+			return fmt.Errorf("invalid pool schedule %s: invalid duration '%s'", poolScheduleName(window, i), window.Duration)
+		}
+		if window.MinReplicas < 0 || window.MaxReplicas < window.MinReplicas {
+			return fmt.Errorf("invalid pool schedule %s: minReplicas %d, maxReplicas %d", poolScheduleName(window, i), window.MinReplicas, window.MaxReplicas)
+		}
+	}
+	return nil
+}
+
+// Returns the autoscaling bounds that apply outside of the schedule windows.
+// The minReplicas defaults to the deployment replicas and the maxReplicas to the minReplicas.
+func (spec *AppConfigSpec) defaultPoolBounds() (int, int) {
+	as := spec.Deployment.Autoscaling
+	min := DefaultDeploymentReplicas
+	if as.MinReplicas != nil {
+		min = *as.MinReplicas
+	} else if spec.Deployment.Replicas != nil {
+		min = *spec.Deployment.Replicas
+	}
+	max := as.MaxReplicas
+	if max == 0 {
+		max = min
+	}
+	return min, max
+}
+
+func poolScheduleName(window PoolScheduleSpec, i int) string {
+	if len(window.Name) > 0 {
+		return window.Name
+	}
+	return fmt.Sprintf("schedules[%d]", i)
+}
+
+// Returns the warm pool bounds at the given time and the name of the schedule window they come from.
+// Windows start when their cron schedule fires, in UTC, and last for their duration. The first active window is used.
+func (spec *AppConfigSpec) PoolSizeBounds(now time.Time) (int, int, string, error) {
+	if err := spec.ValidatePoolAutoscaling(); err != nil {
+		return 0, 0, "", err
+	}
+	for i, window := range spec.Deployment.Autoscaling.Schedules {
+		schedule, _ := ParseCronSchedule(window.Schedule)
+		duration, _ := time.ParseDuration(window.Duration)
+		if _, ok := schedule.LastFiredWithin(now.UTC(), duration); ok {
+			return window.MinReplicas, window.MaxReplicas, poolScheduleName(window, i), nil
+		}
+	}
+	min, max := spec.defaultPoolBounds()
+	return min, max, "", nil
+}
+
+// Computes the warm pool size recommended by the sizer for the demand at the given time, within the bounds at that time.
+func (spec *AppConfigSpec) ComputePoolSize(sizer PoolSizer, demand PoolDemand, now time.Time) (PoolRecommendation, error) {
+	min, max, window, err := spec.PoolSizeBounds(now)
+	if err != nil {
+		return PoolRecommendation{}, err
+	}
+	rec := sizer.Recommend(*spec, demand, now)
+	if rec.Replicas < min {
+		rec.Replicas = min
+		rec.Reason = fmt.Sprintf("%s, raised to minReplicas", rec.Reason)
+	}
+	if rec.Replicas > max {
+		rec.Replicas = max
+		rec.Reason = fmt.Sprintf("%s, capped at maxReplicas", rec.Reason)
+	}
+	rec.App = spec.Name
+	rec.MinReplicas = min
+	rec.MaxReplicas = max
+	rec.Window = window
+	rec.Reserved = demand.Reserved
+	rec.Queued = demand.Queued
+	rec.Time = now
+	return rec, nil
+}
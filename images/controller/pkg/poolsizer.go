@@ -0,0 +1,217 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Names of the pool sizers selected with the autoscaling sizer field.
+const (
+	PoolSizerHeadroom = "headroom"
+	PoolSizerEWMA     = "ewma"
+)
+
+// Defaults for the ewma sizer.
+const (
+	DefaultEmptyPoolTarget = 0.05
+	DefaultPoolRateWindow  = 30 * time.Minute
+	DefaultPoolRefillTime  = 2 * time.Minute
+)
+
+// Weight of a new refill time sample in the smoothed refill time.
+const poolRefillSmoothing = 0.3
+
+// Upper limit of the pool size searched by the ewma sizer.
+const maxPoolSizerReplicas = 10000
+
+// PoolSizer recommends the warm pool size of a reservation app from its observed demand.
+// A PoolSizer holds the history of a single app.
+type PoolSizer interface {
+	// Records that a pod of the app was reserved.
+	ObserveReservation(t time.Time)
+	// Records the time a new pod of the app took to become available after it was created.
+	ObserveRefill(d time.Duration)
+	// Returns the recommended warm pool size, before the autoscaling bounds are applied.
+	Recommend(spec AppConfigSpec, demand PoolDemand, now time.Time) PoolRecommendation
+}
+
+// Creates the pool sizer selected by the app autoscaling spec, the headroom sizer is the default.
+func NewPoolSizer(spec AppConfigSpec) (PoolSizer, error) {
+	switch spec.Deployment.Autoscaling.Sizer {
+	case "", PoolSizerHeadroom:
+		return &HeadroomPoolSizer{}, nil
+	case PoolSizerEWMA:
+		return NewEWMAPoolSizer(), nil
+	default:
+		return nil, fmt.Errorf("unknown pool sizer '%s'", spec.Deployment.Autoscaling.Sizer)
+	}
+}
+
+// HeadroomPoolSizer keeps one pod for each queued user plus headroomPercent of the current reservations.
+type HeadroomPoolSizer struct{}
+
+func (s *HeadroomPoolSizer) ObserveReservation(t time.Time) {}
+
+func (s *HeadroomPoolSizer) ObserveRefill(d time.Duration) {}
+
+func (s *HeadroomPoolSizer) Recommend(spec AppConfigSpec, demand PoolDemand, now time.Time) PoolRecommendation {
+	headroomPercent := spec.Deployment.Autoscaling.HeadroomPercent
+	headroom := (demand.Reserved*headroomPercent + 99) / 100
+	return PoolRecommendation{
+		Sizer:    PoolSizerHeadroom,
+		Replicas: demand.Queued + headroom,
+		Reason:   fmt.Sprintf("%d queued users plus %d%% headroom over %d reservations", demand.Queued, headroomPercent, demand.Reserved),
+	}
+}
+
+// EWMAPoolSizer tracks the reservation rate in a rolling window and the time for new pods to become available, both smoothed with an EWMA.
+// Reservations are assumed to arrive as a Poisson process, a reservation finds the pool empty when more reservations arrive
+// during the refill time than there are warm pods. The recommended pool is the smallest one for which that probability is
+// below the emptyPoolTarget, plus one pod for each queued user.
+type EWMAPoolSizer struct {
+	sync.Mutex
+	reservations []time.Time
+	rate         float64
+	lastUpdate   time.Time
+	refill       time.Duration
+	refillCount  int
+	created      time.Time
+}
+
+func NewEWMAPoolSizer() *EWMAPoolSizer {
+	return &EWMAPoolSizer{
+		reservations: make([]time.Time, 0),
+		refill:       DefaultPoolRefillTime,
+	}
+}
+
+func (s *EWMAPoolSizer) ObserveReservation(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.reservations = append(s.reservations, t)
+}
+
+func (s *EWMAPoolSizer) ObserveRefill(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if s.refillCount == 0 {
+		s.refill = d
+	} else {
+		s.refill = time.Duration(poolRefillSmoothing*float64(d) + (1-poolRefillSmoothing)*float64(s.refill))
+	}
+	s.refillCount++
+}
+
+// Updates the smoothed reservation rate, in reservations per second, from the reservations in the window.
+// The smoothing factor depends on the time since the last update so that the result does not depend on how often it is called,
+// its time constant is a quarter of the window since the window rate is already an average.
+func (s *EWMAPoolSizer) updateRate(window time.Duration, now time.Time) float64 {
+	if s.created.IsZero() {
+		s.created = now
+	}
+
+	// Drop reservations that left the window.
+	kept := s.reservations[:0]
+	for _, t := range s.reservations {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	s.reservations = kept
+
+	// Until the sizer has been running for a full window, the rate is measured over the time it has been running.
+	span := window
+	if running := now.Sub(s.created); running < span {
+		span = running
+	}
+	if span < time.Minute {
+		span = time.Minute
+	}
+	windowRate := float64(len(s.reservations)) / span.Seconds()
+
+	if s.lastUpdate.IsZero() {
+		s.rate = windowRate
+	} else {
+		alpha := 1 - math.Exp(-4*now.Sub(s.lastUpdate).Seconds()/window.Seconds())
+		s.rate = alpha*windowRate + (1-alpha)*s.rate
+	}
+	s.lastUpdate = now
+	return s.rate
+}
+
+func (s *EWMAPoolSizer) Recommend(spec AppConfigSpec, demand PoolDemand, now time.Time) PoolRecommendation {
+	as := spec.Deployment.Autoscaling
+	target := as.EmptyPoolTarget
+	if target == 0 {
+		target = DefaultEmptyPoolTarget
+	}
+	window := DefaultPoolRateWindow
+	if d, err := time.ParseDuration(as.RateWindow); err == nil && d > 0 {
+		window = d
+	}
+
+	s.Lock()
+	rate := s.updateRate(window, now)
+	refill := s.refill
+	s.Unlock()
+
+	replicas, emptyProbability := PoissonPoolSize(rate*refill.Seconds(), target)
+
+	rec := PoolRecommendation{
+		Sizer:                 PoolSizerEWMA,
+		Replicas:              replicas + demand.Queued,
+		ReservationsPerMinute: rate * 60,
+		RefillSeconds:         refill.Seconds(),
+		EmptyPoolProbability:  emptyProbability,
+		Reason: fmt.Sprintf("%.2f reservations/min with %s refill time needs %d pods for empty pool probability %.3f <= %.3f, plus %d queued users",
+			rate*60, refill.Round(time.Second), replicas, emptyProbability, target, demand.Queued),
+	}
+	if rate > 0 {
+		rec.DrainSeconds = float64(replicas) / rate
+	}
+	return rec
+}
+
+// Returns the smallest pool size for which the probability that a Poisson distributed number of arrivals with the given mean
+// exhausts the pool is at most the target, and that probability.
+func PoissonPoolSize(mean, target float64) (int, float64) {
+	// P(X >= n) = 1 - P(X <= n-1), the pmf is computed in log space so that large means do not underflow.
+	cdf := 0.0
+	for n := 0; n < maxPoolSizerReplicas; n++ {
+		tail := 1 - cdf
+		if tail <= target {
+			return n, math.Max(tail, 0)
+		}
+		cdf += poissonPMF(mean, n)
+	}
+	return maxPoolSizerReplicas, math.Max(1-cdf, 0)
+}
+
+func poissonPMF(mean float64, k int) float64 {
+	if mean == 0 {
+		if k == 0 {
+			return 1
+		}
+		return 0
+	}
+	lgamma, _ := math.Lgamma(float64(k + 1))
+	return math.Exp(-mean + float64(k)*math.Log(mean) - lgamma)
+}
@@ -0,0 +1,217 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns n reservation times spread evenly over the duration after start.
+func reservationTrace(start time.Time, duration time.Duration, n int) []time.Time {
+	trace := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		trace = append(trace, start.Add(time.Duration(i)*duration/time.Duration(n)))
+	}
+	return trace
+}
+
+func TestEWMAPoolSizerUpdateRate(t *testing.T) {
+	t0 := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+	window := 30 * time.Minute
+
+	tests := []struct {
+		name         string
+		reservations []time.Time
+		// Times of the updates, the rate is checked after the last one.
+		updates  []time.Time
+		wantRate float64
+	}{
+		{"zero rate", nil, []time.Time{t0, t0.Add(time.Hour)}, 0},
+		{"less than a minute running", reservationTrace(t0, 10*time.Second, 3), []time.Time{t0.Add(10 * time.Second)}, 3.0 / 60},
+		{"first window", reservationTrace(t0, 10*time.Minute, 5), []time.Time{t0.Add(10 * time.Minute)}, 5.0 / 600},
+		{"full window", append(reservationTrace(t0, 10*time.Minute, 10), reservationTrace(t0.Add(45*time.Minute), 10*time.Minute, 6)...), []time.Time{t0.Add(time.Hour)}, 6.0 / 1800},
+		// A burst of 15 reservations after a steady minute rate, 8 of the steady reservations left the window.
+		{"smoothed", append(reservationTrace(t0.Add(15*time.Second), 30*time.Minute, 30), reservationTrace(t0.Add(30*time.Minute+15*time.Second), 7*time.Minute, 15)...),
+			[]time.Time{t0.Add(30 * time.Minute), t0.Add(37*time.Minute + 30*time.Second)}, (1-math.Exp(-1))*37.0/1800 + math.Exp(-1)*30.0/1800},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewEWMAPoolSizer()
+			s.created = t0
+			var rate float64
+			for _, now := range tc.updates {
+				for _, r := range tc.reservations {
+					if !r.After(now) && (s.lastUpdate.IsZero() || r.After(s.lastUpdate)) {
+						s.ObserveReservation(r)
+					}
+				}
+				rate = s.updateRate(window, now)
+			}
+			if math.Abs(rate-tc.wantRate) > 1e-9 {
+				t.Errorf("expected rate %v, got %v", tc.wantRate, rate)
+			}
+		})
+	}
+}
+
+func TestEWMAPoolSizerRateDecays(t *testing.T) {
+	t0 := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+	window := 30 * time.Minute
+	s := NewEWMAPoolSizer()
+	s.created = t0.Add(-window)
+	for _, r := range reservationTrace(t0.Add(-window+15*time.Second), window, 60) {
+		s.ObserveReservation(r)
+	}
+	initial := s.updateRate(window, t0)
+
+	// Without new reservations the rate decays with a time constant of a quarter of the window.
+	got := s.updateRate(window, t0.Add(window/4))
+	want := (1-math.Exp(-1))*45.0/1800 + math.Exp(-1)*initial
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("expected rate %v, got %v", want, got)
+	}
+	if len(s.reservations) != 45 {
+		t.Errorf("expected reservations outside the window to be dropped, got %d", len(s.reservations))
+	}
+}
+
+func TestPoissonPoolSize(t *testing.T) {
+	tests := []struct {
+		mean   float64
+		target float64
+		want   int
+	}{
+		// A single pod is needed even without reservations so that the pool is never empty.
+		{0, 0.05, 1},
+		{3, 0.05, 7},
+		{4, 0.05, 9},
+		{4, 0.5, 5},
+		{4, 0.999, 1},
+	}
+	for _, tc := range tests {
+		got, p := PoissonPoolSize(tc.mean, tc.target)
+		if got != tc.want {
+			t.Errorf("PoissonPoolSize(%v, %v) = %d, want %d", tc.mean, tc.target, got, tc.want)
+		}
+		if p > tc.target || p < 0 {
+			t.Errorf("PoissonPoolSize(%v, %v) empty pool probability %v is not within the target", tc.mean, tc.target, p)
+		}
+	}
+
+	// Large means do not underflow, the pool is about the mean plus 1.645 standard deviations.
+	if got, p := PoissonPoolSize(1000, 0.05); got < 1040 || got > 1060 || math.IsNaN(p) {
+		t.Errorf("PoissonPoolSize(1000, 0.05) = %d, %v", got, p)
+	}
+}
+
+func TestEWMAPoolSizerRecommend(t *testing.T) {
+	t0 := time.Date(2021, 6, 7, 8, 0, 0, 0, time.UTC)
+	spec := AppConfigSpec{}
+	spec.Deployment.Autoscaling = PoolAutoscalingSpec{Enabled: true, Sizer: PoolSizerEWMA}
+
+	tests := []struct {
+		name         string
+		reservations int
+		refills      []time.Duration
+		queued       int
+		want         int
+	}{
+		{"no demand", 0, nil, 0, 1},
+		{"default refill time", 60, nil, 0, 9},
+		{"smoothed refill time", 60, []time.Duration{60 * time.Second, 160 * time.Second}, 0, 7},
+		{"queued users", 60, []time.Duration{60 * time.Second, 160 * time.Second}, 3, 10},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewEWMAPoolSizer()
+			s.created = t0.Add(-30 * time.Minute)
+			for _, r := range reservationTrace(t0.Add(-30*time.Minute+15*time.Second), 30*time.Minute, tc.reservations) {
+				s.ObserveReservation(r)
+			}
+			for _, d := range tc.refills {
+				s.ObserveRefill(d)
+			}
+			rec := s.Recommend(spec, PoolDemand{Queued: tc.queued}, t0)
+			if rec.Replicas != tc.want {
+				t.Errorf("expected %d replicas, got %d: %s", tc.want, rec.Replicas, rec.Reason)
+			}
+		})
+	}
+}
+
+func TestComputePoolSize(t *testing.T) {
+	// 2021-06-07 is a Monday.
+	t0 := time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC)
+	minReplicas := 2
+	spec := AppConfigSpec{Name: "desktop"}
+	spec.Deployment.Autoscaling = PoolAutoscalingSpec{
+		Enabled:         true,
+		MinReplicas:     &minReplicas,
+		MaxReplicas:     5,
+		HeadroomPercent: 50,
+		Schedules: []PoolScheduleSpec{
+			{Name: "morning", Schedule: "0 8 * * 1-5", Duration: "2h", MinReplicas: 6, MaxReplicas: 8},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		demand     PoolDemand
+		want       int
+		wantWindow string
+		wantReason string
+	}{
+		{"raised to min", t0.Add(-2 * time.Hour), PoolDemand{}, 2, "", "raised to minReplicas"},
+		{"within bounds", t0.Add(-2 * time.Hour), PoolDemand{Reserved: 4, Queued: 1}, 3, "", ""},
+		{"capped at max", t0.Add(-2 * time.Hour), PoolDemand{Reserved: 4, Queued: 10}, 5, "", "capped at maxReplicas"},
+		{"schedule window min", t0, PoolDemand{}, 6, "morning", "raised to minReplicas"},
+		{"schedule window max", t0, PoolDemand{Queued: 10}, 8, "morning", "capped at maxReplicas"},
+		{"after schedule window", t0.Add(time.Hour), PoolDemand{}, 2, "", "raised to minReplicas"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec, err := spec.ComputePoolSize(&HeadroomPoolSizer{}, tc.demand, tc.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Replicas != tc.want || rec.Window != tc.wantWindow {
+				t.Errorf("expected %d replicas in window '%s', got %d in window '%s'", tc.want, tc.wantWindow, rec.Replicas, rec.Window)
+			}
+			if len(tc.wantReason) > 0 && !strings.HasSuffix(rec.Reason, tc.wantReason) {
+				t.Errorf("expected reason to end with '%s', got '%s'", tc.wantReason, rec.Reason)
+			}
+		})
+	}
+
+	// The max defaults to the min, which defaults to the deployment replicas.
+	replicas := 3
+	spec = AppConfigSpec{}
+	spec.Deployment.Replicas = &replicas
+	spec.Deployment.Autoscaling = PoolAutoscalingSpec{Enabled: true, Sizer: PoolSizerEWMA}
+	if rec, err := spec.ComputePoolSize(NewEWMAPoolSizer(), PoolDemand{Queued: 10}, t0); err != nil || rec.Replicas != 3 {
+		t.Errorf("expected 3 replicas from the deployment replicas, got %d, %v", rec.Replicas, err)
+	}
+
+	spec.Deployment.Autoscaling.MaxReplicas = 1
+	if _, err := spec.ComputePoolSize(NewEWMAPoolSizer(), PoolDemand{}, t0); err == nil {
+		t.Errorf("expected error for maxReplicas below minReplicas")
+	}
+}
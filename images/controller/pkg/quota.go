@@ -0,0 +1,270 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Names of the quota limits reported when a quota is exceeded.
+const (
+	QuotaLimitUser  = "user"
+	QuotaLimitApp   = "app"
+	QuotaLimitGroup = "group"
+)
+
+// Broker-wide session quotas, configured from POD_BROKER_PARAM_ sysParams.
+type BrokerQuotaSpec struct {
+	// Max concurrent sessions for a single user across all apps.
+	MaxSessionsPerUser int
+	// Default max concurrent sessions for each app, overridden by the app quota.
+	MaxSessionsPerApp int
+	// Max concurrent sessions across all apps for the users in each group.
+	Groups []QuotaGroupSpec
+}
+
+// Session running for a user.
+type ActiveSession struct {
+	App      string
+	User     string
+	Username string
+}
+
+// Returned when starting a session would exceed a quota.
+type QuotaExceededError struct {
+	Limit   string
+	Group   string
+	Max     int
+	Current int
+}
+
+func (e *QuotaExceededError) Error() string {
+	if len(e.Group) > 0 {
+		return fmt.Sprintf("%s quota exceeded for group %s: %d/%d sessions", e.Limit, e.Group, e.Current, e.Max)
+	}
+	return fmt.Sprintf("%s quota exceeded: %d/%d sessions", e.Limit, e.Current, e.Max)
+}
+
+// Parses the broker-wide quotas from the QuotaMaxSessionsPerUser, QuotaMaxSessionsPerApp and QuotaGroups sysParams.
+// QuotaGroups is a JSON list of groups, for example: [{"name": "students", "users": [".*@students.example.com"], "maxSessions": 10}]
+// A value of 0 or a missing param means there is no limit.
+func NewBrokerQuotaSpecFromParams(sysParams map[string]string) (BrokerQuotaSpec, error) {
+	quota := BrokerQuotaSpec{
+		Groups: make([]QuotaGroupSpec, 0),
+	}
+	var err error
+
+	if v, ok := sysParams["QuotaMaxSessionsPerUser"]; ok {
+		if quota.MaxSessionsPerUser, err = strconv.Atoi(v); err != nil {
+			return quota, fmt.Errorf("invalid QuotaMaxSessionsPerUser '%s': %v", v, err)
+		}
+	}
+
+	if v, ok := sysParams["QuotaMaxSessionsPerApp"]; ok {
+		if quota.MaxSessionsPerApp, err = strconv.Atoi(v); err != nil {
+			return quota, fmt.Errorf("invalid QuotaMaxSessionsPerApp '%s': %v", v, err)
+		}
+	}
+
+	if v, ok := sysParams["QuotaGroups"]; ok {
+		if err := json.Unmarshal([]byte(v), &quota.Groups); err != nil {
+			return quota, fmt.Errorf("invalid QuotaGroups JSON: %v", err)
+		}
+		if quota.Groups, err = CompileQuotaGroups(quota.Groups); err != nil {
+			return quota, fmt.Errorf("invalid QuotaGroups: %v", err)
+		}
+	}
+
+	return quota, nil
+}
+
+// Returns a copy of the groups with the user patterns compiled, groups must be compiled before calling Matches.
+// Invalid patterns are skipped and returned as an aggregate error.
+func CompileQuotaGroups(groups []QuotaGroupSpec) ([]QuotaGroupSpec, error) {
+	resp := make([]QuotaGroupSpec, len(groups))
+	errs := make([]error, 0)
+	for i, group := range groups {
+		group.patterns = make([]*regexp.Regexp, 0, len(group.Users))
+		for _, u := range group.Users {
+			re, err := regexp.Compile(u)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid user pattern '%s' in quota group '%s': %v", u, group.Name, err))
+				continue
+			}
+			group.patterns = append(group.patterns, re)
+		}
+		resp[i] = group
+	}
+	return resp, utilerrors.NewAggregate(errs)
+}
+
+// Returns true if any of the non-empty names match one of the compiled user patterns in the group.
+func (g *QuotaGroupSpec) Matches(names ...string) bool {
+	for _, re := range g.patterns {
+		for _, name := range names {
+			if len(name) > 0 && re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verifies that starting a new session of the app for the user stays within the broker and app quotas.
+// Returns a *QuotaExceededError for the first limit that would be exceeded.
+func CheckSessionQuota(brokerQuota BrokerQuotaSpec, app AppConfigSpec, user, username string, sessions []ActiveSession) error {
+	// Per-user limit across all apps.
+	if brokerQuota.MaxSessionsPerUser > 0 {
+		count := 0
+		for _, s := range sessions {
+			if s.User == user {
+				count++
+			}
+		}
+		if count >= brokerQuota.MaxSessionsPerUser {
+			return &QuotaExceededError{Limit: QuotaLimitUser, Max: brokerQuota.MaxSessionsPerUser, Current: count}
+		}
+	}
+
+	// Per-app limit, the app quota takes precedence over the broker default.
+	maxAppSessions := brokerQuota.MaxSessionsPerApp
+	if app.Quota.MaxSessions > 0 {
+		maxAppSessions = app.Quota.MaxSessions
+	}
+	if maxAppSessions > 0 {
+		count := 0
+		for _, s := range sessions {
+			if s.App == app.Name {
+				count++
+			}
+		}
+		if count >= maxAppSessions {
+			return &QuotaExceededError{Limit: QuotaLimitApp, Max: maxAppSessions, Current: count}
+		}
+	}
+
+	// Broker group limits count sessions of all apps, app group limits only count sessions of the app.
+	checkGroup := func(group QuotaGroupSpec, appName string) error {
+		if group.MaxSessions <= 0 || !group.Matches(user, username) {
+			return nil
+		}
+		count := 0
+		for _, s := range sessions {
+			if (len(appName) == 0 || s.App == appName) && group.Matches(s.User, s.Username) {
+				count++
+			}
+		}
+		if count >= group.MaxSessions {
+			return &QuotaExceededError{Limit: QuotaLimitGroup, Group: group.Name, Max: group.MaxSessions, Current: count}
+		}
+		return nil
+	}
+	for _, group := range brokerQuota.Groups {
+		if err := checkGroup(group, ""); err != nil {
+			return err
+		}
+	}
+	for _, group := range app.Quota.Groups {
+		if err := checkGroup(group, app.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Label selector of the session pods of all brokers.
+const ActiveSessionPodSelector = "app.kubernetes.io/managed-by in (pod-broker,reservation-broker)"
+
+// Returns true if the broker or the app sets a quota that the session of a user could exceed.
+// Sessions only need to be counted for admission when a quota applies.
+func (q BrokerQuotaSpec) AppliesTo(app AppConfigSpec) bool {
+	if q.MaxSessionsPerUser > 0 || q.MaxSessionsPerApp > 0 || app.Quota.MaxSessions > 0 {
+		return true
+	}
+	for _, group := range append(append([]QuotaGroupSpec{}, q.Groups...), app.Quota.Groups...) {
+		if group.MaxSessions > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Time after which an admitted session whose pod was not listed no longer counts towards the quotas.
+const DefaultPendingSessionTTL = 5 * time.Minute
+
+// Sessions that were admitted but whose pods may not be listed yet.
+// Pods of new sessions appear asynchronously after their manifests are applied, pending sessions are counted against the quotas until then.
+type PendingSessions struct {
+	sync.Mutex
+	sessions map[ActiveSession]time.Time
+	// Pending sessions are dropped after this long, in case their pod was never created.
+	TTL time.Duration
+}
+
+func NewPendingSessions() *PendingSessions {
+	return &PendingSessions{
+		sessions: make(map[ActiveSession]time.Time, 0),
+		TTL:      DefaultPendingSessionTTL,
+	}
+}
+
+// Records an admitted session.
+func (p *PendingSessions) Add(s ActiveSession) {
+	p.Lock()
+	defer p.Unlock()
+	p.sessions[s] = time.Now()
+}
+
+// Removes the pending session of the app for the user, called when the session failed to start or was shut down.
+func (p *PendingSessions) Remove(app, user string) {
+	p.Lock()
+	defer p.Unlock()
+	for s := range p.sessions {
+		if s.App == app && s.User == user {
+			delete(p.sessions, s)
+		}
+	}
+}
+
+// Returns the active sessions with the pending sessions that are not active yet.
+// Pending sessions that are active or have expired are dropped.
+func (p *PendingSessions) Merge(active []ActiveSession) []ActiveSession {
+	p.Lock()
+	defer p.Unlock()
+	type sessionKey struct{ app, user string }
+	found := make(map[sessionKey]bool, len(active))
+	for _, s := range active {
+		found[sessionKey{s.App, s.User}] = true
+	}
+	resp := append(make([]ActiveSession, 0, len(active)+len(p.sessions)), active...)
+	for s, added := range p.sessions {
+		if found[sessionKey{s.App, s.User}] || time.Since(added) > p.TTL {
+			delete(p.sessions, s)
+			continue
+		}
+		resp = append(resp, s)
+	}
+	return resp
+}
@@ -0,0 +1,203 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBrokerQuotaSpecFromParams(t *testing.T) {
+	quota, err := NewBrokerQuotaSpecFromParams(map[string]string{
+		"QuotaMaxSessionsPerUser": "2",
+		"QuotaGroups":             `[{"name": "students", "users": [".*@students.example.com"], "maxSessions": 1}]`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if quota.MaxSessionsPerUser != 2 || len(quota.Groups) != 1 {
+		t.Fatalf("unexpected quota: %+v", quota)
+	}
+	if !quota.Groups[0].Matches("alice@students.example.com") {
+		t.Errorf("expected compiled group to match student")
+	}
+
+	if _, err := NewBrokerQuotaSpecFromParams(map[string]string{"QuotaGroups": `[{"name": "bad", "users": ["("]}]`}); err == nil {
+		t.Errorf("expected error for invalid group user pattern")
+	}
+}
+
+func TestCheckSessionQuota(t *testing.T) {
+	groups, err := CompileQuotaGroups([]QuotaGroupSpec{
+		{Name: "students", Users: []string{"^student-"}, MaxSessions: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appGroups, err := CompileQuotaGroups([]QuotaGroupSpec{
+		{Name: "guests", Users: []string{"@guest.example.com$"}, MaxSessions: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokerQuota := BrokerQuotaSpec{MaxSessionsPerUser: 2, Groups: groups}
+	app := AppConfigSpec{Name: "desktop", Quota: AppQuotaSpec{MaxSessions: 3, Groups: appGroups}}
+
+	tests := []struct {
+		name      string
+		user      string
+		username  string
+		sessions  []ActiveSession
+		wantLimit string
+	}{
+		{
+			name:     "no sessions",
+			user:     "alice@example.com",
+			sessions: []ActiveSession{},
+		},
+		{
+			name:      "user limit across apps",
+			user:      "alice@example.com",
+			sessions:  []ActiveSession{{App: "desktop", User: "alice@example.com"}, {App: "other", User: "alice@example.com"}},
+			wantLimit: QuotaLimitUser,
+		},
+		{
+			name: "app limit",
+			user: "alice@example.com",
+			sessions: []ActiveSession{
+				{App: "desktop", User: "bob@example.com"},
+				{App: "desktop", User: "carol@example.com"},
+				{App: "desktop", User: "dave@example.com"},
+			},
+			wantLimit: QuotaLimitApp,
+		},
+		{
+			name:      "broker group matched by username counts sessions matched by username",
+			user:      "alice@example.com",
+			username:  "student-alice",
+			sessions:  []ActiveSession{{App: "other", User: "bob@example.com", Username: "student-bob"}},
+			wantLimit: QuotaLimitGroup,
+		},
+		{
+			name:     "broker group ignores sessions of other users",
+			user:     "alice@example.com",
+			username: "student-alice",
+			sessions: []ActiveSession{{App: "other", User: "bob@example.com", Username: "bob"}},
+		},
+		{
+			name:      "app group counts only sessions of the app",
+			user:      "alice@guest.example.com",
+			sessions:  []ActiveSession{{App: "desktop", User: "bob@guest.example.com"}},
+			wantLimit: QuotaLimitGroup,
+		},
+		{
+			name:     "app group ignores sessions of other apps",
+			user:     "alice@guest.example.com",
+			sessions: []ActiveSession{{App: "other", User: "bob@guest.example.com"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckSessionQuota(brokerQuota, app, tc.user, tc.username, tc.sessions)
+			if len(tc.wantLimit) == 0 {
+				if err != nil {
+					t.Errorf("expected session to be allowed, got: %v", err)
+				}
+				return
+			}
+			quotaErr, ok := err.(*QuotaExceededError)
+			if !ok {
+				t.Fatalf("expected *QuotaExceededError, got: %v", err)
+			}
+			if quotaErr.Limit != tc.wantLimit {
+				t.Errorf("expected %s limit, got: %v", tc.wantLimit, quotaErr)
+			}
+		})
+	}
+}
+
+func TestBrokerQuotaAppliesTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota BrokerQuotaSpec
+		app   AppConfigSpec
+		want  bool
+	}{
+		{"no quota", BrokerQuotaSpec{}, AppConfigSpec{}, false},
+		{"user quota", BrokerQuotaSpec{MaxSessionsPerUser: 1}, AppConfigSpec{}, true},
+		{"broker app quota", BrokerQuotaSpec{MaxSessionsPerApp: 1}, AppConfigSpec{}, true},
+		{"app quota", BrokerQuotaSpec{}, AppConfigSpec{Quota: AppQuotaSpec{MaxSessions: 1}}, true},
+		{"broker group", BrokerQuotaSpec{Groups: []QuotaGroupSpec{{Name: "all", MaxSessions: 1}}}, AppConfigSpec{}, true},
+		{"app group", BrokerQuotaSpec{}, AppConfigSpec{Quota: AppQuotaSpec{Groups: []QuotaGroupSpec{{Name: "all", MaxSessions: 1}}}}, true},
+		// Groups without a limit never deny a session.
+		{"unlimited group", BrokerQuotaSpec{Groups: []QuotaGroupSpec{{Name: "all"}}}, AppConfigSpec{}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.quota.AppliesTo(tc.app); got != tc.want {
+				t.Errorf("expected AppliesTo = %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAppRegistrySnapshotCompilesQuotaGroups(t *testing.T) {
+	snapshot := newAppRegistrySnapshot(RegisteredAppsManifest{
+		Apps: map[string]AppConfigSpec{
+			"desktop": {Name: "desktop", Quota: AppQuotaSpec{Groups: []QuotaGroupSpec{{Name: "all", Users: []string{".*"}, MaxSessions: 1}}}},
+		},
+	})
+	group := snapshot.Apps["desktop"].Quota.Groups[0]
+	if !group.Matches("alice@example.com") {
+		t.Errorf("expected quota group of registered app to be compiled")
+	}
+}
+
+func TestPendingSessions(t *testing.T) {
+	pending := NewPendingSessions()
+	pending.Add(ActiveSession{App: "desktop", User: "alice@example.com"})
+	pending.Add(ActiveSession{App: "desktop", User: "bob@example.com"})
+	pending.Add(ActiveSession{App: "other", User: "alice@example.com"})
+
+	// Back to back launches count before their pods are listed.
+	app := AppConfigSpec{Name: "desktop", Quota: AppQuotaSpec{MaxSessions: 2}}
+	err := CheckSessionQuota(BrokerQuotaSpec{}, app, "carol@example.com", "", pending.Merge([]ActiveSession{}))
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Limit != QuotaLimitApp {
+		t.Errorf("expected pending sessions to exceed the app quota, got: %v", err)
+	}
+
+	// Sessions whose pod is listed are no longer pending.
+	sessions := pending.Merge([]ActiveSession{{App: "desktop", User: "alice@example.com", Username: "alice"}})
+	if len(sessions) != 3 {
+		t.Errorf("expected listed session to replace the pending session, got %v", sessions)
+	}
+	if sessions := pending.Merge([]ActiveSession{}); len(sessions) != 2 {
+		t.Errorf("expected listed session to be dropped from the pending sessions, got %v", sessions)
+	}
+
+	pending.Remove("desktop", "bob@example.com")
+	if sessions := pending.Merge([]ActiveSession{}); len(sessions) != 1 || sessions[0].App != "other" {
+		t.Errorf("expected removed session to be dropped, got %v", sessions)
+	}
+
+	pending.TTL = 0
+	time.Sleep(time.Millisecond)
+	if sessions := pending.Merge([]ActiveSession{}); len(sessions) != 0 {
+		t.Errorf("expected expired session to be dropped, got %v", sessions)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Name of the ConfigMap in the app namespace used to persist reservations.
+const ReservationStoreConfigMapName = "reservation-broker-state"
+
+// Returned by ReservationStore.Put when the pod is already reserved by another user.
+var ErrPodAlreadyReserved = errors.New("pod is already reserved by another user")
+
+// Reservation of a pod for a user.
+// Pending is true while the pod is being assigned to the user and the per-user manifests have not been applied yet.
+type Reservation struct {
+	User         string            `json:"user"`
+	PodName      string            `json:"podName"`
+	PodIP        string            `json:"podIP"`
+	SessionKey   string            `json:"sessionKey"`
+	SessionStart string            `json:"sessionStart"`
+	UserObjects  []string          `json:"userObjects"`
+	UserParams   map[string]string `json:"userParams"`
+	Pending      bool              `json:"pending,omitempty"`
+}
+
+// ReservationStore persists reservations per app so they can be recovered after a restart.
+type ReservationStore interface {
+	// Returns all reservations for the app, sorted by user.
+	List(app string) ([]Reservation, error)
+
+	// Adds or replaces the reservation for the user.
+	// Returns ErrPodAlreadyReserved if the pod is reserved by a different user.
+	Put(app string, r Reservation) error
+
+	// Removes the reservation for the user, if it exists.
+	Delete(app, user string) error
+}
+
+func sortReservations(reservations []Reservation) {
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].User < reservations[j].User
+	})
+}
+
+// In-memory ReservationStore, reservations are lost when the process exits.
+type MemoryReservationStore struct {
+	sync.Mutex
+	apps map[string]map[string]Reservation
+}
+
+func NewMemoryReservationStore() *MemoryReservationStore {
+	return &MemoryReservationStore{
+		apps: make(map[string]map[string]Reservation, 0),
+	}
+}
+
+func (s *MemoryReservationStore) List(app string) ([]Reservation, error) {
+	s.Lock()
+	defer s.Unlock()
+	resp := make([]Reservation, 0)
+	for _, r := range s.apps[app] {
+		resp = append(resp, r)
+	}
+	sortReservations(resp)
+	return resp, nil
+}
+
+func (s *MemoryReservationStore) Put(app string, r Reservation) error {
+	s.Lock()
+	defer s.Unlock()
+	reservations, ok := s.apps[app]
+	if !ok {
+		reservations = make(map[string]Reservation, 0)
+		s.apps[app] = reservations
+	}
+	for user, existing := range reservations {
+		if user != r.User && existing.PodName == r.PodName {
+			return ErrPodAlreadyReserved
+		}
+	}
+	reservations[r.User] = r
+	return nil
+}
+
+func (s *MemoryReservationStore) Delete(app, user string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.apps[app], user)
+	return nil
+}
+
+// ReservationStore backed by a ConfigMap in the app namespace.
+// Each reservation is stored as JSON under a key derived from the user.
+// Updates use the ConfigMap resourceVersion so concurrent writers cannot reserve the same pod twice.
+type ConfigMapReservationStore struct {
+	client ClusterClient
+}
+
+func NewConfigMapReservationStore(client ClusterClient) *ConfigMapReservationStore {
+	return &ConfigMapReservationStore{
+		client: client,
+	}
+}
+
+// ConfigMap keys only allow a limited character set, so the hashed user ID is used.
+func reservationKey(user string) string {
+	return fmt.Sprintf("user-%s", MakePodID(user))
+}
+
+// Returns the ConfigMap for the app and if it exists, a new object is returned if it was not found.
+func (s *ConfigMapReservationStore) get(app string) (*corev1.ConfigMap, bool, error) {
+	cm, err := s.client.Kubernetes().CoreV1().ConfigMaps(app).Get(context.TODO(), ReservationStoreConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ReservationStoreConfigMapName,
+				Namespace: app,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "reservation-broker",
+				},
+			},
+			Data: make(map[string]string, 0),
+		}
+		return cm, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 0)
+	}
+	return cm, true, nil
+}
+
+func (s *ConfigMapReservationStore) save(cm *corev1.ConfigMap, exists bool) error {
+	var err error
+	if !exists {
+		_, err = s.client.Kubernetes().CoreV1().ConfigMaps(cm.Namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Created by another writer, retry the update against the current copy.
+			return apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, err)
+		}
+	} else {
+		_, err = s.client.Kubernetes().CoreV1().ConfigMaps(cm.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func (s *ConfigMapReservationStore) List(app string) ([]Reservation, error) {
+	resp := make([]Reservation, 0)
+	cm, _, err := s.get(app)
+	if err != nil {
+		return resp, fmt.Errorf("failed to get reservations for %s: %v", app, err)
+	}
+	for key, data := range cm.Data {
+		var r Reservation
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return resp, fmt.Errorf("failed to decode reservation %s for %s: %v", key, app, err)
+		}
+		resp = append(resp, r)
+	}
+	sortReservations(resp)
+	return resp, nil
+}
+
+func (s *ConfigMapReservationStore) Put(app string, r Reservation) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	key := reservationKey(r.User)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, exists, err := s.get(app)
+		if err != nil {
+			return err
+		}
+		for k, v := range cm.Data {
+			if k == key {
+				continue
+			}
+			var existing Reservation
+			if err := json.Unmarshal([]byte(v), &existing); err == nil && existing.PodName == r.PodName {
+				return ErrPodAlreadyReserved
+			}
+		}
+		cm.Data[key] = string(data)
+		return s.save(cm, exists)
+	})
+}
+
+func (s *ConfigMapReservationStore) Delete(app, user string) error {
+	key := reservationKey(user)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, exists, err := s.get(app)
+		if err != nil {
+			return err
+		}
+		if _, ok := cm.Data[key]; !ok {
+			return nil
+		}
+		delete(cm.Data, key)
+		return s.save(cm, exists)
+	})
+}
@@ -0,0 +1,205 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+const testStoreApp = "desktop"
+
+func reservationStores() map[string]func() broker.ReservationStore {
+	return map[string]func() broker.ReservationStore{
+		"memory": func() broker.ReservationStore {
+			return broker.NewMemoryReservationStore()
+		},
+		"configmap": func() broker.ReservationStore {
+			return broker.NewConfigMapReservationStore(brokertest.NewFakeClusterClient())
+		},
+	}
+}
+
+func TestReservationStorePutDelete(t *testing.T) {
+	for name, newStore := range reservationStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+
+			if err := store.Put(testStoreApp, broker.Reservation{User: "bob", PodName: "pod-1"}); err != nil {
+				t.Fatalf("Put returned error: %v", err)
+			}
+			if err := store.Put(testStoreApp, broker.Reservation{User: "alice", PodName: "pod-2"}); err != nil {
+				t.Fatalf("Put returned error: %v", err)
+			}
+			if err := store.Put(testStoreApp, broker.Reservation{User: "carol", PodName: "pod-1"}); err != broker.ErrPodAlreadyReserved {
+				t.Errorf("expected broker.ErrPodAlreadyReserved for pod reserved by another user, got: %v", err)
+			}
+			// Replacing the reservation of the same user is allowed.
+			if err := store.Put(testStoreApp, broker.Reservation{User: "bob", PodName: "pod-1", SessionKey: "key"}); err != nil {
+				t.Errorf("expected user to replace own reservation, got: %v", err)
+			}
+
+			reservations, err := store.List(testStoreApp)
+			if err != nil {
+				t.Fatalf("List returned error: %v", err)
+			}
+			if len(reservations) != 2 || reservations[0].User != "alice" || reservations[1].User != "bob" {
+				t.Fatalf("expected reservations for alice and bob sorted by user, got %v", reservations)
+			}
+			if reservations[1].SessionKey != "key" {
+				t.Errorf("expected replaced reservation, got %v", reservations[1])
+			}
+
+			if err := store.Delete(testStoreApp, "bob"); err != nil {
+				t.Fatalf("Delete returned error: %v", err)
+			}
+			if err := store.Delete(testStoreApp, "bob"); err != nil {
+				t.Errorf("expected deleting a missing reservation to succeed, got: %v", err)
+			}
+			if err := store.Put(testStoreApp, broker.Reservation{User: "carol", PodName: "pod-1"}); err != nil {
+				t.Errorf("expected released pod to be reservable, got: %v", err)
+			}
+			if reservations, _ := store.List("other"); len(reservations) != 0 {
+				t.Errorf("expected no reservations for other app, got %v", reservations)
+			}
+		})
+	}
+}
+
+func TestReservationStoreConcurrentReserveRelease(t *testing.T) {
+	const users = 8
+	for name, newStore := range reservationStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+
+			// Users race for the same pod, only one can reserve it.
+			var wg sync.WaitGroup
+			errs := make(chan error, users)
+			for i := 0; i < users; i++ {
+				wg.Add(1)
+				go func(user string) {
+					defer wg.Done()
+					errs <- store.Put(testStoreApp, broker.Reservation{User: user, PodName: "pod-shared"})
+				}(fmt.Sprintf("user-%d", i))
+			}
+			wg.Wait()
+			close(errs)
+			reserved := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					reserved++
+				case broker.ErrPodAlreadyReserved:
+				default:
+					t.Errorf("unexpected error reserving shared pod: %v", err)
+				}
+			}
+			if reserved != 1 {
+				t.Errorf("expected exactly 1 reservation of the shared pod, got %d", reserved)
+			}
+
+			// Users reserve their own pod and half of them release it, no update may be lost.
+			for i := 0; i < users; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					user := fmt.Sprintf("user-%d", i)
+					if err := store.Delete(testStoreApp, user); err != nil {
+						t.Errorf("failed to release shared pod for %s: %v", user, err)
+					}
+					if err := store.Put(testStoreApp, broker.Reservation{User: user, PodName: fmt.Sprintf("pod-%d", i)}); err != nil {
+						t.Errorf("failed to reserve pod for %s: %v", user, err)
+						return
+					}
+					if i%2 == 0 {
+						if err := store.Delete(testStoreApp, user); err != nil {
+							t.Errorf("failed to release pod for %s: %v", user, err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			reservations, err := store.List(testStoreApp)
+			if err != nil {
+				t.Fatalf("List returned error: %v", err)
+			}
+			if len(reservations) != users/2 {
+				t.Fatalf("expected %d reservations, got %v", users/2, reservations)
+			}
+			for _, r := range reservations {
+				if r.PodName != "pod-"+r.User[len("user-"):] {
+					t.Errorf("unexpected reservation %v", r)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigMapReservationStoreRetriesOnConflict(t *testing.T) {
+	client := brokertest.NewFakeClusterClient()
+	store := broker.NewConfigMapReservationStore(client)
+	if err := store.Put(testStoreApp, broker.Reservation{User: "alice", PodName: "pod-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the first update with a conflict, as if another broker replica wrote the ConfigMap first.
+	updates := 0
+	fakeClient := client.Kubernetes().(*kubefake.Clientset)
+	fakeClient.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), broker.ReservationStoreConfigMapName, fmt.Errorf("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	if err := store.Put(testStoreApp, broker.Reservation{User: "bob", PodName: "pod-2"}); err != nil {
+		t.Fatalf("expected Put to retry after conflict, got: %v", err)
+	}
+	if updates != 2 {
+		t.Errorf("expected 2 update attempts, got %d", updates)
+	}
+	if reservations, _ := store.List(testStoreApp); len(reservations) != 2 {
+		t.Errorf("expected 2 reservations after retry, got %v", reservations)
+	}
+
+	// Stale writes are rejected by the fake client like they are by the API server.
+	configMaps := client.Kubernetes().CoreV1().ConfigMaps(testStoreApp)
+	cm, err := configMaps.Get(context.TODO(), broker.ReservationStoreConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(testStoreApp, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	cm.Data["stale"] = "{}"
+	if _, err := configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{}); !apierrors.IsConflict(err) {
+		t.Errorf("expected conflict writing stale ConfigMap, got: %v", err)
+	}
+}
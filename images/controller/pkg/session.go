@@ -0,0 +1,173 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a session is reaped.
+const (
+	SessionReapReasonIdle        = "idle"
+	SessionReapReasonMaxDuration = "max-duration"
+	SessionReapReasonMaintenance = "maintenance"
+)
+
+// Activity of a user session for an app.
+type SessionActivity struct {
+	App          string
+	User         string
+	Start        time.Time
+	LastActivity time.Time
+}
+
+// Session that exceeded one of the app session limits.
+type ExpiredSession struct {
+	SessionActivity
+	Reason string
+}
+
+// SessionReaper tracks session activity from heartbeats and finds sessions that exceeded the app idleTimeout or maxSessionDuration,
+// or that are still running after the app maintenance gracePeriod.
+type SessionReaper struct {
+	sync.Mutex
+	sessions map[string]*SessionActivity
+}
+
+func NewSessionReaper() *SessionReaper {
+	return &SessionReaper{
+		sessions: make(map[string]*SessionActivity, 0),
+	}
+}
+
+func sessionActivityKey(app, user string) string {
+	return fmt.Sprintf("%s/%s", app, user)
+}
+
+// Records activity for the user session.
+func (sr *SessionReaper) Heartbeat(app, user string) {
+	sr.Lock()
+	defer sr.Unlock()
+	now := time.Now()
+	key := sessionActivityKey(app, user)
+	if s, ok := sr.sessions[key]; ok {
+		s.LastActivity = now
+		return
+	}
+	sr.sessions[key] = &SessionActivity{
+		App:          app,
+		User:         user,
+		Start:        now,
+		LastActivity: now,
+	}
+}
+
+// Replaces the tracked sessions for the app with the given map of users to session start times.
+// Newly discovered sessions are considered active as of now, sessions that are no longer running are removed.
+func (sr *SessionReaper) Sync(app string, sessions map[string]time.Time) {
+	sr.Lock()
+	defer sr.Unlock()
+	now := time.Now()
+	for key, s := range sr.sessions {
+		if _, ok := sessions[s.User]; s.App == app && !ok {
+			delete(sr.sessions, key)
+		}
+	}
+	for user, start := range sessions {
+		key := sessionActivityKey(app, user)
+		if s, ok := sr.sessions[key]; ok {
+			s.Start = start
+			continue
+		}
+		sr.sessions[key] = &SessionActivity{
+			App:          app,
+			User:         user,
+			Start:        start,
+			LastActivity: now,
+		}
+	}
+}
+
+// Stops tracking the user session.
+func (sr *SessionReaper) Remove(app, user string) {
+	sr.Lock()
+	defer sr.Unlock()
+	delete(sr.sessions, sessionActivityKey(app, user))
+}
+
+// Returns the sessions that exceeded the limits of their app at the given time.
+// Sessions for apps not in the map are skipped.
+func (sr *SessionReaper) Expired(apps map[string]AppConfigSpec, now time.Time) []ExpiredSession {
+	sr.Lock()
+	defer sr.Unlock()
+	resp := make([]ExpiredSession, 0)
+	for _, s := range sr.sessions {
+		app, ok := apps[s.App]
+		if !ok {
+			continue
+		}
+		idleTimeout, maxSessionDuration, err := app.SessionTimeouts()
+		if err != nil {
+			log.Printf("failed to get session timeouts for app %s: %v", app.Name, err)
+			continue
+		}
+		if deadline := app.MaintenanceSessionDeadline(); !deadline.IsZero() && app.InMaintenance(now) && now.After(deadline) {
+			resp = append(resp, ExpiredSession{*s, SessionReapReasonMaintenance})
+		} else if maxSessionDuration > 0 && now.Sub(s.Start) > maxSessionDuration {
+			resp = append(resp, ExpiredSession{*s, SessionReapReasonMaxDuration})
+		} else if idleTimeout > 0 && now.Sub(s.LastActivity) > idleTimeout {
+			resp = append(resp, ExpiredSession{*s, SessionReapReasonIdle})
+		}
+	}
+	return resp
+}
+
+// Copies each hook command to its container and executes it.
+// Errors are logged and do not stop the remaining hooks from running.
+func RunShutdownHooks(client ClusterClient, namespace, fullName string, hooks []ShutdownHookSpec) {
+	for i, hook := range hooks {
+		selector := strings.Join([]string{"app.kubernetes.io/instance=" + fullName, hook.Selector}, ",")
+		tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("shutdown-hook-%d", i))
+		if err != nil {
+			log.Printf("failed to create tempfile for shutdown hook %d", i)
+			continue
+		}
+		// Write contents of hook to temp file.
+		tmpFile.WriteString(hook.Command)
+		tmpFile.Sync()
+		tmpFile.Close()
+		tmpFileDest := fmt.Sprintf("/tmp/broker_shutdown_hook_%s_%d", hook.Container, i)
+		tmpFileCmd := fmt.Sprintf("sh %s", tmpFileDest)
+		if err := client.CopyFileToContainer(namespace, selector, hook.Container, tmpFile.Name(), tmpFileDest); err != nil {
+			log.Printf("error copying shutdown hook file to container: %v", err)
+		} else {
+			log.Printf("executing shutdown hook %d/%d for %s, selector=%s, container=%s, command=%s", i+1, len(hooks), fullName, selector, hook.Container, hook.Command)
+			if err := client.ExecPodCommand(namespace, selector, hook.Container, tmpFileCmd); err != nil {
+				log.Printf("error calling shutdown hook: %v", err)
+			} else {
+				log.Printf("finished shutdown hook %d/%d for %s", i+1, len(hooks), fullName)
+			}
+		}
+		os.Remove(tmpFile.Name())
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionReaperExpired(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	apps := map[string]AppConfigSpec{
+		"desktop": {Name: "desktop", IdleTimeout: "30m", MaxSessionDuration: "8h"},
+		"ide":     {Name: "ide"},
+		"closing": {Name: "closing", Maintenance: MaintenanceSpec{Enabled: true, StartTime: "2021-06-01T11:00:00Z", GracePeriod: "30m"}},
+		"invalid": {Name: "invalid", IdleTimeout: "30"},
+	}
+
+	tests := []struct {
+		name         string
+		app          string
+		start        time.Duration
+		lastActivity time.Duration
+		want         string
+	}{
+		{"active", "desktop", 2 * time.Hour, time.Minute, ""},
+		{"idle", "desktop", 2 * time.Hour, 31 * time.Minute, SessionReapReasonIdle},
+		{"max duration", "desktop", 9 * time.Hour, time.Minute, SessionReapReasonMaxDuration},
+		{"no limits", "ide", 100 * time.Hour, 100 * time.Hour, ""},
+		{"maintenance grace period passed", "closing", time.Hour, time.Minute, SessionReapReasonMaintenance},
+		{"invalid timeouts", "invalid", 100 * time.Hour, 100 * time.Hour, ""},
+		{"unknown app", "removed", 100 * time.Hour, 100 * time.Hour, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sr := NewSessionReaper()
+			sr.sessions[sessionActivityKey(tc.app, "user@example.com")] = &SessionActivity{
+				App:          tc.app,
+				User:         "user@example.com",
+				Start:        now.Add(-tc.start),
+				LastActivity: now.Add(-tc.lastActivity),
+			}
+			expired := sr.Expired(apps, now)
+			got := ""
+			if len(expired) > 0 {
+				got = expired[0].Reason
+			}
+			if got != tc.want || len(expired) > 1 {
+				t.Errorf("expected reason '%s', got %+v", tc.want, expired)
+			}
+		})
+	}
+}
+
+func TestSessionReaperSync(t *testing.T) {
+	sr := NewSessionReaper()
+	sr.Heartbeat("desktop", "alice@example.com")
+	sr.Heartbeat("desktop", "bob@example.com")
+	sr.Heartbeat("ide", "alice@example.com")
+
+	// Sessions that are no longer running are removed, new ones are active from now.
+	start := time.Now().Add(-time.Hour)
+	sr.Sync("desktop", map[string]time.Time{"alice@example.com": start, "carol@example.com": start})
+	if len(sr.sessions) != 3 {
+		t.Fatalf("expected 3 tracked sessions, got %d", len(sr.sessions))
+	}
+	if _, ok := sr.sessions[sessionActivityKey("desktop", "bob@example.com")]; ok {
+		t.Errorf("expected stopped session to be removed")
+	}
+	carol := sr.sessions[sessionActivityKey("desktop", "carol@example.com")]
+	if !carol.Start.Equal(start) || time.Since(carol.LastActivity) > time.Minute {
+		t.Errorf("expected discovered session to start at %v and be active now, got %+v", start, carol)
+	}
+
+	sr.Remove("ide", "alice@example.com")
+	if _, ok := sr.sessions[sessionActivityKey("ide", "alice@example.com")]; ok {
+		t.Errorf("expected removed session not to be tracked")
+	}
+}
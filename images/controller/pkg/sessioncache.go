@@ -0,0 +1,81 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Informer cache of the session pods of all brokers, so that quota admission counts sessions without listing pods from the API server.
+type ActiveSessionCache struct {
+	informer *PodInformer
+}
+
+func NewActiveSessionCache(client ClusterClient, resyncDuration time.Duration) *ActiveSessionCache {
+	return &ActiveSessionCache{
+		informer: NewPodInformer(client, corev1.NamespaceAll, ActiveSessionPodSelector, resyncDuration, func() {}),
+	}
+}
+
+// Starts the informer and waits for the initial cache sync.
+func (c *ActiveSessionCache) Run(stopCh <-chan struct{}) error {
+	return c.informer.Run(stopCh)
+}
+
+// Lists the sessions running for all brokers.
+// StatefulSet sessions are the pod-broker managed pods of StatefulSet apps, reservations are the pods managed by the reservation-broker.
+func (c *ActiveSessionCache) List(apps map[string]AppConfigSpec) ([]ActiveSession, error) {
+	resp := make([]ActiveSession, 0)
+
+	pods, err := c.informer.Lister.List(labels.Everything())
+	if err != nil {
+		return resp, err
+	}
+
+	found := make(map[ActiveSession]bool, 0)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		user, ok := pod.Annotations["app.broker/user"]
+		if !ok {
+			continue
+		}
+		var appName string
+		switch pod.Labels["app.kubernetes.io/managed-by"] {
+		case "reservation-broker":
+			// Reserved pods run in the app namespace.
+			appName = pod.Namespace
+		case "pod-broker":
+			appName = pod.Labels["app.kubernetes.io/name"]
+			if app, ok := apps[appName]; !ok || app.Type != AppTypeStatefulSet {
+				// Skip pods in the reservation pool and unknown apps.
+				continue
+			}
+		}
+		s := ActiveSession{App: appName, User: user, Username: pod.Annotations["app.broker/username"]}
+		if !found[s] {
+			found[s] = true
+			resp = append(resp, s)
+		}
+	}
+
+	return resp, nil
+}
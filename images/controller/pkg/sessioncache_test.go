@@ -0,0 +1,78 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestActiveSessionCache(t *testing.T) {
+	pod := func(namespace, name, managedBy, appName, user string) *corev1.Pod {
+		p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": managedBy, "app.kubernetes.io/name": appName},
+		}}
+		if len(user) > 0 {
+			p.Annotations = map[string]string{"app.broker/user": user, "app.broker/username": "user"}
+		}
+		return p
+	}
+	client := brokertest.NewFakeClusterClient(
+		// Reserved pods run in the app namespace.
+		pod("desktop", "desktop-pool-0", "reservation-broker", "desktop", "alice@example.com"),
+		// StatefulSet sessions, a session with multiple pods is counted once.
+		pod("user-1234", "stateful-1234-0", "pod-broker", "stateful", "bob@example.com"),
+		pod("user-1234", "stateful-1234-1", "pod-broker", "stateful", "bob@example.com"),
+		// Pool pods that are not reserved, pods of other apps and pods of other controllers are skipped.
+		pod("desktop", "desktop-pool-1", "reservation-broker", "desktop", ""),
+		pod("user-1234", "unknown-1234-0", "pod-broker", "unknown", "bob@example.com"),
+		pod("desktop", "other", "kubectl", "desktop", "carol@example.com"),
+	)
+	apps := map[string]broker.AppConfigSpec{
+		"desktop":  {Name: "desktop", Type: broker.AppTypeDeployment},
+		"stateful": {Name: "stateful", Type: broker.AppTypeStatefulSet},
+	}
+
+	cache := broker.NewActiveSessionCache(client, 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := cache.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := cache.List(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].App < sessions[j].App })
+	want := []broker.ActiveSession{
+		{App: "desktop", User: "alice@example.com", Username: "user"},
+		{App: "stateful", User: "bob@example.com", Username: "user"},
+	}
+	if !reflect.DeepEqual(sessions, want) {
+		t.Errorf("expected sessions %+v, got %+v", want, sessions)
+	}
+}
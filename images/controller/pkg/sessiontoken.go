@@ -0,0 +1,201 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSessionTokenInvalid = errors.New("invalid session token")
+	ErrSessionTokenExpired = errors.New("session token expired")
+)
+
+// SessionTokenSigner issues and verifies the per-app session tokens stored in the broker_<app> cookie.
+//
+// Tokens have the form: <user>#<routing mac>.<issued>.<expires>.<claims>.<signature>
+// The <user>#<routing mac> prefix is the routing value rendered into the app VirtualService cookie regex match,
+// it only depends on the user, app and secret so that the route stays valid when the token is renewed.
+// The claims are the base64url encoded JSON username and groups from the authenticator, so that requests with only the cookie keep the groups.
+// The signature is an HMAC-SHA256 over the user, app, issue time, expiry and claims.
+//
+// Secrets are ordered with the current secret first, tokens signed with any of the secrets are accepted.
+// To rotate the secret, set the new secret as current and keep the old secret as previous until sessions started with it have ended.
+type SessionTokenSigner struct {
+	secrets []string
+	maxAge  time.Duration
+}
+
+func NewSessionTokenSigner(secrets []string, maxAge time.Duration) (*SessionTokenSigner, error) {
+	if len(secrets) == 0 || len(secrets[0]) == 0 {
+		return nil, fmt.Errorf("missing session token secret")
+	}
+	return &SessionTokenSigner{
+		secrets: secrets,
+		maxAge:  maxAge,
+	}, nil
+}
+
+// Creates a signer from the COOKIE_SECRET and optional COOKIE_SECRET_PREVIOUS env vars.
+// If COOKIE_SECRET is not set, a random secret is generated and tokens do not survive a restart.
+func NewSessionTokenSignerFromEnv(maxAge time.Duration) (*SessionTokenSigner, error) {
+	secret := os.Getenv("COOKIE_SECRET")
+	if len(secret) == 0 {
+		log.Printf("no COOKIE_SECRET env var found, generating random secret value")
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate random secret: %v", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+	secrets := []string{secret}
+	if previous := os.Getenv("COOKIE_SECRET_PREVIOUS"); len(previous) > 0 {
+		secrets = append(secrets, previous)
+	}
+	return NewSessionTokenSigner(secrets, maxAge)
+}
+
+func sessionTokenMAC(secret string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(fields, ".")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func routingValue(secret, user, app string) string {
+	// Note that this value is used in a regex match for virtualservice routing
+	// and should be free of regex breaking characters.
+	return fmt.Sprintf("%s#%s", user, sessionTokenMAC(secret, "route", user, app)[:40])
+}
+
+// Identity claims carried in the token.
+type sessionTokenClaims struct {
+	Username string   `json:"u,omitempty"`
+	Groups   []string `json:"g,omitempty"`
+}
+
+func (s *SessionTokenSigner) makeToken(secret string, identity AuthIdentity, app string, issued time.Time) string {
+	iat := strconv.FormatInt(issued.Unix(), 10)
+	exp := strconv.FormatInt(issued.Add(s.maxAge).Unix(), 10)
+	data, _ := json.Marshal(sessionTokenClaims{Username: identity.Username, Groups: identity.Groups})
+	claims := base64.RawURLEncoding.EncodeToString(data)
+	user := identity.User
+	return fmt.Sprintf("%s.%s.%s.%s.%s", routingValue(secret, user, app), iat, exp, claims, sessionTokenMAC(secret, "token", user, app, iat, exp, claims))
+}
+
+// Returns the routing value for the user and app, used as the CookieValue in templates.
+func (s *SessionTokenSigner) RoutingValue(user, app string) string {
+	return routingValue(s.secrets[0], user, app)
+}
+
+// Returns a new token for the authenticated identity and app signed with the current secret.
+// Only the user, username and groups are kept, roles are resolved from the group directory on each request.
+func (s *SessionTokenSigner) MakeToken(identity AuthIdentity, app string) string {
+	return s.makeToken(s.secrets[0], identity, app, time.Now())
+}
+
+// Verifies the token for the app and returns the identity and the index of the secret that signed it.
+func (s *SessionTokenSigner) verify(token, app string, now time.Time) (AuthIdentity, int, error) {
+	idx := strings.LastIndex(token, "#")
+	if idx <= 0 {
+		return AuthIdentity{}, -1, ErrSessionTokenInvalid
+	}
+	user := token[:idx]
+	toks := strings.Split(token[idx+1:], ".")
+	if len(toks) != 5 {
+		return AuthIdentity{}, -1, ErrSessionTokenInvalid
+	}
+	iat, exp, claims := toks[1], toks[2], toks[3]
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return AuthIdentity{}, -1, ErrSessionTokenInvalid
+	}
+
+	for i, secret := range s.secrets {
+		if len(secret) == 0 {
+			continue
+		}
+		routing := routingValue(secret, user, app)
+		sig := sessionTokenMAC(secret, "token", user, app, iat, exp, claims)
+		if !hmac.Equal([]byte(routing), []byte(fmt.Sprintf("%s#%s", user, toks[0]))) || !hmac.Equal([]byte(sig), []byte(toks[4])) {
+			continue
+		}
+		if now.Unix() >= expires {
+			return AuthIdentity{}, -1, ErrSessionTokenExpired
+		}
+		var c sessionTokenClaims
+		data, err := base64.RawURLEncoding.DecodeString(claims)
+		if err != nil || json.Unmarshal(data, &c) != nil {
+			return AuthIdentity{}, -1, ErrSessionTokenInvalid
+		}
+		identity := AuthIdentity{
+			User:     user,
+			Username: c.Username,
+			Groups:   c.Groups,
+		}
+		if len(identity.Username) == 0 {
+			identity.Username = user
+		}
+		if identity.Groups == nil {
+			identity.Groups = []string{}
+		}
+		return identity, i, nil
+	}
+	return AuthIdentity{}, -1, ErrSessionTokenInvalid
+}
+
+// Verifies the token for the app and returns the identity it was issued for.
+func (s *SessionTokenSigner) Verify(token, app string) (AuthIdentity, error) {
+	identity, _, err := s.verify(token, app, time.Now())
+	return identity, err
+}
+
+// Returns a renewed token for the authenticated identity to set in the response cookie.
+// If the request carries a valid token for the user that was signed with a previous secret, the renewed token is signed with the same secret
+// so that it still matches the routing value of the running session.
+func (s *SessionTokenSigner) RenewToken(r *http.Request, cookieName string, identity AuthIdentity, app string) string {
+	secret := s.secrets[0]
+	if token := getSessionTokenFromRequest(r, cookieName); len(token) > 0 {
+		if tokenIdentity, i, err := s.verify(token, app, time.Now()); err == nil && tokenIdentity.User == identity.User {
+			secret = s.secrets[i]
+		}
+	}
+	return s.makeToken(secret, identity, app, time.Now())
+}
+
+// Returns the token from the cookie, or from the query parameter of the same name.
+func getSessionTokenFromRequest(r *http.Request, cookieName string) string {
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		return cookie.Value
+	}
+	if keys, ok := r.URL.Query()[cookieName]; ok && len(keys[0]) > 0 {
+		return keys[0]
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTokenVerify(t *testing.T) {
+	signer, err := NewSessionTokenSigner([]string{"current"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := "user@example.com"
+	identity := AuthIdentity{User: user, Username: "user", Groups: []string{"gpu-users@corp"}}
+	now := time.Now()
+	token := signer.makeToken("current", identity, "desktop", now)
+
+	if !strings.HasPrefix(token, signer.RoutingValue(user, "desktop")+".") {
+		t.Errorf("expected token to start with the routing value, got %s", token)
+	}
+
+	// Tokens with the expiry moved a day later or the groups of another token, and the original signature.
+	tamper := func(field int, value string) string {
+		toks := strings.Split(token, ".")
+		toks[len(toks)-field] = value
+		return strings.Join(toks, ".")
+	}
+	extended := tamper(3, strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10))
+	adminToks := strings.Split(signer.makeToken("current", AuthIdentity{User: user, Groups: []string{"admins@corp"}}, "desktop", now), ".")
+	otherGroups := tamper(2, adminToks[len(adminToks)-2])
+
+	tests := []struct {
+		name    string
+		token   string
+		app     string
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", token, "desktop", now, nil},
+		{"before expiry", token, "desktop", now.Add(59 * time.Minute), nil},
+		{"expired", token, "desktop", now.Add(time.Hour), ErrSessionTokenExpired},
+		{"other app", token, "other", now, ErrSessionTokenInvalid},
+		{"other user", strings.Replace(token, user, "admin@example.com", 1), "desktop", now, ErrSessionTokenInvalid},
+		{"extended expiry", extended, "desktop", now.Add(2 * time.Hour), ErrSessionTokenInvalid},
+		{"other groups", otherGroups, "desktop", now, ErrSessionTokenInvalid},
+		{"unsigned secret", signer.makeToken("guessed", identity, "desktop", now), "desktop", now, ErrSessionTokenInvalid},
+		{"legacy cookie", user + "#0123456789abcdef", "desktop", now, ErrSessionTokenInvalid},
+		{"empty", "", "desktop", now, ErrSessionTokenInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, err := signer.verify(tc.token, tc.app, tc.now)
+			if err != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if err == nil && !reflect.DeepEqual(got, identity) {
+				t.Errorf("expected identity %+v, got %+v", identity, got)
+			}
+		})
+	}
+}
+
+func TestSessionTokenSecretRotation(t *testing.T) {
+	user := "user@example.com"
+	oldSigner, err := NewSessionTokenSigner([]string{"old"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := AuthIdentity{User: user}
+	oldToken := oldSigner.MakeToken(identity, "desktop")
+
+	// The previous secret is still accepted after rotation.
+	signer, err := NewSessionTokenSigner([]string{"new", "old"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := signer.Verify(oldToken, "desktop"); err != nil || got.User != user {
+		t.Fatalf("expected token signed with the previous secret to verify, got %+v, %v", got, err)
+	}
+
+	// Renewed tokens keep the secret of the running session so that its route still matches.
+	r := httptest.NewRequest("GET", "/desktop/", nil)
+	r.AddCookie(&http.Cookie{Name: "broker_desktop", Value: oldToken})
+	renewed := signer.RenewToken(r, "broker_desktop", identity, "desktop")
+	if !strings.HasPrefix(renewed, oldSigner.RoutingValue(user, "desktop")+".") {
+		t.Errorf("expected renewed token to keep the previous routing value, got %s", renewed)
+	}
+
+	// New sessions and requests without a valid token use the current secret.
+	if token := signer.MakeToken(identity, "desktop"); !strings.HasPrefix(token, signer.RoutingValue(user, "desktop")+".") {
+		t.Errorf("expected new token to use the current routing value, got %s", token)
+	}
+	renewed = signer.RenewToken(httptest.NewRequest("GET", "/desktop/", nil), "broker_desktop", identity, "desktop")
+	if !strings.HasPrefix(renewed, signer.RoutingValue(user, "desktop")+".") {
+		t.Errorf("expected token renewed without a cookie to use the current secret, got %s", renewed)
+	}
+
+	// Once the previous secret is dropped, its tokens are rejected.
+	signer, _ = NewSessionTokenSigner([]string{"new"}, time.Hour)
+	if _, err := signer.Verify(oldToken, "desktop"); err != ErrSessionTokenInvalid {
+		t.Errorf("expected token signed with a dropped secret to be invalid, got %v", err)
+	}
+
+	if _, err := NewSessionTokenSigner([]string{""}, time.Hour); err == nil {
+		t.Errorf("expected error for empty secret")
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var VolumeSnapshotGVR = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+
+// Label with the ID of the session snapshot that a VolumeSnapshot is part of.
+const SnapshotIDLabel = "app.broker/snapshot-id"
+
+// Annotation with the name of the PVC that a VolumeSnapshot was taken from.
+const SnapshotSourcePVCAnnotation = "app.broker/source-pvc"
+
+// Annotation with the number of VolumeSnapshots in the session snapshot, snapshots with fewer are incomplete.
+const SnapshotVolumeCountAnnotation = "app.broker/snapshot-volumes"
+
+// Returned when a snapshot is requested for a session that has no PVCs.
+var ErrNoSessionVolumes = errors.New("session has no volumes to snapshot")
+
+// Returned when a snapshot of the session was already taken in the same second, since the ID would be the same.
+var ErrSnapshotExists = errors.New("snapshot with the same ID already exists")
+
+// Returned when restoring a snapshot that does not have a VolumeSnapshot of every PVC of the session.
+var ErrSnapshotIncomplete = errors.New("snapshot does not include all session volumes")
+
+// Snapshot IDs are the UTC time the snapshot was taken in this format, so they sort in creation order.
+const snapshotIDFormat = "20060102-150405"
+
+// Number of snapshots kept per user and app when the app does not set a retention.
+const DefaultSnapshotRetention = 3
+
+// VolumeSnapshot of one of the session PVCs.
+type SnapshotVolume struct {
+	PVC            string `json:"pvc"`
+	VolumeSnapshot string `json:"volumeSnapshot"`
+	ReadyToUse     bool   `json:"readyToUse"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Snapshot of all PVCs of a user session, taken at the same time.
+type SessionSnapshot struct {
+	ID           string           `json:"id"`
+	CreationTime time.Time        `json:"creationTime"`
+	Ready        bool             `json:"ready"`
+	Volumes      []SnapshotVolume `json:"volumes"`
+	// Map of PVC name to VolumeSnapshot name, for use as the dataSource of the PVCs in templates.
+	VolumeSnapshots map[string]string `json:"-"`
+}
+
+// Returns the snapshot retention of the app.
+func (spec *AppConfigSpec) SnapshotRetention() int {
+	if spec.Snapshots.Retention > 0 {
+		return spec.Snapshots.Retention
+	}
+	return DefaultSnapshotRetention
+}
+
+// Creates a VolumeSnapshot of each PVC of the session, the PVCs are those labeled with the session instance.
+// The snapshot is returned right away, the VolumeSnapshots become ready to use asynchronously.
+// When a VolumeSnapshot cannot be created, the ones already created are deleted so that no partial snapshot is left.
+func CreateSessionSnapshot(client ClusterClient, namespace, fullName, user string, spec SnapshotSpec) (SessionSnapshot, error) {
+	selector := fmt.Sprintf("app.kubernetes.io/instance=%s", fullName)
+	pvcs, err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return SessionSnapshot{}, fmt.Errorf("failed to list PVCs for %s: %v", fullName, err)
+	}
+	if len(pvcs.Items) == 0 {
+		return SessionSnapshot{}, ErrNoSessionVolumes
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	snapshot := SessionSnapshot{
+		ID:              now.Format(snapshotIDFormat),
+		CreationTime:    now,
+		Volumes:         make([]SnapshotVolume, 0, len(pvcs.Items)),
+		VolumeSnapshots: make(map[string]string, len(pvcs.Items)),
+	}
+
+	for _, pvc := range pvcs.Items {
+		name := fmt.Sprintf("%s-%s", pvc.Name, snapshot.ID)
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": VolumeSnapshotGVR.GroupVersion().String(),
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels": map[string]interface{}{
+					"app.kubernetes.io/instance":   fullName,
+					"app.kubernetes.io/managed-by": "pod-broker",
+					SnapshotIDLabel:                snapshot.ID,
+				},
+				"annotations": map[string]interface{}{
+					"app.broker/user":             user,
+					SnapshotSourcePVCAnnotation:   pvc.Name,
+					SnapshotVolumeCountAnnotation: strconv.Itoa(len(pvcs.Items)),
+				},
+			},
+			"spec": map[string]interface{}{
+				"source": map[string]interface{}{
+					"persistentVolumeClaimName": pvc.Name,
+				},
+			},
+		}}
+		if len(spec.VolumeSnapshotClass) > 0 {
+			unstructured.SetNestedField(obj.Object, spec.VolumeSnapshotClass, "spec", "volumeSnapshotClassName")
+		}
+		if _, err := client.Dynamic().Resource(VolumeSnapshotGVR).Namespace(namespace).Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) && len(snapshot.Volumes) == 0 {
+				return snapshot, ErrSnapshotExists
+			}
+			if deleteErr := deleteVolumeSnapshots(client, namespace, snapshot.Volumes); deleteErr != nil {
+				return snapshot, fmt.Errorf("failed to create VolumeSnapshot %s/%s: %v, %v", namespace, name, err, deleteErr)
+			}
+			return snapshot, fmt.Errorf("failed to create VolumeSnapshot %s/%s: %v", namespace, name, err)
+		}
+		snapshot.Volumes = append(snapshot.Volumes, SnapshotVolume{
+			PVC:            pvc.Name,
+			VolumeSnapshot: name,
+		})
+		snapshot.VolumeSnapshots[pvc.Name] = name
+	}
+
+	return snapshot, nil
+}
+
+// Returns the snapshots of the session, newest first.
+func ListSessionSnapshots(client ClusterClient, namespace, fullName string) ([]SessionSnapshot, error) {
+	selector := fmt.Sprintf("app.kubernetes.io/instance=%s,%s", fullName, SnapshotIDLabel)
+	list, err := client.Dynamic().Resource(VolumeSnapshotGVR).Namespace(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return []SessionSnapshot{}, nil
+		}
+		return nil, fmt.Errorf("failed to list VolumeSnapshots for %s: %v", fullName, err)
+	}
+
+	snapshots := make(map[string]*SessionSnapshot, 0)
+	volumeCounts := make(map[string]int, 0)
+	for _, item := range list.Items {
+		id := item.GetLabels()[SnapshotIDLabel]
+		snapshot, ok := snapshots[id]
+		if !ok {
+			creationTime, err := time.Parse(snapshotIDFormat, id)
+			if err != nil {
+				creationTime = item.GetCreationTimestamp().Time
+			}
+			snapshot = &SessionSnapshot{
+				ID:              id,
+				CreationTime:    creationTime,
+				Ready:           true,
+				Volumes:         make([]SnapshotVolume, 0),
+				VolumeSnapshots: make(map[string]string, 0),
+			}
+			snapshots[id] = snapshot
+		}
+		if count, err := strconv.Atoi(item.GetAnnotations()[SnapshotVolumeCountAnnotation]); err == nil {
+			volumeCounts[id] = count
+		}
+		ready, _, _ := unstructured.NestedBool(item.Object, "status", "readyToUse")
+		errMsg, _, _ := unstructured.NestedString(item.Object, "status", "error", "message")
+		pvc := item.GetAnnotations()[SnapshotSourcePVCAnnotation]
+		snapshot.Volumes = append(snapshot.Volumes, SnapshotVolume{
+			PVC:            pvc,
+			VolumeSnapshot: item.GetName(),
+			ReadyToUse:     ready,
+			Error:          errMsg,
+		})
+		snapshot.VolumeSnapshots[pvc] = item.GetName()
+		snapshot.Ready = snapshot.Ready && ready
+	}
+
+	resp := make([]SessionSnapshot, 0, len(snapshots))
+	for id, snapshot := range snapshots {
+		// VolumeSnapshots left from a failed or interrupted snapshot are not ready to restore.
+		if count, ok := volumeCounts[id]; ok && len(snapshot.Volumes) < count {
+			snapshot.Ready = false
+		}
+		sort.Slice(snapshot.Volumes, func(i, j int) bool {
+			return snapshot.Volumes[i].PVC < snapshot.Volumes[j].PVC
+		})
+		resp = append(resp, *snapshot)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].ID > resp[j].ID
+	})
+	return resp, nil
+}
+
+// Returns the snapshot of the session with the given ID, false if it does not exist.
+func GetSessionSnapshot(client ClusterClient, namespace, fullName, id string) (SessionSnapshot, bool, error) {
+	snapshots, err := ListSessionSnapshots(client, namespace, fullName)
+	if err != nil {
+		return SessionSnapshot{}, false, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot, true, nil
+		}
+	}
+	return SessionSnapshot{}, false, nil
+}
+
+// Deletes the oldest snapshots of the session so that at most retention snapshots are kept, returns the IDs of the deleted snapshots.
+func PruneSessionSnapshots(client ClusterClient, namespace, fullName string, retention int) ([]string, error) {
+	snapshots, err := ListSessionSnapshots(client, namespace, fullName)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]string, 0)
+	for i := retention; i < len(snapshots); i++ {
+		if err := deleteVolumeSnapshots(client, namespace, snapshots[i].Volumes); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, snapshots[i].ID)
+	}
+	return deleted, nil
+}
+
+// Deletes the VolumeSnapshots of the snapshot volumes.
+func deleteVolumeSnapshots(client ClusterClient, namespace string, volumes []SnapshotVolume) error {
+	for _, volume := range volumes {
+		err := client.Dynamic().Resource(VolumeSnapshotGVR).Namespace(namespace).Delete(context.TODO(), volume.VolumeSnapshot, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete VolumeSnapshot %s/%s: %v", namespace, volume.VolumeSnapshot, err)
+		}
+	}
+	return nil
+}
+
+// Deletes the PVCs of the session so that they are provisioned again from the snapshot, which the templates set as their dataSource.
+// Returns ErrSnapshotIncomplete without deleting any PVC when the snapshot does not have a VolumeSnapshot of each of them,
+// since a PVC without one would be provisioned empty.
+func DeleteSessionPVCs(client ClusterClient, namespace, fullName string, snapshot SessionSnapshot) error {
+	selector := fmt.Sprintf("app.kubernetes.io/instance=%s", fullName)
+	pvcs, err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("failed to list PVCs for %s: %v", fullName, err)
+	}
+	for _, pvc := range pvcs.Items {
+		if _, ok := snapshot.VolumeSnapshots[pvc.Name]; !ok {
+			return ErrSnapshotIncomplete
+		}
+	}
+	for _, pvc := range pvcs.Items {
+		err := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).Delete(context.TODO(), pvc.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete PVC %s/%s: %v", namespace, pvc.Name, err)
+		}
+	}
+	return nil
+}
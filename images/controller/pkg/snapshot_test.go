@@ -0,0 +1,145 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestCreateSessionSnapshot(t *testing.T) {
+	namespace := "user-1234"
+	fullName := "desktop-1234"
+	pvc := func(name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app.kubernetes.io/instance": fullName},
+		}}
+	}
+	client := brokertest.NewFakeClusterClient(pvc("home"), pvc("data"))
+
+	snapshot, err := broker.CreateSessionSnapshot(client, namespace, fullName, "user@example.com", broker.SnapshotSpec{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Volumes) != 2 {
+		t.Errorf("expected a VolumeSnapshot for each PVC, got %+v", snapshot.Volumes)
+	}
+
+	// A second snapshot in the same second would have the same ID.
+	again, err := broker.CreateSessionSnapshot(client, namespace, fullName, "user@example.com", broker.SnapshotSpec{Enabled: true})
+	if err != broker.ErrSnapshotExists && (err != nil || again.ID == snapshot.ID) {
+		t.Errorf("expected ErrSnapshotExists for a snapshot in the same second, got %v", err)
+	}
+
+	got, found, err := broker.GetSessionSnapshot(client, namespace, fullName, snapshot.ID)
+	if err != nil || !found {
+		t.Fatalf("expected snapshot %s to be found, got %v, %v", snapshot.ID, found, err)
+	}
+	if len(got.Volumes) != 2 || got.VolumeSnapshots["home"] != "home-"+snapshot.ID || got.Ready {
+		t.Errorf("unexpected snapshot %+v", got)
+	}
+	if _, found, _ := broker.GetSessionSnapshot(client, namespace, fullName, "20000101-000000"); found {
+		t.Errorf("expected unknown snapshot not to be found")
+	}
+
+	if _, err := broker.CreateSessionSnapshot(client, namespace, "other-1234", "user@example.com", broker.SnapshotSpec{Enabled: true}); err != broker.ErrNoSessionVolumes {
+		t.Errorf("expected ErrNoSessionVolumes for a session without PVCs, got %v", err)
+	}
+}
+
+func TestSessionSnapshotPartialFailure(t *testing.T) {
+	namespace := "user-1234"
+	fullName := "desktop-1234"
+	pvc := func(name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app.kubernetes.io/instance": fullName},
+		}}
+	}
+	client := brokertest.NewFakeClusterClient(pvc("home"), pvc("data"))
+	dynamicClient := client.Dynamic().(*dynamicfake.FakeDynamicClient)
+
+	// The second VolumeSnapshot fails, the first is deleted again.
+	creates := 0
+	dynamicClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		creates++
+		if creates == 2 {
+			return true, nil, fmt.Errorf("quota exceeded")
+		}
+		return false, nil, nil
+	})
+	if _, err := broker.CreateSessionSnapshot(client, namespace, fullName, "user@example.com", broker.SnapshotSpec{Enabled: true}); err == nil {
+		t.Fatal("expected error when a VolumeSnapshot cannot be created")
+	}
+	if snapshots, err := broker.ListSessionSnapshots(client, namespace, fullName); err != nil || len(snapshots) != 0 {
+		t.Errorf("expected created VolumeSnapshots to be deleted, got %+v, %v", snapshots, err)
+	}
+
+	// VolumeSnapshots left from an interrupted snapshot are not ready even when they are ready to use.
+	snapshot, err := broker.CreateSessionSnapshot(client, namespace, fullName, "user@example.com", broker.SnapshotSpec{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, volume := range snapshot.Volumes {
+		obj, err := dynamicClient.Resource(broker.VolumeSnapshotGVR).Namespace(namespace).Get(context.TODO(), volume.VolumeSnapshot, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unstructured.SetNestedField(obj.Object, true, "status", "readyToUse")
+		if _, err := dynamicClient.Resource(broker.VolumeSnapshotGVR).Namespace(namespace).Update(context.TODO(), obj, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _, _ := broker.GetSessionSnapshot(client, namespace, fullName, snapshot.ID); !got.Ready {
+		t.Errorf("expected complete snapshot to be ready, got %+v", got)
+	}
+	if err := dynamicClient.Resource(broker.VolumeSnapshotGVR).Namespace(namespace).Delete(context.TODO(), snapshot.VolumeSnapshots["data"], metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	partial, _, _ := broker.GetSessionSnapshot(client, namespace, fullName, snapshot.ID)
+	if partial.Ready {
+		t.Errorf("expected partial snapshot not to be ready, got %+v", partial)
+	}
+
+	// Restoring the partial snapshot would provision the data PVC empty, no PVC is deleted.
+	if err := broker.DeleteSessionPVCs(client, namespace, fullName, partial); err != broker.ErrSnapshotIncomplete {
+		t.Errorf("expected ErrSnapshotIncomplete, got %v", err)
+	}
+	if pvcs, _ := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{}); len(pvcs.Items) != 2 {
+		t.Errorf("expected PVCs to be kept, got %d", len(pvcs.Items))
+	}
+	if err := broker.DeleteSessionPVCs(client, namespace, fullName, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if pvcs, _ := client.Kubernetes().CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{}); len(pvcs.Items) != 0 {
+		t.Errorf("expected PVCs to be deleted, got %d", len(pvcs.Items))
+	}
+}
@@ -16,6 +16,8 @@
 
 package pod_broker
 
+import "regexp"
+
 const DefaultBrokerNamespace = "pod-broker-system"
 
 const ApiVersion = "gcp.solutions/v1"
@@ -57,6 +59,7 @@ type KubeObjectMeta struct {
 	Namespace   string            `json:"namespace"`
 	Annotations map[string]string `json:"annotations"`
 	Labels      map[string]string `json:"labels"`
+	Generation  int64             `json:"generation,omitempty"`
 }
 
 type ConfigMapData map[string]string
@@ -102,6 +105,9 @@ type UserPodData struct {
 	Region                    string
 	Editable                  bool
 	PullSecrets               []string
+	Snapshots                 []SessionSnapshot
+	RestoreSnapshot           *SessionSnapshot
+	HomeVolume                string
 }
 
 type NodeResource struct {
@@ -164,9 +170,77 @@ type ShutdownHookSpec struct {
 	Command   string `yaml:"command" json:"command"`
 }
 
+type QuotaGroupSpec struct {
+	Name        string   `yaml:"name" json:"name"`
+	Users       []string `yaml:"users" json:"users"`
+	MaxSessions int      `yaml:"maxSessions" json:"maxSessions"`
+	// Compiled Users patterns, set by CompileQuotaGroups.
+	patterns []*regexp.Regexp
+}
+
+type AppQuotaSpec struct {
+	MaxSessions int              `yaml:"maxSessions,omitempty" json:"maxSessions,omitempty"`
+	Groups      []QuotaGroupSpec `yaml:"groups,omitempty" json:"groups,omitempty"`
+}
+
+type WaitQueuePrioritySpec struct {
+	Users    []string `yaml:"users" json:"users"`
+	Priority int      `yaml:"priority" json:"priority"`
+}
+
+type WaitQueueSpec struct {
+	Enabled    bool                    `yaml:"enabled" json:"enabled"`
+	MaxLength  int                     `yaml:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Timeout    string                  `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Priorities []WaitQueuePrioritySpec `yaml:"priorities,omitempty" json:"priorities,omitempty"`
+}
+
+type MaintenanceSpec struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`
+	Message     string `yaml:"message,omitempty" json:"message,omitempty"`
+	StartTime   string `yaml:"startTime,omitempty" json:"startTime,omitempty"`
+	EndTime     string `yaml:"endTime,omitempty" json:"endTime,omitempty"`
+	GracePeriod string `yaml:"gracePeriod,omitempty" json:"gracePeriod,omitempty"`
+}
+
+type SnapshotSpec struct {
+	Enabled             bool   `yaml:"enabled" json:"enabled"`
+	VolumeSnapshotClass string `yaml:"volumeSnapshotClass,omitempty" json:"volumeSnapshotClass,omitempty"`
+	Retention           int    `yaml:"retention,omitempty" json:"retention,omitempty"`
+}
+
+type HomeVolumeSpec struct {
+	Enabled       bool   `yaml:"enabled" json:"enabled"`
+	StorageClass  string `yaml:"storageClass,omitempty" json:"storageClass,omitempty"`
+	Size          string `yaml:"size,omitempty" json:"size,omitempty"`
+	MaxSize       string `yaml:"maxSize,omitempty" json:"maxSize,omitempty"`
+	RetentionDays int    `yaml:"retentionDays,omitempty" json:"retentionDays,omitempty"`
+	GCDryRun      bool   `yaml:"gcDryRun,omitempty" json:"gcDryRun,omitempty"`
+}
+
+type PoolScheduleSpec struct {
+	Name        string `yaml:"name,omitempty" json:"name,omitempty"`
+	Schedule    string `yaml:"schedule" json:"schedule"`
+	Duration    string `yaml:"duration" json:"duration"`
+	MinReplicas int    `yaml:"minReplicas" json:"minReplicas"`
+	MaxReplicas int    `yaml:"maxReplicas" json:"maxReplicas"`
+}
+
+type PoolAutoscalingSpec struct {
+	Enabled         bool               `yaml:"enabled" json:"enabled"`
+	Sizer           string             `yaml:"sizer,omitempty" json:"sizer,omitempty"`
+	MinReplicas     *int               `yaml:"minReplicas,omitempty" json:"minReplicas,omitempty"`
+	MaxReplicas     int                `yaml:"maxReplicas" json:"maxReplicas"`
+	HeadroomPercent int                `yaml:"headroomPercent,omitempty" json:"headroomPercent,omitempty"`
+	EmptyPoolTarget float64            `yaml:"emptyPoolTarget,omitempty" json:"emptyPoolTarget,omitempty"`
+	RateWindow      string             `yaml:"rateWindow,omitempty" json:"rateWindow,omitempty"`
+	Schedules       []PoolScheduleSpec `yaml:"schedules,omitempty" json:"schedules,omitempty"`
+}
+
 type DeploymentTypeSpec struct {
-	Replicas *int   `yaml:"replicas" json:"replicas"`
-	Selector string `yaml:"selector" json:"selector"`
+	Replicas    *int                `yaml:"replicas" json:"replicas"`
+	Selector    string              `yaml:"selector" json:"selector"`
+	Autoscaling PoolAutoscalingSpec `yaml:"autoscaling,omitempty" json:"autoscaling,omitempty"`
 }
 
 type AppConfigSpec struct {
@@ -191,6 +265,7 @@ type AppConfigSpec struct {
 	EnableUserConfigAuth bool                    `yaml:"enableUserConfigAuth" json:"enableUserConfigAuth"`
 	UserWritableFields   []string                `yaml:"userWritableFields" json:"userWritableFields"`
 	UserWritableParams   []string                `yaml:"userWritableParams" json:"userWritableParams"`
+	UserConfigWriters    []string                `yaml:"userConfigWriters,omitempty" json:"userConfigWriters,omitempty"`
 	AppParams            []AppConfigParam        `yaml:"appParams" json:"appParams"`
 	AppEnv               []AppEnvSpec            `yaml:"appEnv" json:"appEnv"`
 	ShutdownHooks        []ShutdownHookSpec      `yaml:"shutdownHooks" json:"shutdownHooks"`
@@ -199,12 +274,35 @@ type AppConfigSpec struct {
 	Authorization        AuthZUsersSpec          `yaml:"authorization" json:"authorization"`
 	DisableOptions       bool                    `yaml:"disableOptions" json:"disableOptions"`
 	UserBundles          []UserBundleSpec        `yaml:"userBundles" json:"userBundles"`
+	IdleTimeout          string                  `yaml:"idleTimeout,omitempty" json:"idleTimeout,omitempty"`
+	MaxSessionDuration   string                  `yaml:"maxSessionDuration,omitempty" json:"maxSessionDuration,omitempty"`
+	Quota                AppQuotaSpec            `yaml:"quota,omitempty" json:"quota,omitempty"`
+	WaitQueue            WaitQueueSpec           `yaml:"waitQueue,omitempty" json:"waitQueue,omitempty"`
+	Maintenance          MaintenanceSpec         `yaml:"maintenance,omitempty" json:"maintenance,omitempty"`
+	Snapshots            SnapshotSpec            `yaml:"snapshots,omitempty" json:"snapshots,omitempty"`
+	HomeVolume           HomeVolumeSpec          `yaml:"homeVolume,omitempty" json:"homeVolume,omitempty"`
+}
+
+type AppConfigCondition struct {
+	Type               string `yaml:"type" json:"type"`
+	Status             string `yaml:"status" json:"status"`
+	Reason             string `yaml:"reason,omitempty" json:"reason,omitempty"`
+	Message            string `yaml:"message,omitempty" json:"message,omitempty"`
+	LastTransitionTime string `yaml:"lastTransitionTime,omitempty" json:"lastTransitionTime,omitempty"`
+}
+
+type AppConfigStatus struct {
+	Conditions         []AppConfigCondition `yaml:"conditions,omitempty" json:"conditions,omitempty"`
+	ObservedGeneration int64                `yaml:"observedGeneration,omitempty" json:"observedGeneration,omitempty"`
+	LastSyncTime       string               `yaml:"lastSyncTime,omitempty" json:"lastSyncTime,omitempty"`
+	AppliedChecksum    string               `yaml:"appliedChecksum,omitempty" json:"appliedChecksum,omitempty"`
 }
 
 type AppConfigObject struct {
 	KubeObjectBase
-	Metadata KubeObjectMeta `yaml:"metadata" json:"metadata"`
-	Spec     AppConfigSpec  `yaml:"spec" json:"spec"`
+	Metadata KubeObjectMeta  `yaml:"metadata" json:"metadata"`
+	Spec     AppConfigSpec   `yaml:"spec" json:"spec"`
+	Status   AppConfigStatus `yaml:"status,omitempty" json:"status,omitempty"`
 }
 
 type AppUserConfigSpec struct {
@@ -215,6 +313,8 @@ type AppUserConfigSpec struct {
 	Tags      []string          `yaml:"tags" json:"tags"`
 	NodeTier  string            `yaml:"nodeTier,omitempty" json:"nodeTier,omitempty"`
 	Params    map[string]string `yaml:"params" json:"params"`
+	// ID of the snapshot to restore the session PVCs from on the next launch, set by the restore endpoint.
+	RestoreSnapshot string `yaml:"restoreSnapshot,omitempty" json:"restoreSnapshot,omitempty"`
 }
 
 type AppUserConfigObject struct {
@@ -224,6 +324,7 @@ type AppUserConfigObject struct {
 }
 
 type RegisteredAppsManifest struct {
+	Generation        int64                     `yaml:"generation" json:"generation"`
 	Apps              map[string]AppConfigSpec  `yaml:"apps" json:"apps"`
 	NetworkPolicyData NetworkPolicyTemplateData `yaml:"networkPolicyData" json:"networkPolicyData"`
 }
@@ -238,33 +339,51 @@ type AppListResponse struct {
 }
 
 type AppDataResponse struct {
-	Name           string            `json:"name"`
-	Type           AppType           `json:"type"`
-	DisplayName    string            `json:"displayName"`
-	Description    string            `json:"description"`
-	Icon           string            `json:"icon"`
-	LaunchURL      string            `json:"launchURL"`
-	DefaultRepo    string            `json:"defaultRepo"`
-	DefaultTag     string            `json:"defaultTag"`
-	NodeTiers      []string          `json:"nodeTiers"`
-	DefaultTier    string            `json:"defaultTier"`
-	Params         []AppConfigParam  `json:"params"`
-	Editable       bool              `json:"editable"`
-	DisableOptions bool              `json:"disableOptions"`
-	Metadata       map[string]string `json:"metadata"`
+	Name           string                  `json:"name"`
+	Type           AppType                 `json:"type"`
+	DisplayName    string                  `json:"displayName"`
+	Description    string                  `json:"description"`
+	Icon           string                  `json:"icon"`
+	LaunchURL      string                  `json:"launchURL"`
+	DefaultRepo    string                  `json:"defaultRepo"`
+	DefaultTag     string                  `json:"defaultTag"`
+	NodeTiers      []string                `json:"nodeTiers"`
+	DefaultTier    string                  `json:"defaultTier"`
+	Params         []AppConfigParam        `json:"params"`
+	Editable       bool                    `json:"editable"`
+	DisableOptions bool                    `json:"disableOptions"`
+	Metadata       map[string]string       `json:"metadata"`
+	Maintenance    *AppMaintenanceResponse `json:"maintenance,omitempty"`
+}
+
+type AppMaintenanceResponse struct {
+	Active          bool   `json:"active"`
+	Message         string `json:"message,omitempty"`
+	StartTime       string `json:"startTime,omitempty"`
+	EndTime         string `json:"endTime,omitempty"`
+	SessionDeadline string `json:"sessionDeadline,omitempty"`
 }
 
 type StatusResponse struct {
-	Code              int                `json:"code"`
-	Status            string             `json:"status"`
-	Nodes             []string           `json:"nodes,omitempty"`
-	Containers        map[string]string  `json:"containers,omitempty"`
-	Images            map[string]string  `json:"images,omitempty"`
-	PodIPs            []string           `json:"pod_ips,omitempty"`
-	PodStatus         *PodStatusResponse `json:"pod_status,omitempty"`
-	SessionKeys       []string           `json:"session_keys"`
-	BrokerObjects     []string           `json:"broker_objects"`
-	CreationTimestamp string             `json:"creation_timestamp"`
+	Code              int                     `json:"code"`
+	Status            string                  `json:"status"`
+	Nodes             []string                `json:"nodes,omitempty"`
+	Containers        map[string]string       `json:"containers,omitempty"`
+	Images            map[string]string       `json:"images,omitempty"`
+	PodIPs            []string                `json:"pod_ips,omitempty"`
+	PodStatus         *PodStatusResponse      `json:"pod_status,omitempty"`
+	SessionKeys       []string                `json:"session_keys"`
+	BrokerObjects     []string                `json:"broker_objects"`
+	CreationTimestamp string                  `json:"creation_timestamp"`
+	Maintenance       *AppMaintenanceResponse `json:"maintenance,omitempty"`
+	// Ready pods that the session.ready event was not sent for.
+	UnnotifiedReadyPods []string `json:"-"`
+}
+
+type AppUserConfigResponse struct {
+	AppUserConfigSpec
+	Snapshots  []SessionSnapshot   `json:"snapshots,omitempty"`
+	HomeVolume *HomeVolumeResponse `json:"homeVolume,omitempty"`
 }
 
 type PodStatusResponse struct {
@@ -281,6 +400,22 @@ type ImageListManifestResponse struct {
 	TimeUploaadedMs string   `json:"timeUploadedMs"`
 }
 
+type QuotaExceededResponse struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Limit   string `json:"limit"`
+	Group   string `json:"group,omitempty"`
+	Max     int    `json:"max"`
+	Current int    `json:"current"`
+}
+
+type WaitQueueStatusResponse struct {
+	Code       int    `json:"code"`
+	Status     string `json:"status"`
+	Position   int    `json:"position"`
+	ETASeconds int64  `json:"etaSeconds,omitempty"`
+}
+
 type ReservationMetadataSpec struct {
 	IP           string            `json:"ip"`
 	SessionKey   string            `json:"session_key"`
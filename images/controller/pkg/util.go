@@ -17,10 +17,7 @@
 package pod_broker
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -363,52 +360,6 @@ func ListGCRImageTagsInternalMetadataToken(image string) (ImageListResponse, err
 	return ListGCRImageTags(image, authToken)
 }
 
-// Returns a list of all the dockerconfigjson type secrets found in the given namespace.
-func GetDockerConfigs(namespace string) ([]DockerConfigJSON, []string, error) {
-	resp := make([]DockerConfigJSON, 0)
-	secrets := make([]string, 0)
-
-	type getSecretSpec struct {
-		Metadata map[string]interface{} `json:"metadata"`
-		Data     map[string]interface{} `json:"data"`
-	}
-
-	type getSecretList struct {
-		Items []getSecretSpec `json:"items"`
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get secret -n %s --field-selector 'type=kubernetes.io/dockerconfigjson' -o json 1>&2", namespace))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return resp, secrets, fmt.Errorf("failed to get node: %s, %v", string(stdoutStderr), err)
-	}
-
-	var jsonResp getSecretList
-	if err := json.Unmarshal(stdoutStderr, &jsonResp); err != nil {
-		return resp, secrets, fmt.Errorf("failed to parse secret list spec: %v", err)
-	}
-
-	for _, secret := range jsonResp.Items {
-		secretName := secret.Metadata["name"].(string)
-		secrets = append(secrets, secretName)
-		if v, ok := secret.Data[".dockerconfigjson"]; ok {
-			dockerConfigJSONData, err := base64.StdEncoding.DecodeString(v.(string))
-			if err != nil {
-				return resp, secrets, fmt.Errorf("failed to decode .dockerconfigjson from secret: %s", secretName)
-			}
-
-			var dockerConfig DockerConfigJSON
-			if err := json.Unmarshal(dockerConfigJSONData, &dockerConfig); err != nil {
-				return resp, secrets, fmt.Errorf("failed to parse docker config from secret %s: %v", secretName, err)
-			}
-
-			resp = append(resp, dockerConfig)
-		}
-	}
-
-	return resp, secrets, nil
-}
-
 func GetImagesOnNode() ([]DockerImage, error) {
 	resp := make([]DockerImage, 0)
 
@@ -483,116 +434,6 @@ func GetProjectID() (string, error) {
 	return metadata.ProjectID()
 }
 
-func GetServiceClusterIP(namespace, selector string) (ServiceClusterIPList, error) {
-	resp := ServiceClusterIPList{
-		Services: make([]ServiceClusterIP, 0),
-	}
-
-	type serviceSpec struct {
-		ClusterIP string `json:"clusterIP"`
-	}
-
-	type getServiceSpec struct {
-		Metadata map[string]interface{} `json:"metadata"`
-		Spec     serviceSpec            `json:"spec"`
-	}
-
-	type getServiceList struct {
-		Items []getServiceSpec `json:"items"`
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get service -n %s -l %s -o json 1>&2", namespace, selector))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return resp, fmt.Errorf("failed to get node: %s, %v", string(stdoutStderr), err)
-	}
-
-	var jsonResp getServiceList
-	if err := json.Unmarshal(stdoutStderr, &jsonResp); err != nil {
-		return resp, fmt.Errorf("failed to parse service spec: %v", err)
-	}
-
-	for _, service := range jsonResp.Items {
-		resp.Services = append(resp.Services, ServiceClusterIP{
-			ServiceName: service.Metadata["name"].(string),
-			ClusterIP:   service.Spec.ClusterIP,
-		})
-	}
-
-	return resp, nil
-}
-
-func GetJobs(namespace, selector string) ([]GetJobSpec, error) {
-	resp := make([]GetJobSpec, 0)
-
-	type getJobsList struct {
-		Items []GetJobSpec `json:"items"`
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get jobs -n %s -l %s -o json 1>&2", namespace, selector))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return resp, fmt.Errorf("failed to get jobs: %s, %v", string(stdoutStderr), err)
-	}
-
-	var jsonResp getJobsList
-	if err := json.Unmarshal(stdoutStderr, &jsonResp); err != nil {
-		return resp, fmt.Errorf("failed to parse jobs spec: %v", err)
-	}
-
-	return jsonResp.Items, nil
-}
-
-func ListPods(namespace, selector string) ([]string, error) {
-	resp := make([]string, 0)
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get pod -n %s -l \"%s\" -o name --sort-by=.metadata.creationTimestamp 1>&2", namespace, selector))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return resp, fmt.Errorf("failed to get pods: %s, %v", string(stdoutStderr), err)
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(stdoutStderr))
-	for scanner.Scan() {
-		line := scanner.Text()
-		podName := strings.Split(line, "/")[1]
-		resp = append(resp, podName)
-	}
-
-	return resp, nil
-}
-
-func CopySecret(namespace, name, destDir string) error {
-	err := os.MkdirAll(destDir, os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get secret -n %s %s -o yaml > %s/resource-%s.yaml", namespace, name, destDir, name))
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to copy secret: %s, %v", string(stdoutStderr), err)
-	}
-	return nil
-}
-
-func CopyDockerRegistrySecrets(namespace, destDir string) ([]string, error) {
-	resp := []string{}
-	err := os.MkdirAll(destDir, os.ModePerm)
-	if err != nil {
-		return resp, err
-	}
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("kubectl get secret -n %s --field-selector 'type=kubernetes.io/dockerconfigjson' -o jsonpath='{range .items[*]}{.metadata.name}{\"\\n\"}{end}' | xargs -I{} sh -c \"kubectl get secret {} -n %s -o yaml > %s/resource-{}.yaml && echo {}\"", namespace, namespace, destDir))
-	output, err := cmd.Output()
-	if err != nil {
-		stdoutStderr, err := cmd.CombinedOutput()
-		return resp, fmt.Errorf("failed to copy secret: %s, %v", string(stdoutStderr), err)
-	}
-
-	resp = strings.Split(strings.Trim(string(output), " \n"), "\n")
-	return resp, nil
-}
-
 func GetPubSubSubscription(subName, topicName, project, saEmail string) (*pubsub.Subscription, error) {
 	var sub *pubsub.Subscription
 
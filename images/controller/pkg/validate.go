@@ -0,0 +1,192 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Returns all of the problems with the app spec that would make the brokers skip the app or fail its requests, nil if it is valid.
+// The spec is checked as written, before SetDefaults, except that an empty type is a StatefulSet app.
+func (spec *AppConfigSpec) Validate() error {
+	errs := make([]error, 0)
+
+	if len(spec.Name) == 0 {
+		errs = append(errs, fmt.Errorf("missing name"))
+	}
+
+	switch spec.Type {
+	case "", AppTypeStatefulSet:
+	case AppTypeDeployment:
+		if len(spec.Deployment.Selector) == 0 {
+			errs = append(errs, fmt.Errorf("missing deployment.selector, required for %s apps", AppTypeDeployment))
+		} else if _, err := labels.Parse(spec.Deployment.Selector); err != nil {
+			errs = append(errs, fmt.Errorf("invalid deployment.selector '%s': %v", spec.Deployment.Selector, err))
+		}
+		if spec.Deployment.Replicas != nil && *spec.Deployment.Replicas < 0 {
+			errs = append(errs, fmt.Errorf("invalid deployment.replicas: %d", *spec.Deployment.Replicas))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid type '%s', must be one of: %s, %s", spec.Type, AppTypeStatefulSet, AppTypeDeployment))
+	}
+
+	// Node tiers
+	tiers := make(map[string]bool, len(spec.NodeTiers))
+	for i, tier := range spec.NodeTiers {
+		if len(tier.Name) == 0 {
+			errs = append(errs, fmt.Errorf("missing nodeTiers[%d].name", i))
+		} else if tiers[tier.Name] {
+			errs = append(errs, fmt.Errorf("duplicate node tier '%s'", tier.Name))
+		}
+		tiers[tier.Name] = true
+	}
+	// Apps without node tiers, like most Deployment apps, do not need a defaultTier.
+	if (len(spec.NodeTiers) > 0 || len(spec.DefaultTier) > 0) && !tiers[spec.DefaultTier] {
+		errs = append(errs, fmt.Errorf("defaultTier '%s' not found in nodeTiers: %v", spec.DefaultTier, spec.NodeTierNames()))
+	}
+
+	// User params
+	params := make(map[string]bool, len(spec.UserParams))
+	for i, param := range spec.UserParams {
+		if len(param.Name) == 0 {
+			errs = append(errs, fmt.Errorf("missing userParams[%d].name", i))
+			continue
+		}
+		if params[param.Name] {
+			errs = append(errs, fmt.Errorf("duplicate user param '%s'", param.Name))
+		}
+		params[param.Name] = true
+		if len(param.Regexp) > 0 {
+			re, err := regexp.Compile(param.Regexp)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid regexp for user param '%s': %v", param.Name, err))
+			} else if len(param.Default) > 0 && !re.MatchString(param.Default) {
+				errs = append(errs, fmt.Errorf("default value '%s' of user param '%s' does not match its regexp '%s'", param.Default, param.Name, param.Regexp))
+			}
+		}
+	}
+
+	// Authorization rules
+	for _, field := range []struct {
+		name  string
+		rules []string
+	}{
+		{"authorizedUsers", spec.AuthorizedUsers},
+		{"editors", spec.Editors},
+		{"userConfigWriters", spec.UserConfigWriters},
+	} {
+		for _, rule := range field.rules {
+			if err := ValidateAuthzRule(rule); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %v", field.name, err))
+			}
+		}
+	}
+
+	// User patterns of quota groups and wait queue priorities
+	if _, err := CompileQuotaGroups(spec.Quota.Groups); err != nil {
+		errs = append(errs, err.(utilerrors.Aggregate).Errors()...)
+	}
+	for _, priority := range spec.WaitQueue.Priorities {
+		for _, u := range priority.Users {
+			if _, err := regexp.Compile(u); err != nil {
+				errs = append(errs, fmt.Errorf("invalid user pattern '%s' in waitQueue priorities: %v", u, err))
+			}
+		}
+	}
+	if len(spec.WaitQueue.Timeout) > 0 {
+		if _, err := time.ParseDuration(spec.WaitQueue.Timeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid waitQueue timeout '%s': %v", spec.WaitQueue.Timeout, err))
+		}
+	}
+
+	if _, _, err := spec.SessionTimeouts(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, _, err := spec.MaintenanceWindow(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := spec.ValidatePoolAutoscaling(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := spec.ValidateHomeVolume(); err != nil {
+		errs = append(errs, err)
+	}
+	if spec.Snapshots.Retention < 0 {
+		errs = append(errs, fmt.Errorf("invalid snapshots retention: %d", spec.Snapshots.Retention))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// Returns all of the problems with the user config for the app, nil if it is valid.
+// Empty fields and param values are valid, the brokers fill them in from the app defaults.
+// Params that are not in the app userParams are ignored, they may have been removed from the app after the config was saved.
+func (spec *AppUserConfigSpec) Validate(app AppConfigSpec) error {
+	errs := make([]error, 0)
+
+	if spec.AppName != app.Name {
+		errs = append(errs, fmt.Errorf("appName '%s' does not match app '%s'", spec.AppName, app.Name))
+	}
+	if len(spec.User) == 0 {
+		errs = append(errs, fmt.Errorf("missing user"))
+	}
+
+	if len(spec.NodeTier) > 0 {
+		found := false
+		for _, tier := range app.NodeTiers {
+			if tier.Name == spec.NodeTier {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("nodeTier '%s' not found in app nodeTiers: %v", spec.NodeTier, app.NodeTierNames()))
+		}
+	}
+
+	names := make([]string, 0, len(spec.Params))
+	for name := range spec.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := spec.Params[name]
+		var param *AppConfigParam
+		for i := range app.UserParams {
+			if app.UserParams[i].Name == name {
+				param = &app.UserParams[i]
+				break
+			}
+		}
+		if param == nil {
+			continue
+		}
+		if len(param.Regexp) > 0 && len(value) > 0 {
+			if re, err := regexp.Compile(param.Regexp); err == nil && !re.MatchString(value) {
+				errs = append(errs, fmt.Errorf("invalid value for user param '%s'", name))
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
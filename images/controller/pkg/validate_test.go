@@ -0,0 +1,124 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"testing"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Returns the number of errors in the aggregate returned by Validate.
+func countErrors(err error) int {
+	if err == nil {
+		return 0
+	}
+	return len(err.(utilerrors.Aggregate).Errors())
+}
+
+func TestAppConfigSpecValidate(t *testing.T) {
+	valid := func() AppConfigSpec {
+		return AppConfigSpec{
+			Name:        "desktop",
+			NodeTiers:   []NodeTierSpec{{Name: "standard"}, {Name: "gpu"}},
+			DefaultTier: "standard",
+			UserParams:  []AppConfigParam{{Name: "mode", Default: "fast", Regexp: "^(fast|slow)$"}},
+			Editors:     []string{"group:admins@corp"},
+		}
+	}
+	replicas := -1
+
+	tests := []struct {
+		name     string
+		modify   func(*AppConfigSpec)
+		wantErrs int
+	}{
+		{"valid", func(s *AppConfigSpec) {}, 0},
+		{"deployment without node tiers", func(s *AppConfigSpec) {
+			s.Type = AppTypeDeployment
+			s.Deployment.Selector = "app=desktop"
+			s.NodeTiers = nil
+			s.DefaultTier = ""
+		}, 0},
+		{"statefulset without node tiers", func(s *AppConfigSpec) { s.NodeTiers = nil; s.DefaultTier = "" }, 0},
+		{"missing name", func(s *AppConfigSpec) { s.Name = "" }, 1},
+		{"invalid type", func(s *AppConfigSpec) { s.Type = "job" }, 1},
+		{"deployment without selector", func(s *AppConfigSpec) { s.Type = AppTypeDeployment; s.Deployment.Replicas = &replicas }, 2},
+		{"invalid selector", func(s *AppConfigSpec) { s.Type = AppTypeDeployment; s.Deployment.Selector = "app in (" }, 1},
+		{"duplicate node tier", func(s *AppConfigSpec) { s.NodeTiers = append(s.NodeTiers, NodeTierSpec{Name: "gpu"}) }, 1},
+		{"unknown default tier", func(s *AppConfigSpec) { s.DefaultTier = "tpu" }, 1},
+		{"default tier without node tiers", func(s *AppConfigSpec) { s.NodeTiers = nil }, 1},
+		{"duplicate user param", func(s *AppConfigSpec) { s.UserParams = append(s.UserParams, AppConfigParam{Name: "mode"}) }, 1},
+		{"invalid param regexp", func(s *AppConfigSpec) { s.UserParams[0].Regexp = "(" }, 1},
+		{"default does not match regexp", func(s *AppConfigSpec) { s.UserParams[0].Default = "medium" }, 1},
+		{"invalid authorization rules", func(s *AppConfigSpec) {
+			s.AuthorizedUsers = []string{"("}
+			s.UserConfigWriters = []string{"role:"}
+		}, 2},
+		{"invalid quota group", func(s *AppConfigSpec) {
+			s.Quota.Groups = []QuotaGroupSpec{{Name: "students", Users: []string{"("}, MaxSessions: 1}}
+		}, 1},
+		{"invalid wait queue", func(s *AppConfigSpec) {
+			s.WaitQueue.Timeout = "5"
+			s.WaitQueue.Priorities = []WaitQueuePrioritySpec{{Users: []string{"("}, Priority: 1}}
+		}, 2},
+		{"invalid timeouts", func(s *AppConfigSpec) { s.IdleTimeout = "1 hour" }, 1},
+		{"invalid maintenance window", func(s *AppConfigSpec) { s.Maintenance.GracePeriod = "1h" }, 1},
+		{"invalid snapshot retention", func(s *AppConfigSpec) { s.Snapshots.Retention = -1 }, 1},
+		{"all problems reported", func(s *AppConfigSpec) { s.Name = ""; s.DefaultTier = "tpu"; s.Editors = []string{"("} }, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := valid()
+			tc.modify(&spec)
+			err := spec.Validate()
+			if got := countErrors(err); got != tc.wantErrs {
+				t.Errorf("expected %d errors, got %d: %v", tc.wantErrs, got, err)
+			}
+		})
+	}
+}
+
+func TestAppUserConfigSpecValidate(t *testing.T) {
+	app := AppConfigSpec{
+		Name:       "desktop",
+		NodeTiers:  []NodeTierSpec{{Name: "standard"}},
+		UserParams: []AppConfigParam{{Name: "mode", Regexp: "^(fast|slow)$"}},
+	}
+
+	tests := []struct {
+		name     string
+		spec     AppUserConfigSpec
+		wantErrs int
+	}{
+		{"valid", AppUserConfigSpec{AppName: "desktop", User: "user@example.com", NodeTier: "standard", Params: map[string]string{"mode": "slow"}}, 0},
+		{"defaults", AppUserConfigSpec{AppName: "desktop", User: "user@example.com", Params: map[string]string{"mode": ""}}, 0},
+		{"removed param", AppUserConfigSpec{AppName: "desktop", User: "user@example.com", Params: map[string]string{"legacy": "("}}, 0},
+		{"other app", AppUserConfigSpec{AppName: "ide", User: "user@example.com"}, 1},
+		{"missing user", AppUserConfigSpec{AppName: "desktop"}, 1},
+		{"unknown node tier", AppUserConfigSpec{AppName: "desktop", User: "user@example.com", NodeTier: "gpu"}, 1},
+		{"invalid param", AppUserConfigSpec{AppName: "desktop", User: "user@example.com", Params: map[string]string{"mode": "medium"}}, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.spec.Validate(app)
+			if got := countErrors(err); got != tc.wantErrs {
+				t.Errorf("expected %d errors, got %d: %v", tc.wantErrs, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Time after the last poll that a queued user is removed from the queue, if not set in the app spec.
+const DefaultWaitQueueTimeout = 60 * time.Second
+
+// Weight of the latest sample in the moving average of the time between queued users being served.
+const waitQueueETAWeight = 0.3
+
+// Returned by WaitQueue.Enqueue when the queue is at its max length.
+var ErrWaitQueueFull = errors.New("wait queue is full")
+
+// User waiting for a pod.
+type WaitQueueEntry struct {
+	User       string
+	Username   string
+	UserParams map[string]string
+	Priority   int
+	Enqueued   time.Time
+	LastPoll   time.Time
+}
+
+// WaitQueue is a per-app queue of users waiting for a reservation.
+// Users are ordered by priority, highest first, then in the order they were enqueued.
+// Entries that are not polled within the timeout are removed.
+type WaitQueue struct {
+	sync.Mutex
+	spec        WaitQueueSpec
+	priorities  []waitQueuePriority
+	timeout     time.Duration
+	entries     []*WaitQueueEntry
+	lastServed  time.Time
+	avgInterval time.Duration
+}
+
+func NewWaitQueue() *WaitQueue {
+	return &WaitQueue{
+		timeout: DefaultWaitQueueTimeout,
+		entries: make([]*WaitQueueEntry, 0),
+	}
+}
+
+// Priority spec with the compiled user patterns.
+type waitQueuePriority struct {
+	patterns []*regexp.Regexp
+	priority int
+}
+
+// Updates the queue settings from the app spec, the priority user patterns are compiled when the spec changes.
+// Invalid settings are skipped and returned as an aggregate error, the rest of the spec is applied.
+func (q *WaitQueue) Configure(spec WaitQueueSpec) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.priorities != nil && reflect.DeepEqual(spec, q.spec) {
+		return nil
+	}
+	errs := make([]error, 0)
+
+	q.spec = spec
+	q.timeout = DefaultWaitQueueTimeout
+	if len(spec.Timeout) > 0 {
+		timeout, err := time.ParseDuration(spec.Timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid waitQueue timeout '%s', using default of %v: %v", spec.Timeout, DefaultWaitQueueTimeout, err))
+		} else {
+			q.timeout = timeout
+		}
+	}
+
+	q.priorities = make([]waitQueuePriority, 0, len(spec.Priorities))
+	for _, p := range spec.Priorities {
+		priority := waitQueuePriority{
+			patterns: make([]*regexp.Regexp, 0, len(p.Users)),
+			priority: p.Priority,
+		}
+		for _, u := range p.Users {
+			re, err := regexp.Compile(u)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid user pattern '%s' in waitQueue priorities: %v", u, err))
+				continue
+			}
+			priority.patterns = append(priority.patterns, re)
+		}
+		q.priorities = append(q.priorities, priority)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// Returns true if the queue is enabled for the app.
+func (q *WaitQueue) Enabled() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.spec.Enabled
+}
+
+// Returns the priority for the user from the first matching priority spec, 0 if none match.
+func (q *WaitQueue) priority(user, username string) int {
+	for _, p := range q.priorities {
+		for _, re := range p.patterns {
+			if re.MatchString(user) || (len(username) > 0 && re.MatchString(username)) {
+				return p.priority
+			}
+		}
+	}
+	return 0
+}
+
+// Removes entries that have not been polled within the timeout, must be called with the lock held.
+func (q *WaitQueue) expire(now time.Time) {
+	entries := make([]*WaitQueueEntry, 0, len(q.entries))
+	for _, e := range q.entries {
+		if now.Sub(e.LastPoll) > q.timeout {
+			log.Printf("removing user %s from wait queue, no poll since %v", e.User, e.LastPoll)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	q.entries = entries
+}
+
+// Returns the 1-based position of the user, must be called with the lock held.
+func (q *WaitQueue) position(user string) int {
+	for i, e := range q.entries {
+		if e.User == user {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Adds the user to the queue, or refreshes the entry if the user is already queued.
+// Returns the 1-based position of the user in the queue.
+func (q *WaitQueue) Enqueue(user, username string, userParams map[string]string) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	q.expire(now)
+
+	if pos := q.position(user); pos > 0 {
+		e := q.entries[pos-1]
+		e.LastPoll = now
+		e.Username = username
+		e.UserParams = userParams
+		return pos, nil
+	}
+
+	if q.spec.MaxLength > 0 && len(q.entries) >= q.spec.MaxLength {
+		return 0, ErrWaitQueueFull
+	}
+
+	q.entries = append(q.entries, &WaitQueueEntry{
+		User:       user,
+		Username:   username,
+		UserParams: userParams,
+		Priority:   q.priority(user, username),
+		Enqueued:   now,
+		LastPoll:   now,
+	})
+	sort.SliceStable(q.entries, func(i, j int) bool {
+		return q.entries[i].Priority > q.entries[j].Priority
+	})
+
+	return q.position(user), nil
+}
+
+// Returns the 1-based position of the user and records the poll, 0 if the user is not queued.
+func (q *WaitQueue) Poll(user string) int {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	q.expire(now)
+	pos := q.position(user)
+	if pos > 0 {
+		q.entries[pos-1].LastPoll = now
+	}
+	return pos
+}
+
+// Returns a copy of the entry at the head of the queue.
+func (q *WaitQueue) Head() (WaitQueueEntry, bool) {
+	q.Lock()
+	defer q.Unlock()
+	q.expire(time.Now())
+	if len(q.entries) == 0 {
+		return WaitQueueEntry{}, false
+	}
+	return *q.entries[0], true
+}
+
+// Returns the number of users in the queue.
+func (q *WaitQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	q.expire(time.Now())
+	return len(q.entries)
+}
+
+// Removes the user from the queue without recording that they were served.
+func (q *WaitQueue) Remove(user string) {
+	q.Lock()
+	defer q.Unlock()
+	if pos := q.position(user); pos > 0 {
+		q.entries = append(q.entries[:pos-1], q.entries[pos:]...)
+	}
+}
+
+// Removes the user from the queue and updates the average time between users being served.
+func (q *WaitQueue) Served(user string) {
+	q.Lock()
+	defer q.Unlock()
+	pos := q.position(user)
+	if pos == 0 {
+		return
+	}
+	q.entries = append(q.entries[:pos-1], q.entries[pos:]...)
+
+	now := time.Now()
+	if !q.lastServed.IsZero() {
+		interval := now.Sub(q.lastServed)
+		if q.avgInterval == 0 {
+			q.avgInterval = interval
+		} else {
+			q.avgInterval = time.Duration(waitQueueETAWeight*float64(interval) + (1-waitQueueETAWeight)*float64(q.avgInterval))
+		}
+	}
+	q.lastServed = now
+}
+
+// Returns the estimated wait for the given position, 0 if there is not enough history to estimate.
+func (q *WaitQueue) ETA(position int) time.Duration {
+	q.Lock()
+	defer q.Unlock()
+	return time.Duration(position) * q.avgInterval
+}
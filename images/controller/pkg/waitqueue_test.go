@@ -0,0 +1,75 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"testing"
+)
+
+func TestWaitQueuePriorities(t *testing.T) {
+	q := NewWaitQueue()
+	err := q.Configure(WaitQueueSpec{
+		Enabled: true,
+		Priorities: []WaitQueuePrioritySpec{
+			{Users: []string{"@staff.example.com$"}, Priority: 10},
+			{Users: []string{"^vip-"}, Priority: 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	q.Enqueue("alice@example.com", "", nil)
+	q.Enqueue("bob@example.com", "vip-bob", nil)
+	q.Enqueue("carol@staff.example.com", "", nil)
+	q.Enqueue("dave@example.com", "", nil)
+
+	want := []string{"carol@staff.example.com", "bob@example.com", "alice@example.com", "dave@example.com"}
+	for i, user := range want {
+		if pos := q.Poll(user); pos != i+1 {
+			t.Errorf("expected %s at position %d, got %d", user, i+1, pos)
+		}
+	}
+}
+
+func TestWaitQueueConfigureInvalid(t *testing.T) {
+	q := NewWaitQueue()
+	err := q.Configure(WaitQueueSpec{
+		Timeout: "soon",
+		Priorities: []WaitQueuePrioritySpec{
+			{Users: []string{"(", "^vip-"}, Priority: 5},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error for invalid timeout and user pattern")
+	}
+	if q.timeout != DefaultWaitQueueTimeout {
+		t.Errorf("expected default timeout, got %v", q.timeout)
+	}
+
+	// Valid patterns of the spec are still applied.
+	q.Enqueue("alice@example.com", "", nil)
+	q.Enqueue("bob@example.com", "vip-bob", nil)
+	if pos := q.Poll("bob@example.com"); pos != 1 {
+		t.Errorf("expected prioritized user at position 1, got %d", pos)
+	}
+
+	// The spec is only compiled again when it changes.
+	if err := q.Configure(q.spec); err != nil {
+		t.Errorf("expected unchanged spec to be skipped, got: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Webhook event types.
+const (
+	WebhookEventSessionReady        = "session.ready"
+	WebhookEventReservationAssigned = "reservation.assigned"
+	WebhookEventPublishJobSucceeded = "publish-job.succeeded"
+	WebhookEventPublishJobFailed    = "publish-job.failed"
+	WebhookEventImagePullCompleted  = "image-pull.completed"
+)
+
+// Headers set on each webhook request.
+// The signature is the hex encoded HMAC-SHA256 of the timestamp header, a '.' and the request body using the webhook secret, prefixed with "sha256=".
+// Receivers should reject requests with an old timestamp so that captured deliveries cannot be replayed.
+const (
+	WebhookEventHeader     = "X-Broker-Event"
+	WebhookSignatureHeader = "X-Broker-Signature"
+	WebhookTimestampHeader = "X-Broker-Timestamp"
+)
+
+// Annotation set on session pods once the session.ready event was sent, so that it is sent once per session across broker restarts.
+const SessionReadyNotifiedAnnotation = "app.broker/session-ready-notified"
+
+// Key in the webhooks ConfigMap that holds the JSON list of webhooks.
+const WebhooksConfigMapKey = "webhooks.json"
+
+const (
+	webhookTimeout        = 10 * time.Second
+	webhookMaxAttempts    = 5
+	webhookInitialBackoff = 1 * time.Second
+	webhookReloadPeriod   = 60 * time.Second
+)
+
+// Outbound webhook and the events it is sent.
+type WebhookSpec struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Event types sent to the webhook, all events are sent if empty.
+	Events []string `json:"events"`
+}
+
+// Returns true if the event type should be sent to the webhook.
+func (spec *WebhookSpec) Accepts(event string) bool {
+	if len(spec.Events) == 0 {
+		return true
+	}
+	for _, e := range spec.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload posted to webhooks.
+type WebhookEvent struct {
+	Event  string            `json:"event"`
+	Time   time.Time         `json:"time"`
+	Source string            `json:"source"`
+	App    string            `json:"app,omitempty"`
+	User   string            `json:"user,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// WebhookNotifier posts signed events to the configured webhooks.
+// Webhooks are read from the Webhooks sysParam and from the ConfigMap named by the WebhooksConfigMap sysParam, which is re-read periodically in the background.
+type WebhookNotifier struct {
+	sync.Mutex
+	source         string
+	client         ClusterClient
+	httpClient     *http.Client
+	configMap      string
+	namespace      string
+	paramWebhooks  []WebhookSpec
+	webhooks       []WebhookSpec
+	initialBackoff time.Duration
+}
+
+// Creates a webhook notifier from the Webhooks and WebhooksConfigMap sysParams.
+// Webhooks is a JSON list of webhooks, for example: [{"name": "slack", "url": "https://example.com/hook", "secret": "s3cr3t", "events": ["session.ready"]}]
+// WebhooksConfigMap is the name of a ConfigMap, optionally prefixed with its namespace, with the same JSON list in the webhooks.json key.
+// The ConfigMap is read from namespace if the name has no namespace prefix.
+// source is set in each event and identifies the broker service that sent it.
+func NewWebhookNotifierFromParams(client ClusterClient, sysParams map[string]string, namespace, source string) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		source:         source,
+		client:         client,
+		httpClient:     &http.Client{Timeout: webhookTimeout},
+		namespace:      namespace,
+		paramWebhooks:  make([]WebhookSpec, 0),
+		webhooks:       make([]WebhookSpec, 0),
+		initialBackoff: webhookInitialBackoff,
+	}
+
+	if v, ok := sysParams["Webhooks"]; ok && len(v) > 0 {
+		if err := json.Unmarshal([]byte(v), &n.paramWebhooks); err != nil {
+			return nil, fmt.Errorf("invalid Webhooks JSON: %v", err)
+		}
+	}
+
+	if v, ok := sysParams["WebhooksConfigMap"]; ok && len(v) > 0 {
+		n.configMap = v
+		if toks := strings.SplitN(v, "/", 2); len(toks) == 2 {
+			n.namespace = toks[0]
+			n.configMap = toks[1]
+		}
+		webhooks, err := n.loadConfigMap()
+		if err != nil {
+			return nil, err
+		}
+		n.webhooks = webhooks
+	}
+
+	for _, w := range append(n.paramWebhooks, n.webhooks...) {
+		if len(w.URL) == 0 {
+			return nil, fmt.Errorf("missing url for webhook '%s'", w.Name)
+		}
+	}
+
+	if len(n.configMap) > 0 {
+		go func() {
+			for {
+				time.Sleep(webhookReloadPeriod)
+				n.reload()
+			}
+		}()
+	}
+
+	return n, nil
+}
+
+// Re-reads the webhooks from the ConfigMap, the previous webhooks are kept if it cannot be read.
+func (n *WebhookNotifier) reload() {
+	webhooks, err := n.loadConfigMap()
+	if err != nil {
+		log.Printf("failed to reload webhooks, using previous config: %v", err)
+		return
+	}
+	n.Lock()
+	n.webhooks = webhooks
+	n.Unlock()
+}
+
+// Reads the list of webhooks from the ConfigMap, a missing ConfigMap or key is an empty list.
+func (n *WebhookNotifier) loadConfigMap() ([]WebhookSpec, error) {
+	webhooks := make([]WebhookSpec, 0)
+	cm, err := n.client.Kubernetes().CoreV1().ConfigMaps(n.namespace).Get(context.TODO(), n.configMap, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return webhooks, nil
+		}
+		return webhooks, fmt.Errorf("failed to get webhooks ConfigMap %s/%s: %v", n.namespace, n.configMap, err)
+	}
+	if data, ok := cm.Data[WebhooksConfigMapKey]; ok {
+		if err := json.Unmarshal([]byte(data), &webhooks); err != nil {
+			return webhooks, fmt.Errorf("invalid JSON in webhooks ConfigMap %s/%s: %v", n.namespace, n.configMap, err)
+		}
+	}
+	return webhooks, nil
+}
+
+// Returns the webhooks that accept the event.
+func (n *WebhookNotifier) webhooksFor(event string) []WebhookSpec {
+	n.Lock()
+	defer n.Unlock()
+
+	resp := make([]WebhookSpec, 0)
+	for _, w := range append(append([]WebhookSpec{}, n.paramWebhooks...), n.webhooks...) {
+		if w.Accepts(event) {
+			resp = append(resp, w)
+		}
+	}
+	return resp
+}
+
+// Sends the event to all webhooks that accept it.
+// Delivery is asynchronous and failed requests are retried with exponential backoff.
+func (n *WebhookNotifier) Notify(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	webhooks := n.webhooksFor(event.Event)
+	if len(webhooks) == 0 {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if len(event.Source) == 0 {
+		event.Source = n.source
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal webhook event: %v", err)
+		return
+	}
+
+	for _, w := range webhooks {
+		go n.deliver(w, event.Event, body)
+	}
+}
+
+// Sends the session.ready event if the ready pods of the session were not notified yet.
+// The pods are annotated before the event is sent, the event is sent on a later status request if that fails.
+func (n *WebhookNotifier) NotifySessionReady(client ClusterClient, namespace, app, user string, status StatusResponse) {
+	if len(status.UnnotifiedReadyPods) == 0 {
+		return
+	}
+	notified := "true"
+	for _, pod := range status.UnnotifiedReadyPods {
+		if err := client.PatchPodMetadata(namespace, pod, nil, map[string]*string{SessionReadyNotifiedAnnotation: &notified}); err != nil {
+			log.Printf("failed to mark session of user %s ready for app %s: %v", user, app, err)
+			return
+		}
+	}
+	n.Notify(WebhookEvent{
+		Event: WebhookEventSessionReady,
+		App:   app,
+		User:  user,
+	})
+}
+
+func (n *WebhookNotifier) deliver(w WebhookSpec, event string, body []byte) {
+	backoff := n.initialBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		err := n.post(w, event, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			log.Printf("giving up on webhook '%s' for event %s after %d attempts: %v", w.Name, event, attempt, err)
+			return
+		}
+		log.Printf("webhook '%s' failed for event %s, retrying in %v: %v", w.Name, event, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *WebhookNotifier) post(w WebhookSpec, event string, body []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event)
+	if len(w.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(w.Secret, timestamp, body))
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of the timestamp and payload, receivers compare it to the X-Broker-Signature header.
+func SignWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright 2021 The Selkies Authors. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package pod_broker_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	broker "selkies.io/controller/pkg"
+	"selkies.io/controller/pkg/brokertest"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(`1600000000.{"event":"session.ready"}`))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := broker.SignWebhookPayload("s3cr3t", "1600000000", []byte(`{"event":"session.ready"}`)); got != want {
+		t.Errorf("unexpected signature %s, want %s", got, want)
+	}
+	// A replayed body with a new timestamp does not match the original signature.
+	if got := broker.SignWebhookPayload("s3cr3t", "1600000001", []byte(`{"event":"session.ready"}`)); got == want {
+		t.Errorf("expected signature to change with the timestamp")
+	}
+	if got := broker.SignWebhookPayload("other", "1600000000", []byte(`{"event":"session.ready"}`)); got == want {
+		t.Errorf("expected signature to change with the secret")
+	}
+}
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookNotifierSignsRequests(t *testing.T) {
+	requests := make(chan webhookRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{header: r.Header, body: body}
+	}))
+	defer srv.Close()
+
+	// Webhooks from the ConfigMap in the broker namespace are merged with the webhooks from params.
+	namespace := "broker-ns"
+	client := brokertest.NewFakeClusterClient(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "webhooks"},
+		Data: map[string]string{
+			broker.WebhooksConfigMapKey: fmt.Sprintf(`[{"name": "signed", "url": "%s", "secret": "s3cr3t", "events": ["session.ready"]}]`, srv.URL),
+		},
+	})
+	notifier, err := broker.NewWebhookNotifierFromParams(client, map[string]string{
+		"Webhooks":          fmt.Sprintf(`[{"name": "publish", "url": "%s", "events": ["publish-job.succeeded"]}]`, srv.URL),
+		"WebhooksConfigMap": "webhooks",
+	}, namespace, "pod-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Unix()
+	notifier.Notify(broker.WebhookEvent{Event: broker.WebhookEventSessionReady, App: "desktop", User: "user@example.com"})
+
+	var req webhookRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+	if got := req.header.Get(broker.WebhookEventHeader); got != broker.WebhookEventSessionReady {
+		t.Errorf("unexpected event header: %s", got)
+	}
+	timestamp := req.header.Get(broker.WebhookTimestampHeader)
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || ts < start {
+		t.Errorf("expected current timestamp header, got %q", timestamp)
+	}
+	want := "sha256=" + broker.SignWebhookPayload("s3cr3t", timestamp, req.body)
+	if got := req.header.Get(broker.WebhookSignatureHeader); got != want {
+		t.Errorf("unexpected signature header %s, want %s", got, want)
+	}
+
+	// The event is not sent to webhooks that do not accept it.
+	select {
+	case req := <-requests:
+		t.Errorf("unexpected webhook request: %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -69,10 +69,17 @@ log_cyan "CUSTOM_DOMAIN=${CUSTOM_DOMAIN},ENDPOINT=${ENDPOINT}"
 log_cyan "Obtaining cluster credentials..."
 gcloud container clusters get-credentials ${CLUSTER_NAME} --region=${CLUSTER_LOCATION}
 
+# Create generated manifests, this also generates the broker-webhook certificate used by the CRD conversion.
+log_cyan "Generating manifest kustomizations..."
+./make_generated_manifests.sh
+cat generated/kustomization.yaml
+
 # Install CRDs
 log_cyan "Installing CRDs"
 # gke-deploy apply --project ${PROJECT_ID} --cluster ${CLUSTER_NAME} --location ${CLUSTER_LOCATION} --filename /opt/istio-operator/deploy/crds/istio_v1alpha2_istiocontrolplane_crd.yaml
 gke-deploy apply --project ${PROJECT_ID} --cluster ${CLUSTER_NAME} --location ${CLUSTER_LOCATION} --filename base/pod-broker/crd.yaml
+# Reads of the v2 BrokerAppConfig version are converted by the broker-webhook, which the API server only trusts with the caBundle.
+kubectl patch crd brokerappconfigs.gcp.solutions --type=json -p "$(cat generated/patch-brokerappconfigs-crd-ca-bundle.json)"
 
 # Install AutoNEG controller
 log_cyan "Installing AutoNEG controller..."
@@ -100,11 +107,6 @@ esac
 log_cyan "Repairing neg-status and autoneg-status annotations on istio-ingressgateway service to force update"
 kubectl annotate service istio-ingressgateway -n istio-system anthos.cft.dev/autoneg-status-
 
-# Create generated manifests
-log_cyan "Generating manifest kustomizations..."
-./make_generated_manifests.sh
-cat generated/kustomization.yaml
-
 # If the image cache loader daemonset is present, patch the image puller to wait for it.
 if [[ -n "$(kubectl get ds -n kube-system -l app=pod-broker-image-loader -o name)" ]]; then
     log_cyan "Adding patch to image puller to wait for image cache."
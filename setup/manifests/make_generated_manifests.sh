@@ -36,6 +36,13 @@ COOKIE_SECRET_VERSION=${COOKIE_SECRET_VERSION:-$(gcloud secrets versions list br
 COOKIE_SECRET=$(gcloud secrets versions access ${COOKIE_SECRET_VERSION} --secret broker-cookie-secret)
 [[ -z "${COOKIE_SECRET}" ]] && echo "Failed to get broker-cookie-secret from Secret Manager" && exit 1
 
+# Previous cookie secret version, session tokens signed with it are still accepted after rotating the secret.
+COOKIE_SECRET_PREVIOUS_LITERAL=""
+if [[ -n "${COOKIE_SECRET_PREVIOUS_VERSION}" ]]; then
+  COOKIE_SECRET_PREVIOUS=$(gcloud secrets versions access ${COOKIE_SECRET_PREVIOUS_VERSION} --secret broker-cookie-secret)
+  COOKIE_SECRET_PREVIOUS_LITERAL="--from-literal=COOKIE_SECRET_PREVIOUS=${COOKIE_SECRET_PREVIOUS}"
+fi
+
 ###
 # Fetch OAuth client ID from Secret Manager
 ###
@@ -44,7 +51,7 @@ CLIENT_ID=$(gcloud secrets versions access ${CLIENT_ID_SECRET_VERSION} --secret
 [[ -z "${CLIENT_ID}" ]] && echo "Failed to get broker-oauth2-client-id from Secret Manager" && exit 1
 
 # Add secrets to pod-broker kustomization
-(cd "${SCRIPT_DIR}/base/pod-broker" && kustomize edit add secret pod-broker --from-literal=COOKIE_SECRET=${COOKIE_SECRET})
+(cd "${SCRIPT_DIR}/base/pod-broker" && kustomize edit add secret pod-broker --from-literal=COOKIE_SECRET=${COOKIE_SECRET} ${COOKIE_SECRET_PREVIOUS_LITERAL})
 (cd "${SCRIPT_DIR}/base/pod-broker" && kustomize edit add secret oauth-client-id --from-literal=CLIENT_ID=${CLIENT_ID})
 
 ###
@@ -252,6 +259,81 @@ EOF
 
 echo "INFO: Created pod broker service account patch: ${DEST}"
 
+###
+# Serving certificate of the broker-webhook, the API server only calls webhooks over TLS.
+# The certificate in the broker-webhook-tls Secret is reused until it is about to expire,
+# the CA that signed it is the caBundle of the webhook configuration.
+###
+WEBHOOK_SERVICE="broker-webhook.pod-broker-system.svc"
+WEBHOOK_CERT_DIR=$(mktemp -d)
+trap "rm -rf ${WEBHOOK_CERT_DIR}" EXIT
+
+WEBHOOK_SECRET_JSON=$(kubectl get secret -n pod-broker-system broker-webhook-tls -o json 2>/dev/null || true)
+for f in ca.crt tls.crt tls.key; do
+  echo "${WEBHOOK_SECRET_JSON}" | jq -r '.data["'${f}'"] // empty' 2>/dev/null | base64 -d > "${WEBHOOK_CERT_DIR}/${f}"
+done
+
+# Renew the certificate 30 days before it expires.
+if ! openssl x509 -checkend 2592000 -noout -in "${WEBHOOK_CERT_DIR}/tls.crt" >/dev/null 2>&1 || [[ ! -s "${WEBHOOK_CERT_DIR}/ca.crt" || ! -s "${WEBHOOK_CERT_DIR}/tls.key" ]]; then
+  echo "INFO: Generating broker-webhook serving certificate for ${WEBHOOK_SERVICE}"
+  openssl req -x509 -newkey rsa:2048 -nodes -days 825 -subj "/CN=broker-webhook-ca" \
+    -keyout "${WEBHOOK_CERT_DIR}/ca.key" -out "${WEBHOOK_CERT_DIR}/ca.crt" 2>/dev/null
+  openssl req -newkey rsa:2048 -nodes -subj "/CN=${WEBHOOK_SERVICE}" \
+    -keyout "${WEBHOOK_CERT_DIR}/tls.key" -out "${WEBHOOK_CERT_DIR}/tls.csr" 2>/dev/null
+  echo "subjectAltName=DNS:broker-webhook,DNS:broker-webhook.pod-broker-system,DNS:${WEBHOOK_SERVICE}" > "${WEBHOOK_CERT_DIR}/ext.cnf"
+  openssl x509 -req -days 825 -in "${WEBHOOK_CERT_DIR}/tls.csr" -extfile "${WEBHOOK_CERT_DIR}/ext.cnf" \
+    -CA "${WEBHOOK_CERT_DIR}/ca.crt" -CAkey "${WEBHOOK_CERT_DIR}/ca.key" -CAcreateserial -out "${WEBHOOK_CERT_DIR}/tls.crt" 2>/dev/null
+fi
+
+WEBHOOK_CA_BUNDLE=$(base64 -w0 "${WEBHOOK_CERT_DIR}/ca.crt")
+
+DEST="${DEST_DIR}/broker-webhook-tls.yaml"
+cat > "${DEST}" << EOF
+apiVersion: v1
+kind: Secret
+metadata:
+  name: broker-webhook-tls
+  namespace: pod-broker-system
+type: kubernetes.io/tls
+data:
+  ca.crt: ${WEBHOOK_CA_BUNDLE}
+  tls.crt: $(base64 -w0 "${WEBHOOK_CERT_DIR}/tls.crt")
+  tls.key: $(base64 -w0 "${WEBHOOK_CERT_DIR}/tls.key")
+EOF
+
+echo "INFO: Created broker webhook TLS secret: ${DEST}"
+
+DEST="${DEST_DIR}/patch-broker-webhook-ca-bundle.json"
+cat > "${DEST}" << EOF
+[{"op": "add", "path": "/webhooks/0/clientConfig/caBundle", "value": "${WEBHOOK_CA_BUNDLE}"}]
+EOF
+
+echo "INFO: Created broker webhook caBundle patch: ${DEST}"
+
+# The broker-webhook also converts BrokerAppConfigs between the v1 and v2 versions.
+DEST="${DEST_DIR}/patch-brokerappconfigs-crd-ca-bundle.json"
+cat > "${DEST}" << EOF
+[{"op": "add", "path": "/spec/conversion/webhook/clientConfig/caBundle", "value": "${WEBHOOK_CA_BUNDLE}"}]
+EOF
+
+echo "INFO: Created brokerappconfigs CRD conversion caBundle patch: ${DEST}"
+
+# The webhook loads the certificate at startup, restart it when the certificate changes.
+DEST="${DEST_DIR}/patch-broker-webhook-tls-hash.yaml"
+cat > "${DEST}" << EOF
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: broker-webhook
+spec:
+  template:
+    metadata:
+      annotations:
+        app.broker/tls-hash: "$(md5sum "${WEBHOOK_CERT_DIR}/tls.crt" | cut -d' ' -f1)"
+EOF
+
+echo "INFO: Created broker webhook TLS hash patch: ${DEST}"
+
 ###
 # Patch to add host to istio Gateway for pod broker.
 ###
@@ -358,9 +440,26 @@ fi
   kustomize edit add patch "patch-pod-broker-node-init-service-account.yaml"
   kustomize edit add patch "patch-pod-broker-gateway.yaml"
   kustomize edit add patch "patch-pod-broker-virtual-service.yaml"
+  kustomize edit add resource "broker-webhook-tls.yaml"
+  kustomize edit add patch "patch-broker-webhook-tls-hash.yaml"
   [[ "${ENABLE_IMAGE_PULLER}" == "false" ]] && kustomize edit add patch "patch-image-puller-patch.yaml"
   [[ "${INCLUDE_REDIRECT}" == "true" ]] && kustomize edit add base ../base/pod-broker/redirect/
   kustomize edit set image \
     gcr.io/cloud-solutions-images/kube-pod-broker-controller:latest=${CONTROLLER_IMAGE} \
     gcr.io/cloud-solutions-images/kube-pod-broker-web:latest=${WEB_IMAGE}
+  cat >> kustomization.yaml << EOF
+patchesJson6902:
+  - target:
+      group: admissionregistration.k8s.io
+      version: v1
+      kind: ValidatingWebhookConfiguration
+      name: broker-webhook
+    path: patch-broker-webhook-ca-bundle.json
+  - target:
+      group: apiextensions.k8s.io
+      version: v1
+      kind: CustomResourceDefinition
+      name: brokerappconfigs.gcp.solutions
+    path: patch-brokerappconfigs-crd-ca-bundle.json
+EOF
 )